@@ -3,21 +3,25 @@ package dnsfilter
 import (
 	"encoding/json"
 	"net/http"
+	"sync"
 
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/urlfilter/rules"
 )
 
 var serviceRules map[string][]*rules.NetworkRule // service name -> filtering rules
+var serviceList []BlockedService                 // built-in and custom services
+var serviceLock sync.RWMutex                     // protects serviceRules and serviceList
 
 type svc struct {
 	name  string
 	rules []string
 }
 
-// Keep in sync with:
+// Built-in services.  Keep in sync with:
 // client/src/helpers/constants.js
 // client/src/components/ui/Icons.js
+// Custom services may be loaded from a file or URL (see LoadBlockedServices()).
 var serviceRulesArray = []svc{
 	{"whatsapp", []string{"||whatsapp.net^", "||whatsapp.com^"}},
 	{"facebook", []string{
@@ -165,23 +169,14 @@ var serviceRulesArray = []svc{
 
 // convert array to map
 func initBlockedServices() {
-	serviceRules = make(map[string][]*rules.NetworkRule)
-	for _, s := range serviceRulesArray {
-		netRules := []*rules.NetworkRule{}
-		for _, text := range s.rules {
-			rule, err := rules.NewNetworkRule(text, 0)
-			if err != nil {
-				log.Error("rules.NewNetworkRule: %s  rule: %s", err, text)
-				continue
-			}
-			netRules = append(netRules, rule)
-		}
-		serviceRules[s.name] = netRules
-	}
+	setBlockedServices(builtinBlockedServices())
 }
 
-// BlockedSvcKnown - return TRUE if a blocked service name is known
+// BlockedSvcKnown - return TRUE if a blocked service name is known:
+//  a built-in service or a custom service loaded from the source or from the cache
 func BlockedSvcKnown(s string) bool {
+	serviceLock.RLock()
+	defer serviceLock.RUnlock()
 	_, ok := serviceRules[s]
 	return ok
 }
@@ -194,6 +189,14 @@ func (d *Dnsfilter) ApplyBlockedServices(setts *RequestFilteringSettings, list [
 		defer d.confLock.RUnlock()
 		list = d.Config.BlockedServices
 	}
+	AddBlockedServices(setts, list)
+}
+
+// AddBlockedServices - add the services to the blocked services settings for this DNS request
+func AddBlockedServices(setts *RequestFilteringSettings, list []string) {
+	serviceLock.RLock()
+	defer serviceLock.RUnlock()
+
 	for _, name := range list {
 		rules, ok := serviceRules[name]
 
@@ -202,6 +205,10 @@ func (d *Dnsfilter) ApplyBlockedServices(setts *RequestFilteringSettings, list [
 			continue
 		}
 
+		if serviceEntryExists(setts.ServicesRules, name) {
+			continue
+		}
+
 		s := ServiceEntry{}
 		s.Name = name
 		s.Rules = rules
@@ -209,6 +216,15 @@ func (d *Dnsfilter) ApplyBlockedServices(setts *RequestFilteringSettings, list [
 	}
 }
 
+func serviceEntryExists(list []ServiceEntry, name string) bool {
+	for _, s := range list {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *Dnsfilter) handleBlockedServicesList(w http.ResponseWriter, r *http.Request) {
 	d.confLock.RLock()
 	list := d.Config.BlockedServices
@@ -230,6 +246,13 @@ func (d *Dnsfilter) handleBlockedServicesSet(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	for _, name := range list {
+		if !BlockedSvcKnown(name) {
+			httpError(r, w, http.StatusBadRequest, "unknown service name: %s", name)
+			return
+		}
+	}
+
 	d.confLock.Lock()
 	d.Config.BlockedServices = list
 	d.confLock.Unlock()
@@ -243,4 +266,6 @@ func (d *Dnsfilter) handleBlockedServicesSet(w http.ResponseWriter, r *http.Requ
 func (d *Dnsfilter) registerBlockedServicesHandlers() {
 	d.Config.HTTPRegister("GET", "/control/blocked_services/list", d.handleBlockedServicesList)
 	d.Config.HTTPRegister("POST", "/control/blocked_services/set", d.handleBlockedServicesSet)
+	d.Config.HTTPRegister("GET", "/control/blocked_services/services", d.handleBlockedServicesServices)
+	d.Config.HTTPRegister("POST", "/control/blocked_services/reload", d.handleBlockedServicesReload)
 }
@@ -0,0 +1,318 @@
+// Custom blocked services
+
+package dnsfilter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/file"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/urlfilter/rules"
+	"gopkg.in/yaml.v2"
+)
+
+// How often the custom services are reloaded from their source
+const blockedServicesUpdateInterval = 24 * time.Hour
+
+// How soon the custom services are reloaded after a failed attempt
+const blockedServicesRetryInterval = 10 * time.Minute
+
+// The maximum size of the custom services data
+const blockedServicesMaxSize = 1 * 1024 * 1024
+
+// BlockedService - blocked service definition
+type BlockedService struct {
+	Name   string   `yaml:"name" json:"name"`       // unique name, e.g. "youtube"
+	IconID string   `yaml:"icon_id" json:"icon_id"` // ID of the icon shown in UI (empty: default icon)
+	Rules  []string `yaml:"rules" json:"rules"`     // filtering rules, e.g. "||youtube.com^"
+	Custom bool     `yaml:"-" json:"custom"`        // the service is loaded from a file or URL
+}
+
+// The format of the file with custom services (JSON or YAML):
+//  {"services": [{"name": "...", "icon_id": "...", "rules": ["...", ...]}, ...]}
+// The cache file has the same format plus the source of the services.
+type blockedServicesFile struct {
+	Source   string           `yaml:"source,omitempty"`
+	Services []BlockedService `yaml:"services"`
+}
+
+// Get the built-in services
+func builtinBlockedServices() []BlockedService {
+	list := []BlockedService{}
+	for _, s := range serviceRulesArray {
+		list = append(list, BlockedService{Name: s.name, IconID: s.name, Rules: s.rules})
+	}
+	return list
+}
+
+// Parse the rules of a service
+func compileServiceRules(s BlockedService) ([]*rules.NetworkRule, error) {
+	netRules := []*rules.NetworkRule{}
+	for _, text := range s.Rules {
+		rule, err := rules.NewNetworkRule(text, 0)
+		if err != nil {
+			return nil, fmt.Errorf("rule: %s: %s", text, err)
+		}
+		netRules = append(netRules, rule)
+	}
+	return netRules, nil
+}
+
+// Set the list of known services
+func setBlockedServices(list []BlockedService) {
+	m := make(map[string][]*rules.NetworkRule)
+	for _, s := range list {
+		netRules, err := compileServiceRules(s)
+		if err != nil {
+			log.Error("Blocked services: %s: %s", s.Name, err)
+			continue
+		}
+		m[s.Name] = netRules
+	}
+
+	serviceLock.Lock()
+	serviceRules = m
+	serviceList = list
+	serviceLock.Unlock()
+}
+
+// Get the list of known services
+func getBlockedServices() []BlockedService {
+	serviceLock.RLock()
+	list := make([]BlockedService, len(serviceList))
+	copy(list, serviceList)
+	serviceLock.RUnlock()
+	return list
+}
+
+// Read the custom services data from a file or URL
+func readBlockedServicesSource(source string, client *http.Client) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return readBlockedServicesData(f)
+	}
+
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status code != 200: %d", resp.StatusCode)
+	}
+	return readBlockedServicesData(resp.Body)
+}
+
+// Read the custom services data
+// The data larger than the limit is an error: it must not be truncated.
+func readBlockedServicesData(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, blockedServicesMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > blockedServicesMaxSize {
+		return nil, fmt.Errorf("the data is too large: more than %d bytes", blockedServicesMaxSize)
+	}
+	return data, nil
+}
+
+// Parse and validate the custom services
+// The invalid services are skipped.
+func parseBlockedServices(data []byte) ([]BlockedService, error) {
+	f := blockedServicesFile{}
+	// YAML parser accepts JSON too
+	err := yaml.Unmarshal(data, &f)
+	if err != nil {
+		return nil, err
+	}
+	return validateBlockedServices(f.Services), nil
+}
+
+// Get the valid custom services
+func validateBlockedServices(services []BlockedService) []BlockedService {
+	list := []BlockedService{}
+	names := map[string]bool{}
+	for _, s := range services {
+		if len(s.Name) == 0 {
+			log.Error("Blocked services: skipping the service without name")
+			continue
+		}
+		if names[s.Name] {
+			log.Error("Blocked services: %s: duplicate name", s.Name)
+			continue
+		}
+		if len(s.Rules) == 0 {
+			log.Error("Blocked services: %s: no rules", s.Name)
+			continue
+		}
+		_, err := compileServiceRules(s)
+		if err != nil {
+			log.Error("Blocked services: %s: %s", s.Name, err)
+			continue
+		}
+
+		names[s.Name] = true
+		s.Custom = true
+		list = append(list, s)
+	}
+	return list
+}
+
+// Read the custom services stored in the cache file by the last successful load from the source
+func readBlockedServicesCache(source, cacheFile string) ([]BlockedService, error) {
+	data, err := ioutil.ReadFile(cacheFile)
+	if err != nil {
+		return nil, err
+	}
+	f := blockedServicesFile{}
+	err = yaml.Unmarshal(data, &f)
+	if err != nil {
+		return nil, err
+	}
+	if f.Source != source {
+		return nil, fmt.Errorf("the cache is for another source: %s", f.Source)
+	}
+	return validateBlockedServices(f.Services), nil
+}
+
+// Store the custom services in the cache file
+func writeBlockedServicesCache(source, cacheFile string, list []BlockedService) error {
+	data, err := yaml.Marshal(blockedServicesFile{Source: source, Services: list})
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(cacheFile), 0755)
+	if err != nil {
+		return err
+	}
+	return file.SafeWrite(cacheFile, data)
+}
+
+// Merge the custom services with the built-in services
+// A custom service replaces the built-in service with the same name.
+func mergeBlockedServices(builtin, custom []BlockedService) []BlockedService {
+	customNames := map[string]bool{}
+	for _, s := range custom {
+		customNames[s.Name] = true
+	}
+
+	list := []BlockedService{}
+	for _, s := range builtin {
+		if !customNames[s.Name] {
+			list = append(list, s)
+		}
+	}
+	return append(list, custom...)
+}
+
+// InitBlockedServices - set the services before the custom services are loaded from their source
+// The custom services stored in the cache file by the last successful load are used,
+//  so their names are known (see BlockedSvcKnown()) until LoadBlockedServices() succeeds.
+// If there's no cache, only the built-in services are known.
+func InitBlockedServices(source, cacheFile string) {
+	if len(source) == 0 {
+		setBlockedServices(builtinBlockedServices())
+		return
+	}
+
+	custom, err := readBlockedServicesCache(source, cacheFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("Blocked services: %s: %s", cacheFile, err)
+		}
+		custom = []BlockedService{}
+	}
+	setBlockedServices(mergeBlockedServices(builtinBlockedServices(), custom))
+	log.Debug("Blocked services: loaded %d custom services from %s", len(custom), cacheFile)
+}
+
+// LoadBlockedServices - load the custom services from a file or URL (JSON or YAML)
+// and merge them with the built-in services.
+// If the source is empty, only the built-in services are used.
+// If the custom services can't be loaded, the current services are left intact.
+// cacheFile: the file where the loaded custom services are stored (optional)
+func LoadBlockedServices(source, cacheFile string, client *http.Client) error {
+	custom := []BlockedService{}
+	if len(source) != 0 {
+		data, err := readBlockedServicesSource(source, client)
+		if err != nil {
+			return fmt.Errorf("blocked services: %s: %s", source, err)
+		}
+		custom, err = parseBlockedServices(data)
+		if err != nil {
+			return fmt.Errorf("blocked services: %s: %s", source, err)
+		}
+
+		if len(cacheFile) != 0 {
+			err = writeBlockedServicesCache(source, cacheFile, custom)
+			if err != nil {
+				log.Error("Blocked services: %s: %s", cacheFile, err)
+			}
+		}
+	}
+
+	setBlockedServices(mergeBlockedServices(builtinBlockedServices(), custom))
+	log.Debug("Blocked services: loaded %d custom services from %s", len(custom), source)
+	return nil
+}
+
+// Load the custom services from the source configured for this object
+func (d *Dnsfilter) loadBlockedServices() error {
+	return LoadBlockedServices(d.Config.BlockedServicesSource, d.Config.BlockedServicesCacheFile, d.Config.HTTPClient)
+}
+
+// Load the custom services in background and then reload them periodically
+func (d *Dnsfilter) blockedServicesUpdateLoop(stop chan bool) {
+	t := time.NewTimer(0)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			next := blockedServicesUpdateInterval
+			err := d.loadBlockedServices()
+			if err != nil {
+				log.Error("%s", err)
+				next = blockedServicesRetryInterval
+			}
+			t.Reset(next)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Get the definitions of all known services
+func (d *Dnsfilter) handleBlockedServicesServices(w http.ResponseWriter, r *http.Request) {
+	list := getBlockedServices()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(list)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+// Reload the custom services from their source
+func (d *Dnsfilter) handleBlockedServicesReload(w http.ResponseWriter, r *http.Request) {
+	err := d.loadBlockedServices()
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"os"
 	"runtime"
 	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -34,10 +36,28 @@ type RequestFilteringSettings struct {
 	SafeBrowsingEnabled bool
 	ParentalEnabled     bool
 
+	// Safe search settings
+	SafeSearchDisabledEngines []string // the engines for which safe search isn't enforced
+	SafeSearchStrict          bool     // use strict mode for the engines which support it (YouTube)
+
+	// Match the records in DNS responses against filtering rules
+	FilterResponseCNAME bool // CNAME targets (e.g. CNAME-cloaked trackers)
+	FilterResponseIP    bool // IP addresses in A and AAAA records
+
+	// Block all requests (e.g. by the client's filtering schedule)
+	BlockAll bool
+
+	// Don't count the hits of the matched rules (e.g. for diagnostic lookups)
+	NoRuleHits bool
+
 	ClientName string
 	ClientIP   string
 	ClientTags []string
 
+	// IDs of the filter lists selected for the client (user rules are always used)
+	// nil: all filter lists are used
+	FilterListIDs []int64
+
 	ServicesRules []ServiceEntry
 }
 
@@ -53,18 +73,50 @@ type Config struct {
 	ParentalCacheSize     uint `yaml:"parental_cache_size"`     // (in bytes)
 	CacheTime             uint `yaml:"cache_time"`              // Element's TTL (in minutes)
 
+	// Safe search settings
+	SafeSearchDisabledEngines []string `yaml:"safesearch_disabled_engines"` // the engines for which safe search isn't enforced
+	SafeSearchStrict          bool     `yaml:"safesearch_strict"`           // use strict mode for the engines which support it (YouTube)
+	SafeSearchFile            string   `yaml:"safesearch_file"`             // file with safe search engines (JSON or YAML)
+
+	// Local hash databases (see hashDB): hashes, domain lists or threat feeds
+	// If set, they are used instead of the remote servers.
+	SafeBrowsingDBFiles []string `yaml:"safebrowsing_db_files"`
+	ParentalDBFiles     []string `yaml:"parental_db_files"`
+
 	Rewrites []RewriteEntry `yaml:"rewrites"`
 
 	// Names of services to block (globally).
 	// Per-client settings can override this configuration.
 	BlockedServices []string `yaml:"blocked_services"`
 
+	// File or URL with custom services definitions (JSON or YAML).
+	// They are merged with the built-in services (see LoadBlockedServices()).
+	BlockedServicesSource string `yaml:"blocked_services_source"`
+
+	// File where the custom services are stored after they're loaded from their source.
+	// They are used on startup until the source is available (see InitBlockedServices()).
+	BlockedServicesCacheFile string `yaml:"-"`
+
+	// HTTP client for downloading data (e.g. custom services)
+	HTTPClient *http.Client `yaml:"-"`
+
 	// IP-hostname pairs taken from system configuration (e.g. /etc/hosts) files
 	AutoHosts *util.AutoHosts `yaml:"-"`
 
 	// Called when the configuration is changed by HTTP request
 	ConfigModified func() `yaml:"-"`
 
+	// Called when a rewrite entry for the domain (may be a wildcard) is added or removed by HTTP request
+	RewriteChanged func(domain string) `yaml:"-"`
+
+	// Get the sets of filter list IDs selected for clients
+	// The filtering engines for these sets are built along with the main engine.
+	FilterListSets func() [][]int64 `yaml:"-"`
+
+	// The file where the rule hit counters are stored
+	// If empty, the counters aren't stored on disk.
+	RuleHitsFile string `yaml:"-"`
+
 	// Register an HTTP handler
 	HTTPRegister func(string, string, func(http.ResponseWriter, *http.Request)) `yaml:"-"`
 }
@@ -96,12 +148,20 @@ type Dnsfilter struct {
 	filteringEngine      *urlfilter.DNSEngine
 	rulesStorageWhite    *filterlist.RuleStorage
 	filteringEngineWhite *urlfilter.DNSEngine
+	selectedEngines      map[string]*selectedEngine // filter list IDs -> engines
+	filterIDs            []int64                    // IDs of the filter lists in use (except user rules)
 	engineLock           sync.RWMutex
 
+	ruleHits *ruleHits // rule hit counters
+
+	blockedServicesStop chan bool // signal for 'blockedServicesUpdateLoop' goroutine to stop
+
 	parentalServer       string // access via methods
 	safeBrowsingServer   string // access via methods
 	parentalUpstream     upstream.Upstream
 	safeBrowsingUpstream upstream.Upstream
+	parentalDB           *hashDB // local database (nil: the remote server is used)
+	safeBrowsingDB       *hashDB // local database (nil: the remote server is used)
 
 	Config   // for direct access by library users, even a = assignment
 	confLock sync.RWMutex
@@ -111,6 +171,13 @@ type Dnsfilter struct {
 	filtersInitializerLock sync.Mutex
 }
 
+// Filtering engines built from the selected filter lists
+// The rule lists are shared with the main engines.
+type selectedEngine struct {
+	filteringEngine      *urlfilter.DNSEngine
+	filteringEngineWhite *urlfilter.DNSEngine
+}
+
 // Filter represents a filter list
 type Filter struct {
 	ID       int64  // auto-assigned when filter is added (see nextFilterID)
@@ -151,6 +218,9 @@ const (
 
 	// RewriteEtcHosts - rewrite by /etc/hosts rule
 	RewriteEtcHosts
+
+	// FilteredBlockAll - all requests from the client are blocked (e.g. by a filtering schedule)
+	FilteredBlockAll
 )
 
 var reasonNames = []string{
@@ -167,6 +237,8 @@ var reasonNames = []string{
 
 	"Rewrite",
 	"RewriteEtcHosts",
+
+	"FilteredBlockAll",
 }
 
 func (r Reason) String() string {
@@ -181,6 +253,10 @@ func (d *Dnsfilter) GetConfig() RequestFilteringSettings {
 	c := RequestFilteringSettings{}
 	// d.confLock.RLock()
 	c.SafeSearchEnabled = d.Config.SafeSearchEnabled
+	d.confLock.RLock()
+	c.SafeSearchDisabledEngines = d.Config.SafeSearchDisabledEngines
+	c.SafeSearchStrict = d.Config.SafeSearchStrict
+	d.confLock.RUnlock()
 	c.SafeBrowsingEnabled = d.Config.SafeBrowsingEnabled
 	c.ParentalEnabled = d.Config.ParentalEnabled
 	// d.confLock.RUnlock()
@@ -192,6 +268,7 @@ func (d *Dnsfilter) WriteDiskConfig(c *Config) {
 	d.confLock.Lock()
 	*c = d.Config
 	c.Rewrites = rewriteArrayDup(d.Config.Rewrites)
+	c.SafeSearchDisabledEngines = append([]string{}, d.Config.SafeSearchDisabledEngines...)
 	// BlockedServices
 	d.confLock.Unlock()
 }
@@ -246,6 +323,14 @@ func (d *Dnsfilter) filtersInitializer() {
 
 // Close - close the object
 func (d *Dnsfilter) Close() {
+	if d.ruleHits != nil {
+		d.ruleHits.close()
+	}
+	if d.blockedServicesStop != nil {
+		close(d.blockedServicesStop)
+		d.blockedServicesStop = nil
+	}
+
 	d.engineLock.Lock()
 	defer d.engineLock.Unlock()
 	d.reset()
@@ -286,8 +371,17 @@ type Result struct {
 	// for ReasonRewrite & RewriteEtcHosts:
 	IPList []net.IP `json:",omitempty"` // list of IP addresses
 
+	// for ReasonRewrite with an explicit record type (TXT, MX, SRV, etc.):
+	// Answer records.  If non-nil but empty, respond with an empty answer.
+	RRs []dns.RR `json:"-"`
+
 	// for FilteredBlockedService:
 	ServiceName string `json:",omitempty"` // Name of the blocked service
+
+	// for the matches in DNS response:
+	ResponseRRType string `json:",omitempty"` // Type of the matched record: "CNAME", "A" or "AAAA"
+	ResponseName   string `json:",omitempty"` // Name of the matched record
+	ResponseHost   string `json:",omitempty"` // Matched CNAME target or IP address
 }
 
 // Matched can be used to see if any match at all was found, no matter filtered or not
@@ -301,7 +395,11 @@ func (d *Dnsfilter) CheckHostRules(host string, qtype uint16, setts *RequestFilt
 		return Result{}, nil
 	}
 
-	return d.matchHost(host, qtype, *setts)
+	res, err := d.matchHost(host, qtype, *setts)
+	if err == nil {
+		d.countRuleHit(res, setts)
+	}
+	return res, err
 }
 
 // CheckHost tries to match the host against filtering rules,
@@ -313,10 +411,14 @@ func (d *Dnsfilter) CheckHost(host string, qtype uint16, setts *RequestFiltering
 	}
 	host = strings.ToLower(host)
 
+	if setts.BlockAll {
+		return Result{IsFiltered: true, Reason: FilteredBlockAll}, nil
+	}
+
 	var result Result
 	var err error
 
-	result = d.processRewrites(host)
+	result = d.processRewrites(host, qtype, setts)
 	if result.Reason == ReasonRewrite {
 		return result, nil
 	}
@@ -344,6 +446,7 @@ func (d *Dnsfilter) CheckHost(host string, qtype uint16, setts *RequestFiltering
 			return result, err
 		}
 		if result.Reason.Matched() {
+			d.countRuleHit(result, setts)
 			return result, nil
 		}
 	}
@@ -356,7 +459,7 @@ func (d *Dnsfilter) CheckHost(host string, qtype uint16, setts *RequestFiltering
 	}
 
 	if setts.SafeSearchEnabled {
-		result, err = d.checkSafeSearch(host)
+		result, err = d.checkSafeSearch(host, qtype, setts)
 		if err != nil {
 			log.Info("SafeSearch: failed: %v", err)
 			return Result{}, nil
@@ -399,13 +502,16 @@ func (d *Dnsfilter) CheckHost(host string, qtype uint16, setts *RequestFiltering
 //  . repeat for the new domain name (Note: we return only the last CNAME)
 // . Find A or AAAA record for a domain name (exact match or by wildcard)
 //  . if found, return IP addresses (both IPv4 and IPv6)
-func (d *Dnsfilter) processRewrites(host string) Result {
+// . Find records of the question type (TXT, MX, SRV, etc.) for a domain name
+//  . if found, return these records
+// Client-scoped entries are used only for the matching clients (setts may be nil).
+func (d *Dnsfilter) processRewrites(host string, qtype uint16, setts *RequestFilteringSettings) Result {
 	var res Result
 
 	d.confLock.RLock()
 	defer d.confLock.RUnlock()
 
-	rr := findRewrites(d.Rewrites, host)
+	rr := findRewrites(d.Rewrites, host, qtype, setts)
 	if len(rr) != 0 {
 		res.Reason = ReasonRewrite
 	}
@@ -428,11 +534,21 @@ func (d *Dnsfilter) processRewrites(host string) Result {
 		}
 		cnames[host] = false
 		res.CanonName = rr[0].Answer
-		rr = findRewrites(d.Rewrites, host)
+		rr = findRewrites(d.Rewrites, host, qtype, setts)
 	}
 
 	for _, r := range rr {
-		if r.Type != dns.TypeCNAME {
+		switch {
+		case r.isExtType():
+			if res.RRs == nil {
+				res.RRs = []dns.RR{}
+			}
+			if r.RR != nil {
+				res.RRs = append(res.RRs, dns.Copy(r.RR))
+			}
+			log.Debug("Rewrite: %s for %s is %s", dns.TypeToString[r.Type], host, r.Answer)
+
+		case r.Type != dns.TypeCNAME:
 			res.IPList = append(res.IPList, r.IP)
 			log.Debug("Rewrite: A/AAAA for %s is %s", host, r.IP)
 		}
@@ -523,6 +639,78 @@ func createFilteringEngine(filters []Filter) (*filterlist.RuleStorage, *urlfilte
 	return rulesStorage, filteringEngine, nil
 }
 
+// Get the string key for the set of filter list IDs
+func filterListsKey(ids []int64) string {
+	sorted := make([]int64, len(ids))
+	copy(sorted, ids)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var sb strings.Builder
+	for i, id := range sorted {
+		if i != 0 && sorted[i-1] == id {
+			continue
+		}
+		sb.WriteString(strconv.FormatInt(id, 10))
+		sb.WriteByte(',')
+	}
+	return sb.String()
+}
+
+// Create the filtering engine from the selected rule lists of the main storage
+// User rules (list ID 0) are always selected.
+func createSelectedEngine(storage *filterlist.RuleStorage, ids []int64) (*urlfilter.DNSEngine, error) {
+	listArray := []filterlist.RuleList{}
+	for _, list := range storage.Lists {
+		id := int64(list.GetID())
+		if id == 0 || int64InSlice(ids, id) {
+			listArray = append(listArray, list)
+		}
+	}
+
+	rulesStorage, err := filterlist.NewRuleStorage(listArray)
+	if err != nil {
+		return nil, fmt.Errorf("filterlist.NewRuleStorage(): %s", err)
+	}
+	return urlfilter.NewDNSEngine(rulesStorage), nil
+}
+
+func int64InSlice(a []int64, v int64) bool {
+	for _, i := range a {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Create the filtering engines for the sets of filter lists selected for clients
+func (d *Dnsfilter) createSelectedEngines() error {
+	d.selectedEngines = map[string]*selectedEngine{}
+	if d.FilterListSets == nil {
+		return nil
+	}
+
+	for _, ids := range d.FilterListSets() {
+		key := filterListsKey(ids)
+		if _, ok := d.selectedEngines[key]; ok {
+			continue
+		}
+
+		e := &selectedEngine{}
+		var err error
+		e.filteringEngine, err = createSelectedEngine(d.rulesStorage, ids)
+		if err != nil {
+			return err
+		}
+		e.filteringEngineWhite, err = createSelectedEngine(d.rulesStorageWhite, ids)
+		if err != nil {
+			return err
+		}
+		d.selectedEngines[key] = e
+	}
+	return nil
+}
+
 // Initialize urlfilter objects
 func (d *Dnsfilter) initFiltering(allowFilters, blockFilters []Filter) error {
 	d.engineLock.Lock()
@@ -541,6 +729,20 @@ func (d *Dnsfilter) initFiltering(allowFilters, blockFilters []Filter) error {
 	d.rulesStorageWhite = rulesStorageWhite
 	d.filteringEngineWhite = filteringEngineWhite
 
+	d.filterIDs = nil
+	for _, filters := range [][]Filter{blockFilters, allowFilters} {
+		for _, f := range filters {
+			if f.ID != 0 {
+				d.filterIDs = append(d.filterIDs, f.ID)
+			}
+		}
+	}
+
+	err = d.createSelectedEngines()
+	if err != nil {
+		return err
+	}
+
 	// Make sure that the OS reclaims memory as soon as possible
 	debug.FreeOSMemory()
 	log.Debug("initialized filtering engine")
@@ -561,8 +763,20 @@ func (d *Dnsfilter) matchHost(host string, qtype uint16, setts RequestFilteringS
 	ureq.ClientName = setts.ClientName
 	ureq.SortedClientTags = setts.ClientTags
 
-	if d.filteringEngineWhite != nil {
-		rr, ok := d.filteringEngineWhite.MatchRequest(ureq)
+	filteringEngine := d.filteringEngine
+	filteringEngineWhite := d.filteringEngineWhite
+	if setts.FilterListIDs != nil {
+		e, ok := d.selectedEngines[filterListsKey(setts.FilterListIDs)]
+		if ok {
+			filteringEngine = e.filteringEngine
+			filteringEngineWhite = e.filteringEngineWhite
+		} else {
+			log.Debug("Filtering: no engine for filter lists %v: using all filter lists", setts.FilterListIDs)
+		}
+	}
+
+	if filteringEngineWhite != nil {
+		rr, ok := filteringEngineWhite.MatchRequest(ureq)
 		if ok {
 			var rule rules.Rule
 			if rr.NetworkRule != nil {
@@ -580,11 +794,11 @@ func (d *Dnsfilter) matchHost(host string, qtype uint16, setts RequestFilteringS
 		}
 	}
 
-	if d.filteringEngine == nil {
+	if filteringEngine == nil {
 		return Result{}, nil
 	}
 
-	rr, ok := d.filteringEngine.MatchRequest(ureq)
+	rr, ok := filteringEngine.MatchRequest(ureq)
 	if !ok {
 		return Result{}, nil
 	}
@@ -681,6 +895,11 @@ func New(c *Config, blockFilters []Filter) *Dnsfilter {
 	}
 
 	d := new(Dnsfilter)
+	fileName := ""
+	if c != nil {
+		fileName = c.RuleHitsFile
+	}
+	d.ruleHits = newRuleHits(fileName)
 
 	err := d.initSecurityServices()
 	if err != nil {
@@ -691,6 +910,7 @@ func New(c *Config, blockFilters []Filter) *Dnsfilter {
 	if c != nil {
 		d.Config = *c
 		d.prepareRewrites()
+		d.initHashDBs()
 	}
 
 	bsvcs := []string{}
@@ -722,10 +942,18 @@ func (d *Dnsfilter) Start() {
 	d.filtersInitializerChan = make(chan filtersInitializerParams, 1)
 	go d.filtersInitializer()
 
+	d.ruleHits.start()
+
+	if len(d.Config.BlockedServicesSource) != 0 {
+		d.blockedServicesStop = make(chan bool)
+		go d.blockedServicesUpdateLoop(d.blockedServicesStop)
+	}
+
 	if d.Config.HTTPRegister != nil { // for tests
 		d.registerSecurityHandlers()
 		d.registerRewritesHandlers()
 		d.registerBlockedServicesHandlers()
+		d.registerRuleHitsHandlers()
 	}
 }
 
@@ -1,10 +1,17 @@
 package dnsfilter
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"path/filepath"
 	"runtime"
 	"testing"
 
@@ -536,6 +543,12 @@ func TestClientSettings(t *testing.T) {
 	// blocked by additional rules
 	r, _ = d.CheckHost("facebook.com", dns.TypeA, &setts)
 	assert.True(t, r.IsFiltered && r.Reason == FilteredBlockedService)
+
+	// block all requests
+	setts.BlockAll = true
+	r, _ = d.CheckHost("example.com", dns.TypeA, &setts)
+	setts.BlockAll = false
+	assert.True(t, r.IsFiltered && r.Reason == FilteredBlockAll)
 }
 
 func prepareTestDir() string {
@@ -608,3 +621,408 @@ func BenchmarkSafeSearchParallel(b *testing.B) {
 		}
 	})
 }
+
+func TestFilterListSelection(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	fn1 := filepath.Join(dir, "1.txt")
+	fn2 := filepath.Join(dir, "2.txt")
+	_ = ioutil.WriteFile(fn1, []byte("||strict.example^\n||both.example^\n"), 0644)
+	_ = ioutil.WriteFile(fn2, []byte("||minimal.example^\n||both.example^\n@@||strict.example^\n"), 0644)
+	filters := []Filter{
+		{ID: 0, Data: []byte("||user.example^\n")},
+		{ID: 1, FilePath: fn1},
+		{ID: 2, FilePath: fn2},
+	}
+
+	d := NewForTest(nil, nil)
+	defer d.Close()
+	d.FilterListSets = func() [][]int64 {
+		return [][]int64{{1}, {2}, {}}
+	}
+	assert.Nil(t, d.SetFilters(filters, nil, false))
+
+	check := func(host string, ids []int64) bool {
+		s := RequestFilteringSettings{FilteringEnabled: true, FilterListIDs: ids}
+		r, err := d.CheckHost(host, dns.TypeA, &s)
+		assert.Nil(t, err)
+		return r.IsFiltered
+	}
+
+	// all lists
+	assert.True(t, check("user.example", nil))
+	assert.False(t, check("strict.example", nil))
+	assert.True(t, check("minimal.example", nil))
+
+	// strict list only
+	assert.True(t, check("user.example", []int64{1}))
+	assert.True(t, check("strict.example", []int64{1}))
+	assert.False(t, check("minimal.example", []int64{1}))
+	assert.True(t, check("both.example", []int64{1}))
+
+	// minimal list only
+	assert.False(t, check("strict.example", []int64{2}))
+	assert.True(t, check("minimal.example", []int64{2}))
+
+	// user rules only
+	assert.True(t, check("user.example", []int64{}))
+	assert.False(t, check("both.example", []int64{}))
+}
+
+func TestCheckRules(t *testing.T) {
+	lines := []string{
+		"! comment",
+		"# comment",
+		"||example.org^",
+		"@@||example.org^$important",
+		"0.0.0.0 example.com example.net",
+		"example.net",
+		"/ads[0-9]+\\.example\\.org/",
+		"/ads(\\.example\\.org/",
+		"example.org##.banner",
+		"||example.org/path.js$script",
+		"||example.org^$domain=example.com",
+		"||example.org^$unknown",
+	}
+	s := CheckRules(lines)
+	assert.Equal(t, 2, s.Network)
+	assert.Equal(t, 2, s.Hosts)
+	assert.Equal(t, 1, s.Regex)
+	assert.Equal(t, 2, s.Invalid)
+	assert.Equal(t, 3, s.Unsupported)
+	assert.Equal(t, 5, len(s.Errors))
+	assert.Equal(t, 8, s.Errors[0].Line)
+	assert.Equal(t, 5, s.Supported())
+
+	rt, err := CheckRule("||example.org^$unknown")
+	assert.Equal(t, RuleTypeInvalid, rt)
+	assert.NotNil(t, err)
+}
+
+func TestRuleHits(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	c := &Config{
+		RuleHitsFile: filepath.Join(dir, "rule_hits.json"),
+	}
+	fn1 := filepath.Join(dir, "1.txt")
+	fn2 := filepath.Join(dir, "2.txt")
+	fn3 := filepath.Join(dir, "3.txt")
+	_ = ioutil.WriteFile(fn1, []byte("||host1^\n||host2^\n"), 0644)
+	_ = ioutil.WriteFile(fn2, []byte("@@||host2^\n"), 0644)
+	_ = ioutil.WriteFile(fn3, []byte("||unused^\n"), 0644)
+	filters := []Filter{
+		{ID: 0, Data: []byte("||user.example.org^\n")},
+		{ID: 1, FilePath: fn1},
+		{ID: 3, FilePath: fn3},
+	}
+	whiteFilters := []Filter{
+		{ID: 2, FilePath: fn2},
+	}
+	d := NewForTest(c, nil)
+	_ = d.SetFilters(filters, whiteFilters, false)
+
+	_, _ = d.CheckHost("host1", dns.TypeA, &setts)
+	_, _ = d.CheckHost("host1", dns.TypeA, &setts)
+	_, _ = d.CheckHost("host2", dns.TypeA, &setts)
+	_, _ = d.CheckHost("user.example.org", dns.TypeA, &setts)
+	_, _ = d.CheckHostRules("host1", dns.TypeA, &setts)
+	_, _ = d.CheckHost("host3", dns.TypeA, &setts)
+	// diagnostic lookups aren't counted
+	settsNoHits := setts
+	settsNoHits.NoRuleHits = true
+	_, _ = d.CheckHost("host1", dns.TypeA, &settsNoHits)
+
+	top := d.ruleHits.top(10)
+	assert.Equal(t, 3, len(top))
+	assert.Equal(t, "||host1^", top[0].Rule)
+	assert.Equal(t, int64(1), top[0].FilterID)
+	assert.Equal(t, uint64(3), top[0].Hits)
+	assert.Equal(t, 1, len(d.ruleHits.top(1)))
+
+	h := d.GetRuleHits("@@||host2^", -1)
+	assert.Equal(t, 1, len(h))
+	assert.Equal(t, int64(2), h[0].FilterID)
+	assert.Equal(t, uint64(1), h[0].Hits)
+	assert.Equal(t, 0, len(d.GetRuleHits("@@||host2^", 1)))
+	assert.Equal(t, 0, len(d.GetRuleHits("||unused^", -1)))
+
+	lists := d.ruleHits.filterHits(d.filterListIDs())
+	assert.Equal(t, []FilterHits{{1, 3}, {3, 0}, {2, 1}}, lists)
+
+	// the counters are restored after restart
+	d.Close()
+	d = NewForTest(c, nil)
+	defer d.Close()
+	h = d.GetRuleHits("||host1^", 1)
+	assert.Equal(t, 1, len(h))
+	assert.Equal(t, uint64(3), h[0].Hits)
+	assert.Equal(t, uint64(1), d.ruleHits.filters[0])
+}
+
+func TestLoadBlockedServices(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	InitModule()
+	defer InitModule()
+	nBuiltin := len(getBlockedServices())
+
+	fn := filepath.Join(dir, "services.yaml")
+	_ = ioutil.WriteFile(fn, []byte(`services:
+- name: schoolapp
+  icon_id: ""
+  rules: ["||school.example^", "||cdn.school.example^"]
+- name: youtube
+  icon_id: youtube
+  rules: ["||youtube.example^"]
+- name: invalid
+  rules: ["||invalid.example^$unknown_modifier"]
+- rules: ["||noname.example^"]
+`), 0644)
+	assert.Nil(t, LoadBlockedServices(fn, "", nil))
+
+	assert.True(t, BlockedSvcKnown("schoolapp"))
+	assert.False(t, BlockedSvcKnown("invalid"))
+	list := getBlockedServices()
+	assert.Equal(t, nBuiltin+1, len(list))
+	assert.Equal(t, "schoolapp", list[len(list)-2].Name)
+	assert.True(t, list[len(list)-2].Custom)
+	assert.Equal(t, "youtube", list[len(list)-1].Name)
+
+	setts := RequestFilteringSettings{}
+	AddBlockedServices(&setts, []string{"schoolapp", "youtube"})
+	r := matchBlockedServicesRules("cdn.school.example", setts.ServicesRules)
+	assert.Equal(t, FilteredBlockedService, r.Reason)
+	assert.Equal(t, "schoolapp", r.ServiceName)
+	// the built-in rules are replaced
+	r = matchBlockedServicesRules("youtube.example", setts.ServicesRules)
+	assert.Equal(t, "youtube", r.ServiceName)
+	r = matchBlockedServicesRules("youtube.com", setts.ServicesRules)
+	assert.False(t, r.Reason.Matched())
+
+	// JSON; the current services aren't changed on error
+	fn = filepath.Join(dir, "services.json")
+	_ = ioutil.WriteFile(fn, []byte(`{"services": [{"name": "game", "icon_id": "", "rules": ["||game.example^"]}]}`), 0644)
+	assert.Nil(t, LoadBlockedServices(fn, "", nil))
+	assert.True(t, BlockedSvcKnown("game"))
+	assert.False(t, BlockedSvcKnown("schoolapp"))
+	assert.NotNil(t, LoadBlockedServices(filepath.Join(dir, "unknown.json"), "", nil))
+	assert.True(t, BlockedSvcKnown("game"))
+
+	// built-in services only
+	assert.Nil(t, LoadBlockedServices("", "", nil))
+	assert.False(t, BlockedSvcKnown("game"))
+	assert.Equal(t, nBuiltin, len(getBlockedServices()))
+}
+
+func TestBlockedServicesCache(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	defer InitModule()
+	fn := filepath.Join(dir, "services.json")
+	cacheFile := filepath.Join(dir, "cache", "services.yaml")
+
+	// no cache: only the built-in services are known until the services are loaded
+	InitBlockedServices(fn, cacheFile)
+	assert.False(t, BlockedSvcKnown("game"))
+	assert.True(t, BlockedSvcKnown("youtube"))
+	assert.NotNil(t, LoadBlockedServices(fn, cacheFile, nil))
+	assert.False(t, BlockedSvcKnown("game"))
+
+	_ = ioutil.WriteFile(fn, []byte(`{"services": [{"name": "game", "icon_id": "", "rules": ["||game.example^"]}]}`), 0644)
+	assert.Nil(t, LoadBlockedServices(fn, cacheFile, nil))
+	assert.True(t, BlockedSvcKnown("game"))
+	assert.False(t, BlockedSvcKnown("invalid"))
+
+	// the cached services are used while the source is unavailable
+	_ = os.Remove(fn)
+	InitBlockedServices(fn, cacheFile)
+	assert.True(t, BlockedSvcKnown("game"))
+	assert.False(t, BlockedSvcKnown("invalid"))
+	setts := RequestFilteringSettings{}
+	AddBlockedServices(&setts, []string{"game"})
+	r := matchBlockedServicesRules("game.example", setts.ServicesRules)
+	assert.Equal(t, "game", r.ServiceName)
+
+	// the cache of another source isn't used
+	InitBlockedServices(filepath.Join(dir, "other.json"), cacheFile)
+	assert.False(t, BlockedSvcKnown("game"))
+
+	// no source: built-in services only
+	InitBlockedServices("", cacheFile)
+	assert.False(t, BlockedSvcKnown("game"))
+}
+
+func TestBlockedServicesSourceSize(t *testing.T) {
+	data := []byte(`{"services": [{"name": "game", "icon_id": "", "rules": ["||game.example^"]}]}`)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(data)
+	}))
+	defer srv.Close()
+
+	b, err := readBlockedServicesSource(srv.URL, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+
+	// the data larger than the limit isn't truncated
+	data = append(data, bytes.Repeat([]byte(" "), blockedServicesMaxSize)...)
+	_, err = readBlockedServicesSource(srv.URL, nil)
+	assert.NotNil(t, err)
+}
+
+func TestSafeSearchEngines(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	d := NewForTest(&Config{SafeSearchEnabled: true}, nil)
+	defer d.Close()
+	defer func() { _ = LoadSafeSearchEngines("") }()
+
+	// disabled engine
+	s := setts
+	s.SafeSearchDisabledEngines = []string{SafeSearchYandex}
+	r, err := d.CheckHost("yandex.ru", dns.TypeA, &s)
+	assert.Nil(t, err)
+	assert.False(t, r.IsFiltered)
+	assert.True(t, SafeSearchEngineKnown(SafeSearchEcosia))
+	assert.False(t, SafeSearchEngineKnown("unknown"))
+
+	// custom engines: strict mode
+	fn := filepath.Join(dir, "safesearch.yaml")
+	_ = ioutil.WriteFile(fn, []byte(`engines:
+- name: youtube
+  domains: ["www.youtube.com"]
+  target: "1.2.3.4"
+  strict_target: "1.2.3.5"
+- name: search
+  domains: ["search.example"]
+  target: "::1"
+- name: invalid
+  domains: ["invalid.example"]
+`), 0644)
+	assert.Nil(t, LoadSafeSearchEngines(fn))
+	assert.False(t, SafeSearchEngineKnown("invalid"))
+	assert.True(t, SafeSearchEngineKnown(SafeSearchGoogle))
+
+	s = setts
+	r, _ = d.CheckHost("www.youtube.com", dns.TypeA, &s)
+	assert.Equal(t, FilteredSafeSearch, r.Reason)
+	assert.Equal(t, "1.2.3.4", r.IP.String())
+	s.SafeSearchStrict = true
+	r, _ = d.CheckHost("www.youtube.com", dns.TypeA, &s)
+	assert.Equal(t, "1.2.3.5", r.IP.String())
+	// the built-in domains of the replaced engine aren't used
+	r, _ = d.CheckHost("m.youtube.com", dns.TypeA, &s)
+	assert.False(t, r.IsFiltered)
+
+	r, _ = d.CheckHost("search.example", dns.TypeAAAA, &s)
+	assert.Equal(t, FilteredSafeSearch, r.Reason)
+	assert.Equal(t, "::1", r.IP.String())
+
+	// built-in engines only
+	assert.NotNil(t, LoadSafeSearchEngines(filepath.Join(dir, "unknown.yaml")))
+	assert.True(t, SafeSearchEngineKnown("search"))
+	assert.Nil(t, LoadSafeSearchEngines(""))
+	assert.False(t, SafeSearchEngineKnown("search"))
+	val, ok := d.SafeSearchDomain("www.youtube.com")
+	assert.True(t, ok)
+	assert.Equal(t, "restrictmoderate.youtube.com", val)
+}
+
+func TestHashDB(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	sum := sha256.Sum256([]byte("malware.example"))
+	sbFile := filepath.Join(dir, "sb.txt")
+	_ = ioutil.WriteFile(sbFile, []byte("# hashes\n"+hex.EncodeToString(sum[:])+"\n"), 0644)
+	feedFile := filepath.Join(dir, "feed.txt")
+	_ = ioutil.WriteFile(feedFile, []byte(`# URLhaus
+http://phishing.example:8080/login.php
+"1","2020-01-01 00:00:00","https://csv.example/file.exe","online"
+http://1.2.3.4/bin.sh
+`), 0644)
+	pcFile := filepath.Join(dir, "pc.txt")
+	_ = ioutil.WriteFile(pcFile, []byte(`! adult
+127.0.0.1 localhost
+0.0.0.0 adult.example www.adult6.example # comment
+||adult2.example^
+adult3.example
+`), 0644)
+
+	d := NewForTest(&Config{
+		SafeBrowsingEnabled: true,
+		ParentalEnabled:     true,
+		SafeBrowsingDBFiles: []string{sbFile, feedFile},
+		ParentalDBFiles:     []string{pcFile},
+	}, nil)
+	defer d.Close()
+
+	r, err := d.CheckHost("sub.malware.example", dns.TypeA, &setts)
+	assert.Nil(t, err)
+	assert.Equal(t, FilteredSafeBrowsing, r.Reason)
+	assert.Equal(t, sbFile, r.Rule)
+	r, _ = d.CheckHost("phishing.example", dns.TypeA, &setts)
+	assert.Equal(t, FilteredSafeBrowsing, r.Reason)
+	assert.Equal(t, feedFile, r.Rule)
+	r, _ = d.CheckHost("csv.example", dns.TypeA, &setts)
+	assert.Equal(t, FilteredSafeBrowsing, r.Reason)
+
+	for _, host := range []string{"adult.example", "www.adult2.example", "adult3.example", "www.adult6.example"} {
+		r, _ = d.CheckHost(host, dns.TypeA, &setts)
+		assert.Equal(t, FilteredParental, r.Reason, host)
+	}
+	for _, host := range []string{"localhost", "example", "good.example", "comment"} {
+		r, _ = d.CheckHost(host, dns.TypeA, &setts)
+		assert.False(t, r.IsFiltered, host)
+	}
+
+	n, _, _ := d.parentalDB.stats()
+	assert.Equal(t, 4, n)
+
+	// reload: the current hashes are left intact on error
+	assert.NotNil(t, d.parentalDB.load([]string{filepath.Join(dir, "unknown.txt")}))
+	r, _ = d.CheckHost("adult.example", dns.TypeA, &setts)
+	assert.True(t, r.IsFiltered)
+	_, _, err = d.parentalDB.stats()
+	assert.NotNil(t, err)
+	_ = ioutil.WriteFile(pcFile, []byte("adult4.example\n"), 0644)
+	assert.Nil(t, d.parentalDB.load(d.ParentalDBFiles))
+	r, _ = d.CheckHost("adult.example", dns.TypeA, &setts)
+	assert.False(t, r.IsFiltered)
+	r, _ = d.CheckHost("adult4.example", dns.TypeA, &setts)
+	assert.True(t, r.IsFiltered)
+
+	// host names longer than 4 labels
+	_ = ioutil.WriteFile(pcFile, []byte("a.b.c.adult5.example\n"), 0644)
+	assert.Nil(t, d.parentalDB.load(d.ParentalDBFiles))
+	for _, host := range []string{"a.b.c.adult5.example", "x.y.a.b.c.adult5.example"} {
+		r, _ = d.CheckHost(host, dns.TypeA, &setts)
+		assert.True(t, r.IsFiltered, host)
+	}
+	for _, host := range []string{"b.c.adult5.example", "x.b.c.adult5.example"} {
+		r, _ = d.CheckHost(host, dns.TypeA, &setts)
+		assert.False(t, r.IsFiltered, host)
+	}
+}
+
+func TestHashDBLoadError(t *testing.T) {
+	d := NewForTest(&Config{
+		ParentalEnabled: true,
+		ParentalDBFiles: []string{"/nonexistent/pc.txt"},
+	}, nil)
+	defer d.Close()
+
+	// the database is empty, the remote server isn't used
+	assert.NotNil(t, d.parentalDB)
+	r, err := d.CheckHost("pornhub.com", dns.TypeA, &setts)
+	assert.Nil(t, err)
+	assert.False(t, r.IsFiltered)
+
+	data := map[string]interface{}{}
+	addHashDBStatus(d.parentalDB, data)
+	assert.Equal(t, true, data["local_db"])
+	assert.Equal(t, 0, data["local_db_hashes"])
+	assert.NotNil(t, data["local_db_error"])
+	_, ok := data["local_db_updated"]
+	assert.False(t, ok)
+}
@@ -0,0 +1,283 @@
+// Local hash databases for Safe Browsing and Parental Control
+
+package dnsfilter
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Local hash database:
+//  a set of SHA256 hashes of host names, the same as the hashes returned by AdGuard's TXT-hash servers.
+// A host is matched if the hash of the host or one of its parent domains (see hashDBHashes())
+//  is in the database, so no requests to the remote servers are needed.
+//
+// Supported file formats (one entry per line, may be mixed):
+//  * SHA256 hash of a host name (64 hex characters)
+//  * host name: "malware.example"
+//  * hosts file: "0.0.0.0 malware.example www.malware.example"
+//  * adblock-style rule: "||malware.example^"
+//  * URL or CSV line with URL (URLhaus style): "http://malware.example/file.exe"
+// Lines starting with '#' or '!' are comments.
+type hashDB struct {
+	lock    sync.RWMutex
+	hashes  map[string]int // SHA256 hash (hex) -> index of the file in 'files'
+	files   []string       // the files from which the hashes are loaded
+	updated time.Time      // when the hashes were loaded
+	loadErr error          // the error of the last load (nil: the hashes are loaded)
+}
+
+// Create a database and load the hashes from files
+// If the files can't be loaded, the database is empty.
+func newHashDB(files []string) (*hashDB, error) {
+	db := &hashDB{
+		hashes: map[string]int{},
+	}
+	return db, db.load(files)
+}
+
+// Load the hashes from files
+// If a file can't be read, the current hashes are left intact.
+func (db *hashDB) load(files []string) error {
+	hashes := map[string]int{}
+	for i, fn := range files {
+		n, err := loadHashDBFile(fn, i, hashes)
+		if err != nil {
+			err = fmt.Errorf("hash database: %s", err)
+			db.lock.Lock()
+			db.loadErr = err
+			db.lock.Unlock()
+			return err
+		}
+		log.Debug("Hash database: loaded %d entries from %s", n, fn)
+	}
+
+	db.lock.Lock()
+	db.hashes = hashes
+	db.files = append([]string{}, files...)
+	db.updated = time.Now()
+	db.loadErr = nil
+	db.lock.Unlock()
+	return nil
+}
+
+// Add the hashes from a file
+// Return the number of entries
+func loadHashDBFile(fn string, index int, hashes map[string]int) (int, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		for _, hash := range parseHashDBLine(scanner.Text()) {
+			if _, exists := hashes[hash]; !exists {
+				hashes[hash] = index
+			}
+			n++
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", fn, err)
+	}
+	return n, nil
+}
+
+// Get the hashes (hex) of the entries in the line
+// Return nil if the line doesn't contain an entry
+func parseHashDBLine(line string) []string {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 || line[0] == '#' || line[0] == '!' {
+		return nil
+	}
+
+	if len(line) == sha256.Size*2 {
+		_, err := hex.DecodeString(line)
+		if err == nil {
+			return []string{strings.ToLower(line)}
+		}
+	}
+
+	var hashes []string
+	for _, host := range hashDBHosts(line) {
+		sum := sha256.Sum256([]byte(host))
+		hashes = append(hashes, hex.EncodeToString(sum[:]))
+	}
+	return hashes
+}
+
+// Get the host names from the line: host name, hosts file entry, adblock-style rule or URL
+// A hosts file entry may contain several host names.
+func hashDBHosts(line string) []string {
+	if strings.Contains(line, "://") {
+		return validHashDBHosts(hashDBURLHost(line))
+	}
+
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i] // hosts file: comment at the end of the line
+	}
+	fields := strings.Fields(line)
+	if len(fields) >= 2 && net.ParseIP(fields[0]) != nil {
+		return validHashDBHosts(fields[1:]...)
+	}
+	host := fields[0]
+	if strings.HasPrefix(host, "||") {
+		host = strings.TrimSuffix(host[2:], "^")
+	}
+	return validHashDBHosts(host)
+}
+
+// Get the host name from the URL or CSV line with URL
+func hashDBURLHost(line string) string {
+	pos := strings.Index(line, "://")
+	if pos <= 0 {
+		return ""
+	}
+	// the URL may be enclosed in quotes (CSV)
+	start := strings.LastIndexAny(line[:pos], "\", \t") + 1
+	end := strings.IndexAny(line[pos:], "\", \t")
+	if end < 0 {
+		end = len(line)
+	} else {
+		end += pos
+	}
+	u, err := url.Parse(line[start:end])
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// Normalize the host names and skip the invalid ones, IP addresses and the names without dots
+func validHashDBHosts(hosts ...string) []string {
+	var list []string
+	for _, host := range hosts {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		if !strings.Contains(host, ".") || strings.ContainsAny(host, "/*^$|") ||
+			net.ParseIP(host) != nil {
+			continue
+		}
+		list = append(list, host)
+	}
+	return list
+}
+
+// Get the hashes of the host and all its parent domains except TLD
+// hostnameToHashParam() hashes only the last 4 labels, as the remote servers do,
+//  but the host names imported from the files may be longer.
+func hashDBHashes(host string) map[string]bool {
+	_, hashes := hostnameToHashParam(host)
+	for strings.Count(host, ".") >= 4 {
+		sum := sha256.Sum256([]byte(host))
+		hashes[hex.EncodeToString(sum[:])] = true
+		host = host[strings.IndexByte(host, '.')+1:]
+	}
+	return hashes
+}
+
+// Check the host against the database
+// Return the file from which the matched hash is loaded
+func (db *hashDB) match(host string) (string, bool) {
+	hashes := hashDBHashes(host)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	for hash := range hashes {
+		i, ok := db.hashes[hash]
+		if ok {
+			return db.files[i], true
+		}
+	}
+	return "", false
+}
+
+// Get the number of hashes, the time when they were loaded and the error of the last load
+func (db *hashDB) stats() (int, time.Time, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return len(db.hashes), db.updated, db.loadErr
+}
+
+// Load the local hash databases
+// A service uses its local database instead of the remote server if the database files are configured.
+// If the database can't be loaded, it's empty and the remote server is still never requested:
+//  the error is reported in status and the files may be reloaded later.
+func (d *Dnsfilter) initHashDBs() {
+	var err error
+	if len(d.Config.SafeBrowsingDBFiles) != 0 {
+		d.safeBrowsingDB, err = newHashDB(d.Config.SafeBrowsingDBFiles)
+		if err != nil {
+			log.Error("SafeBrowsing: %s", err)
+		}
+	}
+	if len(d.Config.ParentalDBFiles) != 0 {
+		d.parentalDB, err = newHashDB(d.Config.ParentalDBFiles)
+		if err != nil {
+			log.Error("Parental: %s", err)
+		}
+	}
+}
+
+// Check the host against the local database
+func checkHashDB(db *hashDB, host string, reason Reason) Result {
+	result := Result{}
+	fn, ok := db.match(host)
+	if ok {
+		result.IsFiltered = true
+		result.Reason = reason
+		result.Rule = fn
+	}
+	return result
+}
+
+// Add the status of the local database to the response to "status" request
+func addHashDBStatus(db *hashDB, data map[string]interface{}) {
+	data["local_db"] = db != nil
+	if db == nil {
+		return
+	}
+	n, updated, err := db.stats()
+	data["local_db_hashes"] = n
+	if !updated.IsZero() {
+		data["local_db_updated"] = updated.Format(time.RFC3339)
+	}
+	if err != nil {
+		data["local_db_error"] = err.Error()
+	}
+}
+
+// Reload the local database
+func reloadHashDB(db *hashDB, files []string, r *http.Request, w http.ResponseWriter) {
+	if db == nil {
+		httpError(r, w, http.StatusBadRequest, "local database isn't configured")
+		return
+	}
+	err := db.load(files)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+}
+
+func (d *Dnsfilter) handleSafeBrowsingReload(w http.ResponseWriter, r *http.Request) {
+	reloadHashDB(d.safeBrowsingDB, d.Config.SafeBrowsingDBFiles, r, w)
+}
+
+func (d *Dnsfilter) handleParentalReload(w http.ResponseWriter, r *http.Request) {
+	reloadHashDB(d.parentalDB, d.Config.ParentalDBFiles, r, w)
+}
@@ -4,6 +4,7 @@ package dnsfilter
 
 import (
 	"encoding/json"
+	"fmt"
 	"net"
 	"net/http"
 	"sort"
@@ -16,13 +17,94 @@ import (
 // RewriteEntry is a rewrite array element
 type RewriteEntry struct {
 	Domain string `yaml:"domain"`
-	Answer string `yaml:"answer"` // IP address or canonical name
-	Type   uint16 `yaml:"-"`      // DNS record type: CNAME, A or AAAA
+	Answer string `yaml:"answer"` // IP address or canonical name;  RDATA if RRType is set
+	Type   uint16 `yaml:"-"`      // DNS record type: CNAME, A, AAAA or one of extTypes
 	IP     net.IP `yaml:"-"`      // Parsed IP address (if Type is A or AAAA)
+
+	// Explicit record type, e.g. "TXT" or "SRV".
+	// If empty, the type is detected from Answer: A, AAAA or CNAME.
+	RRType string `yaml:"type,omitempty"`
+
+	// Parsed record (if Type is one of extTypes)
+	// nil if Answer is empty: respond with an empty answer for this type.
+	RR dns.RR `yaml:"-"`
+
+	// If set, the entry is applied only to these clients (persistent client names or IP addresses)
+	// and to the clients with these tags.
+	// Such entries take precedence over the global entries for the same host name.
+	Clients []string `yaml:"clients,omitempty"`
+	Tags    []string `yaml:"tags,omitempty"`
+}
+
+// DNS record types that aren't defined in our version of miekg/dns
+const (
+	TypeSVCB  = 64
+	TypeHTTPS = 65
+)
+
+// Record types that are supported in RewriteEntry.RRType in addition to A, AAAA and CNAME.
+// Entries of these types are matched only if the question type is the same.
+var extTypes = map[string]uint16{
+	"TXT":   dns.TypeTXT,
+	"MX":    dns.TypeMX,
+	"SRV":   dns.TypeSRV,
+	"PTR":   dns.TypePTR,
+	"SVCB":  TypeSVCB,
+	"HTTPS": TypeHTTPS,
 }
 
 func (r *RewriteEntry) equals(b RewriteEntry) bool {
-	return r.Domain == b.Domain && r.Answer == b.Answer
+	return r.Domain == b.Domain && r.Answer == b.Answer &&
+		strings.EqualFold(r.RRType, b.RRType) &&
+		stringArrayEqual(r.Clients, b.Clients) &&
+		stringArrayEqual(r.Tags, b.Tags)
+}
+
+func stringArrayEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Return TRUE if the entry is applied only to some clients
+func (r *RewriteEntry) isScoped() bool {
+	return len(r.Clients) != 0 || len(r.Tags) != 0
+}
+
+// Return TRUE if the entry is applied to the client
+func (r *RewriteEntry) matchClient(setts *RequestFilteringSettings) bool {
+	if !r.isScoped() {
+		return true
+	}
+	if setts == nil {
+		return false
+	}
+
+	for _, c := range r.Clients {
+		if (len(setts.ClientName) != 0 && c == setts.ClientName) ||
+			(len(setts.ClientIP) != 0 && c == setts.ClientIP) {
+			return true
+		}
+	}
+	for _, t := range r.Tags {
+		for _, ct := range setts.ClientTags {
+			if t == ct {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Return TRUE if the entry has one of extTypes
+func (r *RewriteEntry) isExtType() bool {
+	return r.Type != 0 && r.Type != dns.TypeA && r.Type != dns.TypeAAAA && r.Type != dns.TypeCNAME
 }
 
 func isWildcard(host string) bool {
@@ -68,11 +150,68 @@ func (a rewritesArray) Less(i, j int) bool {
 }
 
 // Prepare entry for use
-func (r *RewriteEntry) prepare() {
+func (r *RewriteEntry) prepare() error {
+	r.Type = 0
+	r.IP = nil
+	r.RR = nil
+
+	for _, c := range r.Clients {
+		if len(c) == 0 {
+			return fmt.Errorf("%s: empty client name", r.Domain)
+		}
+	}
+	for _, t := range r.Tags {
+		if len(t) == 0 {
+			return fmt.Errorf("%s: empty tag", r.Domain)
+		}
+	}
+
+	rrType := strings.ToUpper(r.RRType)
+	switch rrType {
+	case "":
+		//
+
+	case "A", "AAAA":
+		ip := net.ParseIP(r.Answer)
+		if ip == nil || (ip.To4() != nil) != (rrType == "A") {
+			return fmt.Errorf("%s: invalid %s answer: %s", r.Domain, rrType, r.Answer)
+		}
+
+	case "CNAME":
+		if net.ParseIP(r.Answer) != nil || len(r.Answer) == 0 {
+			return fmt.Errorf("%s: invalid CNAME answer: %s", r.Domain, r.Answer)
+		}
+		r.Type = dns.TypeCNAME
+		return nil
+
+	default:
+		t, ok := extTypes[rrType]
+		if !ok {
+			return fmt.Errorf("%s: unsupported record type: %s", r.Domain, r.RRType)
+		}
+		r.Type = t
+		if len(r.Answer) == 0 {
+			return nil
+		}
+
+		// SVCB and HTTPS are only supported in RFC 3597 generic format
+		typeName := rrType
+		if t == TypeSVCB || t == TypeHTTPS {
+			typeName = fmt.Sprintf("TYPE%d", t)
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s 0 IN %s %s", dns.Fqdn(r.Domain), typeName, r.Answer))
+		if err != nil || rr == nil {
+			r.Type = 0
+			return fmt.Errorf("%s: invalid %s answer: %s: %v", r.Domain, rrType, r.Answer, err)
+		}
+		r.RR = rr
+		return nil
+	}
+
 	ip := net.ParseIP(r.Answer)
 	if ip == nil {
 		r.Type = dns.TypeCNAME
-		return
+		return nil
 	}
 
 	r.IP = ip
@@ -83,11 +222,15 @@ func (r *RewriteEntry) prepare() {
 		r.IP = ip4
 		r.Type = dns.TypeA
 	}
+	return nil
 }
 
 func (d *Dnsfilter) prepareRewrites() {
 	for i := range d.Rewrites {
-		d.Rewrites[i].prepare()
+		err := d.Rewrites[i].prepare()
+		if err != nil {
+			log.Error("Rewrites: %s", err)
+		}
 	}
 }
 
@@ -95,14 +238,24 @@ func (d *Dnsfilter) prepareRewrites() {
 // Priority: CNAME, A/AAAA;  exact, wildcard.
 // If matched exactly, don't return wildcard entries.
 // If matched by several wildcards, select the more specific one
-func findRewrites(a []RewriteEntry, host string) []RewriteEntry {
+// Entries with an explicit type other than A, AAAA or CNAME are matched only by the question of the same type.
+// If the client matches any client-scoped entry, the global entries are ignored.
+func findRewrites(a []RewriteEntry, host string, qtype uint16, setts *RequestFilteringSettings) []RewriteEntry {
 	rr := rewritesArray{}
+	scoped := false
 	for _, r := range a {
+		if r.Type == 0 || (r.isExtType() && r.Type != qtype) {
+			continue
+		}
 		if r.Domain != host {
 			if !matchDomainWildcard(host, r.Domain) {
 				continue
 			}
 		}
+		if !r.matchClient(setts) {
+			continue
+		}
+		scoped = scoped || r.isScoped()
 		rr = append(rr, r)
 	}
 
@@ -110,6 +263,17 @@ func findRewrites(a []RewriteEntry, host string) []RewriteEntry {
 		return nil
 	}
 
+	if scoped {
+		n := 0
+		for _, r := range rr {
+			if r.isScoped() {
+				rr[n] = r
+				n++
+			}
+		}
+		rr = rr[:n]
+	}
+
 	sort.Sort(rr)
 
 	isWC := isWildcard(rr[0].Domain)
@@ -130,12 +294,23 @@ func findRewrites(a []RewriteEntry, host string) []RewriteEntry {
 func rewriteArrayDup(a []RewriteEntry) []RewriteEntry {
 	a2 := make([]RewriteEntry, len(a))
 	copy(a2, a)
+	for i := range a2 {
+		if a[i].Clients != nil {
+			a2[i].Clients = append([]string{}, a[i].Clients...)
+		}
+		if a[i].Tags != nil {
+			a2[i].Tags = append([]string{}, a[i].Tags...)
+		}
+	}
 	return a2
 }
 
 type rewriteEntryJSON struct {
-	Domain string `json:"domain"`
-	Answer string `json:"answer"`
+	Domain  string   `json:"domain"`
+	Answer  string   `json:"answer"`
+	Type    string   `json:"type,omitempty"`
+	Clients []string `json:"clients,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
 }
 
 func (d *Dnsfilter) handleRewriteList(w http.ResponseWriter, r *http.Request) {
@@ -145,8 +320,11 @@ func (d *Dnsfilter) handleRewriteList(w http.ResponseWriter, r *http.Request) {
 	d.confLock.Lock()
 	for _, ent := range d.Config.Rewrites {
 		jsent := rewriteEntryJSON{
-			Domain: ent.Domain,
-			Answer: ent.Answer,
+			Domain:  ent.Domain,
+			Answer:  ent.Answer,
+			Type:    ent.RRType,
+			Clients: ent.Clients,
+			Tags:    ent.Tags,
 		}
 		arr = append(arr, &jsent)
 	}
@@ -170,10 +348,17 @@ func (d *Dnsfilter) handleRewriteAdd(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ent := RewriteEntry{
-		Domain: jsent.Domain,
-		Answer: jsent.Answer,
+		Domain:  jsent.Domain,
+		Answer:  jsent.Answer,
+		RRType:  jsent.Type,
+		Clients: jsent.Clients,
+		Tags:    jsent.Tags,
+	}
+	err = ent.prepare()
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
 	}
-	ent.prepare()
 	d.confLock.Lock()
 	d.Config.Rewrites = append(d.Config.Rewrites, ent)
 	d.confLock.Unlock()
@@ -181,6 +366,7 @@ func (d *Dnsfilter) handleRewriteAdd(w http.ResponseWriter, r *http.Request) {
 		ent.Domain, ent.Answer, len(d.Config.Rewrites))
 
 	d.Config.ConfigModified()
+	d.rewriteChanged(ent.Domain)
 }
 
 func (d *Dnsfilter) handleRewriteDelete(w http.ResponseWriter, r *http.Request) {
@@ -193,14 +379,19 @@ func (d *Dnsfilter) handleRewriteDelete(w http.ResponseWriter, r *http.Request)
 	}
 
 	entDel := RewriteEntry{
-		Domain: jsent.Domain,
-		Answer: jsent.Answer,
+		Domain:  jsent.Domain,
+		Answer:  jsent.Answer,
+		RRType:  jsent.Type,
+		Clients: jsent.Clients,
+		Tags:    jsent.Tags,
 	}
 	arr := []RewriteEntry{}
+	removed := false
 	d.confLock.Lock()
 	for _, ent := range d.Config.Rewrites {
 		if ent.equals(entDel) {
 			log.Debug("Rewrites: removed element: %s -> %s", ent.Domain, ent.Answer)
+			removed = true
 			continue
 		}
 		arr = append(arr, ent)
@@ -209,6 +400,16 @@ func (d *Dnsfilter) handleRewriteDelete(w http.ResponseWriter, r *http.Request)
 	d.confLock.Unlock()
 
 	d.Config.ConfigModified()
+	if removed {
+		d.rewriteChanged(entDel.Domain)
+	}
+}
+
+// Notify that a rewrite entry for the domain was changed
+func (d *Dnsfilter) rewriteChanged(domain string) {
+	if d.Config.RewriteChanged != nil {
+		d.Config.RewriteChanged(domain)
+	}
 }
 
 func (d *Dnsfilter) registerRewritesHandlers() {
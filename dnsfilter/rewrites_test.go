@@ -4,6 +4,7 @@ import (
 	"net"
 	"testing"
 
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -11,19 +12,19 @@ func TestRewrites(t *testing.T) {
 	d := Dnsfilter{}
 	// CNAME, A, AAAA
 	d.Rewrites = []RewriteEntry{
-		RewriteEntry{"somecname", "somehost.com", 0, nil},
-		RewriteEntry{"somehost.com", "0.0.0.0", 0, nil},
+		RewriteEntry{Domain: "somecname", Answer: "somehost.com"},
+		RewriteEntry{Domain: "somehost.com", Answer: "0.0.0.0"},
 
-		RewriteEntry{"host.com", "1.2.3.4", 0, nil},
-		RewriteEntry{"host.com", "1.2.3.5", 0, nil},
-		RewriteEntry{"host.com", "1:2:3::4", 0, nil},
-		RewriteEntry{"www.host.com", "host.com", 0, nil},
+		RewriteEntry{Domain: "host.com", Answer: "1.2.3.4"},
+		RewriteEntry{Domain: "host.com", Answer: "1.2.3.5"},
+		RewriteEntry{Domain: "host.com", Answer: "1:2:3::4"},
+		RewriteEntry{Domain: "www.host.com", Answer: "host.com"},
 	}
 	d.prepareRewrites()
-	r := d.processRewrites("host2.com")
+	r := d.processRewrites("host2.com", dns.TypeA, nil)
 	assert.Equal(t, NotFilteredNotFound, r.Reason)
 
-	r = d.processRewrites("www.host.com")
+	r = d.processRewrites("www.host.com", dns.TypeA, nil)
 	assert.Equal(t, ReasonRewrite, r.Reason)
 	assert.Equal(t, "host.com", r.CanonName)
 	assert.True(t, len(r.IPList) == 3)
@@ -33,51 +34,51 @@ func TestRewrites(t *testing.T) {
 
 	// wildcard
 	d.Rewrites = []RewriteEntry{
-		RewriteEntry{"host.com", "1.2.3.4", 0, nil},
-		RewriteEntry{"*.host.com", "1.2.3.5", 0, nil},
+		RewriteEntry{Domain: "host.com", Answer: "1.2.3.4"},
+		RewriteEntry{Domain: "*.host.com", Answer: "1.2.3.5"},
 	}
 	d.prepareRewrites()
-	r = d.processRewrites("host.com")
+	r = d.processRewrites("host.com", dns.TypeA, nil)
 	assert.Equal(t, ReasonRewrite, r.Reason)
 	assert.True(t, r.IPList[0].Equal(net.ParseIP("1.2.3.4")))
 
-	r = d.processRewrites("www.host.com")
+	r = d.processRewrites("www.host.com", dns.TypeA, nil)
 	assert.Equal(t, ReasonRewrite, r.Reason)
 	assert.True(t, r.IPList[0].Equal(net.ParseIP("1.2.3.5")))
 
-	r = d.processRewrites("www.host2.com")
+	r = d.processRewrites("www.host2.com", dns.TypeA, nil)
 	assert.Equal(t, NotFilteredNotFound, r.Reason)
 
 	// override a wildcard
 	d.Rewrites = []RewriteEntry{
-		RewriteEntry{"a.host.com", "1.2.3.4", 0, nil},
-		RewriteEntry{"*.host.com", "1.2.3.5", 0, nil},
+		RewriteEntry{Domain: "a.host.com", Answer: "1.2.3.4"},
+		RewriteEntry{Domain: "*.host.com", Answer: "1.2.3.5"},
 	}
 	d.prepareRewrites()
-	r = d.processRewrites("a.host.com")
+	r = d.processRewrites("a.host.com", dns.TypeA, nil)
 	assert.Equal(t, ReasonRewrite, r.Reason)
 	assert.True(t, len(r.IPList) == 1)
 	assert.True(t, r.IPList[0].Equal(net.ParseIP("1.2.3.4")))
 
 	// wildcard + CNAME
 	d.Rewrites = []RewriteEntry{
-		RewriteEntry{"host.com", "1.2.3.4", 0, nil},
-		RewriteEntry{"*.host.com", "host.com", 0, nil},
+		RewriteEntry{Domain: "host.com", Answer: "1.2.3.4"},
+		RewriteEntry{Domain: "*.host.com", Answer: "host.com"},
 	}
 	d.prepareRewrites()
-	r = d.processRewrites("www.host.com")
+	r = d.processRewrites("www.host.com", dns.TypeA, nil)
 	assert.Equal(t, ReasonRewrite, r.Reason)
 	assert.Equal(t, "host.com", r.CanonName)
 	assert.True(t, r.IPList[0].Equal(net.ParseIP("1.2.3.4")))
 
 	// 2 CNAMEs
 	d.Rewrites = []RewriteEntry{
-		RewriteEntry{"b.host.com", "a.host.com", 0, nil},
-		RewriteEntry{"a.host.com", "host.com", 0, nil},
-		RewriteEntry{"host.com", "1.2.3.4", 0, nil},
+		RewriteEntry{Domain: "b.host.com", Answer: "a.host.com"},
+		RewriteEntry{Domain: "a.host.com", Answer: "host.com"},
+		RewriteEntry{Domain: "host.com", Answer: "1.2.3.4"},
 	}
 	d.prepareRewrites()
-	r = d.processRewrites("b.host.com")
+	r = d.processRewrites("b.host.com", dns.TypeA, nil)
 	assert.Equal(t, ReasonRewrite, r.Reason)
 	assert.Equal(t, "host.com", r.CanonName)
 	assert.True(t, len(r.IPList) == 1)
@@ -85,12 +86,12 @@ func TestRewrites(t *testing.T) {
 
 	// 2 CNAMEs + wildcard
 	d.Rewrites = []RewriteEntry{
-		RewriteEntry{"b.host.com", "a.host.com", 0, nil},
-		RewriteEntry{"a.host.com", "x.somehost.com", 0, nil},
-		RewriteEntry{"*.somehost.com", "1.2.3.4", 0, nil},
+		RewriteEntry{Domain: "b.host.com", Answer: "a.host.com"},
+		RewriteEntry{Domain: "a.host.com", Answer: "x.somehost.com"},
+		RewriteEntry{Domain: "*.somehost.com", Answer: "1.2.3.4"},
 	}
 	d.prepareRewrites()
-	r = d.processRewrites("b.host.com")
+	r = d.processRewrites("b.host.com", dns.TypeA, nil)
 	assert.Equal(t, ReasonRewrite, r.Reason)
 	assert.Equal(t, "x.somehost.com", r.CanonName)
 	assert.True(t, len(r.IPList) == 1)
@@ -101,26 +102,26 @@ func TestRewritesLevels(t *testing.T) {
 	d := Dnsfilter{}
 	// exact host, wildcard L2, wildcard L3
 	d.Rewrites = []RewriteEntry{
-		RewriteEntry{"host.com", "1.1.1.1", 0, nil},
-		RewriteEntry{"*.host.com", "2.2.2.2", 0, nil},
-		RewriteEntry{"*.sub.host.com", "3.3.3.3", 0, nil},
+		RewriteEntry{Domain: "host.com", Answer: "1.1.1.1"},
+		RewriteEntry{Domain: "*.host.com", Answer: "2.2.2.2"},
+		RewriteEntry{Domain: "*.sub.host.com", Answer: "3.3.3.3"},
 	}
 	d.prepareRewrites()
 
 	// match exact
-	r := d.processRewrites("host.com")
+	r := d.processRewrites("host.com", dns.TypeA, nil)
 	assert.Equal(t, ReasonRewrite, r.Reason)
 	assert.Equal(t, 1, len(r.IPList))
 	assert.Equal(t, "1.1.1.1", r.IPList[0].String())
 
 	// match L2
-	r = d.processRewrites("sub.host.com")
+	r = d.processRewrites("sub.host.com", dns.TypeA, nil)
 	assert.Equal(t, ReasonRewrite, r.Reason)
 	assert.Equal(t, 1, len(r.IPList))
 	assert.Equal(t, "2.2.2.2", r.IPList[0].String())
 
 	// match L3
-	r = d.processRewrites("my.sub.host.com")
+	r = d.processRewrites("my.sub.host.com", dns.TypeA, nil)
 	assert.Equal(t, ReasonRewrite, r.Reason)
 	assert.Equal(t, 1, len(r.IPList))
 	assert.Equal(t, "3.3.3.3", r.IPList[0].String())
@@ -130,19 +131,19 @@ func TestRewritesException(t *testing.T) {
 	d := Dnsfilter{}
 	// wildcard; exception for a sub-domain
 	d.Rewrites = []RewriteEntry{
-		RewriteEntry{"*.host.com", "2.2.2.2", 0, nil},
-		RewriteEntry{"sub.host.com", "sub.host.com", 0, nil},
+		RewriteEntry{Domain: "*.host.com", Answer: "2.2.2.2"},
+		RewriteEntry{Domain: "sub.host.com", Answer: "sub.host.com"},
 	}
 	d.prepareRewrites()
 
 	// match sub-domain
-	r := d.processRewrites("my.host.com")
+	r := d.processRewrites("my.host.com", dns.TypeA, nil)
 	assert.Equal(t, ReasonRewrite, r.Reason)
 	assert.Equal(t, 1, len(r.IPList))
 	assert.Equal(t, "2.2.2.2", r.IPList[0].String())
 
 	// match sub-domain, but handle exception
-	r = d.processRewrites("sub.host.com")
+	r = d.processRewrites("sub.host.com", dns.TypeA, nil)
 	assert.Equal(t, NotFilteredNotFound, r.Reason)
 }
 
@@ -150,18 +151,131 @@ func TestRewritesExceptionWC(t *testing.T) {
 	d := Dnsfilter{}
 	// wildcard; exception for a sub-wildcard
 	d.Rewrites = []RewriteEntry{
-		RewriteEntry{"*.host.com", "2.2.2.2", 0, nil},
-		RewriteEntry{"*.sub.host.com", "*.sub.host.com", 0, nil},
+		RewriteEntry{Domain: "*.host.com", Answer: "2.2.2.2"},
+		RewriteEntry{Domain: "*.sub.host.com", Answer: "*.sub.host.com"},
 	}
 	d.prepareRewrites()
 
 	// match sub-domain
-	r := d.processRewrites("my.host.com")
+	r := d.processRewrites("my.host.com", dns.TypeA, nil)
 	assert.Equal(t, ReasonRewrite, r.Reason)
 	assert.Equal(t, 1, len(r.IPList))
 	assert.Equal(t, "2.2.2.2", r.IPList[0].String())
 
 	// match sub-domain, but handle exception
-	r = d.processRewrites("my.sub.host.com")
+	r = d.processRewrites("my.sub.host.com", dns.TypeA, nil)
 	assert.Equal(t, NotFilteredNotFound, r.Reason)
 }
+
+func TestRewritesTypes(t *testing.T) {
+	d := Dnsfilter{}
+	d.Rewrites = []RewriteEntry{
+		RewriteEntry{Domain: "host.com", Answer: "1.2.3.4"},
+		RewriteEntry{Domain: "host.com", Answer: "\"v=spf1 -all\"", RRType: "TXT"},
+		RewriteEntry{Domain: "host.com", Answer: "10 mail.host.com.", RRType: "mx"},
+		RewriteEntry{Domain: "_sip._tcp.host.com", Answer: "10 20 5060 sip.host.com.", RRType: "SRV"},
+		RewriteEntry{Domain: "4.3.2.1.in-addr.arpa", Answer: "host.com.", RRType: "PTR"},
+		RewriteEntry{Domain: "www.host.com", Answer: "host.com"},
+		RewriteEntry{Domain: "*.host.com", Answer: "", RRType: "HTTPS"},
+		RewriteEntry{Domain: "svc.host.com", Answer: "\\# 3 000100", RRType: "SVCB"},
+	}
+	d.prepareRewrites()
+
+	// the legacy entry is still matched by A
+	r := d.processRewrites("host.com", dns.TypeA, nil)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.Equal(t, 1, len(r.IPList))
+	assert.Nil(t, r.RRs)
+
+	r = d.processRewrites("host.com", dns.TypeTXT, nil)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.Equal(t, 1, len(r.RRs))
+	assert.Equal(t, []string{"v=spf1 -all"}, r.RRs[0].(*dns.TXT).Txt)
+
+	r = d.processRewrites("host.com", dns.TypeMX, nil)
+	assert.Equal(t, 1, len(r.RRs))
+	assert.Equal(t, "mail.host.com.", r.RRs[0].(*dns.MX).Mx)
+	assert.Equal(t, uint16(10), r.RRs[0].(*dns.MX).Preference)
+
+	r = d.processRewrites("_sip._tcp.host.com", dns.TypeSRV, nil)
+	assert.Equal(t, 1, len(r.RRs))
+	assert.Equal(t, uint16(5060), r.RRs[0].(*dns.SRV).Port)
+
+	r = d.processRewrites("4.3.2.1.in-addr.arpa", dns.TypePTR, nil)
+	assert.Equal(t, 1, len(r.RRs))
+	assert.Equal(t, "host.com.", r.RRs[0].(*dns.PTR).Ptr)
+
+	// typed records are found via CNAME
+	r = d.processRewrites("www.host.com", dns.TypeTXT, nil)
+	assert.Equal(t, "host.com", r.CanonName)
+	assert.Equal(t, 1, len(r.RRs))
+
+	// empty answer
+	r = d.processRewrites("a.host.com", TypeHTTPS, nil)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.NotNil(t, r.RRs)
+	assert.Equal(t, 0, len(r.RRs))
+
+	// generic RFC 3597 format
+	r = d.processRewrites("svc.host.com", TypeSVCB, nil)
+	assert.Equal(t, 1, len(r.RRs))
+	assert.Equal(t, uint16(TypeSVCB), r.RRs[0].Header().Rrtype)
+
+	// other types are not matched
+	r = d.processRewrites("_sip._tcp.host.com", dns.TypeA, nil)
+	assert.Equal(t, NotFilteredNotFound, r.Reason)
+	r = d.processRewrites("a.host.com", dns.TypeA, nil)
+	assert.Equal(t, NotFilteredNotFound, r.Reason)
+
+	// invalid entries
+	ent := RewriteEntry{Domain: "host.com", Answer: "1.2.3.4", RRType: "AAAA"}
+	assert.NotNil(t, ent.prepare())
+	ent = RewriteEntry{Domain: "host.com", Answer: "10", RRType: "MX"}
+	assert.NotNil(t, ent.prepare())
+	ent = RewriteEntry{Domain: "host.com", Answer: "x", RRType: "NAPTR"}
+	assert.NotNil(t, ent.prepare())
+}
+
+func TestRewritesClients(t *testing.T) {
+	d := Dnsfilter{}
+	d.Rewrites = []RewriteEntry{
+		RewriteEntry{Domain: "printer.lan", Answer: "192.168.1.10"},
+		RewriteEntry{Domain: "printer.lan", Answer: "192.168.2.10", Clients: []string{"vlan2", "10.0.0.2"}},
+		RewriteEntry{Domain: "youtube.com", Answer: "restrict.youtube.com", Tags: []string{"user_child"}},
+		RewriteEntry{Domain: "restrict.youtube.com", Answer: "1.2.3.4"},
+	}
+	d.prepareRewrites()
+
+	// global entry
+	r := d.processRewrites("printer.lan", dns.TypeA, nil)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.Equal(t, 1, len(r.IPList))
+	assert.Equal(t, "192.168.1.10", r.IPList[0].String())
+
+	// the client-scoped entry overrides the global one: by name
+	setts := &RequestFilteringSettings{ClientName: "vlan2", ClientIP: "10.0.0.1"}
+	r = d.processRewrites("printer.lan", dns.TypeA, setts)
+	assert.Equal(t, 1, len(r.IPList))
+	assert.Equal(t, "192.168.2.10", r.IPList[0].String())
+
+	// by IP
+	setts = &RequestFilteringSettings{ClientIP: "10.0.0.2"}
+	r = d.processRewrites("printer.lan", dns.TypeA, setts)
+	assert.Equal(t, 1, len(r.IPList))
+	assert.Equal(t, "192.168.2.10", r.IPList[0].String())
+
+	// by tag
+	r = d.processRewrites("youtube.com", dns.TypeA, nil)
+	assert.Equal(t, NotFilteredNotFound, r.Reason)
+	setts = &RequestFilteringSettings{ClientName: "kid", ClientTags: []string{"device_phone", "user_child"}}
+	r = d.processRewrites("youtube.com", dns.TypeA, setts)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.Equal(t, "restrict.youtube.com", r.CanonName)
+	assert.Equal(t, 1, len(r.IPList))
+
+	// equals() takes the scope into account
+	ent := RewriteEntry{Domain: "printer.lan", Answer: "192.168.2.10"}
+	assert.False(t, d.Rewrites[1].equals(ent))
+	ent.Clients = []string{"vlan2", "10.0.0.2"}
+	assert.True(t, d.Rewrites[1].equals(ent))
+}
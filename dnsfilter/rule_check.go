@@ -0,0 +1,148 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/AdguardTeam/urlfilter/rules"
+)
+
+// RuleType - the type of a filtering rule
+type RuleType int
+
+// Rule types
+const (
+	RuleTypeNone        RuleType = iota // empty line or comment
+	RuleTypeNetwork                     // adblock-style rule: "||example.org^"
+	RuleTypeHosts                       // /etc/hosts-style rule: "0.0.0.0 example.org"
+	RuleTypeRegex                       // regular expression: "/example\.org/"
+	RuleTypeInvalid                     // the rule can't be parsed
+	RuleTypeUnsupported                 // the rule is valid, but it can't be used for DNS filtering (e.g. cosmetic rule)
+)
+
+// The maximum number of errors stored in RuleStats
+const maxRuleErrors = 10
+
+// RuleError - an invalid or unsupported rule
+type RuleError struct {
+	Line  int    `json:"line"` // line number (starting from 1)
+	Rule  string `json:"rule"`
+	Error string `json:"error"`
+}
+
+// RuleStats - the numbers of rules of each type in a filter
+type RuleStats struct {
+	Network     int `json:"network"`
+	Hosts       int `json:"hosts"`
+	Regex       int `json:"regex"`
+	Invalid     int `json:"invalid"`
+	Unsupported int `json:"unsupported"`
+
+	Errors []RuleError `json:"errors"` // the first invalid and unsupported rules
+}
+
+// Get the regular expression from the text of a regex rule
+func rulePattern(line string) string {
+	line = strings.TrimPrefix(line, "@@")
+	end := strings.LastIndexByte(line, '/')
+	if end <= 0 {
+		return ""
+	}
+	return line[1:end]
+}
+
+// Get the pattern from the text of an adblock-style rule without the leading "||" and the options
+func ruleHostPattern(line string) string {
+	line = strings.TrimPrefix(line, "@@")
+	i := strings.LastIndexByte(line, '$')
+	if i != -1 {
+		line = line[:i]
+	}
+	line = strings.TrimPrefix(line, "||")
+	line = strings.TrimPrefix(line, "|")
+	line = strings.TrimPrefix(line, "http://")
+	line = strings.TrimPrefix(line, "https://")
+	return strings.TrimSuffix(line, "|")
+}
+
+// CheckRule - get the type of a filtering rule
+// Return an error if the rule is invalid or unsupported
+func CheckRule(line string) (RuleType, error) {
+	r, err := rules.NewRule(line, 0)
+	if err != nil {
+		if err == rules.ErrUnsupportedRule {
+			return RuleTypeUnsupported, err
+		}
+		return RuleTypeInvalid, err
+	}
+
+	switch rule := r.(type) {
+	case nil:
+		return RuleTypeNone, nil
+
+	case *rules.HostRule:
+		return RuleTypeHosts, nil
+
+	case *rules.NetworkRule:
+		if !rule.IsHostLevelNetworkRule() {
+			return RuleTypeUnsupported, fmt.Errorf("the rule's options can't be used for DNS filtering")
+		}
+		if rule.IsRegexRule() {
+			_, err = regexp.Compile(rulePattern(strings.TrimSpace(line)))
+			if err != nil {
+				return RuleTypeInvalid, err
+			}
+			return RuleTypeRegex, nil
+		}
+		if strings.IndexByte(ruleHostPattern(strings.TrimSpace(line)), '/') != -1 {
+			return RuleTypeUnsupported, fmt.Errorf("URL path can't be used for DNS filtering")
+		}
+		return RuleTypeNetwork, nil
+	}
+
+	return RuleTypeUnsupported, fmt.Errorf("cosmetic rules can't be used for DNS filtering")
+}
+
+// Add is called for each line of a filter to collect the statistics
+// lineNum: line number (starting from 1)
+// Return the type of the rule
+func (s *RuleStats) Add(line string, lineNum int) RuleType {
+	t, err := CheckRule(line)
+	switch t {
+	case RuleTypeNetwork:
+		s.Network++
+	case RuleTypeHosts:
+		s.Hosts++
+	case RuleTypeRegex:
+		s.Regex++
+	case RuleTypeInvalid:
+		s.Invalid++
+	case RuleTypeUnsupported:
+		s.Unsupported++
+	}
+
+	if err != nil && len(s.Errors) < maxRuleErrors {
+		e := RuleError{
+			Line:  lineNum,
+			Rule:  strings.TrimSpace(line),
+			Error: err.Error(),
+		}
+		s.Errors = append(s.Errors, e)
+	}
+	return t
+}
+
+// Supported - get the number of rules which are used for DNS filtering
+func (s *RuleStats) Supported() int {
+	return s.Network + s.Hosts + s.Regex
+}
+
+// CheckRules - get the statistics for the list of rules
+func CheckRules(lines []string) RuleStats {
+	s := RuleStats{}
+	for i, line := range lines {
+		s.Add(line, i+1)
+	}
+	return s
+}
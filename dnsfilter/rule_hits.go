@@ -0,0 +1,370 @@
+// Rule hit counters
+
+package dnsfilter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/file"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	ruleHitsMaxRules     = 100000          // the maximum number of rules with counters
+	ruleHitsSaveInterval = 5 * time.Minute // how often the counters are written to disk
+	ruleHitsTopDefault   = 100             // the default number of rules returned by "top" request
+)
+
+// The key of the rule hits table: the same rule text may be used in several filter lists
+type ruleHitsKey struct {
+	filterID int64
+	rule     string
+}
+
+// RuleHits - the number of matches of a rule
+type RuleHits struct {
+	FilterID int64     `json:"filter_id"` // 0: user rules
+	Rule     string    `json:"rule"`
+	Hits     uint64    `json:"hits"`
+	LastHit  time.Time `json:"last_hit"`
+}
+
+// FilterHits - the number of matches of the rules of a filter list
+type FilterHits struct {
+	FilterID int64  `json:"filter_id"`
+	Hits     uint64 `json:"hits"`
+}
+
+// Rule hit counters
+// The number of rules is limited by ruleHitsMaxRules:
+//  when the table is full, the half of the rules with the least number of hits is removed.
+// The counters of filter lists aren't affected by this.
+type ruleHits struct {
+	lock     sync.Mutex
+	rules    map[ruleHitsKey]*RuleHits
+	filters  map[int64]uint64 // filter ID -> hits
+	modified bool             // the counters have been changed since they were written to disk
+	fileName string           // the file where the counters are stored (may be empty)
+
+	saveStop chan bool // signal for 'saveLoop' goroutine to stop
+}
+
+// The data stored on disk
+type ruleHitsData struct {
+	Rules   []RuleHits   `json:"rules"`
+	Filters []FilterHits `json:"filters"`
+}
+
+func newRuleHits(fileName string) *ruleHits {
+	h := ruleHits{
+		rules:    map[ruleHitsKey]*RuleHits{},
+		filters:  map[int64]uint64{},
+		fileName: fileName,
+	}
+	h.load()
+	return &h
+}
+
+// Count a match of the rule
+func (h *ruleHits) add(filterID int64, rule string, now time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.filters[filterID]++
+	h.modified = true
+
+	k := ruleHitsKey{filterID: filterID, rule: rule}
+	e, ok := h.rules[k]
+	if !ok {
+		if len(h.rules) >= ruleHitsMaxRules {
+			h.shrink()
+		}
+		e = &RuleHits{FilterID: filterID, Rule: rule}
+		h.rules[k] = e
+	}
+	e.Hits++
+	e.LastHit = now
+}
+
+// Sort the rules by the number of hits (the most used first)
+func sortRuleHits(list []RuleHits) {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Hits != list[j].Hits {
+			return list[i].Hits > list[j].Hits
+		}
+		return list[i].LastHit.After(list[j].LastHit)
+	})
+}
+
+// Remove the half of the rules with the least number of hits
+// Note: must be called under lock
+func (h *ruleHits) shrink() {
+	list := make([]RuleHits, 0, len(h.rules))
+	for _, e := range h.rules {
+		list = append(list, *e)
+	}
+	sortRuleHits(list)
+
+	for _, e := range list[len(list)/2:] {
+		delete(h.rules, ruleHitsKey{filterID: e.FilterID, rule: e.Rule})
+	}
+	log.Debug("Rule hits: removed %d rules", len(list)-len(h.rules))
+}
+
+// Get the most used rules
+func (h *ruleHits) top(limit int) []RuleHits {
+	h.lock.Lock()
+	list := make([]RuleHits, 0, len(h.rules))
+	for _, e := range h.rules {
+		list = append(list, *e)
+	}
+	h.lock.Unlock()
+
+	sortRuleHits(list)
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list
+}
+
+// Get the counters of the rule
+// filterID: -1: search in all filter lists
+func (h *ruleHits) find(rule string, filterID int64) []RuleHits {
+	list := []RuleHits{}
+	h.lock.Lock()
+	for k, e := range h.rules {
+		if k.rule == rule && (filterID < 0 || k.filterID == filterID) {
+			list = append(list, *e)
+		}
+	}
+	h.lock.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].FilterID < list[j].FilterID
+	})
+	return list
+}
+
+// Get the counters of the filter lists
+func (h *ruleHits) filterHits(ids []int64) []FilterHits {
+	list := []FilterHits{}
+	h.lock.Lock()
+	for _, id := range ids {
+		list = append(list, FilterHits{FilterID: id, Hits: h.filters[id]})
+	}
+	h.lock.Unlock()
+	return list
+}
+
+// Load the counters from disk
+func (h *ruleHits) load() {
+	if len(h.fileName) == 0 {
+		return
+	}
+
+	data, err := ioutil.ReadFile(h.fileName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("Rule hits: ioutil.ReadFile: %s", err)
+		}
+		return
+	}
+
+	d := ruleHitsData{}
+	err = json.Unmarshal(data, &d)
+	if err != nil {
+		log.Error("Rule hits: json.Unmarshal: %s", err)
+		return
+	}
+
+	for i := range d.Rules {
+		e := d.Rules[i]
+		if len(h.rules) == ruleHitsMaxRules {
+			break
+		}
+		h.rules[ruleHitsKey{filterID: e.FilterID, rule: e.Rule}] = &e
+	}
+	for _, f := range d.Filters {
+		h.filters[f.FilterID] = f.Hits
+	}
+	log.Debug("Rule hits: loaded %d rules from %s", len(h.rules), h.fileName)
+}
+
+// Write the counters to disk (if they have been changed)
+func (h *ruleHits) save() {
+	if len(h.fileName) == 0 {
+		return
+	}
+
+	h.lock.Lock()
+	if !h.modified {
+		h.lock.Unlock()
+		return
+	}
+	d := ruleHitsData{}
+	for _, e := range h.rules {
+		d.Rules = append(d.Rules, *e)
+	}
+	for id, n := range h.filters {
+		d.Filters = append(d.Filters, FilterHits{FilterID: id, Hits: n})
+	}
+	h.modified = false
+	h.lock.Unlock()
+
+	data, err := json.Marshal(d)
+	if err != nil {
+		log.Error("Rule hits: json.Marshal: %s", err)
+		return
+	}
+	err = file.SafeWrite(h.fileName, data)
+	if err != nil {
+		log.Error("Rule hits: %s", err)
+		return
+	}
+	log.Debug("Rule hits: saved %d rules to %s", len(d.Rules), h.fileName)
+}
+
+// Periodically write the counters to disk
+func (h *ruleHits) saveLoop(stop chan bool) {
+	t := time.NewTicker(ruleHitsSaveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			h.save()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (h *ruleHits) start() {
+	h.saveStop = make(chan bool)
+	go h.saveLoop(h.saveStop)
+}
+
+func (h *ruleHits) close() {
+	if h.saveStop != nil {
+		close(h.saveStop)
+		h.saveStop = nil
+	}
+	h.save()
+}
+
+// Count a match of the filtering rule
+func (d *Dnsfilter) countRuleHit(res Result, setts *RequestFilteringSettings) {
+	if d.ruleHits == nil || setts.NoRuleHits ||
+		(res.Reason != FilteredBlackList && res.Reason != NotFilteredWhiteList) ||
+		len(res.Rule) == 0 {
+		return
+	}
+	d.ruleHits.add(res.FilterID, res.Rule, time.Now())
+}
+
+// GetRuleHits - get the counters of the rule
+// filterID: -1: search in all filter lists
+func (d *Dnsfilter) GetRuleHits(rule string, filterID int64) []RuleHits {
+	if d.ruleHits == nil {
+		return []RuleHits{}
+	}
+	return d.ruleHits.find(rule, filterID)
+}
+
+// Get the IDs of the filter lists in use (except user rules)
+func (d *Dnsfilter) filterListIDs() []int64 {
+	d.engineLock.RLock()
+	ids := make([]int64, len(d.filterIDs))
+	copy(ids, d.filterIDs)
+	d.engineLock.RUnlock()
+	return ids
+}
+
+func (d *Dnsfilter) handleRuleHitsTop(w http.ResponseWriter, r *http.Request) {
+	limit := ruleHitsTopDefault
+	s := r.URL.Query().Get("limit")
+	if len(s) != 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			httpError(r, w, http.StatusBadRequest, "invalid limit: %s", s)
+			return
+		}
+		limit = n
+	}
+
+	list := d.ruleHits.top(limit)
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(list)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func (d *Dnsfilter) handleRuleHitsLists(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Lists  []FilterHits `json:"lists"`  // the filter lists in use, the most used first
+		Unused []int64      `json:"unused"` // the IDs of the filter lists without hits
+	}
+	resp := response{
+		Unused: []int64{},
+	}
+
+	resp.Lists = d.ruleHits.filterHits(d.filterListIDs())
+	sort.SliceStable(resp.Lists, func(i, j int) bool {
+		return resp.Lists[i].Hits > resp.Lists[j].Hits
+	})
+	for _, f := range resp.Lists {
+		if f.Hits == 0 {
+			resp.Unused = append(resp.Unused, f.FilterID)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func (d *Dnsfilter) handleRuleHitsRule(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	rule := q.Get("rule")
+	if len(rule) == 0 {
+		httpError(r, w, http.StatusBadRequest, "rule is required")
+		return
+	}
+	filterID := int64(-1)
+	s := q.Get("filter_id")
+	if len(s) != 0 {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			httpError(r, w, http.StatusBadRequest, "invalid filter_id: %s", s)
+			return
+		}
+		filterID = n
+	}
+
+	list := d.GetRuleHits(rule, filterID)
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(list)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func (d *Dnsfilter) registerRuleHitsHandlers() {
+	d.Config.HTTPRegister("GET", "/control/filtering/rule_hits/top", d.handleRuleHitsTop)
+	d.Config.HTTPRegister("GET", "/control/filtering/rule_hits/lists", d.handleRuleHitsLists)
+	d.Config.HTTPRegister("GET", "/control/filtering/rule_hits/rule", d.handleRuleHitsRule)
+}
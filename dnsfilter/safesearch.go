@@ -1,218 +1,253 @@
 package dnsfilter
 
-var safeSearchDomains = map[string]string{
-	"yandex.com":     "213.180.193.56",
-	"yandex.ru":      "213.180.193.56",
-	"yandex.ua":      "213.180.193.56",
-	"yandex.by":      "213.180.193.56",
-	"yandex.kz":      "213.180.193.56",
-	"www.yandex.com": "213.180.193.56",
-	"www.yandex.ru":  "213.180.193.56",
-	"www.yandex.ua":  "213.180.193.56",
-	"www.yandex.by":  "213.180.193.56",
-	"www.yandex.kz":  "213.180.193.56",
-
-	"www.bing.com": "strict.bing.com",
-
-	"duckduckgo.com":       "safe.duckduckgo.com",
-	"www.duckduckgo.com":   "safe.duckduckgo.com",
-	"start.duckduckgo.com": "safe.duckduckgo.com",
-
-	"www.google.com":    "forcesafesearch.google.com",
-	"www.google.ad":     "forcesafesearch.google.com",
-	"www.google.ae":     "forcesafesearch.google.com",
-	"www.google.com.af": "forcesafesearch.google.com",
-	"www.google.com.ag": "forcesafesearch.google.com",
-	"www.google.com.ai": "forcesafesearch.google.com",
-	"www.google.al":     "forcesafesearch.google.com",
-	"www.google.am":     "forcesafesearch.google.com",
-	"www.google.co.ao":  "forcesafesearch.google.com",
-	"www.google.com.ar": "forcesafesearch.google.com",
-	"www.google.as":     "forcesafesearch.google.com",
-	"www.google.at":     "forcesafesearch.google.com",
-	"www.google.com.au": "forcesafesearch.google.com",
-	"www.google.az":     "forcesafesearch.google.com",
-	"www.google.ba":     "forcesafesearch.google.com",
-	"www.google.com.bd": "forcesafesearch.google.com",
-	"www.google.be":     "forcesafesearch.google.com",
-	"www.google.bf":     "forcesafesearch.google.com",
-	"www.google.bg":     "forcesafesearch.google.com",
-	"www.google.com.bh": "forcesafesearch.google.com",
-	"www.google.bi":     "forcesafesearch.google.com",
-	"www.google.bj":     "forcesafesearch.google.com",
-	"www.google.com.bn": "forcesafesearch.google.com",
-	"www.google.com.bo": "forcesafesearch.google.com",
-	"www.google.com.br": "forcesafesearch.google.com",
-	"www.google.bs":     "forcesafesearch.google.com",
-	"www.google.bt":     "forcesafesearch.google.com",
-	"www.google.co.bw":  "forcesafesearch.google.com",
-	"www.google.by":     "forcesafesearch.google.com",
-	"www.google.com.bz": "forcesafesearch.google.com",
-	"www.google.ca":     "forcesafesearch.google.com",
-	"www.google.cd":     "forcesafesearch.google.com",
-	"www.google.cf":     "forcesafesearch.google.com",
-	"www.google.cg":     "forcesafesearch.google.com",
-	"www.google.ch":     "forcesafesearch.google.com",
-	"www.google.ci":     "forcesafesearch.google.com",
-	"www.google.co.ck":  "forcesafesearch.google.com",
-	"www.google.cl":     "forcesafesearch.google.com",
-	"www.google.cm":     "forcesafesearch.google.com",
-	"www.google.cn":     "forcesafesearch.google.com",
-	"www.google.com.co": "forcesafesearch.google.com",
-	"www.google.co.cr":  "forcesafesearch.google.com",
-	"www.google.com.cu": "forcesafesearch.google.com",
-	"www.google.cv":     "forcesafesearch.google.com",
-	"www.google.com.cy": "forcesafesearch.google.com",
-	"www.google.cz":     "forcesafesearch.google.com",
-	"www.google.de":     "forcesafesearch.google.com",
-	"www.google.dj":     "forcesafesearch.google.com",
-	"www.google.dk":     "forcesafesearch.google.com",
-	"www.google.dm":     "forcesafesearch.google.com",
-	"www.google.com.do": "forcesafesearch.google.com",
-	"www.google.dz":     "forcesafesearch.google.com",
-	"www.google.com.ec": "forcesafesearch.google.com",
-	"www.google.ee":     "forcesafesearch.google.com",
-	"www.google.com.eg": "forcesafesearch.google.com",
-	"www.google.es":     "forcesafesearch.google.com",
-	"www.google.com.et": "forcesafesearch.google.com",
-	"www.google.fi":     "forcesafesearch.google.com",
-	"www.google.com.fj": "forcesafesearch.google.com",
-	"www.google.fm":     "forcesafesearch.google.com",
-	"www.google.fr":     "forcesafesearch.google.com",
-	"www.google.ga":     "forcesafesearch.google.com",
-	"www.google.ge":     "forcesafesearch.google.com",
-	"www.google.gg":     "forcesafesearch.google.com",
-	"www.google.com.gh": "forcesafesearch.google.com",
-	"www.google.com.gi": "forcesafesearch.google.com",
-	"www.google.gl":     "forcesafesearch.google.com",
-	"www.google.gm":     "forcesafesearch.google.com",
-	"www.google.gp":     "forcesafesearch.google.com",
-	"www.google.gr":     "forcesafesearch.google.com",
-	"www.google.com.gt": "forcesafesearch.google.com",
-	"www.google.gy":     "forcesafesearch.google.com",
-	"www.google.com.hk": "forcesafesearch.google.com",
-	"www.google.hn":     "forcesafesearch.google.com",
-	"www.google.hr":     "forcesafesearch.google.com",
-	"www.google.ht":     "forcesafesearch.google.com",
-	"www.google.hu":     "forcesafesearch.google.com",
-	"www.google.co.id":  "forcesafesearch.google.com",
-	"www.google.ie":     "forcesafesearch.google.com",
-	"www.google.co.il":  "forcesafesearch.google.com",
-	"www.google.im":     "forcesafesearch.google.com",
-	"www.google.co.in":  "forcesafesearch.google.com",
-	"www.google.iq":     "forcesafesearch.google.com",
-	"www.google.is":     "forcesafesearch.google.com",
-	"www.google.it":     "forcesafesearch.google.com",
-	"www.google.je":     "forcesafesearch.google.com",
-	"www.google.com.jm": "forcesafesearch.google.com",
-	"www.google.jo":     "forcesafesearch.google.com",
-	"www.google.co.jp":  "forcesafesearch.google.com",
-	"www.google.co.ke":  "forcesafesearch.google.com",
-	"www.google.com.kh": "forcesafesearch.google.com",
-	"www.google.ki":     "forcesafesearch.google.com",
-	"www.google.kg":     "forcesafesearch.google.com",
-	"www.google.co.kr":  "forcesafesearch.google.com",
-	"www.google.com.kw": "forcesafesearch.google.com",
-	"www.google.kz":     "forcesafesearch.google.com",
-	"www.google.la":     "forcesafesearch.google.com",
-	"www.google.com.lb": "forcesafesearch.google.com",
-	"www.google.li":     "forcesafesearch.google.com",
-	"www.google.lk":     "forcesafesearch.google.com",
-	"www.google.co.ls":  "forcesafesearch.google.com",
-	"www.google.lt":     "forcesafesearch.google.com",
-	"www.google.lu":     "forcesafesearch.google.com",
-	"www.google.lv":     "forcesafesearch.google.com",
-	"www.google.com.ly": "forcesafesearch.google.com",
-	"www.google.co.ma":  "forcesafesearch.google.com",
-	"www.google.md":     "forcesafesearch.google.com",
-	"www.google.me":     "forcesafesearch.google.com",
-	"www.google.mg":     "forcesafesearch.google.com",
-	"www.google.mk":     "forcesafesearch.google.com",
-	"www.google.ml":     "forcesafesearch.google.com",
-	"www.google.com.mm": "forcesafesearch.google.com",
-	"www.google.mn":     "forcesafesearch.google.com",
-	"www.google.ms":     "forcesafesearch.google.com",
-	"www.google.com.mt": "forcesafesearch.google.com",
-	"www.google.mu":     "forcesafesearch.google.com",
-	"www.google.mv":     "forcesafesearch.google.com",
-	"www.google.mw":     "forcesafesearch.google.com",
-	"www.google.com.mx": "forcesafesearch.google.com",
-	"www.google.com.my": "forcesafesearch.google.com",
-	"www.google.co.mz":  "forcesafesearch.google.com",
-	"www.google.com.na": "forcesafesearch.google.com",
-	"www.google.com.nf": "forcesafesearch.google.com",
-	"www.google.com.ng": "forcesafesearch.google.com",
-	"www.google.com.ni": "forcesafesearch.google.com",
-	"www.google.ne":     "forcesafesearch.google.com",
-	"www.google.nl":     "forcesafesearch.google.com",
-	"www.google.no":     "forcesafesearch.google.com",
-	"www.google.com.np": "forcesafesearch.google.com",
-	"www.google.nr":     "forcesafesearch.google.com",
-	"www.google.nu":     "forcesafesearch.google.com",
-	"www.google.co.nz":  "forcesafesearch.google.com",
-	"www.google.com.om": "forcesafesearch.google.com",
-	"www.google.com.pa": "forcesafesearch.google.com",
-	"www.google.com.pe": "forcesafesearch.google.com",
-	"www.google.com.pg": "forcesafesearch.google.com",
-	"www.google.com.ph": "forcesafesearch.google.com",
-	"www.google.com.pk": "forcesafesearch.google.com",
-	"www.google.pl":     "forcesafesearch.google.com",
-	"www.google.pn":     "forcesafesearch.google.com",
-	"www.google.com.pr": "forcesafesearch.google.com",
-	"www.google.ps":     "forcesafesearch.google.com",
-	"www.google.pt":     "forcesafesearch.google.com",
-	"www.google.com.py": "forcesafesearch.google.com",
-	"www.google.com.qa": "forcesafesearch.google.com",
-	"www.google.ro":     "forcesafesearch.google.com",
-	"www.google.ru":     "forcesafesearch.google.com",
-	"www.google.rw":     "forcesafesearch.google.com",
-	"www.google.com.sa": "forcesafesearch.google.com",
-	"www.google.com.sb": "forcesafesearch.google.com",
-	"www.google.sc":     "forcesafesearch.google.com",
-	"www.google.se":     "forcesafesearch.google.com",
-	"www.google.com.sg": "forcesafesearch.google.com",
-	"www.google.sh":     "forcesafesearch.google.com",
-	"www.google.si":     "forcesafesearch.google.com",
-	"www.google.sk":     "forcesafesearch.google.com",
-	"www.google.com.sl": "forcesafesearch.google.com",
-	"www.google.sn":     "forcesafesearch.google.com",
-	"www.google.so":     "forcesafesearch.google.com",
-	"www.google.sm":     "forcesafesearch.google.com",
-	"www.google.sr":     "forcesafesearch.google.com",
-	"www.google.st":     "forcesafesearch.google.com",
-	"www.google.com.sv": "forcesafesearch.google.com",
-	"www.google.td":     "forcesafesearch.google.com",
-	"www.google.tg":     "forcesafesearch.google.com",
-	"www.google.co.th":  "forcesafesearch.google.com",
-	"www.google.com.tj": "forcesafesearch.google.com",
-	"www.google.tk":     "forcesafesearch.google.com",
-	"www.google.tl":     "forcesafesearch.google.com",
-	"www.google.tm":     "forcesafesearch.google.com",
-	"www.google.tn":     "forcesafesearch.google.com",
-	"www.google.to":     "forcesafesearch.google.com",
-	"www.google.com.tr": "forcesafesearch.google.com",
-	"www.google.tt":     "forcesafesearch.google.com",
-	"www.google.com.tw": "forcesafesearch.google.com",
-	"www.google.co.tz":  "forcesafesearch.google.com",
-	"www.google.com.ua": "forcesafesearch.google.com",
-	"www.google.co.ug":  "forcesafesearch.google.com",
-	"www.google.co.uk":  "forcesafesearch.google.com",
-	"www.google.com.uy": "forcesafesearch.google.com",
-	"www.google.co.uz":  "forcesafesearch.google.com",
-	"www.google.com.vc": "forcesafesearch.google.com",
-	"www.google.co.ve":  "forcesafesearch.google.com",
-	"www.google.vg":     "forcesafesearch.google.com",
-	"www.google.co.vi":  "forcesafesearch.google.com",
-	"www.google.com.vn": "forcesafesearch.google.com",
-	"www.google.vu":     "forcesafesearch.google.com",
-	"www.google.ws":     "forcesafesearch.google.com",
-	"www.google.rs":     "forcesafesearch.google.com",
-
-	"www.youtube.com":          "restrictmoderate.youtube.com",
-	"m.youtube.com":            "restrictmoderate.youtube.com",
-	"youtubei.googleapis.com":  "restrictmoderate.youtube.com",
-	"youtube.googleapis.com":   "restrictmoderate.youtube.com",
-	"www.youtube-nocookie.com": "restrictmoderate.youtube.com",
-
-	"pixabay.com": "safesearch.pixabay.com",
+// Built-in safe search engines
+var builtinSafeSearchEngines = []SafeSearchEngine{
+	{
+		Name:   SafeSearchYandex,
+		Target: "213.180.193.56",
+		Domains: []string{
+			"yandex.com",
+			"yandex.ru",
+			"yandex.ua",
+			"yandex.by",
+			"yandex.kz",
+			"www.yandex.com",
+			"www.yandex.ru",
+			"www.yandex.ua",
+			"www.yandex.by",
+			"www.yandex.kz",
+		},
+	},
+	{
+		Name:    SafeSearchBing,
+		Target:  "strict.bing.com",
+		Domains: []string{"www.bing.com"},
+	},
+	{
+		Name:   SafeSearchDuckDuckGo,
+		Target: "safe.duckduckgo.com",
+		Domains: []string{
+			"duckduckgo.com",
+			"www.duckduckgo.com",
+			"start.duckduckgo.com",
+		},
+	},
+	{
+		Name:   SafeSearchYouTube,
+		Target: "restrictmoderate.youtube.com",
+		// Restricted mode: Strict
+		StrictTarget: "restrict.youtube.com",
+		Domains: []string{
+			"www.youtube.com",
+			"m.youtube.com",
+			"youtubei.googleapis.com",
+			"youtube.googleapis.com",
+			"www.youtube-nocookie.com",
+		},
+	},
+	{
+		Name:    SafeSearchPixabay,
+		Target:  "safesearch.pixabay.com",
+		Domains: []string{"pixabay.com"},
+	},
+	{
+		Name:    SafeSearchEcosia,
+		Target:  "strict-safe-search.ecosia.org",
+		Domains: []string{"www.ecosia.org"},
+	},
+	{
+		Name:   SafeSearchGoogle,
+		Target: "forcesafesearch.google.com",
+		Domains: []string{
+			"www.google.com",
+			"www.google.ad",
+			"www.google.ae",
+			"www.google.com.af",
+			"www.google.com.ag",
+			"www.google.com.ai",
+			"www.google.al",
+			"www.google.am",
+			"www.google.co.ao",
+			"www.google.com.ar",
+			"www.google.as",
+			"www.google.at",
+			"www.google.com.au",
+			"www.google.az",
+			"www.google.ba",
+			"www.google.com.bd",
+			"www.google.be",
+			"www.google.bf",
+			"www.google.bg",
+			"www.google.com.bh",
+			"www.google.bi",
+			"www.google.bj",
+			"www.google.com.bn",
+			"www.google.com.bo",
+			"www.google.com.br",
+			"www.google.bs",
+			"www.google.bt",
+			"www.google.co.bw",
+			"www.google.by",
+			"www.google.com.bz",
+			"www.google.ca",
+			"www.google.cd",
+			"www.google.cf",
+			"www.google.cg",
+			"www.google.ch",
+			"www.google.ci",
+			"www.google.co.ck",
+			"www.google.cl",
+			"www.google.cm",
+			"www.google.cn",
+			"www.google.com.co",
+			"www.google.co.cr",
+			"www.google.com.cu",
+			"www.google.cv",
+			"www.google.com.cy",
+			"www.google.cz",
+			"www.google.de",
+			"www.google.dj",
+			"www.google.dk",
+			"www.google.dm",
+			"www.google.com.do",
+			"www.google.dz",
+			"www.google.com.ec",
+			"www.google.ee",
+			"www.google.com.eg",
+			"www.google.es",
+			"www.google.com.et",
+			"www.google.fi",
+			"www.google.com.fj",
+			"www.google.fm",
+			"www.google.fr",
+			"www.google.ga",
+			"www.google.ge",
+			"www.google.gg",
+			"www.google.com.gh",
+			"www.google.com.gi",
+			"www.google.gl",
+			"www.google.gm",
+			"www.google.gp",
+			"www.google.gr",
+			"www.google.com.gt",
+			"www.google.gy",
+			"www.google.com.hk",
+			"www.google.hn",
+			"www.google.hr",
+			"www.google.ht",
+			"www.google.hu",
+			"www.google.co.id",
+			"www.google.ie",
+			"www.google.co.il",
+			"www.google.im",
+			"www.google.co.in",
+			"www.google.iq",
+			"www.google.is",
+			"www.google.it",
+			"www.google.je",
+			"www.google.com.jm",
+			"www.google.jo",
+			"www.google.co.jp",
+			"www.google.co.ke",
+			"www.google.com.kh",
+			"www.google.ki",
+			"www.google.kg",
+			"www.google.co.kr",
+			"www.google.com.kw",
+			"www.google.kz",
+			"www.google.la",
+			"www.google.com.lb",
+			"www.google.li",
+			"www.google.lk",
+			"www.google.co.ls",
+			"www.google.lt",
+			"www.google.lu",
+			"www.google.lv",
+			"www.google.com.ly",
+			"www.google.co.ma",
+			"www.google.md",
+			"www.google.me",
+			"www.google.mg",
+			"www.google.mk",
+			"www.google.ml",
+			"www.google.com.mm",
+			"www.google.mn",
+			"www.google.ms",
+			"www.google.com.mt",
+			"www.google.mu",
+			"www.google.mv",
+			"www.google.mw",
+			"www.google.com.mx",
+			"www.google.com.my",
+			"www.google.co.mz",
+			"www.google.com.na",
+			"www.google.com.nf",
+			"www.google.com.ng",
+			"www.google.com.ni",
+			"www.google.ne",
+			"www.google.nl",
+			"www.google.no",
+			"www.google.com.np",
+			"www.google.nr",
+			"www.google.nu",
+			"www.google.co.nz",
+			"www.google.com.om",
+			"www.google.com.pa",
+			"www.google.com.pe",
+			"www.google.com.pg",
+			"www.google.com.ph",
+			"www.google.com.pk",
+			"www.google.pl",
+			"www.google.pn",
+			"www.google.com.pr",
+			"www.google.ps",
+			"www.google.pt",
+			"www.google.com.py",
+			"www.google.com.qa",
+			"www.google.ro",
+			"www.google.ru",
+			"www.google.rw",
+			"www.google.com.sa",
+			"www.google.com.sb",
+			"www.google.sc",
+			"www.google.se",
+			"www.google.com.sg",
+			"www.google.sh",
+			"www.google.si",
+			"www.google.sk",
+			"www.google.com.sl",
+			"www.google.sn",
+			"www.google.so",
+			"www.google.sm",
+			"www.google.sr",
+			"www.google.st",
+			"www.google.com.sv",
+			"www.google.td",
+			"www.google.tg",
+			"www.google.co.th",
+			"www.google.com.tj",
+			"www.google.tk",
+			"www.google.tl",
+			"www.google.tm",
+			"www.google.tn",
+			"www.google.to",
+			"www.google.com.tr",
+			"www.google.tt",
+			"www.google.com.tw",
+			"www.google.co.tz",
+			"www.google.com.ua",
+			"www.google.co.ug",
+			"www.google.co.uk",
+			"www.google.com.uy",
+			"www.google.co.uz",
+			"www.google.com.vc",
+			"www.google.co.ve",
+			"www.google.vg",
+			"www.google.co.vi",
+			"www.google.com.vn",
+			"www.google.vu",
+			"www.google.ws",
+			"www.google.rs",
+		},
+	},
 }
@@ -0,0 +1,231 @@
+// Safe search engines
+
+package dnsfilter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
+)
+
+// Names of the built-in safe search engines
+const (
+	SafeSearchGoogle     = "google"
+	SafeSearchBing       = "bing"
+	SafeSearchYandex     = "yandex"
+	SafeSearchDuckDuckGo = "duckduckgo"
+	SafeSearchYouTube    = "youtube"
+	SafeSearchPixabay    = "pixabay"
+	SafeSearchEcosia     = "ecosia"
+)
+
+// SafeSearchEngine - safe search settings of a search engine
+type SafeSearchEngine struct {
+	Name    string   `yaml:"name" json:"name"`       // unique name, e.g. "google"
+	Domains []string `yaml:"domains" json:"domains"` // the domains of the search engine, e.g. "www.google.com"
+
+	// The host name or IP address of the safe variant of the search engine,
+	//  e.g. "forcesafesearch.google.com"
+	Target string `yaml:"target" json:"target"`
+
+	// The target used in strict mode (e.g. YouTube restricted mode: Strict)
+	// Empty: the engine doesn't support strict mode, Target is used.
+	StrictTarget string `yaml:"strict_target" json:"strict_target"`
+}
+
+// The format of the file with safe search engines (JSON or YAML):
+//  {"engines": [{"name": "...", "domains": ["...", ...], "target": "...", "strict_target": "..."}, ...]}
+type safeSearchFile struct {
+	Engines []SafeSearchEngine `yaml:"engines"`
+}
+
+var safeSearchEngines = builtinSafeSearchEngines                   // built-in and custom engines
+var safeSearchHosts = safeSearchHostsMap(builtinSafeSearchEngines) // domain -> engine
+var safeSearchLock sync.RWMutex                                    // protects safeSearchEngines and safeSearchHosts
+
+// Get the map: domain -> engine
+func safeSearchHostsMap(list []SafeSearchEngine) map[string]*SafeSearchEngine {
+	hosts := map[string]*SafeSearchEngine{}
+	for i := range list {
+		for _, host := range list[i].Domains {
+			hosts[strings.ToLower(host)] = &list[i]
+		}
+	}
+	return hosts
+}
+
+// Set the list of known engines
+func setSafeSearchEngines(list []SafeSearchEngine) {
+	hosts := safeSearchHostsMap(list)
+
+	safeSearchLock.Lock()
+	safeSearchEngines = list
+	safeSearchHosts = hosts
+	safeSearchLock.Unlock()
+}
+
+// Get the list of known engines
+func getSafeSearchEngines() []SafeSearchEngine {
+	safeSearchLock.RLock()
+	list := make([]SafeSearchEngine, len(safeSearchEngines))
+	copy(list, safeSearchEngines)
+	safeSearchLock.RUnlock()
+	return list
+}
+
+// SafeSearchEngineKnown - return TRUE if a safe search engine name is known
+func SafeSearchEngineKnown(name string) bool {
+	safeSearchLock.RLock()
+	defer safeSearchLock.RUnlock()
+	for _, e := range safeSearchEngines {
+		if e.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the safe search target for the host
+// Return FALSE if the host doesn't belong to a search engine
+//  or safe search is disabled for this engine.
+func safeSearchTarget(host string, setts *RequestFilteringSettings) (string, bool) {
+	safeSearchLock.RLock()
+	e, ok := safeSearchHosts[host]
+	safeSearchLock.RUnlock()
+	if !ok {
+		return "", false
+	}
+
+	for _, name := range setts.SafeSearchDisabledEngines {
+		if name == e.Name {
+			return "", false
+		}
+	}
+
+	if setts.SafeSearchStrict && len(e.StrictTarget) != 0 {
+		return e.StrictTarget, true
+	}
+	return e.Target, true
+}
+
+// Parse and validate the safe search engines
+// The invalid engines are skipped.
+func parseSafeSearchEngines(data []byte) ([]SafeSearchEngine, error) {
+	f := safeSearchFile{}
+	// YAML parser accepts JSON too
+	err := yaml.Unmarshal(data, &f)
+	if err != nil {
+		return nil, err
+	}
+
+	list := []SafeSearchEngine{}
+	names := map[string]bool{}
+	for _, e := range f.Engines {
+		if len(e.Name) == 0 {
+			log.Error("SafeSearch: skipping the engine without name")
+			continue
+		}
+		if names[e.Name] {
+			log.Error("SafeSearch: %s: duplicate name", e.Name)
+			continue
+		}
+		if len(e.Domains) == 0 || len(e.Target) == 0 {
+			log.Error("SafeSearch: %s: no domains or target", e.Name)
+			continue
+		}
+
+		names[e.Name] = true
+		list = append(list, e)
+	}
+	return list, nil
+}
+
+// Merge the custom engines with the built-in engines
+// A custom engine replaces the built-in engine with the same name.
+func mergeSafeSearchEngines(builtin, custom []SafeSearchEngine) []SafeSearchEngine {
+	customNames := map[string]bool{}
+	for _, e := range custom {
+		customNames[e.Name] = true
+	}
+
+	list := []SafeSearchEngine{}
+	for _, e := range builtin {
+		if !customNames[e.Name] {
+			list = append(list, e)
+		}
+	}
+	return append(list, custom...)
+}
+
+// LoadSafeSearchEngines - load the safe search engines from a file (JSON or YAML)
+// and merge them with the built-in engines.
+// If the file name is empty, only the built-in engines are used.
+// If the file can't be loaded, the current engines are left intact.
+func LoadSafeSearchEngines(fileName string) error {
+	custom := []SafeSearchEngine{}
+	if len(fileName) != 0 {
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return fmt.Errorf("safesearch: %s", err)
+		}
+		custom, err = parseSafeSearchEngines(data)
+		if err != nil {
+			return fmt.Errorf("safesearch: %s: %s", fileName, err)
+		}
+	}
+
+	setSafeSearchEngines(mergeSafeSearchEngines(builtinSafeSearchEngines, custom))
+	if gctx.safeSearchCache != nil {
+		gctx.safeSearchCache.Clear()
+	}
+	log.Debug("SafeSearch: loaded %d engines from %s", len(custom), fileName)
+	return nil
+}
+
+// Get the key of the safe search cache
+// The result depends on the mode (e.g. YouTube strict mode) and the requested address family.
+func safeSearchCacheKey(host string, strict bool, qtype uint16) string {
+	key := host
+	if strict {
+		key += "/strict"
+	}
+	if qtype == dns.TypeAAAA {
+		key += "/AAAA"
+	}
+	return key
+}
+
+type safeSearchConfigJSON struct {
+	DisabledEngines []string `json:"disabled_engines"`
+	Strict          bool     `json:"strict"`
+}
+
+func (d *Dnsfilter) handleSafeSearchConfig(w http.ResponseWriter, r *http.Request) {
+	req := safeSearchConfigJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	for _, name := range req.DisabledEngines {
+		if !SafeSearchEngineKnown(name) {
+			httpError(r, w, http.StatusBadRequest, "unknown safe search engine: %s", name)
+			return
+		}
+	}
+
+	d.confLock.Lock()
+	d.Config.SafeSearchDisabledEngines = req.DisabledEngines
+	d.Config.SafeSearchStrict = req.Strict
+	d.confLock.Unlock()
+
+	d.Config.ConfigModified()
+}
@@ -100,35 +100,36 @@ func getCachedResult(cache cache.Cache, host string) (Result, bool) {
 }
 
 // SafeSearchDomain returns replacement address for search engine
+// Note: the default settings are used (all engines are enabled, strict mode is off)
 func (d *Dnsfilter) SafeSearchDomain(host string) (string, bool) {
-	val, ok := safeSearchDomains[host]
-	return val, ok
+	return safeSearchTarget(host, &RequestFilteringSettings{})
 }
 
-func (d *Dnsfilter) checkSafeSearch(host string) (Result, error) {
+func (d *Dnsfilter) checkSafeSearch(host string, qtype uint16, setts *RequestFilteringSettings) (Result, error) {
 	if log.GetLevel() >= log.DEBUG {
 		timer := log.StartTimer()
 		defer timer.LogElapsed("SafeSearch: lookup for %s", host)
 	}
 
+	safeHost, ok := safeSearchTarget(host, setts)
+	if !ok {
+		return Result{}, nil
+	}
+
 	// Check cache. Return cached result if it was found
-	cachedValue, isFound := getCachedResult(gctx.safeSearchCache, host)
+	cacheKey := safeSearchCacheKey(host, setts.SafeSearchStrict, qtype)
+	cachedValue, isFound := getCachedResult(gctx.safeSearchCache, cacheKey)
 	if isFound {
 		// atomic.AddUint64(&gctx.stats.Safesearch.CacheHits, 1)
-		log.Tracef("SafeSearch: found in cache: %s", host)
+		log.Tracef("SafeSearch: found in cache: %s", cacheKey)
 		return cachedValue, nil
 	}
 
-	safeHost, ok := d.SafeSearchDomain(host)
-	if !ok {
-		return Result{}, nil
-	}
-
 	res := Result{IsFiltered: true, Reason: FilteredSafeSearch}
 	if ip := net.ParseIP(safeHost); ip != nil {
 		res.IP = ip
-		valLen := d.setCacheResult(gctx.safeSearchCache, host, res)
-		log.Debug("SafeSearch: stored in cache: %s (%d bytes)", host, valLen)
+		valLen := d.setCacheResult(gctx.safeSearchCache, cacheKey, res)
+		log.Debug("SafeSearch: stored in cache: %s (%d bytes)", cacheKey, valLen)
 		return res, nil
 	}
 
@@ -141,18 +142,24 @@ func (d *Dnsfilter) checkSafeSearch(host string) (Result, error) {
 
 	for _, i := range addrs {
 		if ipv4 := i.To4(); ipv4 != nil {
-			res.IP = ipv4
+			if len(res.IP) == 0 {
+				res.IP = ipv4
+			}
+		} else if qtype == dns.TypeAAAA {
+			res.IP = i
 			break
 		}
 	}
 
+	// Note: for AAAA request an IPv4 address is used if there are no IPv6 addresses,
+	//  so the response will contain no records
 	if len(res.IP) == 0 {
-		return Result{}, fmt.Errorf("no ipv4 addresses in safe search response for %s", safeHost)
+		return Result{}, fmt.Errorf("no ip addresses in safe search response for %s", safeHost)
 	}
 
 	// Cache result
-	valLen := d.setCacheResult(gctx.safeSearchCache, host, res)
-	log.Debug("SafeSearch: stored in cache: %s (%d bytes)", host, valLen)
+	valLen := d.setCacheResult(gctx.safeSearchCache, cacheKey, res)
+	log.Debug("SafeSearch: stored in cache: %s (%d bytes)", cacheKey, valLen)
 	return res, nil
 }
 
@@ -229,6 +236,10 @@ func (d *Dnsfilter) checkSafeBrowsing(host string) (Result, error) {
 		defer timer.LogElapsed("SafeBrowsing lookup for %s", host)
 	}
 
+	if d.safeBrowsingDB != nil {
+		return checkHashDB(d.safeBrowsingDB, host, FilteredSafeBrowsing), nil
+	}
+
 	// check cache
 	cachedValue, isFound := getCachedResult(gctx.safebrowsingCache, host)
 	if isFound {
@@ -269,6 +280,10 @@ func (d *Dnsfilter) checkParental(host string) (Result, error) {
 		defer timer.LogElapsed("Parental lookup for %s", host)
 	}
 
+	if d.parentalDB != nil {
+		return checkHashDB(d.parentalDB, host, FilteredParental), nil
+	}
+
 	// check cache
 	cachedValue, isFound := getCachedResult(gctx.parentalCache, host)
 	if isFound {
@@ -321,6 +336,7 @@ func (d *Dnsfilter) handleSafeBrowsingStatus(w http.ResponseWriter, r *http.Requ
 	data := map[string]interface{}{
 		"enabled": d.Config.SafeBrowsingEnabled,
 	}
+	addHashDBStatus(d.safeBrowsingDB, data)
 	jsonVal, err := json.Marshal(data)
 	if err != nil {
 		httpError(r, w, http.StatusInternalServerError, "Unable to marshal status json: %s", err)
@@ -348,6 +364,7 @@ func (d *Dnsfilter) handleParentalStatus(w http.ResponseWriter, r *http.Request)
 	data := map[string]interface{}{
 		"enabled": d.Config.ParentalEnabled,
 	}
+	addHashDBStatus(d.parentalDB, data)
 	jsonVal, err := json.Marshal(data)
 	if err != nil {
 		httpError(r, w, http.StatusInternalServerError, "Unable to marshal status json: %s", err)
@@ -373,8 +390,16 @@ func (d *Dnsfilter) handleSafeSearchDisable(w http.ResponseWriter, r *http.Reque
 }
 
 func (d *Dnsfilter) handleSafeSearchStatus(w http.ResponseWriter, r *http.Request) {
+	d.confLock.RLock()
+	disabled := append([]string{}, d.Config.SafeSearchDisabledEngines...)
+	strict := d.Config.SafeSearchStrict
+	d.confLock.RUnlock()
+
 	data := map[string]interface{}{
-		"enabled": d.Config.SafeSearchEnabled,
+		"enabled":          d.Config.SafeSearchEnabled,
+		"disabled_engines": disabled,
+		"strict":           strict,
+		"engines":          getSafeSearchEngines(),
 	}
 	jsonVal, err := json.Marshal(data)
 	if err != nil {
@@ -394,12 +419,15 @@ func (d *Dnsfilter) registerSecurityHandlers() {
 	d.Config.HTTPRegister("POST", "/control/safebrowsing/enable", d.handleSafeBrowsingEnable)
 	d.Config.HTTPRegister("POST", "/control/safebrowsing/disable", d.handleSafeBrowsingDisable)
 	d.Config.HTTPRegister("GET", "/control/safebrowsing/status", d.handleSafeBrowsingStatus)
+	d.Config.HTTPRegister("POST", "/control/safebrowsing/reload", d.handleSafeBrowsingReload)
 
 	d.Config.HTTPRegister("POST", "/control/parental/enable", d.handleParentalEnable)
 	d.Config.HTTPRegister("POST", "/control/parental/disable", d.handleParentalDisable)
 	d.Config.HTTPRegister("GET", "/control/parental/status", d.handleParentalStatus)
+	d.Config.HTTPRegister("POST", "/control/parental/reload", d.handleParentalReload)
 
 	d.Config.HTTPRegister("POST", "/control/safesearch/enable", d.handleSafeSearchEnable)
 	d.Config.HTTPRegister("POST", "/control/safesearch/disable", d.handleSafeSearchDisable)
 	d.Config.HTTPRegister("GET", "/control/safesearch/status", d.handleSafeSearchStatus)
+	d.Config.HTTPRegister("POST", "/control/safesearch/config", d.handleSafeSearchConfig)
 }
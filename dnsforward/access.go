@@ -5,39 +5,78 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"regexp"
 	"strings"
 	"sync"
 
+	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/urlfilter"
 	"github.com/AdguardTeam/urlfilter/filterlist"
 )
 
+// Access settings:
+//  allowed/disallowed clients: IP addresses, CIDRs, MAC addresses and client IDs
+//   (client ID is "<id>" from DOH URL "/dns-query/<id>" or DOT server name "<id>.<server name>")
+//  blocked hosts: host names, adblock-style rules ("||host^", "@@||host^" for exceptions),
+//   wildcards ("*.host.com") and regular expressions ("/^ads[0-9]*\./")
 type accessCtx struct {
 	lock sync.Mutex
 
-	allowedClients    map[string]bool // IP addresses of whitelist clients
-	disallowedClients map[string]bool // IP addresses of clients that should be blocked
+	allowedClients    accessClients // whitelist clients
+	disallowedClients accessClients // clients that should be blocked
 
-	allowedClientsIPNet    []net.IPNet // CIDRs of whitelist clients
-	disallowedClientsIPNet []net.IPNet // CIDRs of clients that should be blocked
+	blockedHostsEngine   *urlfilter.DNSEngine // finds hosts that should be blocked
+	blockedHostsPatterns []accessPattern      // wildcards and regular expressions of hosts that should be blocked
+}
+
+// The list of clients
+// The maps are: normalized value -> list entry
+type accessClients struct {
+	ips    map[string]string
+	ipNets []accessIPNet
+	macs   map[string]string
+	ids    map[string]string
+}
+
+type accessIPNet struct {
+	ipNet net.IPNet
+	entry string
+}
+
+type accessPattern struct {
+	re    *regexp.Regexp
+	entry string
+}
 
-	blockedHostsEngine *urlfilter.DNSEngine // finds hosts that should be blocked
+// Identifiers of the client which sent the request
+type accessClient struct {
+	ip  string
+	mac net.HardwareAddr // may be nil
+	id  string           // client ID (may be empty)
 }
 
 func (a *accessCtx) Init(allowedClients, disallowedClients, blockedHosts []string) error {
-	err := processIPCIDRArray(&a.allowedClients, &a.allowedClientsIPNet, allowedClients)
+	err := a.allowedClients.init(allowedClients)
 	if err != nil {
 		return err
 	}
 
-	err = processIPCIDRArray(&a.disallowedClients, &a.disallowedClientsIPNet, disallowedClients)
+	err = a.disallowedClients.init(disallowedClients)
 	if err != nil {
 		return err
 	}
 
 	buf := strings.Builder{}
 	for _, s := range blockedHosts {
+		re, err := accessHostPattern(s)
+		if err != nil {
+			return fmt.Errorf("%s: %s", s, err)
+		}
+		if re != nil {
+			a.blockedHostsPatterns = append(a.blockedHostsPatterns, accessPattern{re: re, entry: s})
+			continue
+		}
 		buf.WriteString(s)
 		buf.WriteString("\n")
 	}
@@ -58,73 +97,178 @@ func (a *accessCtx) Init(allowedClients, disallowedClients, blockedHosts []strin
 	return nil
 }
 
-// Split array of IP or CIDR into 2 containers for fast search
-func processIPCIDRArray(dst *map[string]bool, dstIPNet *[]net.IPNet, src []string) error {
-	*dst = make(map[string]bool)
+// Get the regular expression for a blocked hosts entry
+// Return nil if the entry is neither a regular expression ("/.../") nor a wildcard ("*.host.com").
+func accessHostPattern(s string) (*regexp.Regexp, error) {
+	if len(s) > 2 && s[0] == '/' && s[len(s)-1] == '/' {
+		return regexp.Compile(s[1 : len(s)-1])
+	}
+
+	s = strings.ToLower(s)
+	if strings.IndexByte(s, '*') >= 0 && strings.Trim(s, "*.-_abcdefghijklmnopqrstuvwxyz0123456789") == "" {
+		// "*.host.com" -> "^.*\.host\.com$"
+		re := "^" + strings.ReplaceAll(regexp.QuoteMeta(s), "\\*", ".*") + "$"
+		return regexp.Compile(re)
+	}
+
+	return nil, nil
+}
+
+// Return TRUE if the value is a valid client ID
+// A client ID must contain a letter, so a mistyped IP address (e.g. "19216801") isn't taken for it.
+func isValidClientID(s string) bool {
+	if len(s) == 0 || len(s) > 63 || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	letter := false
+	for _, c := range s {
+		if c >= 'a' && c <= 'z' {
+			letter = true
+		} else if !((c >= '0' && c <= '9') || c == '-') {
+			return false
+		}
+	}
+	return letter
+}
+
+// Split array of IP, CIDR, MAC or client ID into containers for fast search
+func (c *accessClients) init(src []string) error {
+	c.ips = map[string]string{}
+	c.macs = map[string]string{}
+	c.ids = map[string]string{}
 
 	for _, s := range src {
 		ip := net.ParseIP(s)
 		if ip != nil {
-			(*dst)[s] = true
+			c.ips[ip.String()] = s
 			continue
 		}
 
 		_, ipnet, err := net.ParseCIDR(s)
-		if err != nil {
-			return err
+		if err == nil {
+			c.ipNets = append(c.ipNets, accessIPNet{ipNet: *ipnet, entry: s})
+			continue
+		}
+
+		mac, err := net.ParseMAC(s)
+		if err == nil {
+			c.macs[mac.String()] = s
+			continue
 		}
-		*dstIPNet = append(*dstIPNet, *ipnet)
+
+		if isValidClientID(strings.ToLower(s)) {
+			c.ids[strings.ToLower(s)] = s
+			continue
+		}
+
+		return fmt.Errorf("invalid client: %s: must be IP, CIDR, MAC or client ID", s)
 	}
 
 	return nil
 }
 
-// IsBlockedIP - return TRUE if this client should be blocked
-func (a *accessCtx) IsBlockedIP(ip string) bool {
-	a.lock.Lock()
-	defer a.lock.Unlock()
+// Return TRUE if the list is empty
+func (c *accessClients) empty() bool {
+	return len(c.ips) == 0 && len(c.ipNets) == 0 && len(c.macs) == 0 && len(c.ids) == 0
+}
 
-	if len(a.allowedClients) != 0 || len(a.allowedClientsIPNet) != 0 {
-		_, ok := a.allowedClients[ip]
+// Find the list entry which matches the client
+func (c *accessClients) match(client accessClient) (string, bool) {
+	ip := net.ParseIP(client.ip)
+	if ip != nil {
+		e, ok := c.ips[ip.String()]
 		if ok {
-			return false
+			return e, true
 		}
 
-		if len(a.allowedClientsIPNet) != 0 {
-			ipAddr := net.ParseIP(ip)
-			for _, ipnet := range a.allowedClientsIPNet {
-				if ipnet.Contains(ipAddr) {
-					return false
-				}
+		for _, n := range c.ipNets {
+			if n.ipNet.Contains(ip) {
+				return n.entry, true
 			}
 		}
-
-		return true
 	}
 
-	_, ok := a.disallowedClients[ip]
-	if ok {
-		return true
+	if client.mac != nil {
+		e, ok := c.macs[client.mac.String()]
+		if ok {
+			return e, true
+		}
 	}
 
-	if len(a.disallowedClientsIPNet) != 0 {
-		ipAddr := net.ParseIP(ip)
-		for _, ipnet := range a.disallowedClientsIPNet {
-			if ipnet.Contains(ipAddr) {
-				return true
-			}
+	if len(client.id) != 0 {
+		e, ok := c.ids[strings.ToLower(client.id)]
+		if ok {
+			return e, true
 		}
 	}
 
-	return false
+	return "", false
+}
+
+// needMAC - return TRUE if the client's MAC address is needed to check the access
+func (a *accessCtx) needMAC() bool {
+	return len(a.allowedClients.macs) != 0 || len(a.disallowedClients.macs) != 0
+}
+
+// IsBlockedIP - return TRUE if this client should be blocked
+func (a *accessCtx) IsBlockedIP(ip string) bool {
+	blocked, _ := a.isBlockedClient(accessClient{ip: ip})
+	return blocked
+}
+
+// Return TRUE if this client should be blocked, and the matched entry of the access list
+//  (empty if the client is blocked because it isn't in the list of allowed clients)
+func (a *accessCtx) isBlockedClient(client accessClient) (bool, string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if !a.allowedClients.empty() {
+		e, ok := a.allowedClients.match(client)
+		return !ok, e
+	}
+
+	e, ok := a.disallowedClients.match(client)
+	return ok, e
 }
 
 // IsBlockedDomain - return TRUE if this domain should be blocked
 func (a *accessCtx) IsBlockedDomain(host string) bool {
+	blocked, _ := a.isBlockedDomain(host)
+	return blocked
+}
+
+// Return TRUE if this domain should be blocked, and the matched entry of the list
+// Exception rules ("@@||host^") have priority over other entries.
+func (a *accessCtx) isBlockedDomain(host string) (bool, string) {
+	host = strings.ToLower(host)
+
 	a.lock.Lock()
-	_, ok := a.blockedHostsEngine.Match(host)
-	a.lock.Unlock()
-	return ok
+	defer a.lock.Unlock()
+
+	res, ok := a.blockedHostsEngine.Match(host)
+	if ok && res.NetworkRule != nil && res.NetworkRule.Whitelist {
+		return false, res.NetworkRule.Text()
+	}
+
+	for _, p := range a.blockedHostsPatterns {
+		if p.re.MatchString(host) {
+			return true, p.entry
+		}
+	}
+
+	if ok {
+		if res.NetworkRule != nil {
+			return true, res.NetworkRule.Text()
+		}
+		if len(res.HostRulesV4) != 0 {
+			return true, res.HostRulesV4[0].Text()
+		}
+		if len(res.HostRulesV6) != 0 {
+			return true, res.HostRulesV6[0].Text()
+		}
+		return true, ""
+	}
+	return false, ""
 }
 
 type accessListJSON struct {
@@ -150,22 +294,6 @@ func (s *Server) handleAccessList(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func checkIPCIDRArray(src []string) error {
-	for _, s := range src {
-		ip := net.ParseIP(s)
-		if ip != nil {
-			continue
-		}
-
-		_, _, err := net.ParseCIDR(s)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
 func (s *Server) handleAccessSet(w http.ResponseWriter, r *http.Request) {
 	j := accessListJSON{}
 	err := json.NewDecoder(r.Body).Decode(&j)
@@ -174,15 +302,6 @@ func (s *Server) handleAccessSet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = checkIPCIDRArray(j.AllowedClients)
-	if err == nil {
-		err = checkIPCIDRArray(j.DisallowedClients)
-	}
-	if err != nil {
-		httpError(r, w, http.StatusBadRequest, "%s", err)
-		return
-	}
-
 	a := &accessCtx{}
 	err = a.Init(j.AllowedClients, j.DisallowedClients, j.BlockedHosts)
 	if err != nil {
@@ -201,3 +320,94 @@ func (s *Server) handleAccessSet(w http.ResponseWriter, r *http.Request) {
 	log.Debug("Access: updated lists: %d, %d, %d",
 		len(j.AllowedClients), len(j.DisallowedClients), len(j.BlockedHosts))
 }
+
+// Get the identifiers of the client which sent the request
+func (s *Server) accessClientFromDNSContext(d *proxy.DNSContext) accessClient {
+	client := accessClient{
+		ip: ipFromAddr(d.Addr),
+		id: s.clientIDFromDNSContext(d),
+	}
+	if s.access.needMAC() && s.conf.FindMACByIP != nil {
+		ip := net.ParseIP(client.ip)
+		if ip != nil {
+			client.mac = s.conf.FindMACByIP(ip)
+		}
+	}
+	return client
+}
+
+type accessCheckJSON struct {
+	Client *accessCheckClientJSON `json:"client,omitempty"`
+	Domain *accessCheckDomainJSON `json:"domain,omitempty"`
+}
+
+type accessCheckClientJSON struct {
+	Blocked bool   `json:"blocked"`
+	List    string `json:"list"` // "allowed_clients", "disallowed_clients" or "" (no list is used)
+	Rule    string `json:"rule"` // the matched entry (empty: no entry is matched)
+}
+
+type accessCheckDomainJSON struct {
+	Blocked bool   `json:"blocked"`
+	Rule    string `json:"rule"` // the matched entry (empty: no entry is matched)
+}
+
+// Check the client and domain against the access lists
+// Query parameters: ip, mac, client_id, domain
+func (s *Server) handleAccessCheck(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	client := accessClient{
+		ip: q.Get("ip"),
+		id: q.Get("client_id"),
+	}
+	if len(client.ip) != 0 && net.ParseIP(client.ip) == nil {
+		httpError(r, w, http.StatusBadRequest, "invalid ip: %s", client.ip)
+		return
+	}
+	mac := q.Get("mac")
+	if len(mac) != 0 {
+		var err error
+		client.mac, err = net.ParseMAC(mac)
+		if err != nil {
+			httpError(r, w, http.StatusBadRequest, "invalid mac: %s", mac)
+			return
+		}
+	} else if len(client.ip) != 0 && s.conf.FindMACByIP != nil {
+		client.mac = s.conf.FindMACByIP(net.ParseIP(client.ip))
+	}
+	domain := q.Get("domain")
+
+	s.RLock()
+	a := s.access
+	s.RUnlock()
+	if a == nil {
+		httpError(r, w, http.StatusInternalServerError, "DNS server is not initialized")
+		return
+	}
+
+	resp := accessCheckJSON{}
+	if len(client.ip) != 0 || len(client.id) != 0 || client.mac != nil {
+		c := accessCheckClientJSON{}
+		c.Blocked, c.Rule = a.isBlockedClient(client)
+		a.lock.Lock()
+		if !a.allowedClients.empty() {
+			c.List = "allowed_clients"
+		} else if !a.disallowedClients.empty() {
+			c.List = "disallowed_clients"
+		}
+		a.lock.Unlock()
+		resp.Client = &c
+	}
+	if len(domain) != 0 {
+		d := accessCheckDomainJSON{}
+		d.Blocked, d.Rule = a.isBlockedDomain(domain)
+		resp.Domain = &d
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
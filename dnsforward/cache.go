@@ -0,0 +1,648 @@
+package dnsforward
+
+import (
+	"container/list"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/file"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// DNS cache with serve-stale (RFC 8767) and prefetch support
+// It's used instead of dnsproxy's cache so that we control how the entries expire.
+// The responses are stored as they are received from upstream servers, before filtering.
+
+const (
+	defaultCacheStaleMaxAge       = 24 * 60 * 60     // keep expired entries for 1 day
+	defaultCacheStaleTTL          = 30               // TTL of stale answers (RFC 8767 recommends 30 seconds)
+	defaultCachePrefetchThreshold = 10               // refresh an entry when less than 10 seconds remain
+	defaultCachePrefetchHits      = 3                // refresh an entry if it was requested at least 3 times
+	cacheRefreshRetryInterval     = 30 * time.Second // don't retry a failed refresh more often than this
+	cacheItemOverhead             = 64               // approximate size of cacheItem and list element
+	cacheKeyPrefixLen             = 1 + 2 + 2        // DO flag, qtype, qclass
+	cacheFileMagic                = "AGHDNSC1"       // cache file signature and version
+)
+
+// Cache entry
+type cacheItem struct {
+	key        string
+	data       []byte    // packed response
+	expire     time.Time // when the TTL elapses
+	hits       uint32    // number of cache hits since the response was stored
+	refreshing bool      // a background request is in progress
+	retry      time.Time // don't try to refresh before this time (after a failed refresh)
+}
+
+// Cache settings
+type cacheConfig struct {
+	size uint32 // in bytes
+
+	serveStale  bool   // respond with expired entries while refreshing them
+	staleMaxAge uint32 // how long expired entries are kept (in seconds)
+	staleTTL    uint32 // TTL of stale answers (in seconds)
+
+	prefetch          bool   // refresh popular entries before they expire
+	prefetchThreshold uint32 // refresh an entry when less than this number of seconds remain
+	prefetchHits      uint32 // refresh an entry only if it was requested at least this number of times
+}
+
+// DNS cache
+type dnsCache struct {
+	lock  sync.Mutex
+	conf  cacheConfig
+	items map[string]*list.Element // key -> element with *cacheItem
+	lru   *list.List               // the most recently used items go first
+	size  int                      // total size of the items (in bytes)
+
+	now func() time.Time // current time (for tests)
+}
+
+// Create cache object
+func newDNSCache(conf cacheConfig) *dnsCache {
+	if conf.staleMaxAge == 0 {
+		conf.staleMaxAge = defaultCacheStaleMaxAge
+	}
+	if conf.staleTTL == 0 {
+		conf.staleTTL = defaultCacheStaleTTL
+	}
+	if conf.prefetchThreshold == 0 {
+		conf.prefetchThreshold = defaultCachePrefetchThreshold
+	}
+	if conf.prefetchHits == 0 {
+		conf.prefetchHits = defaultCachePrefetchHits
+	}
+	return &dnsCache{
+		conf:  conf,
+		items: map[string]*list.Element{},
+		lru:   list.New(),
+		now:   time.Now,
+	}
+}
+
+// Get cache key for the message
+// Format:
+// uint8(do)
+// uint16(qtype)
+// uint16(qclass)
+// name (lower-case)
+func cacheKey(m *dns.Msg) string {
+	q := m.Question[0]
+	b := make([]byte, cacheKeyPrefixLen+len(q.Name))
+	opt := m.IsEdns0()
+	if opt != nil && opt.Do() {
+		b[0] = 1
+	}
+	binary.BigEndian.PutUint16(b[1:], q.Qtype)
+	binary.BigEndian.PutUint16(b[3:], q.Qclass)
+	copy(b[cacheKeyPrefixLen:], strings.ToLower(q.Name))
+	return string(b)
+}
+
+// Get the time until which the item is kept in cache
+func (c *dnsCache) deadline(item *cacheItem) time.Time {
+	if !c.conf.serveStale {
+		return item.expire
+	}
+	return item.expire.Add(time.Duration(c.conf.staleMaxAge) * time.Second)
+}
+
+// Get response from cache
+// Returns nil if there's no suitable response.
+// refresh: TRUE if the caller must refresh this entry in background (serve-stale or prefetch)
+func (c *dnsCache) get(req *dns.Msg) (resp *dns.Msg, refresh bool) {
+	if len(req.Question) != 1 {
+		return nil, false
+	}
+	key := cacheKey(req)
+	now := c.now()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := e.Value.(*cacheItem)
+	if !now.Before(c.deadline(item)) {
+		c.remove(e)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	item.hits++
+
+	var ttl uint32
+	canRefresh := !item.refreshing && !now.Before(item.retry)
+	if now.Before(item.expire) {
+		ttl = uint32(item.expire.Sub(now) / time.Second)
+		if ttl == 0 {
+			ttl = 1
+		}
+		refresh = c.conf.prefetch && canRefresh &&
+			item.hits >= c.conf.prefetchHits && ttl <= c.conf.prefetchThreshold
+		if refresh {
+			log.Debug("DNS cache: prefetching %s", req.Question[0].Name)
+		}
+	} else {
+		ttl = c.conf.staleTTL
+		refresh = canRefresh
+		log.Debug("DNS cache: serving stale response for %s", req.Question[0].Name)
+	}
+	if refresh {
+		item.refreshing = true
+	}
+
+	resp = unpackCachedResponse(item.data, req, ttl)
+	if resp == nil {
+		c.remove(e)
+		return nil, false
+	}
+	return resp, refresh
+}
+
+// Store response in cache
+// key: the key of the request (see cacheKey()), because upstream servers may not copy OPT record from the request
+// Returns FALSE if the response can't be cached.
+func (c *dnsCache) set(key string, m *dns.Msg) bool {
+	if !isCacheable(m) {
+		return false
+	}
+	data, err := m.Pack()
+	if err != nil {
+		return false
+	}
+
+	item := &cacheItem{
+		key:    key,
+		data:   data,
+		expire: c.now().Add(time.Duration(findLowestTTL(m)) * time.Second),
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.items[item.key]
+	if ok {
+		c.remove(e)
+	}
+	c.items[item.key] = c.lru.PushFront(item)
+	c.size += itemSize(item)
+
+	for c.size > int(c.conf.size) && c.lru.Len() > 1 {
+		c.remove(c.lru.Back())
+	}
+	return true
+}
+
+// Allow refreshing the entry again after a failed attempt
+func (c *dnsCache) refreshFailed(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return
+	}
+	item := e.Value.(*cacheItem)
+	item.refreshing = false
+	item.retry = c.now().Add(cacheRefreshRetryInterval)
+}
+
+// Remove element from cache (must be called under lock)
+func (c *dnsCache) remove(e *list.Element) {
+	item := e.Value.(*cacheItem)
+	c.lru.Remove(e)
+	delete(c.items, item.key)
+	c.size -= itemSize(item)
+}
+
+// Remove all entries
+func (c *dnsCache) clear() {
+	c.lock.Lock()
+	c.items = map[string]*list.Element{}
+	c.lru.Init()
+	c.size = 0
+	c.lock.Unlock()
+}
+
+// Get the number of entries and their total size (in bytes)
+func (c *dnsCache) stats() (entries int, size int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len(), c.size
+}
+
+// Remove the entries for the name (lower-case FQDN) and, optionally, its subdomains
+// Returns the number of removed entries.
+func (c *dnsCache) flush(name string, subdomains bool) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	n := 0
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		itemName := e.Value.(*cacheItem).name()
+		if itemName == name || (subdomains && dns.IsSubDomain(name, itemName)) {
+			c.remove(e)
+			n++
+		}
+		e = next
+	}
+	return n
+}
+
+// Get the entries for the name (lower-case FQDN), or all entries if name is empty
+// The most recently used entries go first.
+func (c *dnsCache) list(name string) []cacheEntryJSON {
+	now := c.now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entries := []cacheEntryJSON{}
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		item := e.Value.(*cacheItem)
+		if len(name) != 0 && item.name() != name {
+			continue
+		}
+		if !now.Before(c.deadline(item)) {
+			continue
+		}
+
+		ent := cacheEntryJSON{
+			Name:   item.name(),
+			Type:   dns.Type(binary.BigEndian.Uint16([]byte(item.key[1:]))).String(),
+			DNSSEC: item.key[0] == 1,
+			TTL:    int64(item.expire.Sub(now) / time.Second),
+			Answer: []string{},
+		}
+		m := dns.Msg{}
+		if m.Unpack(item.data) == nil {
+			ent.Rcode = dns.RcodeToString[m.Rcode]
+			for _, rr := range m.Answer {
+				ent.Answer = append(ent.Answer, rr.String())
+			}
+		}
+		entries = append(entries, ent)
+	}
+	return entries
+}
+
+// Get the question name of the entry
+func (item *cacheItem) name() string {
+	return item.key[cacheKeyPrefixLen:]
+}
+
+func itemSize(item *cacheItem) int {
+	return len(item.key) + len(item.data) + cacheItemOverhead
+}
+
+// Save cache entries to a file
+// File format:
+// "AGHDNSC1"
+// entries: (the least recently used first)
+//  uint16(key length) key
+//  int64(expire, unix time in seconds)
+//  uint32(data length) data
+func (c *dnsCache) save(fn string) error {
+	var b []byte
+	b = append(b, cacheFileMagic...)
+
+	c.lock.Lock()
+	n := c.lru.Len()
+	for e := c.lru.Back(); e != nil; e = e.Prev() {
+		item := e.Value.(*cacheItem)
+		b = appendUint16(b, uint16(len(item.key)))
+		b = append(b, item.key...)
+		b = appendUint64(b, uint64(item.expire.Unix()))
+		b = appendUint32(b, uint32(len(item.data)))
+		b = append(b, item.data...)
+	}
+	c.lock.Unlock()
+
+	err := file.SafeWrite(fn, b)
+	if err != nil {
+		return err
+	}
+	log.Debug("DNS cache: saved %d entries to %s", n, fn)
+	return nil
+}
+
+// Load cache entries from a file
+// The entries that would be removed from cache by now are skipped.
+func (c *dnsCache) load(fn string) error {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if len(b) < len(cacheFileMagic) || string(b[:len(cacheFileMagic)]) != cacheFileMagic {
+		return fmt.Errorf("%s: invalid file format", fn)
+	}
+	b = b[len(cacheFileMagic):]
+
+	now := c.now()
+	n := 0
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for len(b) != 0 {
+		item := &cacheItem{}
+		if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b))+8+4 {
+			return fmt.Errorf("%s: unexpected end of file", fn)
+		}
+		keyLen := int(binary.BigEndian.Uint16(b))
+		item.key = string(b[2 : 2+keyLen])
+		b = b[2+keyLen:]
+		item.expire = time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+		dataLen := int(binary.BigEndian.Uint32(b[8:]))
+		b = b[12:]
+		if len(b) < dataLen || keyLen < cacheKeyPrefixLen {
+			return fmt.Errorf("%s: unexpected end of file", fn)
+		}
+		item.data = append([]byte{}, b[:dataLen]...)
+		b = b[dataLen:]
+
+		if !now.Before(c.deadline(item)) {
+			continue
+		}
+		e, ok := c.items[item.key]
+		if ok {
+			c.remove(e)
+		}
+		c.items[item.key] = c.lru.PushFront(item)
+		c.size += itemSize(item)
+		n++
+	}
+
+	for c.size > int(c.conf.size) && c.lru.Len() > 1 {
+		c.remove(c.lru.Back())
+	}
+	log.Debug("DNS cache: loaded %d entries from %s", n, fn)
+	return nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
+
+// Refresh cache entry by sending the request to an upstream server
+func (c *dnsCache) refresh(p *proxy.Proxy, req *dns.Msg) {
+	key := cacheKey(req)
+	d := &proxy.DNSContext{
+		Proto:     "udp",
+		Req:       req,
+		StartTime: time.Now(),
+	}
+	err := p.Resolve(d)
+	if err != nil || d.Res == nil || !c.set(key, d.Res) {
+		log.Debug("DNS cache: couldn't refresh %s: %v", req.Question[0].Name, err)
+		c.refreshFailed(key)
+		return
+	}
+	log.Debug("DNS cache: refreshed %s", req.Question[0].Name)
+}
+
+// Return TRUE if the message can be cached
+func isCacheable(m *dns.Msg) bool {
+	if m.Truncated || len(m.Question) != 1 {
+		return false
+	}
+
+	if findLowestTTL(m) == 0 {
+		return false
+	}
+
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return false
+	}
+
+	qType := m.Question[0].Qtype
+	if m.Rcode == dns.RcodeSuccess && (qType == dns.TypeA || qType == dns.TypeAAAA) {
+		// NOERROR response must contain at least one A or AAAA record
+		for _, rr := range m.Answer {
+			if rr.Header().Rrtype == dns.TypeA || rr.Header().Rrtype == dns.TypeAAAA {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// Get the lowest TTL of all the records in the message
+// Returns 0 if there are no records.
+func findLowestTTL(m *dns.Msg) uint32 {
+	var ttl uint32 = math.MaxUint32
+	for _, sect := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range sect {
+			if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+	}
+	if ttl == math.MaxUint32 {
+		return 0
+	}
+	return ttl
+}
+
+// Create a response to the request from the packed cached response
+func unpackCachedResponse(data []byte, req *dns.Msg, ttl uint32) *dns.Msg {
+	m := dns.Msg{}
+	err := m.Unpack(data)
+	if err != nil {
+		return nil
+	}
+
+	reqDo := false
+	reqOpt := req.IsEdns0()
+	if reqOpt != nil {
+		reqDo = reqOpt.Do()
+	}
+
+	res := &dns.Msg{}
+	res.SetReply(req)
+	res.AuthenticatedData = m.AuthenticatedData
+	res.RecursionAvailable = m.RecursionAvailable
+	res.Rcode = m.Rcode
+	res.Compress = true
+
+	for _, rr := range m.Answer {
+		rr.Header().Ttl = ttl
+		res.Answer = append(res.Answer, rr)
+	}
+	for _, rr := range m.Ns {
+		rr.Header().Ttl = ttl
+		res.Ns = append(res.Ns, rr)
+	}
+	for _, rr := range m.Extra {
+		// OPT records are hop-by-hop, only DO flag is copied
+		if opt, ok := rr.(*dns.OPT); ok {
+			if reqDo {
+				res.SetEdns0(opt.UDPSize(), opt.Do())
+			}
+			continue
+		}
+		rr.Header().Ttl = ttl
+		res.Extra = append(res.Extra, rr)
+	}
+	return res
+}
+
+// Save cache to the file if configured
+// Must be called under lock.
+func (s *Server) saveCache() {
+	if s.cache == nil || len(s.conf.CacheFile) == 0 {
+		return
+	}
+	err := s.cache.save(s.conf.CacheFile)
+	if err != nil {
+		log.Error("DNS cache: %s", err)
+	}
+}
+
+// FlushCache removes the cached responses for the host name
+// "*.host" removes the responses for all subdomains of the host.
+// Returns the number of removed entries.
+func (s *Server) FlushCache(host string) int {
+	s.RLock()
+	c := s.cache
+	s.RUnlock()
+	if c == nil {
+		return 0
+	}
+
+	subdomains := strings.HasPrefix(host, "*.")
+	if subdomains {
+		host = host[2:]
+	}
+	n := c.flush(dns.Fqdn(strings.ToLower(host)), subdomains)
+	log.Debug("DNS cache: flushed %d entries for %s", n, host)
+	return n
+}
+
+type cacheInfoJSON struct {
+	Enabled bool `json:"enabled"`
+	Entries int  `json:"entries"`
+	Size    int  `json:"size"` // in bytes
+}
+
+func (s *Server) handleCacheInfo(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	c := s.cache
+	s.RUnlock()
+
+	resp := cacheInfoJSON{}
+	if c != nil {
+		resp.Enabled = true
+		resp.Entries, resp.Size = c.stats()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func (s *Server) handleCacheClear(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	c := s.cache
+	s.RUnlock()
+
+	if c != nil {
+		c.clear()
+		log.Debug("DNS cache: cleared")
+	}
+}
+
+type cacheEntryJSON struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	DNSSEC bool     `json:"dnssec"` // the request had DO flag
+	TTL    int64    `json:"ttl"`    // remaining TTL (in seconds);  negative if the entry is stale
+	Rcode  string   `json:"rcode"`
+	Answer []string `json:"answer"` // answer records in zone file format
+}
+
+func (s *Server) handleCacheList(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	c := s.cache
+	s.RUnlock()
+
+	name := r.URL.Query().Get("name")
+	if len(name) != 0 {
+		name = dns.Fqdn(strings.ToLower(name))
+	}
+
+	resp := []cacheEntryJSON{}
+	if c != nil {
+		resp = c.list(name)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+type cacheFlushJSON struct {
+	Name       string `json:"name"`
+	Subdomains bool   `json:"subdomains"`
+}
+
+type cacheFlushResultJSON struct {
+	Removed int `json:"removed"`
+}
+
+func (s *Server) handleCacheFlush(w http.ResponseWriter, r *http.Request) {
+	req := cacheFlushJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	if len(req.Name) == 0 {
+		httpError(r, w, http.StatusBadRequest, "name is required")
+		return
+	}
+
+	name := req.Name
+	if req.Subdomains {
+		name = "*." + name
+	}
+	resp := cacheFlushResultJSON{
+		Removed: s.FlushCache(name),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
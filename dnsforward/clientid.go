@@ -0,0 +1,61 @@
+package dnsforward
+
+import (
+	"crypto/tls"
+	"path"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+)
+
+// Get the client ID from the request:
+//  DOH: the last element of URL path: "/dns-query/<id>"
+//  DOT: the first label of the server name (SNI): "<id>.<server name>"
+// Return empty string if the client didn't specify its ID.
+func (s *Server) clientIDFromDNSContext(d *proxy.DNSContext) string {
+	switch d.Proto {
+	case proxy.ProtoHTTPS:
+		if d.HTTPRequest == nil {
+			return ""
+		}
+		return clientIDFromDOHPath(d.HTTPRequest.URL.Path)
+
+	case proxy.ProtoTLS:
+		conn, ok := d.Conn.(*tls.Conn)
+		if !ok {
+			return ""
+		}
+		return clientIDFromServerName(conn.ConnectionState().ServerName, s.conf.TLSServerName)
+	}
+	return ""
+}
+
+// "/dns-query/<id>" -> "<id>"
+func clientIDFromDOHPath(p string) string {
+	p = path.Clean(p)
+	if !strings.HasPrefix(p, "/dns-query/") {
+		return ""
+	}
+	id := strings.ToLower(p[len("/dns-query/"):])
+	if !isValidClientID(id) {
+		return ""
+	}
+	return id
+}
+
+// "<id>.<server name>" -> "<id>"
+func clientIDFromServerName(sni, serverName string) string {
+	if len(serverName) == 0 {
+		return ""
+	}
+	sni = strings.ToLower(sni)
+	suffix := "." + strings.ToLower(serverName)
+	if !strings.HasSuffix(sni, suffix) {
+		return ""
+	}
+	id := sni[:len(sni)-len(suffix)]
+	if !isValidClientID(id) {
+		return ""
+	}
+	return id
+}
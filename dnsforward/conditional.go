@@ -0,0 +1,202 @@
+package dnsforward
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/utils"
+)
+
+// ConditionalForwarding - forward requests for the specified domains (and their subdomains) to the specified upstreams
+// The most specific domain wins.
+type ConditionalForwarding struct {
+	Domains      []string `yaml:"domains" json:"domains"`             // e.g. "corp.example", "lan"
+	Upstreams    []string `yaml:"upstreams" json:"upstreams"`         // the same syntax as UpstreamDNS
+	BootstrapDNS []string `yaml:"bootstrap_dns" json:"bootstrap_dns"` // if empty, the global bootstrap servers are used
+
+	EnableEDNSClientSubnet bool `yaml:"edns_client_subnet" json:"edns_cs_enabled"`  // Enable EDNS Client Subnet option
+	EnableDNSSEC           bool `yaml:"enable_dnssec" json:"dnssec_enabled"`        // Set DNSSEC flag in outcoming DNS request
+	DisableCache           bool `yaml:"disable_cache" json:"disable_cache"`         // Don't cache the responses
+	DisableFiltering       bool `yaml:"disable_filtering" json:"disable_filtering"` // Don't apply filtering rules
+}
+
+// Prepared ConditionalForwarding object
+type condForwarder struct {
+	conf  ConditionalForwarding
+	key   string       // the settings the proxy is created with
+	proxy *proxy.Proxy // we don't Start() it, only Resolve() is used
+}
+
+// Domain name -> forwarder pair
+type condDomain struct {
+	domain string // lower-case, without the last dot
+	fwd    *condForwarder
+}
+
+func conditionalForwardingDup(a []ConditionalForwarding) []ConditionalForwarding {
+	a2 := make([]ConditionalForwarding, len(a))
+	for i, c := range a {
+		a2[i] = c
+		a2[i].Domains = stringArrayDup(c.Domains)
+		a2[i].Upstreams = stringArrayDup(c.Upstreams)
+		a2[i].BootstrapDNS = stringArrayDup(c.BootstrapDNS)
+	}
+	return a2
+}
+
+// ValidateConditionalForwarding validates each entry and returns an error if any entry is invalid
+func ValidateConditionalForwarding(entries []ConditionalForwarding) error {
+	domains := map[string]bool{}
+	for _, c := range entries {
+		if len(c.Domains) == 0 {
+			return fmt.Errorf("no domains specified")
+		}
+		for _, host := range c.Domains {
+			host = strings.ToLower(strings.TrimSuffix(host, "."))
+			err := utils.IsValidHostname(host)
+			if err != nil {
+				return fmt.Errorf("invalid domain %s: %s", host, err)
+			}
+			if domains[host] {
+				return fmt.Errorf("duplicate domain %s", host)
+			}
+			domains[host] = true
+		}
+
+		if len(c.Upstreams) == 0 {
+			return fmt.Errorf("no upstreams specified for %s", c.Domains[0])
+		}
+		err := ValidateUpstreams(c.Upstreams)
+		if err != nil {
+			return fmt.Errorf("%s: %s", c.Domains[0], err)
+		}
+
+		for _, host := range c.BootstrapDNS {
+			err = checkPlainDNS(host)
+			if err != nil {
+				return fmt.Errorf("%s: %s can not be used as bootstrap dns cause: %s", c.Domains[0], host, err)
+			}
+		}
+	}
+	return nil
+}
+
+// prepareConditionalForwarding - create upstreams for each conditional forwarding entry
+// The upstreams of the entries with unchanged settings are reused, the replaced upstreams are closed.
+func (s *Server) prepareConditionalForwarding() error {
+	err := ValidateConditionalForwarding(s.conf.ConditionalForwarding)
+	if err != nil {
+		return fmt.Errorf("DNS: conditional forwarding: %s", err)
+	}
+
+	// the previous proxies by their settings (unique since the domains are unique)
+	prev := map[string]*proxy.Proxy{}
+	for _, cd := range s.condDomains {
+		prev[cd.fwd.key] = cd.fwd.proxy
+	}
+
+	condDomains := []condDomain{}
+	for _, c := range s.conf.ConditionalForwarding {
+		bootstrap := c.BootstrapDNS
+		if len(bootstrap) == 0 {
+			bootstrap = s.conf.BootstrapDNS
+		}
+		key := fmt.Sprintf("%q %q %q %t %t %d %d %d", c.Domains, c.Upstreams, bootstrap,
+			c.EnableEDNSClientSubnet, c.DisableCache, s.conf.CacheMinTTL, s.conf.CacheMaxTTL, s.conf.CacheSize)
+
+		p, ok := prev[key]
+		if ok {
+			delete(prev, key)
+			fwd := &condForwarder{conf: c, key: key, proxy: p}
+			condDomains = appendCondDomains(condDomains, fwd)
+			continue
+		}
+
+		upstreamConfig, err := s.ParseUpstreamsConfig(c.Upstreams, bootstrap)
+		if err != nil {
+			return fmt.Errorf("DNS: conditional forwarding: ParseUpstreamsConfig: %s", err)
+		}
+
+		proxyConfig := proxy.Config{
+			UpstreamConfig:         &upstreamConfig,
+			CacheMinTTL:            s.conf.CacheMinTTL,
+			CacheMaxTTL:            s.conf.CacheMaxTTL,
+			EnableEDNSClientSubnet: c.EnableEDNSClientSubnet,
+			UpstreamMode:           proxy.UModeLoadBalance,
+		}
+		// dnsproxy's cache is used only with EDNS Client Subnet, otherwise we use our own cache
+		if !c.DisableCache && s.conf.CacheSize != 0 && c.EnableEDNSClientSubnet {
+			proxyConfig.CacheEnabled = true
+			proxyConfig.CacheSizeBytes = int(s.conf.CacheSize)
+		}
+
+		fwd := &condForwarder{
+			conf:  c,
+			key:   key,
+			proxy: &proxy.Proxy{Config: proxyConfig},
+		}
+		fwd.proxy.Init()
+		condDomains = appendCondDomains(condDomains, fwd)
+	}
+
+	// longer (more specific) domains go first
+	sort.SliceStable(condDomains, func(i, j int) bool {
+		return len(condDomains[i].domain) > len(condDomains[j].domain)
+	})
+	s.condDomains = condDomains
+
+	// the proxies that aren't reused
+	for _, p := range prev {
+		closeUpstreams(p.UpstreamConfig)
+	}
+
+	log.Debug("DNS: conditional forwarding: %d domains", len(s.condDomains))
+	return nil
+}
+
+// Add the domains of the forwarder
+func appendCondDomains(condDomains []condDomain, fwd *condForwarder) []condDomain {
+	for _, host := range fwd.conf.Domains {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		condDomains = append(condDomains, condDomain{domain: host, fwd: fwd})
+	}
+	return condDomains
+}
+
+// Close the upstreams that hold connections
+func closeUpstreams(conf *proxy.UpstreamConfig) {
+	if conf == nil {
+		return
+	}
+	list := append([]upstream.Upstream{}, conf.Upstreams...)
+	for _, u := range conf.DomainReservedUpstreams {
+		list = append(list, u...)
+	}
+	for _, u := range list {
+		c, ok := u.(io.Closer)
+		if !ok {
+			continue
+		}
+		err := c.Close()
+		if err != nil {
+			log.Debug("DNS: conditional forwarding: %s: %s", u.Address(), err)
+		}
+	}
+}
+
+// Find the conditional forwarding entry for the host name
+// host: lower-case, without the last dot
+func (s *Server) findConditionalForwarding(host string) *condForwarder {
+	for _, cd := range s.condDomains {
+		if host == cd.domain ||
+			(strings.HasSuffix(host, cd.domain) && host[len(host)-len(cd.domain)-1] == '.') {
+			return cd.fwd
+		}
+	}
+	return nil
+}
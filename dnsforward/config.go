@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/http"
 	"sort"
+	"time"
 
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
@@ -15,6 +16,7 @@ import (
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
 )
 
 // FilteringConfig represents the DNS filtering configuration of AdGuard Home
@@ -41,10 +43,24 @@ type FilteringConfig struct {
 	BlockingIPAddrv6   net.IP `yaml:"-"`
 	BlockedResponseTTL uint32 `yaml:"blocked_response_ttl"` // if 0, then default is used (3600)
 
+	// Protection is paused until this time (nil: not paused)
+	ProtectionDisabledUntil *time.Time `yaml:"protection_disabled_until"`
+
+	// Protection is paused for these clients
+	ProtectionPausedClients []ProtectionPause `yaml:"protection_paused_clients"`
+
+	// Blocking modes in which Extended DNS Errors (RFC 8914) are added to blocked and failed responses
+	EDEBlockingModes []string `yaml:"ede_blocking_modes"`
+
 	// IP (or domain name) which is used to respond to DNS requests blocked by parental control or safe-browsing
 	ParentalBlockHost     string `yaml:"parental_block_host"`
 	SafeBrowsingBlockHost string `yaml:"safebrowsing_block_host"`
 
+	// Don't match the records in DNS responses against filtering rules
+	// Clients may override these settings.
+	DisableResponseCNAME bool `yaml:"disable_response_cname"` // CNAME targets (e.g. CNAME-cloaked trackers)
+	DisableResponseIP    bool `yaml:"disable_response_ip"`    // IP addresses in A and AAAA records
+
 	// Anti-DNS amplification
 	// --
 
@@ -60,12 +76,24 @@ type FilteringConfig struct {
 	AllServers   bool     `yaml:"all_servers"`   // if true, parallel queries to all configured upstream servers are enabled
 	FastestAddr  bool     `yaml:"fastest_addr"`  // use Fastest Address algorithm
 
+	// Recursive resolver settings (used by "recursive" upstreams)
+	RecursorQNAMEMinimization bool     `yaml:"recursor_qname_minimization"` // send only the necessary part of the name to the authoritative servers
+	RecursorDNSSEC            bool     `yaml:"recursor_dnssec"`             // validate the responses with DNSSEC
+	RecursorCacheSize         uint32   `yaml:"recursor_cache_size"`         // max number of cached records (0: default)
+	RecursorRootHints         []string `yaml:"recursor_root_hints"`         // IP addresses of the root servers (empty: default)
+
+	// Per-domain upstream settings (split-horizon DNS)
+	ConditionalForwarding []ConditionalForwarding `yaml:"conditional_forwarding"`
+
+	// RFC 1035 zone files for the local zones that we serve authoritatively
+	LocalZoneFiles []string `yaml:"local_zone_files"`
+
 	// Access settings
 	// --
 
-	AllowedClients    []string `yaml:"allowed_clients"`    // IP addresses of whitelist clients
-	DisallowedClients []string `yaml:"disallowed_clients"` // IP addresses of clients that should be blocked
-	BlockedHosts      []string `yaml:"blocked_hosts"`      // hosts that should be blocked
+	AllowedClients    []string `yaml:"allowed_clients"`    // IP, CIDR, MAC or client ID of whitelist clients
+	DisallowedClients []string `yaml:"disallowed_clients"` // IP, CIDR, MAC or client ID of clients that should be blocked
+	BlockedHosts      []string `yaml:"blocked_hosts"`      // hosts that should be blocked (rules, wildcards or regular expressions)
 
 	// DNS cache settings
 	// --
@@ -74,12 +102,20 @@ type FilteringConfig struct {
 	CacheMinTTL uint32 `yaml:"cache_ttl_min"` // override TTL value (minimum) received from upstream server
 	CacheMaxTTL uint32 `yaml:"cache_ttl_max"` // override TTL value (maximum) received from upstream server
 
+	CacheServeStale        bool   `yaml:"cache_serve_stale"`        // respond with expired entries while refreshing them (RFC 8767)
+	CacheStaleMaxAge       uint32 `yaml:"cache_stale_max_age"`      // how long expired entries are kept (in seconds)
+	CacheStaleTTL          uint32 `yaml:"cache_stale_ttl"`          // TTL of stale answers (in seconds)
+	CachePrefetch          bool   `yaml:"cache_prefetch"`           // refresh popular entries before they expire
+	CachePrefetchThreshold uint32 `yaml:"cache_prefetch_threshold"` // refresh an entry when less than this number of seconds remain
+	CachePrefetchHits      uint32 `yaml:"cache_prefetch_hits"`      // refresh an entry only if it was requested at least this number of times
+
 	// Other settings
 	// --
 
 	BogusNXDomain          []string `yaml:"bogus_nxdomain"`     // transform responses with these IP addresses to NXDOMAIN
 	AAAADisabled           bool     `yaml:"aaaa_disabled"`      // Respond with an empty answer to all AAAA requests
 	EnableDNSSEC           bool     `yaml:"enable_dnssec"`      // Set DNSSEC flag in outcoming DNS request
+	DNSSECValidation       bool     `yaml:"dnssec_validation"`  // Validate the responses from upstream servers with DNSSEC
 	EnableEDNSClientSubnet bool     `yaml:"edns_client_subnet"` // Enable EDNS Client Subnet option
 }
 
@@ -112,6 +148,14 @@ type ServerConfig struct {
 	FilteringConfig
 	TLSConfig
 	TLSAllowUnencryptedDOH bool
+	TLSServerName          string // used to get client ID from DOT server name "<id>.<server name>"
+
+	// Get the MAC address of the client by its IP address (optional)
+	// It's used to check access lists with MAC addresses.
+	FindMACByIP func(ip net.IP) net.HardwareAddr
+
+	// File to store DNS cache between restarts (optional)
+	CacheFile string
 
 	TLSv12Roots *x509.CertPool // list of root CAs for TLSv1.2
 	TLSCiphers  []uint16       // list of TLS ciphers to use
@@ -146,7 +190,8 @@ func (s *Server) createProxyConfig() (proxy.Config, error) {
 		EnableEDNSClientSubnet: s.conf.EnableEDNSClientSubnet,
 	}
 
-	if s.conf.CacheSize != 0 {
+	// dnsproxy's cache is used only with EDNS Client Subnet, otherwise we use our own cache
+	if s.conf.CacheSize != 0 && s.conf.EnableEDNSClientSubnet {
 		proxyConfig.CacheEnabled = true
 		proxyConfig.CacheSizeBytes = int(s.conf.CacheSize)
 	}
@@ -208,9 +253,9 @@ func (s *Server) initDefaultSettings() {
 
 // prepareUpstreamSettings - prepares upstream DNS server settings
 func (s *Server) prepareUpstreamSettings() error {
-	upstreamConfig, err := proxy.ParseUpstreamsConfig(s.conf.UpstreamDNS, s.conf.BootstrapDNS, DefaultTimeout)
+	upstreamConfig, err := s.ParseUpstreamsConfig(s.conf.UpstreamDNS, s.conf.BootstrapDNS)
 	if err != nil {
-		return fmt.Errorf("DNS: proxy.ParseUpstreamsConfig: %s", err)
+		return fmt.Errorf("DNS: ParseUpstreamsConfig: %s", err)
 	}
 	s.conf.UpstreamConfig = &upstreamConfig
 	return nil
@@ -226,6 +271,41 @@ func (s *Server) prepareIntlProxy() {
 	s.internalProxy = &proxy.Proxy{Config: intlProxyConfig}
 }
 
+// prepareValidator - creates DNSSEC validator that uses the upstream servers to get DS and DNSKEY records
+func (s *Server) prepareValidator() {
+	s.validator = nil
+	if !s.conf.DNSSECValidation {
+		return
+	}
+	p := s.internalProxy
+	s.validator = newValidator(nil, func(req *dns.Msg) (*dns.Msg, error) {
+		ctx := &proxy.DNSContext{
+			Proto:     "udp",
+			Req:       req,
+			StartTime: time.Now(),
+		}
+		err := p.Resolve(ctx)
+		return ctx.Res, err
+	})
+}
+
+// prepareCache - creates DNS cache
+func (s *Server) prepareCache() {
+	s.cache = nil
+	if s.conf.CacheSize == 0 {
+		return
+	}
+	s.cache = newDNSCache(cacheConfig{
+		size:              s.conf.CacheSize,
+		serveStale:        s.conf.CacheServeStale,
+		staleMaxAge:       s.conf.CacheStaleMaxAge,
+		staleTTL:          s.conf.CacheStaleTTL,
+		prefetch:          s.conf.CachePrefetch,
+		prefetchThreshold: s.conf.CachePrefetchThreshold,
+		prefetchHits:      s.conf.CachePrefetchHits,
+	})
+}
+
 // prepareTLS - prepares TLS configuration for the DNS proxy
 func (s *Server) prepareTLS(proxyConfig *proxy.Config) error {
 	if s.conf.TLSListenAddr != nil && len(s.conf.CertificateChainData) != 0 && len(s.conf.PrivateKeyData) != 0 {
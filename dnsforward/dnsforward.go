@@ -51,6 +51,12 @@ type Server struct {
 	stats      stats.Stats
 	access     *accessCtx
 
+	condDomains []condDomain // conditional forwarding: domain -> upstreams (sorted, most specific first)
+	localZones  *localZones  // zones we're authoritative for
+	cache       *dnsCache    // DNS cache (nil if disabled)
+	recursor    *recursor    // recursive resolver (used by "recursive" upstreams)
+	validator   *validator   // DNSSEC validator (nil if disabled)
+
 	tablePTR     map[string]string // "IP -> hostname" table for reverse lookup
 	tablePTRLock sync.Mutex
 
@@ -60,6 +66,8 @@ type Server struct {
 
 	isRunning bool
 
+	now func() time.Time // get the current time (for tests);  nil: time.Now()
+
 	sync.RWMutex
 	conf ServerConfig
 }
@@ -96,10 +104,18 @@ func NewServer(p DNSCreateParams) *Server {
 // Close - close object
 func (s *Server) Close() {
 	s.Lock()
+	if s.isRunning {
+		s.saveCache()
+	}
+	s.cache = nil
 	s.dnsFilter = nil
 	s.stats = nil
 	s.queryLog = nil
 	s.dnsProxy = nil
+	if s.localZones != nil {
+		s.localZones.Close()
+		s.localZones = nil
+	}
 	s.Unlock()
 }
 
@@ -114,6 +130,19 @@ func (s *Server) WriteDiskConfig(c *FilteringConfig) {
 	c.DisallowedClients = stringArrayDup(sc.DisallowedClients)
 	c.BlockedHosts = stringArrayDup(sc.BlockedHosts)
 	c.UpstreamDNS = stringArrayDup(sc.UpstreamDNS)
+	c.ConditionalForwarding = conditionalForwardingDup(sc.ConditionalForwarding)
+	c.LocalZoneFiles = stringArrayDup(sc.LocalZoneFiles)
+	c.RecursorRootHints = stringArrayDup(sc.RecursorRootHints)
+	c.EDEBlockingModes = stringArrayDup(sc.EDEBlockingModes)
+
+	now := s.currentTime()
+	if !s.protectionPaused(now) {
+		c.ProtectionDisabledUntil = nil
+	} else {
+		until := *sc.ProtectionDisabledUntil
+		c.ProtectionDisabledUntil = &until
+	}
+	c.ProtectionPausedClients = activeProtectionPauses(sc.ProtectionPausedClients, now)
 	s.RUnlock()
 }
 
@@ -184,11 +213,17 @@ func (s *Server) Prepare(config *ServerConfig) error {
 
 	// 3. Prepare DNS servers settings
 	// --
+	s.prepareRecursor()
 	err := s.prepareUpstreamSettings()
 	if err != nil {
 		return err
 	}
 
+	err = s.prepareConditionalForwarding()
+	if err != nil {
+		return err
+	}
+
 	// 3. Create DNS proxy configuration
 	// --
 	var proxyConfig proxy.Config
@@ -200,8 +235,16 @@ func (s *Server) Prepare(config *ServerConfig) error {
 	// 4. Prepare a DNS proxy instance that we use for internal DNS queries
 	// --
 	s.prepareIntlProxy()
+	s.prepareValidator()
+
+	// 5. Load local zones
+	// --
+	if s.localZones != nil {
+		s.localZones.Close()
+	}
+	s.localZones = newLocalZones(s.conf.LocalZoneFiles)
 
-	// 5. Initialize DNS access module
+	// 6. Initialize DNS access module
 	// --
 	s.access = &accessCtx{}
 	err = s.access.Init(s.conf.AllowedClients, s.conf.DisallowedClients, s.conf.BlockedHosts)
@@ -209,16 +252,23 @@ func (s *Server) Prepare(config *ServerConfig) error {
 		return err
 	}
 
-	// 6. Register web handlers if necessary
+	// 7. Register web handlers if necessary
 	// --
 	if !webRegistered && s.conf.HTTPRegister != nil {
 		webRegistered = true
 		s.registerHandlers()
 	}
 
-	// 7. Create the main DNS proxy instance
+	// 8. Create the main DNS proxy instance and DNS cache
 	// --
 	s.dnsProxy = &proxy.Proxy{Config: proxyConfig}
+	s.prepareCache()
+	if s.cache != nil && len(s.conf.CacheFile) != 0 {
+		err = s.cache.load(s.conf.CacheFile)
+		if err != nil {
+			log.Error("DNS cache: %s", err)
+		}
+	}
 	return nil
 }
 
@@ -238,6 +288,9 @@ func (s *Server) stopInternal() error {
 		}
 	}
 
+	if s.isRunning {
+		s.saveCache()
+	}
 	s.isRunning = false
 	return nil
 }
@@ -25,15 +25,22 @@ type dnsConfigJSON struct {
 	Upstreams  []string `json:"upstream_dns"`
 	Bootstraps []string `json:"bootstrap_dns"`
 
-	ProtectionEnabled bool   `json:"protection_enabled"`
-	RateLimit         uint32 `json:"ratelimit"`
-	BlockingMode      string `json:"blocking_mode"`
-	BlockingIPv4      string `json:"blocking_ipv4"`
-	BlockingIPv6      string `json:"blocking_ipv6"`
-	EDNSCSEnabled     bool   `json:"edns_cs_enabled"`
-	DNSSECEnabled     bool   `json:"dnssec_enabled"`
-	DisableIPv6       bool   `json:"disable_ipv6"`
-	UpstreamMode      string `json:"upstream_mode"`
+	ProtectionEnabled bool     `json:"protection_enabled"`
+	RateLimit         uint32   `json:"ratelimit"`
+	BlockingMode      string   `json:"blocking_mode"`
+	BlockingIPv4      string   `json:"blocking_ipv4"`
+	BlockingIPv6      string   `json:"blocking_ipv6"`
+	EDEBlockingModes  []string `json:"ede_blocking_modes"`
+	EDNSCSEnabled     bool     `json:"edns_cs_enabled"`
+	DNSSECEnabled     bool     `json:"dnssec_enabled"`
+	DNSSECValidation  bool     `json:"dnssec_validation"`
+	DisableIPv6       bool     `json:"disable_ipv6"`
+	UpstreamMode      string   `json:"upstream_mode"`
+
+	FilterResponseCNAME bool `json:"filter_response_cname"`
+	FilterResponseIP    bool `json:"filter_response_ip"`
+
+	ConditionalForwarding []ConditionalForwarding `json:"conditional_forwarding"`
 }
 
 func (s *Server) handleGetConfig(w http.ResponseWriter, r *http.Request) {
@@ -41,15 +48,20 @@ func (s *Server) handleGetConfig(w http.ResponseWriter, r *http.Request) {
 	s.RLock()
 	resp.Upstreams = stringArrayDup(s.conf.UpstreamDNS)
 	resp.Bootstraps = stringArrayDup(s.conf.BootstrapDNS)
+	resp.ConditionalForwarding = conditionalForwardingDup(s.conf.ConditionalForwarding)
 
 	resp.ProtectionEnabled = s.conf.ProtectionEnabled
 	resp.BlockingMode = s.conf.BlockingMode
 	resp.BlockingIPv4 = s.conf.BlockingIPv4
 	resp.BlockingIPv6 = s.conf.BlockingIPv6
+	resp.EDEBlockingModes = stringArrayDup(s.conf.EDEBlockingModes)
 	resp.RateLimit = s.conf.Ratelimit
 	resp.EDNSCSEnabled = s.conf.EnableEDNSClientSubnet
 	resp.DNSSECEnabled = s.conf.EnableDNSSEC
+	resp.DNSSECValidation = s.conf.DNSSECValidation
 	resp.DisableIPv6 = s.conf.AAAADisabled
+	resp.FilterResponseCNAME = !s.conf.DisableResponseCNAME
+	resp.FilterResponseIP = !s.conf.DisableResponseIP
 	if s.conf.FastestAddr {
 		resp.UpstreamMode = "fastest_addr"
 	} else if s.conf.AllServers {
@@ -66,9 +78,13 @@ func (s *Server) handleGetConfig(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(js)
 }
 
+func isValidBlockingMode(bm string) bool {
+	return bm == "default" || bm == "nxdomain" || bm == "null_ip" || bm == "custom_ip"
+}
+
 func checkBlockingMode(req dnsConfigJSON) bool {
 	bm := req.BlockingMode
-	if !(bm == "default" || bm == "nxdomain" || bm == "null_ip" || bm == "custom_ip") {
+	if !isValidBlockingMode(bm) {
 		return false
 	}
 
@@ -115,11 +131,28 @@ func (s *Server) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if js.Exists("conditional_forwarding") {
+		err = ValidateConditionalForwarding(req.ConditionalForwarding)
+		if err != nil {
+			httpError(r, w, http.StatusBadRequest, "wrong conditional forwarding specification: %s", err)
+			return
+		}
+	}
+
 	if js.Exists("blocking_mode") && !checkBlockingMode(req) {
 		httpError(r, w, http.StatusBadRequest, "blocking_mode: incorrect value")
 		return
 	}
 
+	if js.Exists("ede_blocking_modes") {
+		for _, bm := range req.EDEBlockingModes {
+			if !isValidBlockingMode(bm) {
+				httpError(r, w, http.StatusBadRequest, "ede_blocking_modes: incorrect value: %s", bm)
+				return
+			}
+		}
+	}
+
 	if js.Exists("upstream_mode") &&
 		!(req.UpstreamMode == "" || req.UpstreamMode == "fastest_addr" || req.UpstreamMode == "parallel") {
 		httpError(r, w, http.StatusBadRequest, "upstream_mode: incorrect value")
@@ -139,8 +172,14 @@ func (s *Server) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 		restart = true
 	}
 
+	if js.Exists("conditional_forwarding") {
+		s.conf.ConditionalForwarding = req.ConditionalForwarding
+		restart = true
+	}
+
 	if js.Exists("protection_enabled") {
 		s.conf.ProtectionEnabled = req.ProtectionEnabled
+		s.conf.ProtectionDisabledUntil = nil
 	}
 
 	if js.Exists("blocking_mode") {
@@ -157,6 +196,10 @@ func (s *Server) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if js.Exists("ede_blocking_modes") {
+		s.conf.EDEBlockingModes = req.EDEBlockingModes
+	}
+
 	if js.Exists("ratelimit") {
 		if s.conf.Ratelimit != req.RateLimit {
 			restart = true
@@ -173,10 +216,25 @@ func (s *Server) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 		s.conf.EnableDNSSEC = req.DNSSECEnabled
 	}
 
+	if js.Exists("dnssec_validation") {
+		if s.conf.DNSSECValidation != req.DNSSECValidation {
+			restart = true
+		}
+		s.conf.DNSSECValidation = req.DNSSECValidation
+	}
+
 	if js.Exists("disable_ipv6") {
 		s.conf.AAAADisabled = req.DisableIPv6
 	}
 
+	if js.Exists("filter_response_cname") {
+		s.conf.DisableResponseCNAME = !req.FilterResponseCNAME
+	}
+
+	if js.Exists("filter_response_ip") {
+		s.conf.DisableResponseIP = !req.FilterResponseIP
+	}
+
 	if js.Exists("upstream_mode") {
 		s.conf.FastestAddr = false
 		s.conf.AllServers = false
@@ -246,6 +304,11 @@ func validateUpstream(u string) (bool, error) {
 		return defaultUpstream, nil
 	}
 
+	// Our own recursive resolver
+	if u == RecursiveUpstream {
+		return defaultUpstream, nil
+	}
+
 	// Check if the upstream has a valid protocol prefix
 	for _, proto := range protocols {
 		if strings.HasPrefix(u, proto) {
@@ -328,7 +391,7 @@ func (s *Server) handleTestUpstreamDNS(w http.ResponseWriter, r *http.Request) {
 	result := map[string]string{}
 
 	for _, host := range req.Upstreams {
-		err = checkDNS(host, req.BootstrapDNS)
+		err = s.checkDNS(host, req.BootstrapDNS)
 		if err != nil {
 			log.Info("%v", err)
 			result[host] = err.Error()
@@ -351,7 +414,7 @@ func (s *Server) handleTestUpstreamDNS(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func checkDNS(input string, bootstrap []string) error {
+func (s *Server) checkDNS(input string, bootstrap []string) error {
 	// separate upstream from domains list
 	input, defaultUpstream, err := separateUpstream(input)
 	if err != nil {
@@ -372,9 +435,20 @@ func checkDNS(input string, bootstrap []string) error {
 	}
 
 	log.Debug("Checking if DNS %s works...", input)
-	u, err := upstream.AddressToUpstream(input, upstream.Options{Bootstrap: bootstrap, Timeout: DefaultTimeout})
-	if err != nil {
-		return fmt.Errorf("failed to choose upstream for %s: %s", input, err)
+	var u upstream.Upstream
+	if input == RecursiveUpstream {
+		s.RLock()
+		r := s.recursor
+		s.RUnlock()
+		if r == nil {
+			return fmt.Errorf("recursive resolver isn't initialized")
+		}
+		u = &recursiveUpstream{r: r}
+	} else {
+		u, err = upstream.AddressToUpstream(input, upstream.Options{Bootstrap: bootstrap, Timeout: DefaultTimeout})
+		if err != nil {
+			return fmt.Errorf("failed to choose upstream for %s: %s", input, err)
+		}
 	}
 
 	req := dns.Msg{}
@@ -423,9 +497,18 @@ func (s *Server) registerHandlers() {
 	s.conf.HTTPRegister("GET", "/control/dns_info", s.handleGetConfig)
 	s.conf.HTTPRegister("POST", "/control/dns_config", s.handleSetConfig)
 	s.conf.HTTPRegister("POST", "/control/test_upstream_dns", s.handleTestUpstreamDNS)
+	s.conf.HTTPRegister("POST", "/control/protection", s.handleProtection)
 
 	s.conf.HTTPRegister("GET", "/control/access/list", s.handleAccessList)
 	s.conf.HTTPRegister("POST", "/control/access/set", s.handleAccessSet)
 
+	s.conf.HTTPRegister("GET", "/control/cache_info", s.handleCacheInfo)
+	s.conf.HTTPRegister("POST", "/control/cache_clear", s.handleCacheClear)
+	s.conf.HTTPRegister("GET", "/control/cache_list", s.handleCacheList)
+	s.conf.HTTPRegister("POST", "/control/cache_flush", s.handleCacheFlush)
+
+	s.conf.HTTPRegister("GET", "/control/access/check", s.handleAccessCheck)
+
 	s.conf.HTTPRegister("", "/dns-query", s.handleDOH)
+	s.conf.HTTPRegister("", "/dns-query/", s.handleDOH) // "/dns-query/<client ID>"
 }
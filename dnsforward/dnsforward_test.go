@@ -1,6 +1,7 @@
 package dnsforward
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
@@ -8,9 +9,17 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -449,6 +458,71 @@ func TestClientRulesForCNAMEMatching(t *testing.T) {
 	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
 }
 
+func TestFilterResponseSettings(t *testing.T) {
+	s := createTestServer(t)
+	testUpstm := &testUpstream{testCNAMEs, testIPv4, nil}
+	// the settings are read by the goroutines that process requests
+	var lock sync.Mutex
+	filterCNAME := true
+	filterIP := true
+	s.conf.FilterHandler = func(clientAddr string, settings *dnsfilter.RequestFilteringSettings) {
+		lock.Lock()
+		defer lock.Unlock()
+		settings.FilterResponseCNAME = filterCNAME
+		settings.FilterResponseIP = filterIP
+	}
+	set := func(cname, ip bool) {
+		lock.Lock()
+		defer lock.Unlock()
+		filterCNAME = cname
+		filterIP = ip
+	}
+	err := s.startWithUpstream(testUpstm)
+	assert.Nil(t, err)
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	check := func(host string, rcode int) {
+		t.Helper()
+		reply, err := dns.Exchange(createTestMessage(host), addr.String())
+		assert.Nil(t, err)
+		assert.Equal(t, rcode, reply.Rcode)
+	}
+
+	// CNAME target 'null.example.org' is blocked by filters
+	check("badhost.", dns.RcodeNameError)
+	set(false, true)
+	check("badhost.", dns.RcodeSuccess)
+
+	// IP address 127.0.0.255 is blocked by filters
+	check("example.org.", dns.RcodeNameError)
+	set(false, false)
+	check("example.org.", dns.RcodeSuccess)
+
+	_ = s.Stop()
+
+	// the matched record is stored in the result
+	resp := dns.Msg{}
+	resp.SetQuestion("badhost.", dns.TypeA)
+	resp.Answer = []dns.RR{
+		&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: "badhost.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET},
+			Target: "null.example.org.",
+		},
+	}
+	ctx := &dnsContext{
+		srv:      s,
+		proxyCtx: &proxy.DNSContext{Req: resp.Copy(), Res: &resp},
+		setts:    &dnsfilter.RequestFilteringSettings{FilteringEnabled: true, FilterResponseCNAME: true},
+	}
+	res, err := s.filterDNSResponse(ctx)
+	assert.Nil(t, err)
+	assert.NotNil(t, res)
+	assert.Equal(t, "CNAME", res.ResponseRRType)
+	assert.Equal(t, "badhost", res.ResponseName)
+	assert.Equal(t, "null.example.org", res.ResponseHost)
+	assert.Equal(t, "||null.example.org^", res.Rule)
+}
+
 func TestNullBlockedRequest(t *testing.T) {
 	s := createTestServer(t)
 	s.conf.FilteringConfig.BlockingMode = "null_ip"
@@ -1049,3 +1123,1155 @@ func TestPTRResponse(t *testing.T) {
 
 	s.Close()
 }
+
+func TestValidateConditionalForwarding(t *testing.T) {
+	cf := []ConditionalForwarding{{
+		Domains:   []string{"corp.example", "lan"},
+		Upstreams: []string{"10.0.0.1", "tls://1.1.1.1"},
+	}}
+	assert.Nil(t, ValidateConditionalForwarding(cf))
+
+	cf[0].BootstrapDNS = []string{"https://1.1.1.1"}
+	assert.NotNil(t, ValidateConditionalForwarding(cf))
+	cf[0].BootstrapDNS = nil
+
+	cf = append(cf, ConditionalForwarding{
+		Domains:   []string{"LAN."},
+		Upstreams: []string{"10.0.0.2"},
+	})
+	assert.NotNil(t, ValidateConditionalForwarding(cf)) // duplicate domain
+
+	cf[1].Domains = []string{"home"}
+	cf[1].Upstreams = nil
+	assert.NotNil(t, ValidateConditionalForwarding(cf)) // no upstreams
+
+	cf[1].Upstreams = []string{"[/sub.home/]10.0.0.2"}
+	assert.NotNil(t, ValidateConditionalForwarding(cf)) // no default upstream
+}
+
+func TestConditionalForwarding(t *testing.T) {
+	filters := []dnsfilter.Filter{{
+		ID: 0, Data: []byte("||host.lan^\n||host.corp.example^\n"),
+	}}
+	c := dnsfilter.Config{}
+	f := dnsfilter.New(&c, filters)
+	s := NewServer(DNSCreateParams{DNSFilter: f})
+	s.conf.UDPListenAddr = &net.UDPAddr{Port: 0}
+	s.conf.TCPListenAddr = &net.TCPAddr{Port: 0}
+	s.conf.UpstreamDNS = []string{"127.0.0.1:53"}
+	s.conf.ProtectionEnabled = true
+	s.conf.ConditionalForwarding = []ConditionalForwarding{
+		{
+			Domains:          []string{"lan"},
+			Upstreams:        []string{"127.0.0.1:53"},
+			DisableFiltering: true,
+		},
+		{
+			Domains:   []string{"corp.example"},
+			Upstreams: []string{"127.0.0.1:53"},
+		},
+	}
+	assert.Nil(t, s.Prepare(nil))
+
+	lanUpstream := &testUpstream{
+		ipv4: map[string][]net.IP{"host.lan.": {{192, 168, 0, 2}}},
+	}
+	corpUpstream := &testUpstream{
+		ipv4: map[string][]net.IP{
+			"host.corp.example.":  {{10, 0, 0, 2}},
+			"other.corp.example.": {{10, 0, 0, 3}},
+		},
+	}
+	s.findConditionalForwarding("lan").proxy.UpstreamConfig = &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{lanUpstream},
+	}
+	s.findConditionalForwarding("corp.example").proxy.UpstreamConfig = &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{corpUpstream},
+	}
+	assert.Nil(t, s.findConditionalForwarding("example"))
+	assert.Nil(t, s.findConditionalForwarding("xlan"))
+
+	assert.Nil(t, s.Start())
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	// filtering is disabled for "lan"
+	reply, err := dns.Exchange(createTestMessage("host.lan."), addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(reply.Answer))
+	assert.Equal(t, "192.168.0.2", reply.Answer[0].(*dns.A).A.String())
+
+	// filtering is enabled for "corp.example"
+	reply, err = dns.Exchange(createTestMessage("host.corp.example."), addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+
+	reply, err = dns.Exchange(createTestMessage("other.corp.example."), addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(reply.Answer))
+	assert.Equal(t, "10.0.0.3", reply.Answer[0].(*dns.A).A.String())
+
+	_ = s.Stop()
+}
+
+// Upstream that counts Close() calls
+type closingUpstream struct {
+	testUpstream
+	closed int
+}
+
+func (u *closingUpstream) Close() error {
+	u.closed++
+	return nil
+}
+
+func TestConditionalForwardingReconfigure(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.ConditionalForwarding = []ConditionalForwarding{
+		{Domains: []string{"lan"}, Upstreams: []string{"127.0.0.1:53"}},
+		{Domains: []string{"corp.example"}, Upstreams: []string{"127.0.0.1:53"}},
+	}
+	assert.Nil(t, s.Prepare(nil))
+	lanProxy := s.findConditionalForwarding("lan").proxy
+	lanUpstream := &closingUpstream{}
+	lanProxy.UpstreamConfig = &proxy.UpstreamConfig{Upstreams: []upstream.Upstream{lanUpstream}}
+	corpUpstream := &closingUpstream{}
+	s.findConditionalForwarding("corp.example").proxy.UpstreamConfig = &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{corpUpstream},
+	}
+
+	// the upstreams of the unchanged entry are reused, the replaced ones are closed
+	s.conf.ConditionalForwarding = []ConditionalForwarding{
+		{Domains: []string{"lan"}, Upstreams: []string{"127.0.0.1:53"}, DisableFiltering: true},
+		{Domains: []string{"corp.example"}, Upstreams: []string{"127.0.0.2:53"}},
+	}
+	assert.Nil(t, s.Prepare(nil))
+	fwd := s.findConditionalForwarding("lan")
+	assert.True(t, fwd.proxy == lanProxy)
+	assert.True(t, fwd.conf.DisableFiltering)
+	assert.Equal(t, 0, lanUpstream.closed)
+	assert.Equal(t, 1, corpUpstream.closed)
+
+	// all entries are removed
+	s.conf.ConditionalForwarding = nil
+	assert.Nil(t, s.Prepare(nil))
+	assert.Nil(t, s.findConditionalForwarding("lan"))
+	assert.Equal(t, 1, lanUpstream.closed)
+}
+
+const testZone = `$ORIGIN home.lan.
+$TTL 300
+@	IN	SOA	ns.home.lan. admin.home.lan. 1 3600 600 86400 300
+@	IN	NS	ns
+@	IN	MX	10 mail
+ns	IN	A	192.168.1.1
+mail	IN	A	192.168.1.2
+www	IN	CNAME	mail
+_http._tcp.svc	IN	SRV	0 0 80 mail
+txt	IN	TXT	"hello"
+*.dyn	IN	A	192.168.1.3
+`
+
+func TestLocalZones(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agh-zones")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	fn := filepath.Join(dir, "home.lan.zone")
+	assert.Nil(t, ioutil.WriteFile(fn, []byte(testZone), 0644))
+
+	z := newLocalZones([]string{fn})
+	defer z.Close()
+	s := &Server{}
+
+	req := createTestMessageWithType("mail.home.lan.", dns.TypeA)
+	resp := z.respond(s, req)
+	assert.True(t, resp.Authoritative)
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, "192.168.1.2", resp.Answer[0].(*dns.A).A.String())
+
+	// CNAME is followed inside the zone
+	resp = z.respond(s, createTestMessageWithType("WWW.home.lan.", dns.TypeA))
+	assert.Equal(t, 2, len(resp.Answer))
+	assert.Equal(t, "mail.home.lan.", resp.Answer[0].(*dns.CNAME).Target)
+	assert.Equal(t, "192.168.1.2", resp.Answer[1].(*dns.A).A.String())
+
+	// MX with additional records
+	resp = z.respond(s, createTestMessageWithType("home.lan.", dns.TypeMX))
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, 1, len(resp.Extra))
+
+	resp = z.respond(s, createTestMessageWithType("_http._tcp.svc.home.lan.", dns.TypeSRV))
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, uint16(80), resp.Answer[0].(*dns.SRV).Port)
+
+	resp = z.respond(s, createTestMessageWithType("txt.home.lan.", dns.TypeTXT))
+	assert.Equal(t, []string{"hello"}, resp.Answer[0].(*dns.TXT).Txt)
+
+	// wildcard
+	resp = z.respond(s, createTestMessageWithType("any.dyn.home.lan.", dns.TypeA))
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, "any.dyn.home.lan.", resp.Answer[0].Header().Name)
+
+	// wildcard at the closest encloser
+	resp = z.respond(s, createTestMessageWithType("a.b.dyn.home.lan.", dns.TypeA))
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, "a.b.dyn.home.lan.", resp.Answer[0].Header().Name)
+
+	// the closest encloser has no wildcard
+	resp = z.respond(s, createTestMessageWithType("a.mail.home.lan.", dns.TypeA))
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+
+	// NODATA: the name exists, but there's no record of this type
+	resp = z.respond(s, createTestMessageWithType("mail.home.lan.", dns.TypeAAAA))
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, 0, len(resp.Answer))
+	assert.Equal(t, dns.TypeSOA, resp.Ns[0].Header().Rrtype)
+
+	// empty non-terminal
+	resp = z.respond(s, createTestMessageWithType("_tcp.svc.home.lan.", dns.TypeA))
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+
+	// NXDOMAIN
+	resp = z.respond(s, createTestMessageWithType("unknown.home.lan.", dns.TypeA))
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	assert.Equal(t, dns.TypeSOA, resp.Ns[0].Header().Rrtype)
+
+	// not our zone
+	assert.Nil(t, z.respond(s, createTestMessageWithType("example.org.", dns.TypeA)))
+
+	// reload on change
+	data := strings.Replace(testZone, "192.168.1.2", "192.168.1.22", 1)
+	assert.Nil(t, ioutil.WriteFile(fn, []byte(data), 0644))
+	for i := 0; i != 50; i++ {
+		resp = z.respond(s, createTestMessageWithType("mail.home.lan.", dns.TypeA))
+		if resp.Answer[0].(*dns.A).A.String() == "192.168.1.22" {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(t, "192.168.1.22", resp.Answer[0].(*dns.A).A.String())
+}
+
+func TestDNSCache(t *testing.T) {
+	c := newDNSCache(cacheConfig{
+		size:              64 * 1024,
+		prefetch:          true,
+		prefetchThreshold: 5,
+		prefetchHits:      2,
+	})
+	now := time.Unix(1000000, 0)
+	c.now = func() time.Time { return now }
+
+	req := createTestMessage("host.example.org.")
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "host.example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+		A:   net.IP{1, 2, 3, 4},
+	})
+	assert.True(t, c.set(cacheKey(req), resp))
+
+	// not cacheable: no A records
+	resp2 := &dns.Msg{}
+	resp2.SetReply(createTestMessage("empty.example.org."))
+	assert.False(t, c.set(cacheKey(resp2), resp2))
+
+	// fresh
+	r, refresh := c.get(req)
+	assert.NotNil(t, r)
+	assert.False(t, refresh)
+	assert.Equal(t, uint32(10), r.Answer[0].Header().Ttl)
+	assert.Equal(t, req.Id, r.Id)
+
+	// prefetch: less than 5 seconds remain and 2 hits
+	now = now.Add(6 * time.Second)
+	r, refresh = c.get(req)
+	assert.Equal(t, uint32(4), r.Answer[0].Header().Ttl)
+	assert.True(t, refresh)
+	r, refresh = c.get(req)
+	assert.NotNil(t, r)
+	assert.False(t, refresh) // already refreshing
+
+	// expired, serve-stale is disabled
+	now = now.Add(5 * time.Second)
+	r, _ = c.get(req)
+	assert.Nil(t, r)
+	assert.Equal(t, 0, c.lru.Len())
+
+	// serve-stale
+	c.conf.serveStale = true
+	assert.True(t, c.set(cacheKey(req), resp))
+	now = now.Add(20 * time.Second)
+	r, refresh = c.get(req)
+	assert.NotNil(t, r)
+	assert.True(t, refresh)
+	assert.Equal(t, uint32(defaultCacheStaleTTL), r.Answer[0].Header().Ttl)
+
+	// don't retry refresh right after a failure
+	c.refreshFailed(cacheKey(req))
+	_, refresh = c.get(req)
+	assert.False(t, refresh)
+	now = now.Add(cacheRefreshRetryInterval)
+	_, refresh = c.get(req)
+	assert.True(t, refresh)
+
+	// expired entries are kept no longer than staleMaxAge
+	now = now.Add(defaultCacheStaleMaxAge * time.Second)
+	r, _ = c.get(req)
+	assert.Nil(t, r)
+
+	// the least recently used entries are removed when the cache is full
+	c.conf.size = 1
+	assert.True(t, c.set(cacheKey(req), resp))
+	resp3 := resp.Copy()
+	resp3.Question[0].Name = "other.example.org."
+	assert.True(t, c.set(cacheKey(resp3), resp3))
+	assert.Equal(t, 1, c.lru.Len())
+	r, _ = c.get(req)
+	assert.Nil(t, r)
+
+	// the response doesn't contain OPT record from the request
+	reqDO := createTestMessage("do.example.org.")
+	reqDO.SetEdns0(4096, true)
+	respDO := &dns.Msg{}
+	respDO.SetReply(reqDO)
+	respDO.Answer = append(respDO.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "do.example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+		A:   net.IP{1, 2, 3, 4},
+	})
+	assert.True(t, c.set(cacheKey(reqDO), respDO))
+	r, _ = c.get(reqDO)
+	assert.NotNil(t, r)
+}
+
+func TestDNSCacheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agh-cache")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	fn := filepath.Join(dir, "dnscache.db")
+
+	c := newDNSCache(cacheConfig{size: 64 * 1024})
+	now := time.Unix(1000000, 0)
+	c.now = func() time.Time { return now }
+
+	for i, ttl := range []uint32{10, 100} {
+		req := createTestMessage(fmt.Sprintf("host%d.example.org.", i))
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.IP{1, 2, 3, 4},
+		})
+		assert.True(t, c.set(cacheKey(req), resp))
+	}
+	assert.Nil(t, c.save(fn))
+
+	// the first entry expires while the server is stopped
+	now = now.Add(50 * time.Second)
+	c2 := newDNSCache(cacheConfig{size: 64 * 1024})
+	c2.now = c.now
+	assert.Nil(t, c2.load(fn))
+	entries, _ := c2.stats()
+	assert.Equal(t, 1, entries)
+	r, _ := c2.get(createTestMessage("host1.example.org."))
+	assert.NotNil(t, r)
+	assert.Equal(t, uint32(50), r.Answer[0].Header().Ttl)
+
+	// no file
+	c3 := newDNSCache(cacheConfig{size: 64 * 1024})
+	assert.Nil(t, c3.load(filepath.Join(dir, "nonexistent")))
+
+	// invalid file
+	assert.Nil(t, ioutil.WriteFile(fn, []byte("AGHDNSC1\x00"), 0644))
+	assert.NotNil(t, c3.load(fn))
+
+	c3.clear()
+	entries, size := c3.stats()
+	assert.Equal(t, 0, entries)
+	assert.Equal(t, 0, size)
+}
+
+func TestDNSCacheFlush(t *testing.T) {
+	s := &Server{}
+	s.cache = newDNSCache(cacheConfig{size: 64 * 1024})
+	now := time.Unix(1000000, 0)
+	s.cache.now = func() time.Time { return now }
+
+	for _, host := range []string{"example.org.", "www.example.org.", "a.b.example.org.", "example.com."} {
+		req := createTestMessage(host)
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 100},
+			A:   net.IP{1, 2, 3, 4},
+		})
+		assert.True(t, s.cache.set(cacheKey(req), resp))
+	}
+
+	now = now.Add(10 * time.Second)
+	entries := s.cache.list("")
+	assert.Equal(t, 4, len(entries))
+	assert.Equal(t, "example.com.", entries[0].Name) // the most recently used first
+
+	entries = s.cache.list("www.example.org.")
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "A", entries[0].Type)
+	assert.Equal(t, int64(90), entries[0].TTL)
+	assert.Equal(t, "NOERROR", entries[0].Rcode)
+	assert.Equal(t, 1, len(entries[0].Answer))
+	assert.True(t, strings.HasSuffix(entries[0].Answer[0], "1.2.3.4"))
+
+	assert.Equal(t, 1, s.FlushCache("WWW.example.org"))
+	assert.Equal(t, 0, s.FlushCache("www.example.org"))
+	assert.Equal(t, 2, s.FlushCache("*.example.org"))
+	entries = s.cache.list("")
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "example.com.", entries[0].Name)
+
+	// no cache
+	s.cache = nil
+	assert.Equal(t, 0, s.FlushCache("example.com"))
+}
+
+// Authoritative server for a test zone
+type authZone struct {
+	name    string
+	key     *dns.DNSKEY
+	priv    crypto.Signer
+	rrs     map[rrsetKey][]dns.RR // signed RRsets (with RRSIG)
+	names   []string              // authoritative names (sorted)
+	cuts    []string              // delegated child zones
+	nsec3   []dns.RR              // signed NSEC3 records for NXDOMAIN responses (instead of NSEC)
+	queries []string
+}
+
+func newTestZone(t *testing.T, name string, signed bool, records ...string) *authZone {
+	z := &authZone{name: name, rrs: map[rrsetKey][]dns.RR{}}
+	apex := strings.TrimSuffix(name, ".")
+	records = append(records, fmt.Sprintf("%s 3600 IN SOA %s %s 1 3600 600 86400 300",
+		name, dns.Fqdn("ns."+apex), dns.Fqdn("admin."+apex)))
+
+	var all []dns.RR
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		assert.Nil(t, err, s)
+		all = append(all, rr)
+	}
+	if signed {
+		z.key = &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+			Flags:     257,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		priv, err := z.key.Generate(256)
+		assert.Nil(t, err)
+		z.priv = priv.(crypto.Signer)
+		all = append(all, z.key)
+	}
+
+	types := map[string][]uint16{}
+	for _, rr := range all {
+		n := strings.ToLower(rr.Header().Name)
+		if rr.Header().Rrtype == dns.TypeNS && n != name {
+			z.cuts = append(z.cuts, n)
+		}
+		k := rrsetKey{name: n, rtype: rr.Header().Rrtype}
+		z.rrs[k] = append(z.rrs[k], rr)
+		types[n] = append(types[n], rr.Header().Rrtype)
+	}
+
+	// names below the zone cuts (glue) aren't authoritative
+	for n := range types {
+		glue := false
+		for _, c := range z.cuts {
+			if n != c && dns.IsSubDomain(c, n) {
+				glue = true
+			}
+		}
+		if !glue {
+			z.names = append(z.names, n)
+		}
+	}
+	sort.Slice(z.names, func(i, j int) bool { return canonicalCompare(z.names[i], z.names[j]) < 0 })
+
+	if !signed {
+		return z
+	}
+
+	for i, n := range z.names {
+		nsec := &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: n, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+			NextDomain: z.names[(i+1)%len(z.names)],
+			TypeBitMap: append(types[n], dns.TypeNSEC, dns.TypeRRSIG),
+		}
+		sort.Slice(nsec.TypeBitMap, func(i, j int) bool { return nsec.TypeBitMap[i] < nsec.TypeBitMap[j] })
+		z.rrs[rrsetKey{name: n, rtype: dns.TypeNSEC}] = []dns.RR{nsec}
+	}
+
+	for k, set := range z.rrs {
+		if k.name != name && stringInSlice(k.name, z.cuts) && k.rtype != dns.TypeDS && k.rtype != dns.TypeNSEC {
+			continue // delegation NS records aren't signed
+		}
+		if !stringInSlice(k.name, z.names) {
+			continue
+		}
+		z.rrs[k] = z.sign(t, set)
+	}
+	return z
+}
+
+// Add RRSIG record to RRset
+func (z *authZone) sign(t *testing.T, set []dns.RR) []dns.RR {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: set[0].Header().Ttl},
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.name,
+		Algorithm:  z.key.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	assert.Nil(t, sig.Sign(z.priv, set))
+	return append(set, sig)
+}
+
+// Use NSEC3 with Opt-Out for NXDOMAIN responses:
+//  the only hashed name is the zone apex, all other names are in the Opt-Out span
+func (z *authZone) setNSEC3OptOut(t *testing.T) {
+	hash := dns.HashName(z.name, dns.SHA1, 0, "")
+	nsec3 := &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: strings.ToLower(hash) + "." + z.name, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+		Hash:       dns.SHA1,
+		Flags:      1, // Opt-Out
+		HashLength: 20,
+		NextDomain: hash,
+		TypeBitMap: []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM},
+	}
+	z.nsec3 = z.sign(t, []dns.RR{nsec3})
+}
+
+// Get DS record for the zone key
+func (z *authZone) ds() string {
+	return z.key.ToDS(dns.SHA256).String()
+}
+
+func (z *authZone) get(name string, t uint16) []dns.RR {
+	return z.rrs[rrsetKey{name: name, rtype: t}]
+}
+
+func (z *authZone) respond(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+	z.queries = append(z.queries, fmt.Sprintf("%s/%s", name, dns.Type(q.Qtype)))
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+
+	for _, c := range z.cuts {
+		if dns.IsSubDomain(c, name) && !(name == c && q.Qtype == dns.TypeDS) {
+			resp.Ns = append(resp.Ns, z.get(c, dns.TypeNS)...)
+			ds := z.get(c, dns.TypeDS)
+			if len(ds) == 0 {
+				ds = z.get(c, dns.TypeNSEC)
+			}
+			resp.Ns = append(resp.Ns, ds...)
+			for _, rr := range z.get(c, dns.TypeNS) {
+				resp.Extra = append(resp.Extra, z.get(rr.(*dns.NS).Ns, dns.TypeA)...)
+			}
+			return resp
+		}
+	}
+
+	resp.Authoritative = true
+	resp.Answer = z.get(name, q.Qtype)
+	if len(resp.Answer) == 0 {
+		resp.Answer = z.get(name, dns.TypeCNAME)
+	}
+	if len(resp.Answer) != 0 {
+		return resp
+	}
+
+	resp.Ns = z.get(z.name, dns.TypeSOA)
+	if stringInSlice(name, z.names) {
+		resp.Ns = append(resp.Ns, z.get(name, dns.TypeNSEC)...)
+		return resp
+	}
+
+	resp.Rcode = dns.RcodeNameError
+	if len(z.nsec3) != 0 {
+		resp.Ns = append(resp.Ns, z.nsec3...)
+		return resp
+	}
+	for _, n := range z.names {
+		nsec := z.get(n, dns.TypeNSEC)
+		if len(nsec) != 0 && (nsecCovers(nsec[0].(*dns.NSEC), name) ||
+			nsecCovers(nsec[0].(*dns.NSEC), "*."+z.name)) {
+			resp.Ns = append(resp.Ns, nsec...)
+		}
+	}
+	return resp
+}
+
+// Create a recursor that works with the test zone hierarchy:
+//  . -> com. -> example.com. (signed), bad.com. (broken signature), insecure.com. (unsigned),
+//  optout.com. (signed, NSEC3 with Opt-Out)
+func createTestRecursor(t *testing.T) (*recursor, map[string]*authZone) {
+	example := newTestZone(t, "example.com.", true,
+		"example.com. 3600 IN NS ns.example.com.",
+		"ns.example.com. 3600 IN A 10.0.0.3",
+		"www.example.com. 3600 IN A 1.2.3.4",
+		"alias.example.com. 3600 IN CNAME www.example.com.",
+	)
+	bad := newTestZone(t, "bad.com.", true,
+		"bad.com. 3600 IN NS ns.bad.com.",
+		"ns.bad.com. 3600 IN A 10.0.0.4",
+		"www.bad.com. 3600 IN A 1.2.3.4",
+	)
+	// break the signature of A record
+	set := bad.get("www.bad.com.", dns.TypeA)
+	set[1].(*dns.RRSIG).Signature = bad.get("bad.com.", dns.TypeSOA)[1].(*dns.RRSIG).Signature
+	insecure := newTestZone(t, "insecure.com.", false,
+		"insecure.com. 3600 IN NS ns.insecure.com.",
+		"ns.insecure.com. 3600 IN A 10.0.0.5",
+		"www.insecure.com. 3600 IN A 5.6.7.8",
+	)
+	optout := newTestZone(t, "optout.com.", true,
+		"optout.com. 3600 IN NS ns.optout.com.",
+		"ns.optout.com. 3600 IN A 10.0.0.6",
+	)
+	optout.setNSEC3OptOut(t)
+	com := newTestZone(t, "com.", true,
+		"com. 3600 IN NS ns.com.",
+		"ns.com. 3600 IN A 10.0.0.2",
+		"example.com. 3600 IN NS ns.example.com.",
+		"ns.example.com. 3600 IN A 10.0.0.3",
+		example.ds(),
+		"bad.com. 3600 IN NS ns.bad.com.",
+		"ns.bad.com. 3600 IN A 10.0.0.4",
+		bad.ds(),
+		"insecure.com. 3600 IN NS ns.insecure.com.",
+		"ns.insecure.com. 3600 IN A 10.0.0.5",
+		"optout.com. 3600 IN NS ns.optout.com.",
+		"ns.optout.com. 3600 IN A 10.0.0.6",
+		optout.ds(),
+	)
+	root := newTestZone(t, ".", true,
+		". 3600 IN NS a.root.",
+		"a.root. 3600 IN A 10.0.0.1",
+		"com. 3600 IN NS ns.com.",
+		"ns.com. 3600 IN A 10.0.0.2",
+		com.ds(),
+	)
+
+	zones := map[string]*authZone{
+		"10.0.0.1:53": root,
+		"10.0.0.2:53": com,
+		"10.0.0.3:53": example,
+		"10.0.0.4:53": bad,
+		"10.0.0.5:53": insecure,
+		"10.0.0.6:53": optout,
+	}
+
+	anchor, err := parseTrustAnchors([]string{root.ds()})
+	assert.Nil(t, err)
+	r := newRecursor(recursorConfig{
+		qnameMinimization: true,
+		dnssec:            true,
+		rootHints:         []string{"10.0.0.1"},
+		trustAnchors:      anchor,
+	})
+	var lock sync.Mutex
+	r.exchange = func(req *dns.Msg, addr string) (*dns.Msg, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		z, ok := zones[addr]
+		if !ok {
+			return nil, fmt.Errorf("no server at %s", addr)
+		}
+		return z.respond(req), nil
+	}
+	return r, zones
+}
+
+func recursorQuery(t *testing.T, r *recursor, name string, qtype uint16, do bool) *dns.Msg {
+	req := &dns.Msg{}
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(4096, do)
+	resp, err := r.Exchange(req)
+	assert.Nil(t, err)
+	return resp
+}
+
+func TestRecursor(t *testing.T) {
+	r, zones := createTestRecursor(t)
+
+	// secure answer
+	resp := recursorQuery(t, r, "www.example.com.", dns.TypeA, true)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.True(t, resp.AuthenticatedData)
+	assert.Equal(t, 2, len(resp.Answer)) // A + RRSIG
+	a, ok := resp.Answer[0].(*dns.A)
+	assert.True(t, ok)
+	assert.Equal(t, "1.2.3.4", a.A.String())
+
+	// QNAME minimization: the root and TLD servers don't see the full name
+	assert.Equal(t, []string{"com./A", "./DNSKEY"}, zones["10.0.0.1:53"].queries)
+	assert.Equal(t, []string{"example.com./A", "com./DNSKEY"}, zones["10.0.0.2:53"].queries)
+
+	// DNSSEC records are removed if the client didn't ask for them
+	resp = recursorQuery(t, r, "www.example.com.", dns.TypeA, false)
+	assert.False(t, resp.AuthenticatedData)
+	assert.Equal(t, 1, len(resp.Answer))
+	// the answer is cached
+	assert.Equal(t, 1, len(zones["10.0.0.3:53"].queries[1:]))
+	ttl := resp.Answer[0].Header().Ttl
+
+	// the TTL of the cached answer is reduced by the time spent in cache
+	r.now = func() time.Time { return time.Now().Add(100 * time.Second) }
+	resp = recursorQuery(t, r, "www.example.com.", dns.TypeA, false)
+	assert.True(t, resp.Answer[0].Header().Ttl <= ttl-99)
+	r.now = time.Now
+
+	// CNAME
+	resp = recursorQuery(t, r, "alias.example.com.", dns.TypeA, false)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, 2, len(resp.Answer))
+	_, ok = resp.Answer[0].(*dns.CNAME)
+	assert.True(t, ok)
+
+	// proven NXDOMAIN
+	resp = recursorQuery(t, r, "nope.example.com.", dns.TypeA, true)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	assert.True(t, resp.AuthenticatedData)
+
+	// proven NODATA
+	resp = recursorQuery(t, r, "www.example.com.", dns.TypeAAAA, true)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, 0, len(resp.Answer))
+	assert.True(t, resp.AuthenticatedData)
+
+	// bogus signature
+	resp = recursorQuery(t, r, "www.bad.com.", dns.TypeA, true)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+	assert.Equal(t, 0, len(resp.Answer))
+
+	// insecure delegation
+	resp = recursorQuery(t, r, "www.insecure.com.", dns.TypeA, true)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.False(t, resp.AuthenticatedData)
+	assert.Equal(t, 1, len(resp.Answer))
+
+	// NXDOMAIN in NSEC3 Opt-Out span: insecure, not bogus
+	resp = recursorQuery(t, r, "nope.optout.com.", dns.TypeA, true)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	assert.False(t, resp.AuthenticatedData)
+}
+
+func TestVerifyNameErrorNSEC3(t *testing.T) {
+	nsec3 := func(name, next string, flags uint8) *dns.NSEC3 {
+		return &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			HashLength: 20,
+			NextDomain: next,
+			TypeBitMap: []uint16{dns.TypeNS, dns.TypeSOA},
+		}
+	}
+	apex := dns.HashName("example.com.", dns.SHA1, 0, "")
+	owner := strings.ToLower(apex) + ".example.com."
+
+	// the closest encloser and the next closer name are proven, the wildcard is covered
+	assert.Nil(t, verifyNameError("a.example.com.", []dns.RR{nsec3(owner, apex, 0)}))
+
+	// Opt-Out span
+	err := verifyNameError("a.example.com.", []dns.RR{nsec3(owner, apex, 1)})
+	assert.True(t, errors.Is(err, errNSEC3Insecure))
+
+	// unsupported hash algorithm
+	n := nsec3(owner, apex, 0)
+	n.Hash = 2
+	err = verifyNameError("a.example.com.", []dns.RR{n})
+	assert.True(t, errors.Is(err, errNSEC3Insecure))
+
+	// no closest encloser proof
+	err = verifyNameError("a.example.com.", []dns.RR{nsec3("0p9mhaveqvm6t7vbl5lop2u3t2rp3tom.example.com.", apex, 1)})
+	assert.True(t, errors.Is(err, errDNSSECBogus))
+}
+
+func TestVerifyWildcardNoData(t *testing.T) {
+	nsec := func(name, next string, types ...uint16) *dns.NSEC {
+		return &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+			NextDomain: next,
+			TypeBitMap: append(types, dns.TypeNSEC, dns.TypeRRSIG),
+		}
+	}
+	wildcard := nsec("*.example.com.", "b.example.com.", dns.TypeA)
+
+	// the same NSEC record proves that the name doesn't exist
+	assert.Nil(t, verifyNoData("a.example.com.", dns.TypeAAAA, []dns.RR{wildcard}))
+
+	// no proof that the name doesn't exist
+	assert.NotNil(t, verifyNoData("c.example.com.", dns.TypeAAAA, []dns.RR{wildcard}))
+	assert.Nil(t, verifyNoData("c.example.com.", dns.TypeAAAA,
+		[]dns.RR{wildcard, nsec("b.example.com.", "example.com.", dns.TypeA)}))
+
+	// the closest encloser is "b.example.com.", so the wildcard doesn't apply
+	assert.NotNil(t, verifyNoData("a.b.example.com.", dns.TypeAAAA,
+		[]dns.RR{wildcard, nsec("b.example.com.", "example.com.", dns.TypeA)}))
+
+	// the wildcard has records of this type
+	assert.NotNil(t, verifyNoData("a.example.com.", dns.TypeA, []dns.RR{wildcard}))
+}
+
+func TestRecursorNoValidation(t *testing.T) {
+	r, _ := createTestRecursor(t)
+	conf := r.conf
+	conf.dnssec = false
+	conf.qnameMinimization = false
+	r.setConfig(conf)
+
+	resp := recursorQuery(t, r, "www.bad.com.", dns.TypeA, false)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.False(t, resp.AuthenticatedData)
+	assert.Equal(t, 1, len(resp.Answer))
+}
+
+func TestRecursiveUpstream(t *testing.T) {
+	s := NewServer(DNSCreateParams{})
+	conf, err := s.ParseUpstreamsConfig([]string{"8.8.8.8", RecursiveUpstream, "[/local/]recursive"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(conf.Upstreams))
+	assert.Equal(t, RecursiveUpstream, conf.Upstreams[1].Address())
+	assert.Equal(t, 1, len(conf.DomainReservedUpstreams["local."]))
+
+	assert.Nil(t, ValidateUpstreams([]string{RecursiveUpstream}))
+}
+
+func TestDNSSECValidator(t *testing.T) {
+	r, zones := createTestRecursor(t)
+	// the upstream server doesn't validate the responses
+	conf := r.conf
+	conf.dnssec = false
+	r.setConfig(conf)
+
+	root := zones["10.0.0.1:53"]
+	anchor, _ := parseTrustAnchors([]string{root.ds()})
+	v := newValidator(anchor, r.Exchange)
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		return recursorQuery(t, r, name, qtype, true)
+	}
+
+	status, err := v.validate(query("www.example.com.", dns.TypeA))
+	assert.Nil(t, err)
+	assert.Equal(t, dnssecSecure, status)
+
+	status, err = v.validate(query("alias.example.com.", dns.TypeA))
+	assert.Nil(t, err)
+	assert.Equal(t, dnssecSecure, status)
+
+	status, err = v.validate(query("nope.example.com.", dns.TypeA))
+	assert.Nil(t, err)
+	assert.Equal(t, dnssecSecure, status)
+
+	status, err = v.validate(query("www.example.com.", dns.TypeAAAA))
+	assert.Nil(t, err)
+	assert.Equal(t, dnssecSecure, status)
+
+	status, err = v.validate(query("www.insecure.com.", dns.TypeA))
+	assert.Nil(t, err)
+	assert.Equal(t, dnssecInsecure, status)
+
+	// NXDOMAIN in NSEC3 Opt-Out span
+	status, err = v.validate(query("nope.optout.com.", dns.TypeA))
+	assert.Nil(t, err)
+	assert.Equal(t, dnssecInsecure, status)
+
+	status, err = v.validate(query("www.bad.com.", dns.TypeA))
+	assert.NotNil(t, err)
+	assert.Equal(t, dnssecBogus, status)
+
+	// signatures are removed
+	resp := query("www.example.com.", dns.TypeA)
+	stripDNSSECRecords(resp)
+	status, _ = v.validate(resp)
+	assert.Equal(t, dnssecBogus, status)
+
+	// NXDOMAIN without the proof
+	resp = query("nope.example.com.", dns.TypeA)
+	resp.Ns = filterRRs(resp.Ns, dns.TypeSOA)
+	status, _ = v.validate(resp)
+	assert.Equal(t, dnssecBogus, status)
+
+	// upstream server doesn't respond
+	v = newValidator(anchor, func(req *dns.Msg) (*dns.Msg, error) {
+		return nil, fmt.Errorf("timeout")
+	})
+	status, _ = v.validate(query("www.example.com.", dns.TypeA))
+	assert.Equal(t, dnssecIndeterminate, status)
+}
+
+func TestDNSSECValidationResponse(t *testing.T) {
+	r, zones := createTestRecursor(t)
+	conf := r.conf
+	conf.dnssec = false
+	r.setConfig(conf)
+	anchor, _ := parseTrustAnchors([]string{zones["10.0.0.1:53"].ds()})
+
+	s := &Server{}
+	s.validator = newValidator(anchor, r.Exchange)
+
+	process := func(name string, do, cd bool) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion(name, dns.TypeA)
+		req.SetEdns0(4096, do)
+		ctx := &dnsContext{
+			srv:                  s,
+			proxyCtx:             &proxy.DNSContext{Req: req},
+			responseFromUpstream: true,
+			origReqDNSSEC:        do,
+			origReqCD:            cd,
+		}
+		ctx.proxyCtx.Res = recursorQuery(t, r, name, dns.TypeA, true)
+		assert.Equal(t, resultDone, processDNSSECValidation(ctx))
+		return ctx.proxyCtx.Res
+	}
+
+	resp := process("www.example.com.", true, false)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.True(t, resp.AuthenticatedData)
+
+	resp = process("www.insecure.com.", true, false)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.False(t, resp.AuthenticatedData)
+
+	// bogus: SERVFAIL with Extended DNS Error
+	resp = process("www.bad.com.", false, false)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+	assert.Equal(t, edeDNSSECBogus, getEDE(resp))
+
+	// the client has disabled checking
+	resp = process("www.bad.com.", true, true)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.True(t, resp.CheckingDisabled)
+	assert.False(t, resp.AuthenticatedData)
+}
+
+func TestExtendedDNSErrors(t *testing.T) {
+	// the running server reads its settings, so a new server is started for each blocking mode
+	start := func(blockingMode string) (*Server, string) {
+		s := createTestServer(t)
+		s.conf.UpstreamDNS = []string{"127.0.0.1:1"}
+		s.conf.BlockingMode = blockingMode
+		s.conf.EDEBlockingModes = []string{"default"}
+		assert.Nil(t, s.Prepare(nil))
+		assert.Nil(t, s.Start())
+		return s, s.dnsProxy.Addr(proxy.ProtoUDP).String()
+	}
+	s, addr := start("default")
+
+	req := createTestMessage("nxdomain.example.org.")
+	req.SetEdns0(4096, false)
+	reply, err := dns.Exchange(req, addr)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+	assert.Equal(t, edeBlocked, getEDE(reply))
+
+	// no EDNS in the request
+	reply, err = dns.Exchange(createTestMessage("nxdomain.example.org."), addr)
+	assert.Nil(t, err)
+	assert.Nil(t, reply.IsEdns0())
+
+	// upstream server doesn't respond
+	req = createTestMessage("example.net.")
+	req.SetEdns0(4096, false)
+	reply, err = dns.Exchange(req, addr)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeServerFailure, reply.Rcode)
+	assert.Equal(t, edeNetworkError, getEDE(reply))
+
+	assert.Nil(t, s.Stop())
+
+	// EDE is disabled for this blocking mode
+	s, addr = start("nxdomain")
+	req = createTestMessage("nxdomain.example.org.")
+	req.SetEdns0(4096, false)
+	reply, err = dns.Exchange(req, addr)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+	assert.Equal(t, -1, getEDE(reply))
+
+	assert.Nil(t, s.Stop())
+}
+
+func TestFilteringEDE(t *testing.T) {
+	req := createTestMessage("example.org.")
+	req.SetEdns0(4096, false)
+
+	resp := &dns.Msg{}
+	resp.SetRcode(req, dns.RcodeNameError)
+	addFilteringEDE(req, resp, &dnsfilter.Result{Reason: dnsfilter.FilteredBlockedService, ServiceName: "youtube"})
+	assert.Equal(t, edeCensored, getEDE(resp))
+	opt := resp.IsEdns0().Option[0].(*dns.EDNS0_LOCAL)
+	assert.Equal(t, "reason: FilteredBlockedService, service: youtube", string(opt.Data[2:]))
+
+	resp = &dns.Msg{}
+	resp.SetRcode(req, dns.RcodeNameError)
+	addFilteringEDE(req, resp, &dnsfilter.Result{Reason: dnsfilter.FilteredParental})
+	assert.Equal(t, edeFiltered, getEDE(resp))
+
+	resp = &dns.Msg{}
+	resp.SetRcode(req, dns.RcodeNameError)
+	addFilteringEDE(req, resp, &dnsfilter.Result{Reason: dnsfilter.FilteredBlackList, FilterID: 3})
+	opt = resp.IsEdns0().Option[0].(*dns.EDNS0_LOCAL)
+	assert.Equal(t, "reason: FilteredBlackList, filter_id: 3", string(opt.Data[2:]))
+}
+
+func TestProtectionPause(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.UpstreamDNS = []string{"127.0.0.1:1"}
+	s.conf.ConfigModified = func() {}
+	s.conf.FilterHandler = func(clientAddr string, setts *dnsfilter.RequestFilteringSettings) {
+		setts.ClientName = "client1"
+	}
+	// the time is read by the goroutines that process requests
+	var nowLock sync.Mutex
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time {
+		nowLock.Lock()
+		defer nowLock.Unlock()
+		return now
+	}
+	assert.Nil(t, s.Prepare(nil))
+	assert.Nil(t, s.Start())
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+
+	setProtection := func(body string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/control/protection", strings.NewReader(body))
+		s.handleProtection(w, r)
+		return w.Code
+	}
+	blocked := func() bool {
+		reply, err := dns.Exchange(createTestMessage("nxdomain.example.org."), addr)
+		assert.Nil(t, err)
+		return reply.Rcode == dns.RcodeNameError
+	}
+
+	assert.True(t, blocked())
+
+	// pause for 10 minutes
+	assert.Equal(t, http.StatusOK, setProtection(`{"enabled":false,"duration":600000}`))
+	assert.False(t, blocked())
+	c := FilteringConfig{}
+	s.WriteDiskConfig(&c)
+	assert.True(t, c.ProtectionEnabled)
+	assert.Equal(t, now.Add(10*time.Minute), *c.ProtectionDisabledUntil)
+
+	// the pause has elapsed
+	nowLock.Lock()
+	now = now.Add(10 * time.Minute)
+	nowLock.Unlock()
+	assert.True(t, blocked())
+	s.WriteDiskConfig(&c)
+	assert.Nil(t, c.ProtectionDisabledUntil)
+
+	// pause for the client
+	assert.Equal(t, http.StatusOK, setProtection(`{"enabled":false,"duration":60000,"client":"client1"}`))
+	assert.False(t, blocked())
+	assert.Equal(t, http.StatusOK, setProtection(`{"enabled":true,"client":"client1"}`))
+	assert.True(t, blocked())
+
+	// the pause for another client
+	assert.Equal(t, http.StatusOK, setProtection(`{"enabled":false,"duration":60000,"client":"client2"}`))
+	assert.True(t, blocked())
+
+	assert.Equal(t, http.StatusBadRequest, setProtection(`{"enabled":false,"client":"1.2.3.4"}`))
+
+	// the duration is too large
+	assert.Equal(t, http.StatusBadRequest, setProtection(`{"enabled":false,"duration":18446744073709551615}`))
+	assert.Equal(t, http.StatusBadRequest, setProtection(`{"enabled":false,"duration":31536000001}`))
+	assert.Equal(t, http.StatusOK, setProtection(`{"enabled":false,"duration":31536000000}`))
+	assert.False(t, blocked())
+
+	assert.Nil(t, s.Stop())
+}
+
+func TestIsBlockedClientMACAndID(t *testing.T) {
+	a := &accessCtx{}
+	assert.Nil(t, a.Init(nil, []string{"1.1.1.1", "aa:bb:cc:dd:ee:ff", "Kid-1"}, nil))
+
+	blocked, entry := a.isBlockedClient(accessClient{ip: "1.1.1.1"})
+	assert.True(t, blocked)
+	assert.Equal(t, "1.1.1.1", entry)
+	mac, _ := net.ParseMAC("AA:BB:CC:DD:EE:FF")
+	blocked, entry = a.isBlockedClient(accessClient{ip: "1.1.1.2", mac: mac})
+	assert.True(t, blocked)
+	assert.Equal(t, "aa:bb:cc:dd:ee:ff", entry)
+	blocked, entry = a.isBlockedClient(accessClient{ip: "1.1.1.2", id: "kid-1"})
+	assert.True(t, blocked)
+	assert.Equal(t, "Kid-1", entry)
+	blocked, _ = a.isBlockedClient(accessClient{ip: "1.1.1.2", id: "kid-2"})
+	assert.False(t, blocked)
+
+	// allowed clients
+	a = &accessCtx{}
+	assert.Nil(t, a.Init([]string{"kid-1"}, nil, nil))
+	blocked, _ = a.isBlockedClient(accessClient{ip: "1.1.1.1", id: "kid-1"})
+	assert.False(t, blocked)
+	blocked, entry = a.isBlockedClient(accessClient{ip: "1.1.1.1"})
+	assert.True(t, blocked)
+	assert.Equal(t, "", entry)
+
+	a = &accessCtx{}
+	assert.NotNil(t, a.Init(nil, []string{"1.2.3.4.5"}, nil))
+	// mistyped IP addresses aren't client IDs
+	for _, s := range []string{"19216801", "192.168.0.1O", "1.2.3", "-kid", "kid-"} {
+		a = &accessCtx{}
+		assert.NotNil(t, a.Init(nil, []string{s}, nil), s)
+	}
+	a = &accessCtx{}
+	assert.NotNil(t, a.Init(nil, nil, []string{"/ads[/"}))
+}
+
+func TestIsBlockedDomainPatterns(t *testing.T) {
+	a := &accessCtx{}
+	assert.Nil(t, a.Init(nil, nil, []string{
+		"/^ads[0-9]+\\./",
+		"tracker*.example.org",
+		"||host.com^",
+		"@@||ads1.good.com^",
+	}))
+
+	blocked, entry := a.isBlockedDomain("ads12.example.com")
+	assert.True(t, blocked)
+	assert.Equal(t, "/^ads[0-9]+\\./", entry)
+	assert.False(t, a.IsBlockedDomain("ads.example.com"))
+	assert.False(t, a.IsBlockedDomain("www.ads1.example.com"))
+
+	blocked, entry = a.isBlockedDomain("Tracker-eu.example.org")
+	assert.True(t, blocked)
+	assert.Equal(t, "tracker*.example.org", entry)
+	assert.False(t, a.IsBlockedDomain("tracker.example.com"))
+
+	blocked, entry = a.isBlockedDomain("www.host.com")
+	assert.True(t, blocked)
+	assert.Equal(t, "||host.com^", entry)
+
+	// exception
+	blocked, entry = a.isBlockedDomain("ads1.good.com")
+	assert.False(t, blocked)
+	assert.Equal(t, "@@||ads1.good.com^", entry)
+}
+
+func TestClientID(t *testing.T) {
+	assert.Equal(t, "kid1", clientIDFromDOHPath("/dns-query/Kid1"))
+	assert.Equal(t, "", clientIDFromDOHPath("/dns-query"))
+	assert.Equal(t, "", clientIDFromDOHPath("/dns-query/a.b"))
+	assert.Equal(t, "", clientIDFromDOHPath("/dns-query/123"))
+	assert.Equal(t, "kid1", clientIDFromServerName("kid1.dns.example.org", "dns.example.org"))
+	assert.Equal(t, "", clientIDFromServerName("dns.example.org", "dns.example.org"))
+	assert.Equal(t, "", clientIDFromServerName("a.kid1.dns.example.org", "dns.example.org"))
+	assert.Equal(t, "", clientIDFromServerName("kid1.dns.example.org", ""))
+}
@@ -0,0 +1,480 @@
+package dnsforward
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSSEC validation (RFC 4033, 4034, 4035, 5155)
+
+// Root zone trust anchors: KSK-2017 and KSK-2024
+var rootTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// errDNSSECBogus is returned when the data doesn't pass DNSSEC validation
+var errDNSSECBogus = errors.New("DNSSEC validation failed")
+
+// errNSEC3Insecure is returned when NSEC3 records by design don't prove that the name doesn't exist:
+// the name is in an Opt-Out span or the NSEC3 hash algorithm isn't supported (RFC 5155 8.1, 9.2).
+// The response is insecure, not bogus.
+var errNSEC3Insecure = errors.New("NSEC3 proof is insecure")
+
+// DNSKEY algorithms supported by miekg/dns
+var supportedDNSSECAlgorithms = map[uint8]bool{
+	dns.RSASHA1:          true,
+	dns.RSASHA1NSEC3SHA1: true,
+	dns.RSASHA256:        true,
+	dns.RSASHA512:        true,
+	dns.ECDSAP256SHA256:  true,
+	dns.ECDSAP384SHA384:  true,
+	dns.ED25519:          true,
+}
+
+// DS digest types supported by miekg/dns
+var supportedDSDigests = map[uint8]bool{
+	dns.SHA1:   true,
+	dns.SHA256: true,
+	dns.SHA384: true,
+}
+
+// Parse trust anchors (DS records in zone file format)
+func parseTrustAnchors(anchors []string) ([]*dns.DS, error) {
+	var ds []*dns.DS
+	for _, a := range anchors {
+		rr, err := dns.NewRR(a)
+		if err != nil {
+			return nil, err
+		}
+		d, ok := rr.(*dns.DS)
+		if !ok {
+			return nil, fmt.Errorf("trust anchor is not a DS record: %s", a)
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// Return TRUE if any of DS records can be used for validation
+// If there are no such records, the zone must be treated as insecure (RFC 4035 5.2).
+func hasSupportedDS(ds []*dns.DS) bool {
+	for _, d := range ds {
+		if supportedDNSSECAlgorithms[d.Algorithm] && supportedDSDigests[d.DigestType] {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate DNSKEY RRset using DS records from the parent zone
+// Returns the keys that may be used to validate the zone data.
+func verifyDNSKEYs(zone string, rrs []dns.RR, ds []*dns.DS, now time.Time) ([]*dns.DNSKEY, error) {
+	var keys []*dns.DNSKEY
+	var keySet []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range rrs {
+		if !strings.EqualFold(rr.Header().Name, zone) {
+			continue
+		}
+		switch v := rr.(type) {
+		case *dns.DNSKEY:
+			keys = append(keys, v)
+			keySet = append(keySet, v)
+		case *dns.RRSIG:
+			if v.TypeCovered == dns.TypeDNSKEY {
+				sigs = append(sigs, v)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no DNSKEY records: %w", zone, errDNSSECBogus)
+	}
+
+	// find the key that matches DS record and verify DNSKEY RRset with it
+	for _, d := range ds {
+		for _, k := range keys {
+			if k.KeyTag() != d.KeyTag || k.Algorithm != d.Algorithm {
+				continue
+			}
+			kds := k.ToDS(d.DigestType)
+			if kds == nil || !strings.EqualFold(kds.Digest, d.Digest) {
+				continue
+			}
+			if verifyRRset(keySet, sigs, []*dns.DNSKEY{k}, now) == nil {
+				return zoneKeys(keys), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s: no valid DNSKEY matching DS: %w", zone, errDNSSECBogus)
+}
+
+// Get the keys that have ZONE flag set
+func zoneKeys(keys []*dns.DNSKEY) []*dns.DNSKEY {
+	var zk []*dns.DNSKEY
+	for _, k := range keys {
+		if k.Flags&dns.ZONE != 0 && k.Protocol == 3 {
+			zk = append(zk, k)
+		}
+	}
+	return zk
+}
+
+// Verify RRset with any of the signatures made by any of the keys
+func verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY, now time.Time) error {
+	if len(rrset) == 0 {
+		return nil
+	}
+	hdr := rrset[0].Header()
+	for _, sig := range sigs {
+		if sig.TypeCovered != hdr.Rrtype || !strings.EqualFold(sig.Hdr.Name, hdr.Name) ||
+			!dns.IsSubDomain(sig.SignerName, hdr.Name) || !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, k := range keys {
+			if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm ||
+				!strings.EqualFold(k.Hdr.Name, sig.SignerName) {
+				continue
+			}
+			if sig.Verify(k, rrset) == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s/%s: no valid signature: %w",
+		hdr.Name, dns.Type(hdr.Rrtype), errDNSSECBogus)
+}
+
+// RRset identifier
+type rrsetKey struct {
+	name  string // lower-case
+	rtype uint16
+}
+
+// Split records into RRsets and signatures
+func splitRRsets(rrs []dns.RR) (map[rrsetKey][]dns.RR, []*dns.RRSIG) {
+	sets := map[rrsetKey][]dns.RR{}
+	var sigs []*dns.RRSIG
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs = append(sigs, sig)
+			continue
+		}
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		k := rrsetKey{name: strings.ToLower(rr.Header().Name), rtype: rr.Header().Rrtype}
+		sets[k] = append(sets[k], rr)
+	}
+	return sets, sigs
+}
+
+// Verify all RRsets of the section with the zone keys
+// Returns the closest encloser name if the answer was synthesized from a wildcard.
+func verifySection(rrs []dns.RR, keys []*dns.DNSKEY, now time.Time) (string, error) {
+	sets, sigs := splitRRsets(rrs)
+	wildcard := ""
+	for _, set := range sets {
+		err := verifyRRset(set, sigs, keys, now)
+		if err != nil {
+			return "", err
+		}
+		name := set[0].Header().Name
+		labels := dns.CountLabel(name)
+		for _, sig := range sigs {
+			if sig.TypeCovered == set[0].Header().Rrtype &&
+				strings.EqualFold(sig.Hdr.Name, name) && int(sig.Labels) < labels {
+				l := dns.SplitDomainName(name)
+				wildcard = dns.Fqdn(strings.Join(l[len(l)-int(sig.Labels):], "."))
+			}
+		}
+	}
+	return wildcard, nil
+}
+
+// Verify the proof that the wildcard answer was synthesized correctly:
+//
+//	the name itself must not exist (RFC 4035 5.3.4, RFC 5155 8.8)
+func verifyWildcardAnswer(qname, ce string, rrs []dns.RR) error {
+	nsec, nsec3 := nsecRecords(rrs)
+	for _, n := range nsec {
+		if nsecCovers(n, qname) {
+			return nil
+		}
+	}
+	if len(nsec3) != 0 && dns.CountLabel(qname) > dns.CountLabel(ce) {
+		nc := nextCloser(ce, qname)
+		for _, n := range nsec3 {
+			if n.Cover(nc) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s: no proof for wildcard answer: %w", qname, errDNSSECBogus)
+}
+
+// Get NSEC and NSEC3 records from the section
+func nsecRecords(rrs []dns.RR) (nsec []*dns.NSEC, nsec3 []*dns.NSEC3) {
+	for _, rr := range rrs {
+		switch v := rr.(type) {
+		case *dns.NSEC:
+			nsec = append(nsec, v)
+		case *dns.NSEC3:
+			nsec3 = append(nsec3, v)
+		}
+	}
+	return nsec, nsec3
+}
+
+// Compare domain names in canonical DNS name order (RFC 4034 6.1)
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; ; i++ {
+		switch {
+		case i > len(la) && i > len(lb):
+			return 0
+		case i > len(la):
+			return -1
+		case i > len(lb):
+			return 1
+		}
+		c := strings.Compare(la[len(la)-i], lb[len(lb)-i])
+		if c != 0 {
+			return c
+		}
+	}
+}
+
+// Return TRUE if NSEC record proves that the name doesn't exist
+func nsecCovers(n *dns.NSEC, name string) bool {
+	owner := n.Hdr.Name
+	next := n.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// the last NSEC in the zone
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+// Return TRUE if the type bitmap contains the type
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, bt := range bitmap {
+		if bt == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the longest common ancestor of two names
+func commonAncestor(a, b string) string {
+	n := dns.CompareDomainName(a, b)
+	if n == 0 {
+		return "."
+	}
+	labels := dns.SplitDomainName(a)
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+// Get the name that is one label longer than the ancestor and is an ancestor of (or equal to) the name
+func nextCloser(ancestor, name string) string {
+	labels := dns.SplitDomainName(name)
+	n := dns.CountLabel(ancestor)
+	return dns.Fqdn(strings.Join(labels[len(labels)-n-1:], "."))
+}
+
+// Verify the proof that the name doesn't exist (NXDOMAIN)
+func verifyNameError(qname string, rrs []dns.RR) error {
+	nsec, nsec3 := nsecRecords(rrs)
+	if len(nsec) != 0 {
+		for _, n := range nsec {
+			if !nsecCovers(n, qname) {
+				continue
+			}
+			// the closest encloser can't have a wildcard
+			ce := commonAncestor(qname, n.Hdr.Name)
+			ce2 := commonAncestor(qname, n.NextDomain)
+			if dns.CountLabel(ce2) > dns.CountLabel(ce) {
+				ce = ce2
+			}
+			for _, w := range nsec {
+				if nsecCovers(w, "*."+ce) {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("%s: no NSEC proof of non-existence: %w", qname, errDNSSECBogus)
+	}
+
+	if len(nsec3) != 0 {
+		if !nsec3Supported(nsec3) {
+			return fmt.Errorf("%s: unsupported NSEC3 hash algorithm: %w", qname, errNSEC3Insecure)
+		}
+		ce, optOut := nsec3ClosestEncloser(qname, nsec3)
+		if len(ce) != 0 {
+			if optOut {
+				return fmt.Errorf("%s: NSEC3 Opt-Out span: %w", qname, errNSEC3Insecure)
+			}
+			for _, n := range nsec3 {
+				if n.Cover("*." + ce) {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("%s: no NSEC3 proof of non-existence: %w", qname, errDNSSECBogus)
+	}
+
+	return fmt.Errorf("%s: no NSEC or NSEC3 records: %w", qname, errDNSSECBogus)
+}
+
+// Return TRUE if there are NSEC3 records with the supported hash algorithm
+// The records with unknown hash algorithms must be ignored (RFC 5155 8.1).
+func nsec3Supported(nsec3 []*dns.NSEC3) bool {
+	for _, n := range nsec3 {
+		if n.Hash == dns.SHA1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the closest encloser of the name from the NSEC record that proves the name doesn't exist
+// Returns an empty string if there's no such proof.
+func nsecClosestEncloser(qname string, nsec []*dns.NSEC) string {
+	for _, n := range nsec {
+		if !nsecCovers(n, qname) {
+			continue
+		}
+		ce := commonAncestor(qname, n.Hdr.Name)
+		ce2 := commonAncestor(qname, n.NextDomain)
+		if dns.CountLabel(ce2) > dns.CountLabel(ce) {
+			ce = ce2
+		}
+		return strings.ToLower(ce)
+	}
+	return ""
+}
+
+// Find the closest encloser of the name and check that the next closer name is covered (RFC 5155 8.3)
+// Returns an empty string if there's no such proof.
+// optOut: TRUE if the next closer name is covered by an NSEC3 record with Opt-Out flag.
+func nsec3ClosestEncloser(qname string, nsec3 []*dns.NSEC3) (ce string, optOut bool) {
+	labels := dns.SplitDomainName(qname)
+	for i := 1; i <= len(labels); i++ {
+		candidate := dns.Fqdn(strings.Join(labels[i:], "."))
+		for _, n := range nsec3 {
+			if !n.Match(candidate) {
+				continue
+			}
+			nc := nextCloser(candidate, qname)
+			for _, c := range nsec3 {
+				if c.Cover(nc) {
+					return candidate, c.Flags&1 != 0
+				}
+			}
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// Verify the proof that the name exists but has no records of the type (NODATA)
+func verifyNoData(qname string, qtype uint16, rrs []dns.RR) error {
+	nsec, nsec3 := nsecRecords(rrs)
+	for _, n := range nsec {
+		if strings.EqualFold(n.Hdr.Name, qname) {
+			if !hasType(n.TypeBitMap, qtype) && !hasType(n.TypeBitMap, dns.TypeCNAME) {
+				return nil
+			}
+			continue
+		}
+		// empty non-terminal: the next name is a subdomain of qname
+		if nsecCovers(n, qname) && dns.IsSubDomain(qname, n.NextDomain) {
+			return nil
+		}
+		// wildcard NODATA: the name itself must not exist (RFC 4035 3.1.3.4)
+		if strings.HasPrefix(n.Hdr.Name, "*.") &&
+			!hasType(n.TypeBitMap, qtype) && !hasType(n.TypeBitMap, dns.TypeCNAME) &&
+			nsecClosestEncloser(qname, nsec) == strings.ToLower(n.Hdr.Name[2:]) {
+			return nil
+		}
+	}
+
+	for _, n := range nsec3 {
+		if n.Match(qname) {
+			if !hasType(n.TypeBitMap, qtype) && !hasType(n.TypeBitMap, dns.TypeCNAME) {
+				return nil
+			}
+			return fmt.Errorf("%s: NSEC3 type bitmap contains the type: %w", qname, errDNSSECBogus)
+		}
+	}
+	if len(nsec3) != 0 {
+		// wildcard NODATA: closest encloser proof and the wildcard at the closest encloser (RFC 5155 8.7)
+		ce, _ := nsec3ClosestEncloser(qname, nsec3)
+		if len(ce) != 0 {
+			for _, n := range nsec3 {
+				if n.Match("*."+ce) &&
+					!hasType(n.TypeBitMap, qtype) && !hasType(n.TypeBitMap, dns.TypeCNAME) {
+					return nil
+				}
+			}
+		}
+	}
+	if len(nsec3) != 0 && qtype == dns.TypeDS {
+		// DS NODATA for an Opt-Out delegation (RFC 5155 8.6)
+		_, optOut := nsec3ClosestEncloser(qname, nsec3)
+		if optOut {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s/%s: no proof of non-existence: %w", qname, dns.Type(qtype), errDNSSECBogus)
+}
+
+// Verify the proof that the delegation to the child zone is insecure (there's no DS record)
+func verifyNoDS(child string, rrs []dns.RR) error {
+	nsec, nsec3 := nsecRecords(rrs)
+	for _, n := range nsec {
+		if strings.EqualFold(n.Hdr.Name, child) &&
+			hasType(n.TypeBitMap, dns.TypeNS) && !hasType(n.TypeBitMap, dns.TypeDS) {
+			return nil
+		}
+	}
+	for _, n := range nsec3 {
+		if n.Match(child) && !hasType(n.TypeBitMap, dns.TypeDS) {
+			return nil
+		}
+	}
+	if len(nsec3) != 0 {
+		_, optOut := nsec3ClosestEncloser(child, nsec3)
+		if optOut {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: no proof of insecure delegation: %w", child, errDNSSECBogus)
+}
+
+// Remove DNSSEC records from the message
+// It's used when the client didn't request them.
+func stripDNSSECRecords(m *dns.Msg) {
+	m.Answer = filterDNSSECRecords(m.Answer)
+	m.Ns = filterDNSSECRecords(m.Ns)
+	m.Extra = filterDNSSECRecords(m.Extra)
+}
+
+func filterDNSSECRecords(rrs []dns.RR) []dns.RR {
+	var res []dns.RR
+	for _, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			continue
+		}
+		res = append(res, rr)
+	}
+	return res
+}
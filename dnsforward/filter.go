@@ -11,9 +11,10 @@ import (
 )
 
 func (s *Server) beforeRequestHandler(_ *proxy.Proxy, d *proxy.DNSContext) (bool, error) {
-	ip := ipFromAddr(d.Addr)
-	if s.access.IsBlockedIP(ip) {
-		log.Tracef("Client IP %s is blocked by settings", ip)
+	client := s.accessClientFromDNSContext(d)
+	blocked, entry := s.access.isBlockedClient(client)
+	if blocked {
+		log.Tracef("Client %s (ID: %s) is blocked by settings: %s", client.ip, client.id, entry)
 		return false, nil
 	}
 
@@ -33,6 +34,8 @@ func (s *Server) beforeRequestHandler(_ *proxy.Proxy, d *proxy.DNSContext) (bool
 func (s *Server) getClientRequestFilteringSettings(d *proxy.DNSContext) *dnsfilter.RequestFilteringSettings {
 	setts := s.dnsFilter.GetConfig()
 	setts.FilteringEnabled = true
+	setts.FilterResponseCNAME = !s.conf.DisableResponseCNAME
+	setts.FilterResponseIP = !s.conf.DisableResponseIP
 	if s.conf.FilterHandler != nil {
 		clientAddr := ipFromAddr(d.Addr)
 		s.conf.FilterHandler(clientAddr, &setts)
@@ -52,7 +55,25 @@ func (s *Server) filterDNSRequest(ctx *dnsContext) (*dnsfilter.Result, error) {
 
 	} else if res.IsFiltered {
 		// log.Tracef("Host %s is filtered, reason - '%s', matched rule: '%s'", host, res.Reason, res.Rule)
-		d.Res = s.genDNSFilterMessage(d, &res)
+		d.Res = s.genDNSFilterMessage(ctx, &res)
+
+	} else if res.Reason == dnsfilter.ReasonRewrite && res.RRs != nil {
+		// TXT, MX, SRV, PTR, SVCB or HTTPS records;  an empty list means an empty answer
+		resp := s.makeResponse(req)
+
+		name := req.Question[0].Name
+		if len(res.CanonName) != 0 {
+			resp.Answer = append(resp.Answer, s.genCNAMEAnswer(req, res.CanonName))
+			name = dns.Fqdn(res.CanonName)
+		}
+
+		for _, rr := range res.RRs {
+			rr.Header().Name = name
+			rr.Header().Ttl = s.conf.BlockedResponseTTL
+			resp.Answer = append(resp.Answer, rr)
+		}
+
+		d.Res = resp
 
 	} else if (res.Reason == dnsfilter.ReasonRewrite || res.Reason == dnsfilter.RewriteEtcHosts) &&
 		len(res.IPList) != 0 {
@@ -111,14 +132,23 @@ func (s *Server) filterDNSResponse(ctx *dnsContext) (*dnsfilter.Result, error) {
 
 		switch v := a.(type) {
 		case *dns.CNAME:
+			if !ctx.setts.FilterResponseCNAME {
+				continue
+			}
 			log.Debug("DNSFwd: Checking CNAME %s for %s", v.Target, v.Hdr.Name)
 			host = strings.TrimSuffix(v.Target, ".")
 
 		case *dns.A:
+			if !ctx.setts.FilterResponseIP {
+				continue
+			}
 			host = v.A.String()
 			log.Debug("DNSFwd: Checking record A (%s) for %s", host, v.Hdr.Name)
 
 		case *dns.AAAA:
+			if !ctx.setts.FilterResponseIP {
+				continue
+			}
 			host = v.AAAA.String()
 			log.Debug("DNSFwd: Checking record AAAA (%s) for %s", host, v.Hdr.Name)
 
@@ -140,8 +170,11 @@ func (s *Server) filterDNSResponse(ctx *dnsContext) (*dnsfilter.Result, error) {
 			return nil, err
 
 		} else if res.IsFiltered {
-			d.Res = s.genDNSFilterMessage(d, &res)
-			log.Debug("DNSFwd: Matched %s by response: %s", d.Req.Question[0].Name, host)
+			res.ResponseRRType = dns.TypeToString[a.Header().Rrtype]
+			res.ResponseName = strings.TrimSuffix(a.Header().Name, ".")
+			res.ResponseHost = host
+			d.Res = s.genDNSFilterMessage(ctx, &res)
+			log.Debug("DNSFwd: Matched %s by response: %s %s", d.Req.Question[0].Name, res.ResponseRRType, host)
 			return &res, nil
 		}
 	}
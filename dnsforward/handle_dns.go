@@ -1,6 +1,7 @@
 package dnsforward
 
 import (
+	"fmt"
 	"strings"
 	"time"
 
@@ -19,12 +20,16 @@ type dnsContext struct {
 	setts                *dnsfilter.RequestFilteringSettings // filtering settings for this client
 	startTime            time.Time
 	result               *dnsfilter.Result
-	origResp             *dns.Msg     // response received from upstream servers.  Set when response is modified by filtering
-	origQuestion         dns.Question // question received from client.  Set when Rewrites are used.
-	err                  error        // error returned from the module
-	protectionEnabled    bool         // filtering is enabled, dnsfilter object is ready
-	responseFromUpstream bool         // response is received from upstream servers
-	origReqDNSSEC        bool         // DNSSEC flag in the original request from user
+	origResp             *dns.Msg       // response received from upstream servers.  Set when response is modified by filtering
+	origQuestion         dns.Question   // question received from client.  Set when Rewrites are used.
+	condFwd              *condForwarder // conditional forwarding settings for this host (optional)
+	err                  error          // error returned from the module
+	protectionEnabled    bool           // filtering is enabled, dnsfilter object is ready
+	responseFromUpstream bool           // response is received from upstream servers
+	origReqDNSSEC        bool           // DNSSEC flag in the original request from user
+	origReqCD            bool           // CD (checking disabled) flag in the original request from user
+	dnssecStatus         string         // DNSSEC validation status of the response (empty if not validated)
+	ede                  bool           // add Extended DNS Errors to blocked and failed responses
 }
 
 const (
@@ -44,7 +49,9 @@ func (s *Server) handleDNSRequest(_ *proxy.Proxy, d *proxy.DNSContext) error {
 		processInitial,
 		processInternalIPAddrs,
 		processFilteringBeforeRequest,
+		processLocalZones,
 		processUpstream,
+		processDNSSECValidation,
 		processDNSSECAfterResponse,
 		processFilteringAfterResponse,
 		processQueryLogsAndStats,
@@ -89,6 +96,12 @@ func processInitial(ctx *dnsContext) int {
 		return resultFinish
 	}
 
+	host := strings.ToLower(strings.TrimSuffix(d.Req.Question[0].Name, "."))
+	s.RLock()
+	ctx.condFwd = s.findConditionalForwarding(host)
+	ctx.ede = s.edeEnabled()
+	s.RUnlock()
+
 	return resultDone
 }
 
@@ -177,10 +190,16 @@ func processFilteringBeforeRequest(ctx *dnsContext) int {
 	//  (to prevent from hanging while waiting for unresponsive DNS server to respond).
 
 	var err error
-	ctx.protectionEnabled = s.conf.ProtectionEnabled && s.dnsFilter != nil
+	now := s.currentTime()
+	ctx.protectionEnabled = s.conf.ProtectionEnabled && !s.protectionPaused(now) && s.dnsFilter != nil &&
+		!(ctx.condFwd != nil && ctx.condFwd.conf.DisableFiltering)
 	if ctx.protectionEnabled {
 		ctx.setts = s.getClientRequestFilteringSettings(d)
-		ctx.result, err = s.filterDNSRequest(ctx)
+		if s.clientProtectionPaused(ipFromAddr(d.Addr), ctx.setts, now) {
+			ctx.protectionEnabled = false
+		} else {
+			ctx.result, err = s.filterDNSRequest(ctx)
+		}
 	}
 	s.RUnlock()
 
@@ -199,7 +218,7 @@ func processUpstream(ctx *dnsContext) int {
 		return resultDone // response is already set - nothing to do
 	}
 
-	if d.Addr != nil && s.conf.GetCustomUpstreamByClient != nil {
+	if ctx.condFwd == nil && d.Addr != nil && s.conf.GetCustomUpstreamByClient != nil {
 		clientIP := ipFromAddr(d.Addr)
 		upstreamsConf := s.conf.GetCustomUpstreamByClient(clientIP)
 		if upstreamsConf != nil {
@@ -208,7 +227,7 @@ func processUpstream(ctx *dnsContext) int {
 		}
 	}
 
-	if s.conf.EnableDNSSEC {
+	if ctx.dnssecEnabled() {
 		opt := d.Req.IsEdns0()
 		if opt == nil {
 			log.Debug("DNS: Adding OPT record with DNSSEC flag")
@@ -220,23 +239,144 @@ func processUpstream(ctx *dnsContext) int {
 		}
 	}
 
+	if ctx.dnssecValidation() {
+		// we validate the responses ourselves, so we need them even if upstream server considers them bogus
+		ctx.origReqCD = d.Req.CheckingDisabled
+		d.Req.CheckingDisabled = true
+	}
+
 	// request was not filtered so let it be processed further
-	err := s.dnsProxy.Resolve(d)
+	p := s.dnsProxy
+	if ctx.condFwd != nil {
+		log.Debug("DNS: using conditional forwarding for %s", d.Req.Question[0].Name)
+		p = ctx.condFwd.proxy
+	}
+
+	c := ctx.cache()
+	if c != nil {
+		resp, refresh := c.get(d.Req)
+		if resp != nil {
+			if refresh {
+				go c.refresh(p, d.Req.Copy())
+			}
+			d.Res = resp
+			ctx.responseFromUpstream = true
+			return resultDone
+		}
+	}
+
+	err := p.Resolve(d)
 	if err != nil {
+		if d.Res != nil && d.Res.Rcode == dns.RcodeServerFailure && ctx.ede {
+			addEDE(d.Req, d.Res, edeNetworkError, err.Error())
+		}
 		ctx.err = err
 		return resultError
 	}
 
+	if c != nil {
+		c.set(cacheKey(d.Req), d.Res)
+	}
+
 	ctx.responseFromUpstream = true
 	return resultDone
 }
 
+// Get DNS cache for the request
+// Returns nil if the response mustn't be cached by us:
+// the cache is disabled, dnsproxy's cache is used (with EDNS Client Subnet), custom upstreams are used
+// or the request is invalid.
+func (ctx *dnsContext) cache() *dnsCache {
+	s := ctx.srv
+	if ctx.proxyCtx.CustomUpstreamConfig != nil || len(ctx.proxyCtx.Req.Question) != 1 {
+		return nil
+	}
+	if ctx.condFwd != nil {
+		if ctx.condFwd.conf.DisableCache || ctx.condFwd.conf.EnableEDNSClientSubnet {
+			return nil
+		}
+	} else if s.conf.EnableEDNSClientSubnet {
+		return nil
+	}
+	return s.cache
+}
+
+// Return TRUE if DNSSEC flag must be set in the request to upstream servers
+func (ctx *dnsContext) dnssecEnabled() bool {
+	if ctx.condFwd != nil {
+		return ctx.condFwd.conf.EnableDNSSEC
+	}
+	return ctx.srv.conf.EnableDNSSEC || ctx.dnssecValidation()
+}
+
+// Return TRUE if the response from upstream servers must be validated by us
+// The responses for conditionally forwarded domains aren't validated:
+//  these are usually private zones that can't be validated from the root.
+func (ctx *dnsContext) dnssecValidation() bool {
+	return ctx.condFwd == nil && ctx.srv.validator != nil
+}
+
+// Validate the response from upstream servers with DNSSEC
+// Bogus responses are replaced with SERVFAIL with Extended DNS Error, unless the client has set CD flag.
+func processDNSSECValidation(ctx *dnsContext) int {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if !ctx.responseFromUpstream || !ctx.dnssecValidation() || d.Res == nil {
+		return resultDone
+	}
+	d.Res.CheckingDisabled = ctx.origReqCD
+
+	var status string
+	var err error
+	if d.Upstream != nil && d.Upstream.Address() == RecursiveUpstream && s.recursor.validating() {
+		// the recursive resolver has validated the response already
+		status = dnssecInsecure
+		if d.Res.AuthenticatedData {
+			status = dnssecSecure
+		} else if getEDE(d.Res) == edeDNSSECBogus {
+			status = dnssecBogus
+		}
+	} else {
+		status, err = s.validator.validate(d.Res)
+	}
+	ctx.dnssecStatus = status
+
+	switch status {
+	case dnssecSecure:
+		d.Res.AuthenticatedData = ctx.origReqDNSSEC || d.Req.AuthenticatedData
+
+	case dnssecBogus, dnssecIndeterminate:
+		log.Debug("DNS: DNSSEC validation: %s: %s: %v", d.Req.Question[0].Name, status, err)
+		if ctx.origReqCD {
+			// the client will validate the response itself
+			d.Res.AuthenticatedData = false
+			break
+		}
+		if getEDE(d.Res) != -1 {
+			break // SERVFAIL from the recursive resolver
+		}
+		code := uint16(edeDNSSECBogus)
+		if status == dnssecIndeterminate {
+			code = edeDNSSECIndeterminate
+		}
+		resp := s.genServerFailure(d.Req)
+		addEDE(d.Req, resp, code, fmt.Sprintf("%s", err))
+		ctx.origResp = d.Res
+		d.Res = resp
+
+	default:
+		d.Res.AuthenticatedData = false
+	}
+
+	return resultDone
+}
+
 // Process DNSSEC after response from upstream server
 func processDNSSECAfterResponse(ctx *dnsContext) int {
 	d := ctx.proxyCtx
 
 	if !ctx.responseFromUpstream || // don't process response if it's not from upstream servers
-		!ctx.srv.conf.EnableDNSSEC {
+		!ctx.dnssecEnabled() {
 		return resultDone
 	}
 
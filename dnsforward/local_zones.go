@@ -0,0 +1,370 @@
+package dnsforward
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/fsnotify/fsnotify"
+	"github.com/miekg/dns"
+)
+
+// maximum number of CNAME records we follow inside a local zone
+const maxLocalZoneCNAMEs = 8
+
+// Authoritative data for one zone loaded from an RFC 1035 zone file
+type localZone struct {
+	origin  string              // lower-case FQDN
+	soa     *dns.SOA            // zone's SOA record
+	records map[string][]dns.RR // lower-case FQDN -> records
+	names   map[string]bool     // all existing names, including empty non-terminals
+}
+
+// Local zones served authoritatively
+type localZones struct {
+	lock  sync.RWMutex
+	zones []*localZone // sorted by origin, the most specific first
+
+	files      []string          // zone file names
+	watcher    *fsnotify.Watcher // zone files watcher
+	updateChan chan bool         // signal for 'updateLoop' goroutine
+	done       chan bool         // closed when the object is closed
+}
+
+// Create object, load zone files and start watching them for changes
+func newLocalZones(files []string) *localZones {
+	z := &localZones{}
+	for _, fn := range files {
+		abs, err := filepath.Abs(fn)
+		if err != nil {
+			log.Error("DNS: local zones: %s", err)
+			continue
+		}
+		z.files = append(z.files, abs)
+	}
+	z.update()
+
+	if len(z.files) == 0 {
+		return z
+	}
+
+	var err error
+	z.watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		log.Error("DNS: local zones: %s", err)
+		return z
+	}
+
+	// Watch the directories so we can notice the files that are replaced by rename
+	dirs := map[string]bool{}
+	for _, fn := range z.files {
+		dirs[filepath.Dir(fn)] = true
+	}
+	for dir := range dirs {
+		err = z.watcher.Add(dir)
+		if err != nil {
+			log.Error("DNS: local zones: error while initializing watcher for a directory %s: %s", dir, err)
+		}
+	}
+
+	z.updateChan = make(chan bool, 2)
+	z.done = make(chan bool)
+	go z.updateLoop()
+	go z.watcherLoop()
+	return z
+}
+
+// Close - stop watching zone files
+func (z *localZones) Close() {
+	if z.watcher == nil {
+		return
+	}
+	_ = z.watcher.Close()
+	close(z.done)
+}
+
+// Receive notifications from fsnotify package
+func (z *localZones) watcherLoop() {
+	for {
+		select {
+		case event, ok := <-z.watcher.Events:
+			if !ok {
+				return
+			}
+
+			if !z.isZoneFile(event.Name) ||
+				event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) == 0 {
+				continue
+			}
+
+			log.Debug("DNS: local zones: modified: %s", event.Name)
+			select {
+			case z.updateChan <- true:
+				// sent a signal to 'updateLoop' goroutine
+			default:
+				// queue is full
+			}
+
+		case err, ok := <-z.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Error("DNS: local zones: %s", err)
+		}
+	}
+}
+
+func (z *localZones) isZoneFile(fn string) bool {
+	for _, f := range z.files {
+		if f == fn {
+			return true
+		}
+	}
+	return false
+}
+
+// updateLoop - reload zone files
+func (z *localZones) updateLoop() {
+	for {
+		select {
+		case <-z.updateChan:
+			z.update()
+		case <-z.done:
+			log.Debug("DNS: local zones: finished update loop")
+			return
+		}
+	}
+}
+
+// Load all zone files
+// A zone file that can't be loaded is skipped.
+func (z *localZones) update() {
+	zones := []*localZone{}
+	for _, fn := range z.files {
+		lz, err := loadLocalZone(fn)
+		if err != nil {
+			log.Error("DNS: local zones: %s", err)
+			continue
+		}
+		log.Debug("DNS: local zones: loaded zone %s from %s: %d names",
+			lz.origin, fn, len(lz.records))
+		zones = append(zones, lz)
+	}
+
+	// longer (more specific) origins go first
+	sort.SliceStable(zones, func(i, j int) bool {
+		return len(zones[i].origin) > len(zones[j].origin)
+	})
+
+	z.lock.Lock()
+	z.zones = zones
+	z.lock.Unlock()
+}
+
+// Parse a zone file
+// The zone origin is taken from the SOA record, which is required.
+func loadLocalZone(fn string) (*localZone, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lz := &localZone{
+		records: map[string][]dns.RR{},
+		names:   map[string]bool{},
+	}
+
+	zp := dns.NewZoneParser(f, "", fn)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if lz.soa != nil {
+				return nil, fmt.Errorf("%s: more than one SOA record", fn)
+			}
+			lz.soa = soa
+			lz.origin = strings.ToLower(soa.Hdr.Name)
+		}
+		name := strings.ToLower(rr.Header().Name)
+		lz.records[name] = append(lz.records[name], rr)
+	}
+	if err = zp.Err(); err != nil {
+		return nil, err
+	}
+	if lz.soa == nil {
+		return nil, fmt.Errorf("%s: no SOA record", fn)
+	}
+
+	for name := range lz.records {
+		if !dns.IsSubDomain(lz.origin, name) {
+			return nil, fmt.Errorf("%s: %s is out of zone %s", fn, name, lz.origin)
+		}
+
+		// mark all the names between the record and the origin as existing (empty non-terminals)
+		for n := name; len(n) >= len(lz.origin); {
+			lz.names[n] = true
+			i, end := dns.NextLabel(n, 0)
+			if end {
+				break
+			}
+			n = n[i:]
+		}
+	}
+
+	return lz, nil
+}
+
+// Find the zone that is authoritative for the name
+func (z *localZones) findZone(name string) *localZone {
+	for _, lz := range z.zones {
+		if dns.IsSubDomain(lz.origin, name) {
+			return lz
+		}
+	}
+	return nil
+}
+
+// Get records of the specified type, or the wildcard records matching the name
+func (lz *localZone) lookup(name string, qtype uint16) (rrs []dns.RR, cname *dns.CNAME, exists bool) {
+	all, exists := lz.records[name]
+	owner := name
+	if !exists && !lz.names[name] {
+		// try wildcard at the closest encloser (RFC 4592 section 4.1)
+		owner = "*." + lz.closestEncloser(name)
+		all, exists = lz.records[owner]
+	} else {
+		exists = true
+	}
+
+	for _, rr := range all {
+		switch {
+		case rr.Header().Rrtype == qtype || qtype == dns.TypeANY:
+			rrs = append(rrs, lz.copyRR(rr, owner, name))
+		case rr.Header().Rrtype == dns.TypeCNAME:
+			cname = lz.copyRR(rr, owner, name).(*dns.CNAME)
+		}
+	}
+	return rrs, cname, exists
+}
+
+// Get the closest encloser: the longest existing ancestor of the name (RFC 4592 section 3.3.1)
+// The zone origin always exists, so the search stops there.
+func (lz *localZone) closestEncloser(name string) string {
+	for name != lz.origin {
+		i, end := dns.NextLabel(name, 0)
+		if end {
+			break
+		}
+		name = name[i:]
+		if lz.names[name] {
+			return name
+		}
+	}
+	return lz.origin
+}
+
+// Copy the record, synthesize the owner name for wildcards
+func (lz *localZone) copyRR(rr dns.RR, owner, name string) dns.RR {
+	rr = dns.Copy(rr)
+	if owner != name {
+		rr.Header().Name = name
+	}
+	return rr
+}
+
+// Get the additional records for MX, SRV and NS targets from the zone
+func (lz *localZone) additional(answer []dns.RR) []dns.RR {
+	var extra []dns.RR
+	for _, rr := range answer {
+		target := ""
+		switch v := rr.(type) {
+		case *dns.MX:
+			target = v.Mx
+		case *dns.SRV:
+			target = v.Target
+		case *dns.NS:
+			target = v.Ns
+		default:
+			continue
+		}
+
+		for _, t := range lz.records[strings.ToLower(target)] {
+			if t.Header().Rrtype == dns.TypeA || t.Header().Rrtype == dns.TypeAAAA {
+				extra = append(extra, dns.Copy(t))
+			}
+		}
+	}
+	return extra
+}
+
+// Respond to the request if its name belongs to a local zone
+// Returns nil if no zone is authoritative for this name.
+func (z *localZones) respond(s *Server, req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+
+	z.lock.RLock()
+	defer z.lock.RUnlock()
+
+	lz := z.findZone(name)
+	if lz == nil {
+		return nil
+	}
+
+	resp := s.makeResponse(req)
+	resp.Authoritative = true
+
+	for i := 0; ; i++ {
+		rrs, cname, exists := lz.lookup(name, q.Qtype)
+		if !exists {
+			resp.Rcode = dns.RcodeNameError
+			break
+		}
+
+		if len(rrs) != 0 || cname == nil || q.Qtype == dns.TypeCNAME {
+			resp.Answer = append(resp.Answer, rrs...)
+			break
+		}
+
+		// follow CNAME inside the zone
+		resp.Answer = append(resp.Answer, cname)
+		name = strings.ToLower(cname.Target)
+		if i == maxLocalZoneCNAMEs || !dns.IsSubDomain(lz.origin, name) {
+			return resp
+		}
+	}
+
+	if len(resp.Answer) == 0 || resp.Rcode == dns.RcodeNameError {
+		// NODATA or NXDOMAIN
+		resp.Ns = append(resp.Ns, dns.Copy(lz.soa))
+	} else {
+		resp.Extra = append(resp.Extra, lz.additional(resp.Answer)...)
+	}
+	return resp
+}
+
+// Respond to requests for names inside local zones
+func processLocalZones(ctx *dnsContext) int {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if d.Res != nil {
+		return resultDone // response is already set - nothing to do
+	}
+
+	s.RLock()
+	z := s.localZones
+	s.RUnlock()
+	if z == nil {
+		return resultDone
+	}
+
+	resp := z.respond(s, d.Req)
+	if resp != nil {
+		log.Debug("DNS: local zones: answered %s", d.Req.Question[0].Name)
+		d.Res = resp
+	}
+	return resultDone
+}
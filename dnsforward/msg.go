@@ -1,6 +1,8 @@
 package dnsforward
 
 import (
+	"encoding/binary"
+	"fmt"
 	"log"
 	"net"
 	"time"
@@ -20,7 +22,55 @@ func (s *Server) makeResponse(req *dns.Msg) *dns.Msg {
 }
 
 // genDNSFilterMessage generates a DNS message corresponding to the filtering result
-func (s *Server) genDNSFilterMessage(d *proxy.DNSContext, result *dnsfilter.Result) *dns.Msg {
+// Extended DNS Error with the reason is added if it's enabled for the current blocking mode.
+func (s *Server) genDNSFilterMessage(ctx *dnsContext, result *dnsfilter.Result) *dns.Msg {
+	d := ctx.proxyCtx
+	resp := s.genBlockedResponse(d, result)
+	if ctx.ede {
+		addFilteringEDE(d.Req, resp, result)
+	}
+	return resp
+}
+
+// Return TRUE if Extended DNS Errors must be added to blocked and failed responses
+// Must be called under s.RLock(): the settings may be changed by Reconfigure().
+func (s *Server) edeEnabled() bool {
+	mode := s.conf.BlockingMode
+	if len(mode) == 0 {
+		mode = "default"
+	}
+	for _, m := range s.conf.EDEBlockingModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// Add Extended DNS Error with the filtering reason to the response
+func addFilteringEDE(req, resp *dns.Msg, result *dnsfilter.Result) {
+	switch result.Reason {
+	case dnsfilter.FilteredSafeSearch:
+		// not an error: the response contains the safe search host address
+
+	case dnsfilter.FilteredBlockedService:
+		addEDE(req, resp, edeCensored, fmt.Sprintf("reason: %s, service: %s",
+			result.Reason, result.ServiceName))
+
+	case dnsfilter.FilteredSafeBrowsing, dnsfilter.FilteredParental:
+		addEDE(req, resp, edeFiltered, fmt.Sprintf("reason: %s", result.Reason))
+
+	case dnsfilter.FilteredBlockAll:
+		addEDE(req, resp, edeBlocked, fmt.Sprintf("reason: %s", result.Reason))
+
+	default:
+		addEDE(req, resp, edeBlocked, fmt.Sprintf("reason: %s, filter_id: %d",
+			result.Reason, result.FilterID))
+	}
+}
+
+// Generate the response for the blocked request according to the blocking mode
+func (s *Server) genBlockedResponse(d *proxy.DNSContext, result *dnsfilter.Result) *dns.Msg {
 	m := d.Req
 
 	if m.Question[0].Qtype != dns.TypeA && m.Question[0].Qtype != dns.TypeAAAA {
@@ -83,6 +133,53 @@ func (s *Server) genServerFailure(request *dns.Msg) *dns.Msg {
 	return &resp
 }
 
+// Extended DNS Error codes (RFC 8914)
+const (
+	edeDNSSECIndeterminate = 5
+	edeDNSSECBogus         = 6
+	edeBlocked             = 15
+	edeCensored            = 16
+	edeFiltered            = 17
+	edeNetworkError        = 23
+)
+
+// EDNS option code for Extended DNS Error
+const edeOptionCode = 15
+
+// Add Extended DNS Error option to the response
+// Nothing is added if the client didn't use EDNS.
+func addEDE(req, resp *dns.Msg, code uint16, text string) {
+	reqOpt := req.IsEdns0()
+	if reqOpt == nil {
+		return
+	}
+	opt := resp.IsEdns0()
+	if opt == nil {
+		resp.SetEdns0(4096, reqOpt.Do())
+		opt = resp.IsEdns0()
+	}
+	data := make([]byte, 2+len(text))
+	binary.BigEndian.PutUint16(data, code)
+	copy(data[2:], text)
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: edeOptionCode, Data: data})
+}
+
+// Get Extended DNS Error code from the response
+// Returns -1 if there's no such option.
+func getEDE(resp *dns.Msg) int {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return -1
+	}
+	for _, o := range opt.Option {
+		l, ok := o.(*dns.EDNS0_LOCAL)
+		if ok && l.Code == edeOptionCode && len(l.Data) >= 2 {
+			return int(binary.BigEndian.Uint16(l.Data))
+		}
+	}
+	return -1
+}
+
 func (s *Server) genARecord(request *dns.Msg, ip net.IP) *dns.Msg {
 	resp := s.makeResponse(request)
 	resp.Answer = append(resp.Answer, s.genAAnswer(request, ip))
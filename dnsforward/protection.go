@@ -0,0 +1,119 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+)
+
+// Temporary protection pause: the protection is disabled globally or for a client until the specified time.
+// The pause time is stored in configuration, so the protection is resumed at the right time after restart.
+
+// ProtectionPause - the protection is paused for the client until the specified time
+type ProtectionPause struct {
+	Client string    `yaml:"client"` // persistent client name or IP address
+	Until  time.Time `yaml:"until"`
+}
+
+// Get the current time
+func (s *Server) currentTime() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// Return TRUE if the protection is paused globally
+// Note: must be called under lock
+func (s *Server) protectionPaused(now time.Time) bool {
+	return s.conf.ProtectionDisabledUntil != nil && now.Before(*s.conf.ProtectionDisabledUntil)
+}
+
+// Return TRUE if the protection is paused for the client
+// Note: must be called under lock
+func (s *Server) clientProtectionPaused(clientIP string, setts *dnsfilter.RequestFilteringSettings, now time.Time) bool {
+	for _, p := range s.conf.ProtectionPausedClients {
+		if !now.Before(p.Until) {
+			continue
+		}
+		if p.Client == clientIP ||
+			(len(setts.ClientName) != 0 && p.Client == setts.ClientName) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the pauses which haven't yet elapsed
+func activeProtectionPauses(a []ProtectionPause, now time.Time) []ProtectionPause {
+	var a2 []ProtectionPause
+	for _, p := range a {
+		if now.Before(p.Until) {
+			a2 = append(a2, p)
+		}
+	}
+	return a2
+}
+
+// The maximum duration of a protection pause
+const maxProtectionPause = 365 * 24 * time.Hour
+
+type protectionJSON struct {
+	Enabled  bool   `json:"enabled"`
+	Duration uint64 `json:"duration"` // pause duration (in milliseconds)
+	Client   string `json:"client"`   // persistent client name or IP address;  empty: global setting
+}
+
+// Enable the protection or disable it (permanently or for some time)
+func (s *Server) handleProtection(w http.ResponseWriter, r *http.Request) {
+	req := protectionJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	if len(req.Client) != 0 && !req.Enabled && req.Duration == 0 {
+		httpError(r, w, http.StatusBadRequest, "duration is required to pause the protection for a client")
+		return
+	}
+	if req.Duration > uint64(maxProtectionPause/time.Millisecond) {
+		httpError(r, w, http.StatusBadRequest, "duration must not exceed %d milliseconds",
+			maxProtectionPause/time.Millisecond)
+		return
+	}
+
+	s.Lock()
+	now := s.currentTime()
+	until := now.Add(time.Duration(req.Duration) * time.Millisecond)
+
+	if len(req.Client) == 0 {
+		s.conf.ProtectionDisabledUntil = nil
+		if req.Enabled {
+			s.conf.ProtectionEnabled = true
+		} else if req.Duration == 0 {
+			s.conf.ProtectionEnabled = false
+		} else {
+			// the protection is resumed when the pause elapses
+			s.conf.ProtectionEnabled = true
+			s.conf.ProtectionDisabledUntil = &until
+		}
+
+	} else {
+		pauses := []ProtectionPause{}
+		for _, p := range activeProtectionPauses(s.conf.ProtectionPausedClients, now) {
+			if p.Client != req.Client {
+				pauses = append(pauses, p)
+			}
+		}
+		if !req.Enabled {
+			pauses = append(pauses, ProtectionPause{Client: req.Client, Until: until})
+		}
+		s.conf.ProtectionPausedClients = pauses
+	}
+	s.Unlock()
+
+	s.conf.ConfigModified()
+}
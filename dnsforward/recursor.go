@@ -0,0 +1,786 @@
+package dnsforward
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Recursive resolver: resolves names iteratively starting from the root servers.
+// It's used as an upstream server with the special address "recursive".
+
+// RecursiveUpstream is the special upstream address that means "resolve the names ourselves"
+const RecursiveUpstream = "recursive"
+
+const (
+	recursorTimeout      = 3 * time.Second // timeout for a request to an authoritative server
+	recursorMaxReferrals = 30              // max number of referrals while resolving a name
+	recursorMaxCNAMEs    = 8               // max length of CNAME chain
+	recursorMaxDepth     = 4               // max nesting level when resolving NS names without glue
+	recursorNegativeTTL  = 60              // TTL for negative answers without SOA (in seconds)
+	recursorMaxTTL       = 86400           // max TTL of cached records (in seconds)
+)
+
+// IP addresses of the root servers (a-m.root-servers.net)
+var defaultRootHints = []string{
+	"198.41.0.4",
+	"170.247.170.2",
+	"192.33.4.12",
+	"199.7.91.13",
+	"192.203.230.10",
+	"192.5.5.241",
+	"192.112.36.4",
+	"198.97.190.53",
+	"192.36.148.17",
+	"192.58.128.30",
+	"193.0.14.129",
+	"199.7.83.42",
+	"202.12.27.33",
+}
+
+type recursorConfig struct {
+	qnameMinimization bool      // send only the necessary part of the name to the servers (RFC 7816)
+	dnssec            bool      // validate the responses
+	cacheSize         int       // max number of cached entries
+	rootHints         []string  // IP addresses of the root servers
+	trustAnchors      []*dns.DS // DS records of the root zone
+}
+
+// Delegation point
+type zoneCut struct {
+	zone    string        // zone name (FQDN, lower-case)
+	servers []string      // addresses of the authoritative servers ("IP:port")
+	secure  bool          // the zone is signed and there's a chain of trust to it
+	ds      []*dns.DS     // DS records from the parent zone
+	keys    []*dns.DNSKEY // validated zone keys (loaded on demand)
+	expire  time.Time
+}
+
+// The result of name resolution
+type recursorResult struct {
+	rcode  int
+	answer []dns.RR
+	ns     []dns.RR
+	secure bool  // the data is validated
+	bogus  error // non-nil if the data failed validation
+	expire time.Time
+}
+
+type recursor struct {
+	lock    sync.Mutex
+	conf    recursorConfig
+	answers map[string]*recursorResult // "name/type" -> result
+	cuts    map[string]*zoneCut        // zone -> delegation point
+
+	// Send request to the server and receive a response
+	// It's replaced in tests.
+	exchange func(req *dns.Msg, addr string) (*dns.Msg, error)
+
+	now func() time.Time
+}
+
+func newRecursor(conf recursorConfig) *recursor {
+	r := &recursor{
+		exchange: exchangeWithServer,
+		now:      time.Now,
+	}
+	r.setConfig(conf)
+	return r
+}
+
+// Apply new configuration
+// The cache is cleared.
+func (r *recursor) setConfig(conf recursorConfig) {
+	if len(conf.rootHints) == 0 {
+		conf.rootHints = defaultRootHints
+	}
+	if len(conf.trustAnchors) == 0 {
+		conf.trustAnchors, _ = parseTrustAnchors(rootTrustAnchors)
+	}
+	if conf.cacheSize == 0 {
+		conf.cacheSize = 10000
+	}
+
+	r.lock.Lock()
+	r.conf = conf
+	r.answers = map[string]*recursorResult{}
+	r.cuts = map[string]*zoneCut{}
+	r.lock.Unlock()
+}
+
+// Send request over UDP and retry over TCP if the response is truncated
+func exchangeWithServer(req *dns.Msg, addr string) (*dns.Msg, error) {
+	c := dns.Client{Net: "udp", Timeout: recursorTimeout}
+	resp, _, err := c.Exchange(req, addr)
+	if err == nil && resp.Truncated {
+		c.Net = "tcp"
+		resp, _, err = c.Exchange(req, addr)
+	}
+	return resp, err
+}
+
+// Exchange resolves the request and builds a response
+func (r *recursor) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	if len(req.Question) != 1 {
+		return nil, errors.New("recursor: the request must contain 1 question")
+	}
+	q := req.Question[0]
+	res, err := r.resolve(dns.CanonicalName(q.Name), q.Qtype, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	do := false
+	opt := req.IsEdns0()
+	if opt != nil {
+		do = opt.Do()
+	}
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	if res.bogus != nil {
+		log.Debug("recursor: %s", res.bogus)
+		resp.Rcode = dns.RcodeServerFailure
+	} else {
+		resp.Rcode = res.rcode
+		resp.Answer = copyRRs(res.answer)
+		resp.Ns = copyRRs(res.ns)
+		// the result may be taken from cache, so the TTL is the time left until it expires
+		ttl := uint32(0)
+		if left := res.expire.Sub(r.now()); left > 0 {
+			ttl = uint32(left / time.Second)
+		}
+		setTTL(resp.Answer, ttl)
+		setTTL(resp.Ns, ttl)
+		resp.AuthenticatedData = res.secure && (do || req.AuthenticatedData)
+		for _, rr := range resp.Answer {
+			// restore the letter case of the name the client asked for
+			if strings.EqualFold(rr.Header().Name, q.Name) {
+				rr.Header().Name = q.Name
+			}
+		}
+	}
+	if !do {
+		stripDNSSECRecords(resp)
+	}
+	if opt != nil {
+		resp.SetEdns0(4096, do)
+	}
+	if res.bogus != nil {
+		addEDE(req, resp, edeDNSSECBogus, res.bogus.Error())
+	}
+	return resp, nil
+}
+
+// Return TRUE if the resolver validates the responses
+func (r *recursor) validating() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.conf.dnssec
+}
+
+func setTTL(rrs []dns.RR, ttl uint32) {
+	for _, rr := range rrs {
+		rr.Header().Ttl = ttl
+	}
+}
+
+func copyRRs(rrs []dns.RR) []dns.RR {
+	var res []dns.RR
+	for _, rr := range rrs {
+		res = append(res, dns.Copy(rr))
+	}
+	return res
+}
+
+// Resolve the name recursively
+// depth: nesting level (resolution of NS names and CNAME targets)
+func (r *recursor) resolve(qname string, qtype uint16, depth int) (*recursorResult, error) {
+	if depth > recursorMaxCNAMEs+recursorMaxDepth {
+		return nil, fmt.Errorf("recursor: %s: max depth exceeded", qname)
+	}
+
+	key := fmt.Sprintf("%s/%d", qname, qtype)
+	r.lock.Lock()
+	res, ok := r.answers[key]
+	if ok && r.now().After(res.expire) {
+		delete(r.answers, key)
+		ok = false
+	}
+	r.lock.Unlock()
+	if ok {
+		return res, nil
+	}
+
+	res, err := r.iterate(qname, qtype, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	// CNAME chain
+	if len(res.answer) != 0 && res.bogus == nil && qtype != dns.TypeCNAME {
+		cname, ok := res.answer[0].(*dns.CNAME)
+		if ok {
+			target := dns.CanonicalName(cname.Target)
+			if depth >= recursorMaxCNAMEs {
+				return nil, fmt.Errorf("recursor: %s: CNAME chain is too long", qname)
+			}
+			next, err := r.resolve(target, qtype, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			chain := &recursorResult{
+				rcode:  next.rcode,
+				answer: append(res.answer, next.answer...),
+				ns:     next.ns,
+				secure: res.secure && next.secure,
+				bogus:  next.bogus,
+				expire: res.expire,
+			}
+			if next.expire.Before(chain.expire) {
+				chain.expire = next.expire
+			}
+			res = chain
+		}
+	}
+
+	if res.bogus == nil {
+		r.lock.Lock()
+		if len(r.answers) >= r.conf.cacheSize {
+			for k := range r.answers {
+				delete(r.answers, k)
+				break
+			}
+		}
+		r.answers[key] = res
+		r.lock.Unlock()
+	}
+	return res, nil
+}
+
+// Find the closest known delegation point for the name
+func (r *recursor) findCut(name string) *zoneCut {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.now()
+	for {
+		c, ok := r.cuts[name]
+		if ok && now.Before(c.expire) {
+			return c
+		}
+		if name == "." {
+			break
+		}
+		i, _ := dns.NextLabel(name, 0)
+		name = name[i:]
+		if len(name) == 0 {
+			name = "."
+		}
+	}
+
+	root := &zoneCut{
+		zone:   ".",
+		secure: r.conf.dnssec,
+		ds:     r.conf.trustAnchors,
+		expire: now.Add(recursorMaxTTL * time.Second),
+	}
+	for _, ip := range r.conf.rootHints {
+		root.servers = append(root.servers, serverAddr(ip))
+	}
+	r.cuts["."] = root
+	return root
+}
+
+func serverAddr(ip string) string {
+	_, _, err := net.SplitHostPort(ip)
+	if err == nil {
+		return ip
+	}
+	return net.JoinHostPort(ip, "53")
+}
+
+// Get the name that should be sent to the servers of the zone
+func (r *recursor) minimizedName(zone, qname string, labels int) string {
+	if !r.conf.qnameMinimization {
+		return qname
+	}
+	n := dns.CountLabel(zone) + labels
+	l := dns.SplitDomainName(qname)
+	if n >= len(l) {
+		return qname
+	}
+	return dns.Fqdn(strings.Join(l[len(l)-n:], "."))
+}
+
+// Resolve the name iteratively, following referrals from the closest known delegation point
+func (r *recursor) iterate(qname string, qtype uint16, depth int) (*recursorResult, error) {
+	cut := r.findCut(qname)
+	if qtype == dns.TypeDS && cut.zone == qname && qname != "." {
+		// DS records are served by the parent zone
+		i, _ := dns.NextLabel(qname, 0)
+		cut = r.findCut(qname[i:])
+	}
+	minLabels := 1
+	minimize := r.conf.qnameMinimization
+	referrals := 0
+
+	for {
+		name := qname
+		t := qtype
+		if minimize {
+			name = r.minimizedName(cut.zone, qname, minLabels)
+			if name != qname {
+				t = dns.TypeA
+			}
+		}
+		resp, err := r.query(cut, name, t)
+		if err != nil {
+			if name != qname {
+				// the servers don't handle minimized names properly
+				minimize = false
+				continue
+			}
+			return nil, err
+		}
+
+		child := referral(resp, cut.zone, name)
+		if child != "" && !(qtype == dns.TypeDS && child == qname) {
+			referrals++
+			if referrals > recursorMaxReferrals {
+				return nil, fmt.Errorf("recursor: %s: too many referrals", qname)
+			}
+			newCut, res, err := r.delegate(cut, child, resp, depth)
+			if err != nil {
+				return nil, err
+			}
+			if res != nil {
+				return res, nil
+			}
+			cut = newCut
+			minLabels = 1
+			continue
+		}
+
+		if name != qname {
+			if resp.Rcode == dns.RcodeNameError {
+				// there's nothing below this name (RFC 8020),
+				//  but ask for the full name so that we get a proper denial of existence
+				minimize = false
+			}
+			minLabels++
+			continue
+		}
+
+		return r.answer(cut, qname, qtype, resp)
+	}
+}
+
+// Send the request to one of the zone servers
+func (r *recursor) query(cut *zoneCut, name string, qtype uint16) (*dns.Msg, error) {
+	req := &dns.Msg{}
+	req.SetQuestion(name, qtype)
+	req.RecursionDesired = false
+	req.SetEdns0(4096, r.conf.dnssec)
+
+	var lastErr error
+	for _, i := range rand.Perm(len(cut.servers)) {
+		addr := cut.servers[i]
+		resp, err := r.exchange(req, addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.Id != req.Id || len(resp.Question) != 1 ||
+			!strings.EqualFold(resp.Question[0].Name, name) {
+			lastErr = fmt.Errorf("%s: invalid response", addr)
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("%s: %s", addr, dns.RcodeToString[resp.Rcode])
+			continue
+		}
+		return resp, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no servers")
+	}
+	return nil, fmt.Errorf("recursor: %s/%s at %s: %w", name, dns.Type(qtype), cut.zone, lastErr)
+}
+
+// If the response is a referral to a child zone, return the child zone name
+func referral(resp *dns.Msg, zone, name string) string {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		return ""
+	}
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		child := dns.CanonicalName(ns.Hdr.Name)
+		if child != zone && dns.IsSubDomain(zone, child) && dns.IsSubDomain(child, name) {
+			return child
+		}
+	}
+	return ""
+}
+
+// Process the referral to the child zone
+// Returns a non-nil result if the delegation is bogus.
+func (r *recursor) delegate(cut *zoneCut, child string, resp *dns.Msg, depth int) (*zoneCut, *recursorResult, error) {
+	newCut := &zoneCut{
+		zone:   child,
+		expire: r.now().Add(recursorMaxTTL * time.Second),
+	}
+
+	var nsNames []string
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok || dns.CanonicalName(ns.Hdr.Name) != child {
+			continue
+		}
+		nsNames = append(nsNames, dns.CanonicalName(ns.Ns))
+		newCut.expire = minExpire(newCut.expire, r.now(), ns.Hdr.Ttl)
+	}
+
+	// use only the glue records from the zone we've asked
+	for _, rr := range resp.Extra {
+		name := dns.CanonicalName(rr.Header().Name)
+		if !dns.IsSubDomain(cut.zone, name) || !stringInSlice(name, nsNames) {
+			continue
+		}
+		switch v := rr.(type) {
+		case *dns.A:
+			newCut.servers = append(newCut.servers, serverAddr(v.A.String()))
+		case *dns.AAAA:
+			newCut.servers = append(newCut.servers, serverAddr(v.AAAA.String()))
+		}
+	}
+
+	if len(newCut.servers) == 0 {
+		for _, ns := range nsNames {
+			if dns.IsSubDomain(child, ns) {
+				continue // can't resolve without glue
+			}
+			if depth >= recursorMaxDepth {
+				break
+			}
+			res, err := r.resolve(ns, dns.TypeA, depth+1)
+			if err != nil || res.bogus != nil {
+				continue
+			}
+			for _, rr := range res.answer {
+				a, ok := rr.(*dns.A)
+				if ok {
+					newCut.servers = append(newCut.servers, serverAddr(a.A.String()))
+				}
+			}
+			if len(newCut.servers) != 0 {
+				break
+			}
+		}
+		if len(newCut.servers) == 0 {
+			return nil, nil, fmt.Errorf("recursor: %s: can't find addresses of the name servers", child)
+		}
+	}
+
+	if cut.secure {
+		keys, err := r.loadKeys(cut)
+		if err == nil {
+			err = r.verifyDelegation(keys, newCut, resp)
+		}
+		if err != nil {
+			return nil, &recursorResult{bogus: err}, nil
+		}
+	}
+
+	log.Debug("recursor: %s -> %s (secure:%t)", cut.zone, child, newCut.secure)
+
+	r.lock.Lock()
+	if len(r.cuts) >= r.conf.cacheSize {
+		for k := range r.cuts {
+			delete(r.cuts, k)
+			break
+		}
+	}
+	r.cuts[child] = newCut
+	r.lock.Unlock()
+	return newCut, nil, nil
+}
+
+// Get DS records for the child zone from the referral or check the proof that there are no DS records
+func (r *recursor) verifyDelegation(keys []*dns.DNSKEY, newCut *zoneCut, resp *dns.Msg) error {
+	now := r.now()
+	sets, sigs := splitRRsets(resp.Ns)
+	dsSet := sets[rrsetKey{name: newCut.zone, rtype: dns.TypeDS}]
+	if len(dsSet) == 0 {
+		_, err := verifySection(filterRRs(resp.Ns, dns.TypeNSEC, dns.TypeNSEC3), keys, now)
+		if err != nil {
+			return err
+		}
+		return verifyNoDS(newCut.zone, resp.Ns)
+	}
+
+	err := verifyRRset(dsSet, sigs, keys, now)
+	if err != nil {
+		return err
+	}
+	for _, rr := range dsSet {
+		newCut.ds = append(newCut.ds, rr.(*dns.DS))
+	}
+	newCut.secure = hasSupportedDS(newCut.ds)
+	return nil
+}
+
+// Get the records of the specified types
+func filterRRs(rrs []dns.RR, types ...uint16) []dns.RR {
+	var res []dns.RR
+	for _, rr := range rrs {
+		t := rr.Header().Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			t = sig.TypeCovered
+		}
+		for _, tt := range types {
+			if t == tt {
+				res = append(res, rr)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// Load and validate the zone keys
+func (r *recursor) loadKeys(cut *zoneCut) ([]*dns.DNSKEY, error) {
+	r.lock.Lock()
+	keys := cut.keys
+	r.lock.Unlock()
+	if len(keys) != 0 {
+		return keys, nil
+	}
+
+	resp, err := r.query(cut, cut.zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	keys, err = verifyDNSKEYs(cut.zone, resp.Answer, cut.ds, r.now())
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	cut.keys = keys
+	r.lock.Unlock()
+	return keys, nil
+}
+
+// Process the final response from the authoritative server
+func (r *recursor) answer(cut *zoneCut, qname string, qtype uint16, resp *dns.Msg) (*recursorResult, error) {
+	now := r.now()
+	res := &recursorResult{
+		rcode:  resp.Rcode,
+		expire: now.Add(recursorMaxTTL * time.Second),
+	}
+
+	// take the records for the name: either the requested type or CNAME
+	for _, rr := range resp.Answer {
+		hdr := rr.Header()
+		t := hdr.Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			t = sig.TypeCovered
+		}
+		if !strings.EqualFold(hdr.Name, qname) || (t != qtype && t != dns.TypeCNAME) {
+			continue
+		}
+		res.answer = append(res.answer, rr)
+		if hdr.Rrtype != dns.TypeRRSIG {
+			res.expire = minExpire(res.expire, now, hdr.Ttl)
+		}
+	}
+	// CNAME goes first
+	if qtype != dns.TypeCNAME && hasRRType(res.answer, dns.TypeCNAME) {
+		res.answer = filterRRs(res.answer, dns.TypeCNAME)
+	}
+
+	if len(res.answer) != 0 {
+		res.rcode = dns.RcodeSuccess
+		res.ns = filterRRs(resp.Ns, dns.TypeNSEC, dns.TypeNSEC3)
+	} else {
+		res.ns = filterRRs(resp.Ns, dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3)
+		ttl := uint32(recursorNegativeTTL)
+		for _, rr := range res.ns {
+			soa, ok := rr.(*dns.SOA)
+			if ok {
+				ttl = soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+			}
+		}
+		res.expire = minExpire(res.expire, now, ttl)
+	}
+
+	if !cut.secure {
+		return res, nil
+	}
+
+	keys, err := r.loadKeys(cut)
+	if err == nil {
+		err = r.validate(keys, qname, qtype, res)
+	}
+	if errors.Is(err, errNSEC3Insecure) {
+		log.Debug("recursor: %s: %s", qname, err)
+		return res, nil
+	}
+	if err != nil {
+		res.bogus = err
+		return res, nil
+	}
+	res.secure = true
+	return res, nil
+}
+
+// Validate the answer or the denial of existence
+func (r *recursor) validate(keys []*dns.DNSKEY, qname string, qtype uint16, res *recursorResult) error {
+	now := r.now()
+	if len(res.answer) != 0 {
+		ce, err := verifySection(res.answer, keys, now)
+		if err != nil {
+			return err
+		}
+		if ce != "" {
+			_, err = verifySection(res.ns, keys, now)
+			if err != nil {
+				return err
+			}
+			return verifyWildcardAnswer(qname, ce, res.ns)
+		}
+		return nil
+	}
+
+	_, err := verifySection(res.ns, keys, now)
+	if err != nil {
+		return err
+	}
+	if res.rcode == dns.RcodeNameError {
+		return verifyNameError(qname, res.ns)
+	}
+	return verifyNoData(qname, qtype, res.ns)
+}
+
+func hasRRType(rrs []dns.RR, t uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == t {
+			return true
+		}
+	}
+	return false
+}
+
+func minExpire(expire, now time.Time, ttl uint32) time.Time {
+	if ttl > recursorMaxTTL {
+		ttl = recursorMaxTTL
+	}
+	e := now.Add(time.Duration(ttl) * time.Second)
+	if e.Before(expire) {
+		return e
+	}
+	return expire
+}
+
+func stringInSlice(s string, arr []string) bool {
+	for _, a := range arr {
+		if a == s {
+			return true
+		}
+	}
+	return false
+}
+
+// recursiveUpstream is the upstream.Upstream interface implementation for the recursive resolver
+type recursiveUpstream struct {
+	r *recursor
+}
+
+// Exchange - upstream.Upstream interface
+func (u *recursiveUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	return u.r.Exchange(m)
+}
+
+// Address - upstream.Upstream interface
+func (u *recursiveUpstream) Address() string {
+	return RecursiveUpstream
+}
+
+// Create or reconfigure the recursive resolver
+func (s *Server) prepareRecursor() {
+	conf := recursorConfig{
+		qnameMinimization: s.conf.RecursorQNAMEMinimization,
+		dnssec:            s.conf.RecursorDNSSEC,
+		cacheSize:         int(s.conf.RecursorCacheSize),
+		rootHints:         s.conf.RecursorRootHints,
+	}
+	if s.recursor == nil {
+		s.recursor = newRecursor(conf)
+		return
+	}
+	s.recursor.setConfig(conf)
+}
+
+// ParseUpstreamsConfig parses the list of upstream servers
+// In addition to the formats supported by dnsproxy, the special address "recursive" is supported:
+//
+//	the names are resolved by our recursive resolver.
+func (s *Server) ParseUpstreamsConfig(upstreams, bootstrap []string) (proxy.UpstreamConfig, error) {
+	var others []string
+	var recursive []string
+	for _, u := range upstreams {
+		addr, _, err := separateUpstream(u)
+		if err == nil && addr == RecursiveUpstream {
+			recursive = append(recursive, u)
+			continue
+		}
+		others = append(others, u)
+	}
+
+	conf, err := proxy.ParseUpstreamsConfig(others, bootstrap, DefaultTimeout)
+	if err != nil || len(recursive) == 0 {
+		return conf, err
+	}
+
+	if s.recursor == nil {
+		s.prepareRecursor()
+	}
+	u := &recursiveUpstream{r: s.recursor}
+	for _, line := range recursive {
+		if !strings.HasPrefix(line, "[/") {
+			conf.Upstreams = append(conf.Upstreams, u)
+			continue
+		}
+
+		domains := strings.Split(strings.TrimPrefix(line, "[/"), "/]")[0]
+		for _, host := range strings.Split(domains, "/") {
+			if host == "" {
+				host = proxy.UnqualifiedNames
+			} else {
+				host = strings.ToLower(host) + "."
+			}
+			if conf.DomainReservedUpstreams == nil {
+				conf.DomainReservedUpstreams = map[string][]upstream.Upstream{}
+			}
+			conf.DomainReservedUpstreams[host] = append(conf.DomainReservedUpstreams[host], u)
+		}
+	}
+	return conf, nil
+}
@@ -38,6 +38,7 @@ func processQueryLogsAndStats(ctx *dnsContext) int {
 			Result:     ctx.result,
 			Elapsed:    elapsed,
 			ClientIP:   getIP(d.Addr),
+			DNSSEC:     ctx.dnssecStatus,
 		}
 
 		if d.Proto == "https" {
@@ -91,6 +92,8 @@ func (s *Server) updateStats(d *proxy.DNSContext, elapsed time.Duration, res dns
 	case dnsfilter.FilteredInvalid:
 		fallthrough
 	case dnsfilter.FilteredBlockedService:
+		fallthrough
+	case dnsfilter.FilteredBlockAll:
 		e.Result = stats.RFiltered
 	}
 
@@ -0,0 +1,357 @@
+package dnsforward
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Local DNSSEC validation of the responses from upstream servers.
+// The chain of trust from the root trust anchor is built with DS and DNSKEY requests to the same upstream servers.
+
+// DNSSEC validation status
+const (
+	dnssecSecure        = "secure"        // the data is signed and the signatures are valid
+	dnssecInsecure      = "insecure"      // the data isn't signed and there's a proof that it doesn't need to be
+	dnssecBogus         = "bogus"         // validation failed
+	dnssecIndeterminate = "indeterminate" // couldn't get the data necessary for validation
+)
+
+const (
+	validatorCacheTTL  = 3600 // max time the zone keys are kept in cache (in seconds)
+	validatorCacheSize = 1000 // max number of zones in cache
+)
+
+// Validated zone keys
+type validatorZone struct {
+	keys   []*dns.DNSKEY // nil: the zone is insecure
+	err    error         // non-nil: the zone is bogus
+	expire time.Time
+}
+
+type validator struct {
+	lock    sync.Mutex
+	anchors []*dns.DS
+	zones   map[string]*validatorZone // zone -> validated keys
+
+	// Send request to upstream servers
+	exchange func(req *dns.Msg) (*dns.Msg, error)
+
+	now func() time.Time
+}
+
+func newValidator(anchors []*dns.DS, exchange func(req *dns.Msg) (*dns.Msg, error)) *validator {
+	if len(anchors) == 0 {
+		anchors, _ = parseTrustAnchors(rootTrustAnchors)
+	}
+	return &validator{
+		anchors:  anchors,
+		zones:    map[string]*validatorZone{},
+		exchange: exchange,
+		now:      time.Now,
+	}
+}
+
+// Get DNSSEC validation status from the error returned by validate()
+func dnssecStatus(err error) string {
+	if errors.Is(err, errDNSSECBogus) {
+		return dnssecBogus
+	}
+	return dnssecIndeterminate
+}
+
+// Send DNSSEC-enabled request with CD flag:
+//
+//	we want to receive the data even if the upstream server considers it bogus
+func (v *validator) query(name string, qtype uint16) (*dns.Msg, error) {
+	req := &dns.Msg{}
+	req.SetQuestion(name, qtype)
+	req.CheckingDisabled = true
+	req.SetEdns0(4096, true)
+	resp, err := v.exchange(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s/%s: %s", name, dns.Type(qtype), err)
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%s/%s: %s", name, dns.Type(qtype), dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+// Get the name of the zone the response data belongs to: the signer name or the owner of SOA record
+func responseZone(resp *dns.Msg) string {
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns} {
+		for _, rr := range rrs {
+			if sig, ok := rr.(*dns.RRSIG); ok {
+				return dns.CanonicalName(sig.SignerName)
+			}
+		}
+	}
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				return dns.CanonicalName(rr.Header().Name)
+			}
+		}
+	}
+	return ""
+}
+
+// Get the validated keys of the zone
+// Returns nil keys and nil error if the zone is insecure.
+func (v *validator) zoneKeys(zone string) ([]*dns.DNSKEY, error) {
+	zone = dns.CanonicalName(zone)
+	now := v.now()
+
+	v.lock.Lock()
+	z, ok := v.zones[zone]
+	v.lock.Unlock()
+	if ok && now.Before(z.expire) {
+		return z.keys, z.err
+	}
+
+	keys, err := v.loadZoneKeys(zone)
+	if err != nil && !errors.Is(err, errDNSSECBogus) {
+		return nil, err // don't cache network errors
+	}
+
+	v.lock.Lock()
+	if len(v.zones) >= validatorCacheSize {
+		v.zones = map[string]*validatorZone{}
+	}
+	v.zones[zone] = &validatorZone{
+		keys:   keys,
+		err:    err,
+		expire: now.Add(validatorCacheTTL * time.Second),
+	}
+	v.lock.Unlock()
+	return keys, err
+}
+
+// Build the chain of trust for the zone: DS records (validated with the parent's keys) -> DNSKEY
+func (v *validator) loadZoneKeys(zone string) ([]*dns.DNSKEY, error) {
+	now := v.now()
+	ds := v.anchors
+	if zone != "." {
+		resp, err := v.query(zone, dns.TypeDS)
+		if err != nil {
+			return nil, err
+		}
+
+		parent := responseZone(resp)
+		if parent == "" || parent == zone || !dns.IsSubDomain(parent, zone) {
+			return nil, fmt.Errorf("%s: can't find the parent zone: %w", zone, errDNSSECBogus)
+		}
+		parentKeys, err := v.zoneKeys(parent)
+		if err != nil || parentKeys == nil {
+			return nil, err
+		}
+
+		sets, sigs := splitRRsets(resp.Answer)
+		dsSet := sets[rrsetKey{name: zone, rtype: dns.TypeDS}]
+		if len(dsSet) == 0 {
+			_, err = verifySection(resp.Ns, parentKeys, now)
+			if err != nil {
+				return nil, err
+			}
+			err = verifyNoDS(zone, resp.Ns)
+			if err != nil {
+				return nil, err
+			}
+			return nil, nil // insecure delegation
+		}
+
+		err = verifyRRset(dsSet, sigs, parentKeys, now)
+		if err != nil {
+			return nil, err
+		}
+		ds = nil
+		for _, rr := range dsSet {
+			ds = append(ds, rr.(*dns.DS))
+		}
+		if !hasSupportedDS(ds) {
+			return nil, nil
+		}
+	}
+
+	resp, err := v.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	return verifyDNSKEYs(zone, resp.Answer, ds, now)
+}
+
+// Check that the unsigned data for the name is allowed: the name belongs to an insecure zone
+func (v *validator) checkInsecure(name string) error {
+	resp, err := v.query(name, dns.TypeSOA)
+	if err != nil {
+		return err
+	}
+	zone := responseZone(resp)
+	if zone == "" || !dns.IsSubDomain(zone, name) {
+		return fmt.Errorf("%s: can't find the zone", name)
+	}
+	keys, err := v.zoneKeys(zone)
+	if err != nil {
+		return err
+	}
+	if keys != nil {
+		return fmt.Errorf("%s: the data isn't signed: %w", name, errDNSSECBogus)
+	}
+	return nil
+}
+
+// Get the name of the signer of the RRset
+func rrsetSigner(set []dns.RR, sigs []*dns.RRSIG) string {
+	hdr := set[0].Header()
+	for _, sig := range sigs {
+		if sig.TypeCovered == hdr.Rrtype && strings.EqualFold(sig.Hdr.Name, hdr.Name) {
+			return dns.CanonicalName(sig.SignerName)
+		}
+	}
+	return ""
+}
+
+// Follow the CNAME chain in the answer section starting with the name
+func cnameChainEnd(name string, answer []dns.RR) string {
+	for i := 0; i != recursorMaxCNAMEs; i++ {
+		found := false
+		for _, rr := range answer {
+			c, ok := rr.(*dns.CNAME)
+			if ok && strings.EqualFold(c.Hdr.Name, name) {
+				name = dns.CanonicalName(c.Target)
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return name
+}
+
+// Validate the response
+// Returns validation status.  Returns an empty status if the response can't be validated (e.g. SERVFAIL).
+func (v *validator) validate(resp *dns.Msg) (string, error) {
+	if len(resp.Question) != 1 ||
+		(resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return "", nil
+	}
+	q := resp.Question[0]
+	now := v.now()
+	secure := true
+
+	sets, sigs := splitRRsets(resp.Answer)
+	for _, set := range sets {
+		name := set[0].Header().Name
+		signer := rrsetSigner(set, sigs)
+		if signer == "" {
+			err := v.checkInsecure(name)
+			if err != nil {
+				return dnssecStatus(err), err
+			}
+			secure = false
+			continue
+		}
+
+		keys, err := v.zoneKeys(signer)
+		if err != nil {
+			return dnssecStatus(err), err
+		}
+		if keys == nil {
+			secure = false
+			continue
+		}
+
+		ce, err := verifySection(append(set, rrsigsFor(set, sigs)...), keys, now)
+		if err == nil && ce != "" {
+			_, err = verifySection(resp.Ns, keys, now)
+			if err == nil {
+				err = verifyWildcardAnswer(dns.CanonicalName(name), ce, resp.Ns)
+			}
+		}
+		if err != nil {
+			return dnssecBogus, err
+		}
+	}
+
+	// check the proof of non-existence of the data for the last name in CNAME chain
+	name := cnameChainEnd(dns.CanonicalName(q.Name), resp.Answer)
+	if q.Qtype != dns.TypeCNAME && q.Qtype != dns.TypeANY &&
+		len(sets[rrsetKey{name: name, rtype: q.Qtype}]) == 0 {
+
+		err := v.validateDenial(name, q.Qtype, resp)
+		if errors.Is(err, errInsecure) {
+			secure = false
+		} else if err != nil {
+			return dnssecStatus(err), err
+		}
+	}
+
+	if secure {
+		return dnssecSecure, nil
+	}
+	return dnssecInsecure, nil
+}
+
+// errInsecure is returned by validateDenial() when the data is not signed and doesn't need to be
+var errInsecure = errors.New("insecure")
+
+// Validate the proof of non-existence (NXDOMAIN or NODATA)
+func (v *validator) validateDenial(name string, qtype uint16, resp *dns.Msg) error {
+	signer := ""
+	for _, rr := range resp.Ns {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			signer = dns.CanonicalName(sig.SignerName)
+			break
+		}
+	}
+	if signer == "" {
+		err := v.checkInsecure(name)
+		if err != nil {
+			return err
+		}
+		return errInsecure
+	}
+	if !dns.IsSubDomain(signer, name) {
+		return fmt.Errorf("%s: unexpected signer %s: %w", name, signer, errDNSSECBogus)
+	}
+
+	keys, err := v.zoneKeys(signer)
+	if err != nil {
+		return err
+	}
+	if keys == nil {
+		return errInsecure
+	}
+
+	_, err = verifySection(resp.Ns, keys, v.now())
+	if err != nil {
+		return err
+	}
+	if resp.Rcode == dns.RcodeNameError {
+		err = verifyNameError(name, resp.Ns)
+		if errors.Is(err, errNSEC3Insecure) {
+			return errInsecure
+		}
+		return err
+	}
+	return verifyNoData(name, qtype, resp.Ns)
+}
+
+// Get the signatures for the RRset
+func rrsigsFor(set []dns.RR, sigs []*dns.RRSIG) []dns.RR {
+	var res []dns.RR
+	hdr := set[0].Header()
+	for _, sig := range sigs {
+		if sig.TypeCovered == hdr.Rrtype && strings.EqualFold(sig.Hdr.Name, hdr.Name) {
+			res = append(res, sig)
+		}
+	}
+	return res
+}
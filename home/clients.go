@@ -32,7 +32,8 @@ type Client struct {
 	IDs                 []string
 	Tags                []string
 	Name                string
-	UseOwnSettings      bool // false: use global settings
+	Group               string // name of the group whose settings are used if the client doesn't specify its own
+	UseOwnSettings      bool   // false: use global settings
 	FilteringEnabled    bool
 	SafeSearchEnabled   bool
 	SafeBrowsingEnabled bool
@@ -41,6 +42,17 @@ type Client struct {
 	UseOwnBlockedServices bool // false: use global settings
 	BlockedServices       []string
 
+	UseOwnFilterLists bool    // false: use the filter lists selected for the client's tags or all filter lists
+	FilterListIDs     []int64 // IDs of the filter lists applied to the client's requests
+
+	UseOwnResponseFiltering bool // false: use global settings
+	FilterResponseCNAME     bool // match CNAME targets in DNS responses against filtering rules
+	FilterResponseIP        bool // match IP addresses in DNS responses against filtering rules
+
+	UseOwnSafeSearchSettings  bool     // false: use global settings
+	SafeSearchDisabledEngines []string // the engines for which safe search isn't enforced
+	SafeSearchStrict          bool     // use strict mode for the engines which support it (YouTube)
+
 	Upstreams []string // list of upstream servers to be used for the client's requests
 
 	// Custom upstream config for this client
@@ -48,6 +60,11 @@ type Client struct {
 	// not nil, but empty: initialized, no good upstreams
 	// not nil, not empty: Upstreams ready to be used
 	upstreamConfig *proxy.UpstreamConfig
+
+	// Where the effective settings come from (set by Find())
+	settingsSource        string
+	blockedServicesSource string
+	upstreamsSource       string
 }
 
 type clientSource uint
@@ -82,6 +99,14 @@ type clientsContainer struct {
 
 	autoHosts *util.AutoHosts // get entries from system hosts-files
 
+	groups map[string]*clientGroup // name -> client group
+
+	schedules []clientSchedule // filtering schedules
+	now       func() time.Time // get the current time (for schedules)
+
+	tagFilterLists      []tagFilterLists // filter lists selected for client tags
+	filterListSetsBuilt string           // the sets of selected filter lists the filtering engines were built for
+
 	testing bool // if TRUE, this object is used for internal tests
 }
 
@@ -102,6 +127,7 @@ func (clients *clientsContainer) Init(objects []clientObject, dhcpServer *dhcpd.
 
 	clients.dhcpServer = dhcpServer
 	clients.autoHosts = autoHosts
+	clients.now = time.Now
 	clients.addFromConfig(objects)
 
 	if !clients.testing {
@@ -132,6 +158,7 @@ type clientObject struct {
 	Name                string   `yaml:"name"`
 	Tags                []string `yaml:"tags"`
 	IDs                 []string `yaml:"ids"`
+	Group               string   `yaml:"group"`
 	UseGlobalSettings   bool     `yaml:"use_global_settings"`
 	FilteringEnabled    bool     `yaml:"filtering_enabled"`
 	ParentalEnabled     bool     `yaml:"parental_enabled"`
@@ -141,6 +168,17 @@ type clientObject struct {
 	UseGlobalBlockedServices bool     `yaml:"use_global_blocked_services"`
 	BlockedServices          []string `yaml:"blocked_services"`
 
+	UseOwnFilterLists bool    `yaml:"use_own_filter_lists"`
+	FilterListIDs     []int64 `yaml:"filter_list_ids"`
+
+	UseOwnResponseFiltering bool `yaml:"use_own_response_filtering"`
+	FilterResponseCNAME     bool `yaml:"filter_response_cname"`
+	FilterResponseIP        bool `yaml:"filter_response_ip"`
+
+	UseOwnSafeSearchSettings  bool     `yaml:"use_own_safesearch_settings"`
+	SafeSearchDisabledEngines []string `yaml:"safesearch_disabled_engines"`
+	SafeSearchStrict          bool     `yaml:"safesearch_strict"`
+
 	Upstreams []string `yaml:"upstreams"`
 }
 
@@ -154,6 +192,7 @@ func (clients *clientsContainer) addFromConfig(objects []clientObject) {
 		cli := Client{
 			Name:                cy.Name,
 			IDs:                 cy.IDs,
+			Group:               cy.Group,
 			UseOwnSettings:      !cy.UseGlobalSettings,
 			FilteringEnabled:    cy.FilteringEnabled,
 			ParentalEnabled:     cy.ParentalEnabled,
@@ -162,9 +201,27 @@ func (clients *clientsContainer) addFromConfig(objects []clientObject) {
 
 			UseOwnBlockedServices: !cy.UseGlobalBlockedServices,
 
+			UseOwnFilterLists: cy.UseOwnFilterLists,
+			FilterListIDs:     cy.FilterListIDs,
+
+			UseOwnResponseFiltering: cy.UseOwnResponseFiltering,
+			FilterResponseCNAME:     cy.FilterResponseCNAME,
+			FilterResponseIP:        cy.FilterResponseIP,
+
+			UseOwnSafeSearchSettings: cy.UseOwnSafeSearchSettings,
+			SafeSearchStrict:         cy.SafeSearchStrict,
+
 			Upstreams: cy.Upstreams,
 		}
 
+		for _, s := range cy.SafeSearchDisabledEngines {
+			if !dnsfilter.SafeSearchEngineKnown(s) {
+				log.Debug("Clients: skipping unknown safe search engine '%s'", s)
+				continue
+			}
+			cli.SafeSearchDisabledEngines = append(cli.SafeSearchDisabledEngines, s)
+		}
+
 		for _, s := range cy.BlockedServices {
 			if !dnsfilter.BlockedSvcKnown(s) {
 				log.Debug("Clients: skipping unknown blocked-service '%s'", s)
@@ -182,6 +239,11 @@ func (clients *clientsContainer) addFromConfig(objects []clientObject) {
 		}
 		sort.Strings(cli.Tags)
 
+		if len(cli.Group) != 0 && !clients.groupExists(cli.Group) {
+			log.Debug("Clients: skipping unknown group '%s'", cli.Group)
+			cli.Group = ""
+		}
+
 		_, err := clients.Add(cli)
 		if err != nil {
 			log.Tracef("clientAdd: %s", err)
@@ -195,17 +257,26 @@ func (clients *clientsContainer) WriteDiskConfig(objects *[]clientObject) {
 	for _, cli := range clients.list {
 		cy := clientObject{
 			Name:                     cli.Name,
+			Group:                    cli.Group,
 			UseGlobalSettings:        !cli.UseOwnSettings,
 			FilteringEnabled:         cli.FilteringEnabled,
 			ParentalEnabled:          cli.ParentalEnabled,
 			SafeSearchEnabled:        cli.SafeSearchEnabled,
 			SafeBrowsingEnabled:      cli.SafeBrowsingEnabled,
 			UseGlobalBlockedServices: !cli.UseOwnBlockedServices,
+			UseOwnFilterLists:        cli.UseOwnFilterLists,
+			UseOwnResponseFiltering:  cli.UseOwnResponseFiltering,
+			FilterResponseCNAME:      cli.FilterResponseCNAME,
+			FilterResponseIP:         cli.FilterResponseIP,
+			UseOwnSafeSearchSettings: cli.UseOwnSafeSearchSettings,
+			SafeSearchStrict:         cli.SafeSearchStrict,
 		}
 
 		cy.Tags = stringArrayDup(cli.Tags)
 		cy.IDs = stringArrayDup(cli.IDs)
 		cy.BlockedServices = stringArrayDup(cli.BlockedServices)
+		cy.FilterListIDs = int64ArrayDup(cli.FilterListIDs)
+		cy.SafeSearchDisabledEngines = stringArrayDup(cli.SafeSearchDisabledEngines)
 		cy.Upstreams = stringArrayDup(cli.Upstreams)
 
 		*objects = append(*objects, cy)
@@ -260,6 +331,7 @@ func stringArrayDup(a []string) []string {
 }
 
 // Find searches for a client by IP
+// The returned object contains the client's effective settings (see resolveSettings())
 func (clients *clientsContainer) Find(ip string) (Client, bool) {
 	clients.lock.Lock()
 	defer clients.lock.Unlock()
@@ -271,11 +343,13 @@ func (clients *clientsContainer) Find(ip string) (Client, bool) {
 	c.IDs = stringArrayDup(c.IDs)
 	c.Tags = stringArrayDup(c.Tags)
 	c.BlockedServices = stringArrayDup(c.BlockedServices)
+	c.FilterListIDs = int64ArrayDup(c.FilterListIDs)
 	c.Upstreams = stringArrayDup(c.Upstreams)
+	clients.resolveSettings(&c)
 	return c, true
 }
 
-// FindUpstreams looks for upstreams configured for the client
+// FindUpstreams looks for upstreams configured for the client or for its group
 // If no client found for this IP, or if no custom upstreams are configured,
 // this method returns nil
 func (clients *clientsContainer) FindUpstreams(ip string) *proxy.UpstreamConfig {
@@ -288,19 +362,38 @@ func (clients *clientsContainer) FindUpstreams(ip string) *proxy.UpstreamConfig
 	}
 
 	if len(c.Upstreams) == 0 {
-		return nil
+		g := clients.groups[c.Group]
+		if g == nil || len(g.Upstreams) == 0 {
+			return nil
+		}
+		if g.upstreamConfig == nil {
+			g.upstreamConfig = parseClientUpstreams(g.Upstreams)
+		}
+		return g.upstreamConfig
 	}
 
 	if c.upstreamConfig == nil {
-		config, err := proxy.ParseUpstreamsConfig(c.Upstreams, config.DNS.BootstrapDNS, dnsforward.DefaultTimeout)
-		if err == nil {
-			c.upstreamConfig = &config
-		}
+		c.upstreamConfig = parseClientUpstreams(c.Upstreams)
 	}
 
 	return c.upstreamConfig
 }
 
+// Parse the upstreams configured for a client or a group
+func parseClientUpstreams(upstreams []string) *proxy.UpstreamConfig {
+	var conf proxy.UpstreamConfig
+	var err error
+	if Context.dnsServer != nil {
+		conf, err = Context.dnsServer.ParseUpstreamsConfig(upstreams, config.DNS.BootstrapDNS)
+	} else {
+		conf, err = proxy.ParseUpstreamsConfig(upstreams, config.DNS.BootstrapDNS, dnsforward.DefaultTimeout)
+	}
+	if err != nil {
+		return nil
+	}
+	return &conf
+}
+
 // Find searches for a client by IP (and does not lock anything)
 func (clients *clientsContainer) findByIP(ip string) (Client, bool) {
 	ipAddr := net.ParseIP(ip)
@@ -401,6 +494,12 @@ func (clients *clientsContainer) check(c *Client) error {
 	}
 	sort.Strings(c.Tags)
 
+	for _, s := range c.SafeSearchDisabledEngines {
+		if !dnsfilter.SafeSearchEngineKnown(s) {
+			return fmt.Errorf("invalid safe search engine: %s", s)
+		}
+	}
+
 	if len(c.Upstreams) != 0 {
 		err := dnsforward.ValidateUpstreams(c.Upstreams)
 		if err != nil {
@@ -428,6 +527,10 @@ func (clients *clientsContainer) Add(c Client) (bool, error) {
 		return false, nil
 	}
 
+	if len(c.Group) != 0 && clients.groups[c.Group] == nil {
+		return false, fmt.Errorf("group not found: %s", c.Group)
+	}
+
 	// check ID index
 	for _, id := range c.IDs {
 		c2, ok := clients.idIndex[id]
@@ -504,6 +607,10 @@ func (clients *clientsContainer) Update(name string, c Client) error {
 		}
 	}
 
+	if len(c.Group) != 0 && clients.groups[c.Group] == nil {
+		return fmt.Errorf("group not found: %s", c.Group)
+	}
+
 	// check IP index
 	if !arraysEqual(old.IDs, c.IDs) {
 		for _, id := range c.IDs {
@@ -0,0 +1,171 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Per-client filter list selection:
+//  a persistent client or a client tag may select the filter lists which are applied to its requests.
+// User rules are always applied.
+
+// The filter lists selected for the clients with a tag
+type tagFilterLists struct {
+	Tag           string  `yaml:"tag" json:"tag"`
+	FilterListIDs []int64 `yaml:"filter_list_ids" json:"filter_list_ids"`
+}
+
+func tagFilterListsDup(a []tagFilterLists) []tagFilterLists {
+	a2 := make([]tagFilterLists, len(a))
+	for i := range a {
+		a2[i].Tag = a[i].Tag
+		a2[i].FilterListIDs = int64ArrayDup(a[i].FilterListIDs)
+	}
+	return a2
+}
+
+func int64ArrayDup(a []int64) []int64 {
+	a2 := make([]int64, len(a))
+	copy(a2, a)
+	return a2
+}
+
+// SetTagFilterLists - check and set the filter lists selected for client tags
+func (clients *clientsContainer) SetTagFilterLists(list []tagFilterLists) error {
+	tags := map[string]bool{}
+	for _, t := range list {
+		if !clients.tagKnown(t.Tag) {
+			return fmt.Errorf("invalid tag: %s", t.Tag)
+		}
+		if tags[t.Tag] {
+			return fmt.Errorf("duplicate tag: %s", t.Tag)
+		}
+		tags[t.Tag] = true
+	}
+
+	clients.lock.Lock()
+	clients.tagFilterLists = tagFilterListsDup(list)
+	clients.lock.Unlock()
+	return nil
+}
+
+// WriteTagFilterListsConfig - write the configuration of filter lists selected for client tags
+func (clients *clientsContainer) WriteTagFilterListsConfig(list *[]tagFilterLists) {
+	clients.lock.Lock()
+	*list = tagFilterListsDup(clients.tagFilterLists)
+	clients.lock.Unlock()
+}
+
+// Get IDs of the filter lists selected for the client
+// Returns nil if all filter lists are used.
+// Returns an empty array if only user rules are used.
+// If the client doesn't select its own lists, the lists selected for all its tags are used.
+// Note: must be called under lock
+func (clients *clientsContainer) filterListIDs(c *Client) []int64 {
+	if c.UseOwnFilterLists {
+		return int64ArrayDup(c.FilterListIDs)
+	}
+
+	var ids []int64
+	for _, tfl := range clients.tagFilterLists {
+		for _, t := range c.Tags {
+			if t == tfl.Tag {
+				if ids == nil {
+					ids = []int64{} // a tag with an empty list selects user rules only
+				}
+				ids = append(ids, tfl.FilterListIDs...)
+				break
+			}
+		}
+	}
+	return ids
+}
+
+// Get the string representation of the sets of filter lists
+func filterListSetsKey(sets [][]int64) string {
+	keys := []string{}
+	for _, ids := range sets {
+		sorted := int64ArrayDup(ids)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		keys = append(keys, fmt.Sprint(sorted))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ";")
+}
+
+// Get IDs of the filter lists selected for the client (see filterListIDs())
+func (clients *clientsContainer) FindFilterListIDs(c *Client) []int64 {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+	return clients.filterListIDs(c)
+}
+
+// Get all sets of filter lists selected for clients
+// Note: must be called under lock
+func (clients *clientsContainer) getFilterListSets() [][]int64 {
+	sets := [][]int64{}
+	for _, c := range clients.list {
+		ids := clients.filterListIDs(c)
+		if ids != nil {
+			sets = append(sets, ids)
+		}
+	}
+	return sets
+}
+
+// FilterListSets - get all sets of filter lists selected for clients
+// This function is called by dnsfilter module when the filtering engines are being built.
+func (clients *clientsContainer) FilterListSets() [][]int64 {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	sets := clients.getFilterListSets()
+	clients.filterListSetsBuilt = filterListSetsKey(sets)
+	return sets
+}
+
+// Rebuild the filtering engines if the sets of filter lists selected for clients have changed
+func (clients *clientsContainer) onFilterListsChanged() {
+	clients.lock.Lock()
+	changed := filterListSetsKey(clients.getFilterListSets()) != clients.filterListSetsBuilt
+	clients.lock.Unlock()
+
+	if changed {
+		enableFilters(true)
+	}
+}
+
+// Get the filter lists selected for client tags
+func (clients *clientsContainer) handleGetTagFilterLists(w http.ResponseWriter, r *http.Request) {
+	list := []tagFilterLists{}
+	clients.WriteTagFilterListsConfig(&list)
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(list)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Failed to encode to json: %v", err)
+		return
+	}
+}
+
+// Set the filter lists selected for client tags
+func (clients *clientsContainer) handleSetTagFilterLists(w http.ResponseWriter, r *http.Request) {
+	list := []tagFilterLists{}
+	err := json.NewDecoder(r.Body).Decode(&list)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "JSON parse: %s", err)
+		return
+	}
+
+	err = clients.SetTagFilterLists(list)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	onConfigModified()
+	clients.onFilterListsChanged()
+}
@@ -0,0 +1,427 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+)
+
+// Client groups:
+//  a group holds the filtering settings, blocked services, upstreams and filtering schedules of its clients.
+// A client belongs to one group and overrides only the settings it specifies itself:
+//  client settings > group settings > global settings
+
+// Sources of the client's effective settings
+const (
+	settingsFromClient = "client"
+	settingsFromGroup  = "group"
+	settingsFromGlobal = "global"
+)
+
+// Group of clients
+type clientGroup struct {
+	Name string `yaml:"name" json:"name"`
+
+	UseOwnSettings      bool `yaml:"use_own_settings" json:"use_own_settings"` // false: use global settings
+	FilteringEnabled    bool `yaml:"filtering_enabled" json:"filtering_enabled"`
+	ParentalEnabled     bool `yaml:"parental_enabled" json:"parental_enabled"`
+	SafeSearchEnabled   bool `yaml:"safesearch_enabled" json:"safesearch_enabled"`
+	SafeBrowsingEnabled bool `yaml:"safebrowsing_enabled" json:"safebrowsing_enabled"`
+
+	UseOwnBlockedServices bool     `yaml:"use_own_blocked_services" json:"use_own_blocked_services"` // false: use global settings
+	BlockedServices       []string `yaml:"blocked_services" json:"blocked_services"`
+
+	Upstreams []string `yaml:"upstreams" json:"upstreams"` // empty: use global upstreams
+	Schedules []string `yaml:"schedules" json:"schedules"` // names of the filtering schedules applied to the group's clients
+
+	upstreamConfig *proxy.UpstreamConfig // custom upstream config for the group's clients (nil: not yet initialized)
+}
+
+func clientGroupDup(g *clientGroup) clientGroup {
+	g2 := *g
+	g2.BlockedServices = stringArrayDup(g.BlockedServices)
+	g2.Upstreams = stringArrayDup(g.Upstreams)
+	g2.Schedules = stringArrayDup(g.Schedules)
+	g2.upstreamConfig = nil
+	return g2
+}
+
+// Return TRUE if the schedule is applied to the group's clients
+func (g *clientGroup) hasSchedule(name string) bool {
+	for _, s := range g.Schedules {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the group's fields are correct
+func checkGroup(g *clientGroup) error {
+	if len(g.Name) == 0 {
+		return fmt.Errorf("invalid Name")
+	}
+
+	for _, s := range g.BlockedServices {
+		if !dnsfilter.BlockedSvcKnown(s) {
+			return fmt.Errorf("%s: unknown blocked service: %s", g.Name, s)
+		}
+	}
+
+	if len(g.Upstreams) != 0 {
+		err := dnsforward.ValidateUpstreams(g.Upstreams)
+		if err != nil {
+			return fmt.Errorf("%s: invalid upstream servers: %s", g.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// SetGroups - check and set the list of client groups
+// Note: it must be called before Init(), because clients refer to their groups
+func (clients *clientsContainer) SetGroups(list []clientGroup) error {
+	groups := map[string]*clientGroup{}
+	for i := range list {
+		g := clientGroupDup(&list[i])
+		err := checkGroup(&g)
+		if err != nil {
+			return err
+		}
+		_, ok := groups[g.Name]
+		if ok {
+			return fmt.Errorf("duplicate group name: %s", g.Name)
+		}
+		groups[g.Name] = &g
+	}
+
+	clients.lock.Lock()
+	clients.groups = groups
+	clients.lock.Unlock()
+	return nil
+}
+
+// WriteGroupsConfig - write the client groups configuration
+func (clients *clientsContainer) WriteGroupsConfig(list *[]clientGroup) {
+	clients.lock.Lock()
+	for _, g := range clients.groups {
+		*list = append(*list, clientGroupDup(g))
+	}
+	clients.lock.Unlock()
+
+	sort.Slice(*list, func(i, j int) bool { return (*list)[i].Name < (*list)[j].Name })
+}
+
+// Return TRUE if the group exists
+func (clients *clientsContainer) groupExists(name string) bool {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+	_, ok := clients.groups[name]
+	return ok
+}
+
+// AddGroup - add a new client group
+func (clients *clientsContainer) AddGroup(g clientGroup) error {
+	g = clientGroupDup(&g)
+	err := checkGroup(&g)
+	if err != nil {
+		return err
+	}
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	_, ok := clients.groups[g.Name]
+	if ok {
+		return fmt.Errorf("group already exists")
+	}
+
+	if clients.groups == nil {
+		clients.groups = map[string]*clientGroup{}
+	}
+	clients.groups[g.Name] = &g
+	return nil
+}
+
+// DelGroup - remove a client group;  its clients are left without a group
+func (clients *clientsContainer) DelGroup(name string) bool {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	_, ok := clients.groups[name]
+	if !ok {
+		return false
+	}
+	delete(clients.groups, name)
+
+	for _, c := range clients.list {
+		if c.Group == name {
+			c.Group = ""
+		}
+	}
+	return true
+}
+
+// UpdateGroup - update a client group
+func (clients *clientsContainer) UpdateGroup(name string, g clientGroup) error {
+	g = clientGroupDup(&g)
+	err := checkGroup(&g)
+	if err != nil {
+		return err
+	}
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	_, ok := clients.groups[name]
+	if !ok {
+		return fmt.Errorf("group not found")
+	}
+
+	if g.Name != name {
+		_, ok = clients.groups[g.Name]
+		if ok {
+			return fmt.Errorf("group already exists")
+		}
+		delete(clients.groups, name)
+
+		for _, c := range clients.list {
+			if c.Group == name {
+				c.Group = g.Name
+			}
+		}
+	}
+
+	clients.groups[g.Name] = &g
+	return nil
+}
+
+// Resolve the client's effective settings:
+//  the settings which the client doesn't specify are taken from its group.
+// Fields UseOwnSettings and UseOwnBlockedServices are set if the settings come from the group.
+// Note: must be called under lock
+func (clients *clientsContainer) resolveSettings(c *Client) {
+	g := clients.groups[c.Group]
+
+	c.settingsSource = settingsFromGlobal
+	if c.UseOwnSettings {
+		c.settingsSource = settingsFromClient
+	} else if g != nil && g.UseOwnSettings {
+		c.UseOwnSettings = true
+		c.FilteringEnabled = g.FilteringEnabled
+		c.ParentalEnabled = g.ParentalEnabled
+		c.SafeSearchEnabled = g.SafeSearchEnabled
+		c.SafeBrowsingEnabled = g.SafeBrowsingEnabled
+		c.settingsSource = settingsFromGroup
+	}
+
+	c.blockedServicesSource = settingsFromGlobal
+	if c.UseOwnBlockedServices {
+		c.blockedServicesSource = settingsFromClient
+	} else if g != nil && g.UseOwnBlockedServices {
+		c.UseOwnBlockedServices = true
+		c.BlockedServices = stringArrayDup(g.BlockedServices)
+		c.blockedServicesSource = settingsFromGroup
+	}
+
+	c.upstreamsSource = settingsFromGlobal
+	if len(c.Upstreams) != 0 {
+		c.upstreamsSource = settingsFromClient
+	} else if g != nil && len(g.Upstreams) != 0 {
+		c.Upstreams = stringArrayDup(g.Upstreams)
+		c.upstreamsSource = settingsFromGroup
+	}
+}
+
+// Find a client by IP and return both its own settings and its effective settings
+func (clients *clientsContainer) findEffective(ip string) (Client, Client, bool) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok := clients.findByIP(ip)
+	if !ok {
+		return Client{}, Client{}, false
+	}
+	ec := c
+	clients.resolveSettings(&ec)
+	return c, ec, true
+}
+
+// Effective settings of a client and where they come from
+type clientEffectiveJSON struct {
+	FilteringEnabled    bool   `json:"filtering_enabled"`
+	ParentalEnabled     bool   `json:"parental_enabled"`
+	SafeSearchEnabled   bool   `json:"safesearch_enabled"`
+	SafeBrowsingEnabled bool   `json:"safebrowsing_enabled"`
+	SettingsSource      string `json:"settings_source"` // "client", "group" or "global"
+
+	BlockedServices       []string `json:"blocked_services"`
+	BlockedServicesSource string   `json:"blocked_services_source"`
+
+	Upstreams       []string `json:"upstreams"`
+	UpstreamsSource string   `json:"upstreams_source"`
+
+	FilterResponseCNAME bool `json:"filter_response_cname"`
+	FilterResponseIP    bool `json:"filter_response_ip"`
+
+	SafeSearchDisabledEngines []string `json:"safesearch_disabled_engines"`
+	SafeSearchStrict          bool     `json:"safesearch_strict"`
+}
+
+// Get the global settings which are used for the clients without their own or group settings
+// Note: it must be called without clients.lock, because config.write() locks config and then clients
+func globalClientSettings() Client {
+	c := Client{}
+
+	config.RLock()
+	c.FilteringEnabled = config.DNS.FilteringEnabled
+	config.RUnlock()
+
+	if Context.dnsFilter != nil {
+		fc := dnsfilter.Config{}
+		Context.dnsFilter.WriteDiskConfig(&fc)
+		c.ParentalEnabled = fc.ParentalEnabled
+		c.SafeSearchEnabled = fc.SafeSearchEnabled
+		c.SafeBrowsingEnabled = fc.SafeBrowsingEnabled
+		c.BlockedServices = stringArrayDup(fc.BlockedServices)
+		c.SafeSearchDisabledEngines = fc.SafeSearchDisabledEngines
+		c.SafeSearchStrict = fc.SafeSearchStrict
+	}
+
+	if Context.dnsServer != nil {
+		fc := dnsforward.FilteringConfig{}
+		Context.dnsServer.WriteDiskConfig(&fc)
+		c.Upstreams = fc.UpstreamDNS
+		c.FilterResponseCNAME = !fc.DisableResponseCNAME
+		c.FilterResponseIP = !fc.DisableResponseIP
+	}
+	return c
+}
+
+// Convert the client's resolved settings (see resolveSettings()) to JSON
+func effectiveToJSON(c *Client, global *Client) *clientEffectiveJSON {
+	e := clientEffectiveJSON{
+		FilteringEnabled:    c.FilteringEnabled,
+		ParentalEnabled:     c.ParentalEnabled,
+		SafeSearchEnabled:   c.SafeSearchEnabled,
+		SafeBrowsingEnabled: c.SafeBrowsingEnabled,
+		SettingsSource:      c.settingsSource,
+
+		BlockedServices:       c.BlockedServices,
+		BlockedServicesSource: c.blockedServicesSource,
+
+		Upstreams:       c.Upstreams,
+		UpstreamsSource: c.upstreamsSource,
+
+		FilterResponseCNAME: c.FilterResponseCNAME,
+		FilterResponseIP:    c.FilterResponseIP,
+
+		SafeSearchDisabledEngines: c.SafeSearchDisabledEngines,
+		SafeSearchStrict:          c.SafeSearchStrict,
+	}
+
+	if c.settingsSource == settingsFromGlobal {
+		e.FilteringEnabled = global.FilteringEnabled
+		e.ParentalEnabled = global.ParentalEnabled
+		e.SafeSearchEnabled = global.SafeSearchEnabled
+		e.SafeBrowsingEnabled = global.SafeBrowsingEnabled
+	}
+	if c.blockedServicesSource == settingsFromGlobal {
+		e.BlockedServices = global.BlockedServices
+	}
+	if c.upstreamsSource == settingsFromGlobal {
+		e.Upstreams = global.Upstreams
+	}
+	if !c.UseOwnResponseFiltering {
+		e.FilterResponseCNAME = global.FilterResponseCNAME
+		e.FilterResponseIP = global.FilterResponseIP
+	}
+	if !c.UseOwnSafeSearchSettings {
+		e.SafeSearchDisabledEngines = global.SafeSearchDisabledEngines
+		e.SafeSearchStrict = global.SafeSearchStrict
+	}
+	if e.SafeSearchDisabledEngines == nil {
+		e.SafeSearchDisabledEngines = []string{}
+	}
+	return &e
+}
+
+// Get the list of client groups
+func (clients *clientsContainer) handleGetGroups(w http.ResponseWriter, r *http.Request) {
+	list := []clientGroup{}
+	clients.WriteGroupsConfig(&list)
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(list)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Failed to encode to json: %v", err)
+		return
+	}
+}
+
+// Add a new client group
+func (clients *clientsContainer) handleAddGroup(w http.ResponseWriter, r *http.Request) {
+	g := clientGroup{}
+	err := json.NewDecoder(r.Body).Decode(&g)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "JSON parse: %s", err)
+		return
+	}
+
+	err = clients.AddGroup(g)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	onConfigModified()
+}
+
+// Remove client group
+func (clients *clientsContainer) handleDelGroup(w http.ResponseWriter, r *http.Request) {
+	g := clientGroup{}
+	err := json.NewDecoder(r.Body).Decode(&g)
+	if err != nil || len(g.Name) == 0 {
+		httpError(w, http.StatusBadRequest, "JSON parse: %s", err)
+		return
+	}
+
+	if !clients.DelGroup(g.Name) {
+		httpError(w, http.StatusBadRequest, "Group not found")
+		return
+	}
+
+	onConfigModified()
+}
+
+type groupUpdateJSON struct {
+	Name string      `json:"name"`
+	Data clientGroup `json:"data"`
+}
+
+// Update client group's properties
+func (clients *clientsContainer) handleUpdateGroup(w http.ResponseWriter, r *http.Request) {
+	req := groupUpdateJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "JSON parse: %s", err)
+		return
+	}
+	if len(req.Name) == 0 {
+		httpError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	err = clients.UpdateGroup(req.Name, req.Data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	onConfigModified()
+}
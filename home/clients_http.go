@@ -11,6 +11,7 @@ type clientJSON struct {
 	IDs                 []string `json:"ids"`
 	Tags                []string `json:"tags"`
 	Name                string   `json:"name"`
+	Group               string   `json:"group"`
 	UseGlobalSettings   bool     `json:"use_global_settings"`
 	FilteringEnabled    bool     `json:"filtering_enabled"`
 	ParentalEnabled     bool     `json:"parental_enabled"`
@@ -20,7 +21,20 @@ type clientJSON struct {
 	UseGlobalBlockedServices bool     `json:"use_global_blocked_services"`
 	BlockedServices          []string `json:"blocked_services"`
 
+	UseOwnFilterLists bool    `json:"use_own_filter_lists"`
+	FilterListIDs     []int64 `json:"filter_list_ids"`
+
+	UseOwnResponseFiltering bool `json:"use_own_response_filtering"`
+	FilterResponseCNAME     bool `json:"filter_response_cname"`
+	FilterResponseIP        bool `json:"filter_response_ip"`
+
+	UseOwnSafeSearchSettings  bool     `json:"use_own_safesearch_settings"`
+	SafeSearchDisabledEngines []string `json:"safesearch_disabled_engines"`
+	SafeSearchStrict          bool     `json:"safesearch_strict"`
+
 	Upstreams []string `json:"upstreams"`
+
+	Effective *clientEffectiveJSON `json:"effective,omitempty"` // effective settings (only in responses)
 }
 
 type clientHostJSON struct {
@@ -40,10 +54,14 @@ type clientListJSON struct {
 // respond with information about configured clients
 func (clients *clientsContainer) handleGetClients(w http.ResponseWriter, r *http.Request) {
 	data := clientListJSON{}
+	global := globalClientSettings()
 
 	clients.lock.Lock()
 	for _, c := range clients.list {
 		cj := clientToJSON(c)
+		ec := *c
+		clients.resolveSettings(&ec)
+		cj.Effective = effectiveToJSON(&ec, &global)
 		data.Clients = append(data.Clients, cj)
 	}
 	for ip, ch := range clients.ipHost {
@@ -89,6 +107,7 @@ func jsonToClient(cj clientJSON) (*Client, error) {
 		Name:                cj.Name,
 		IDs:                 cj.IDs,
 		Tags:                cj.Tags,
+		Group:               cj.Group,
 		UseOwnSettings:      !cj.UseGlobalSettings,
 		FilteringEnabled:    cj.FilteringEnabled,
 		ParentalEnabled:     cj.ParentalEnabled,
@@ -98,6 +117,17 @@ func jsonToClient(cj clientJSON) (*Client, error) {
 		UseOwnBlockedServices: !cj.UseGlobalBlockedServices,
 		BlockedServices:       cj.BlockedServices,
 
+		UseOwnFilterLists: cj.UseOwnFilterLists,
+		FilterListIDs:     cj.FilterListIDs,
+
+		UseOwnResponseFiltering: cj.UseOwnResponseFiltering,
+		FilterResponseCNAME:     cj.FilterResponseCNAME,
+		FilterResponseIP:        cj.FilterResponseIP,
+
+		UseOwnSafeSearchSettings:  cj.UseOwnSafeSearchSettings,
+		SafeSearchDisabledEngines: cj.SafeSearchDisabledEngines,
+		SafeSearchStrict:          cj.SafeSearchStrict,
+
 		Upstreams: cj.Upstreams,
 	}
 	return &c, nil
@@ -109,6 +139,7 @@ func clientToJSON(c *Client) clientJSON {
 		Name:                c.Name,
 		IDs:                 c.IDs,
 		Tags:                c.Tags,
+		Group:               c.Group,
 		UseGlobalSettings:   !c.UseOwnSettings,
 		FilteringEnabled:    c.FilteringEnabled,
 		ParentalEnabled:     c.ParentalEnabled,
@@ -118,6 +149,17 @@ func clientToJSON(c *Client) clientJSON {
 		UseGlobalBlockedServices: !c.UseOwnBlockedServices,
 		BlockedServices:          c.BlockedServices,
 
+		UseOwnFilterLists: c.UseOwnFilterLists,
+		FilterListIDs:     c.FilterListIDs,
+
+		UseOwnResponseFiltering: c.UseOwnResponseFiltering,
+		FilterResponseCNAME:     c.FilterResponseCNAME,
+		FilterResponseIP:        c.FilterResponseIP,
+
+		UseOwnSafeSearchSettings:  c.UseOwnSafeSearchSettings,
+		SafeSearchDisabledEngines: c.SafeSearchDisabledEngines,
+		SafeSearchStrict:          c.SafeSearchStrict,
+
 		Upstreams: c.Upstreams,
 	}
 	return cj
@@ -174,6 +216,7 @@ func (clients *clientsContainer) handleAddClient(w http.ResponseWriter, r *http.
 	}
 
 	onConfigModified()
+	clients.onFilterListsChanged()
 }
 
 // Remove client
@@ -197,6 +240,7 @@ func (clients *clientsContainer) handleDelClient(w http.ResponseWriter, r *http.
 	}
 
 	onConfigModified()
+	clients.onFilterListsChanged()
 }
 
 type updateJSON struct {
@@ -236,19 +280,21 @@ func (clients *clientsContainer) handleUpdateClient(w http.ResponseWriter, r *ht
 	}
 
 	onConfigModified()
+	clients.onFilterListsChanged()
 }
 
 // Get the list of clients by IP address list
 func (clients *clientsContainer) handleFindClient(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
 	data := []map[string]interface{}{}
+	global := globalClientSettings()
 	for i := 0; ; i++ {
 		ip := q.Get(fmt.Sprintf("ip%d", i))
 		if len(ip) == 0 {
 			break
 		}
 		el := map[string]interface{}{}
-		c, ok := clients.Find(ip)
+		c, ec, ok := clients.findEffective(ip)
 		if !ok {
 			ch, ok := clients.FindAutoClient(ip)
 			if !ok {
@@ -258,6 +304,7 @@ func (clients *clientsContainer) handleFindClient(w http.ResponseWriter, r *http
 			el[ip] = cj
 		} else {
 			cj := clientToJSON(&c)
+			cj.Effective = effectiveToJSON(&ec, &global)
 			el[ip] = cj
 		}
 
@@ -277,6 +324,37 @@ func (clients *clientsContainer) handleFindClient(w http.ResponseWriter, r *http
 	}
 }
 
+// Get the list of filtering schedules
+func (clients *clientsContainer) handleGetSchedules(w http.ResponseWriter, r *http.Request) {
+	list := []clientSchedule{}
+	clients.WriteSchedulesConfig(&list)
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(list)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Failed to encode to json: %v", err)
+		return
+	}
+}
+
+// Set the new list of filtering schedules
+func (clients *clientsContainer) handleSetSchedules(w http.ResponseWriter, r *http.Request) {
+	list := []clientSchedule{}
+	err := json.NewDecoder(r.Body).Decode(&list)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "JSON parse: %s", err)
+		return
+	}
+
+	err = clients.SetSchedules(list)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	onConfigModified()
+}
+
 // RegisterClientsHandlers registers HTTP handlers
 func (clients *clientsContainer) registerWebHandlers() {
 	httpRegister("GET", "/control/clients", clients.handleGetClients)
@@ -284,4 +362,12 @@ func (clients *clientsContainer) registerWebHandlers() {
 	httpRegister("POST", "/control/clients/delete", clients.handleDelClient)
 	httpRegister("POST", "/control/clients/update", clients.handleUpdateClient)
 	httpRegister("GET", "/control/clients/find", clients.handleFindClient)
+	httpRegister("GET", "/control/clients/groups", clients.handleGetGroups)
+	httpRegister("POST", "/control/clients/groups/add", clients.handleAddGroup)
+	httpRegister("POST", "/control/clients/groups/delete", clients.handleDelGroup)
+	httpRegister("POST", "/control/clients/groups/update", clients.handleUpdateGroup)
+	httpRegister("GET", "/control/clients/schedules", clients.handleGetSchedules)
+	httpRegister("POST", "/control/clients/schedules/set", clients.handleSetSchedules)
+	httpRegister("GET", "/control/clients/tag_filter_lists", clients.handleGetTagFilterLists)
+	httpRegister("POST", "/control/clients/tag_filter_lists/set", clients.handleSetTagFilterLists)
 }
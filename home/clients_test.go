@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dhcpd"
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -264,3 +265,111 @@ func TestClientsCustomUpstream(t *testing.T) {
 	assert.Equal(t, 1, len(config.Upstreams))
 	assert.Equal(t, 1, len(config.DomainReservedUpstreams))
 }
+
+func TestClientsFilterLists(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+	clients.Init(nil, nil, nil)
+
+	_, _ = clients.Add(Client{Name: "kid", IDs: []string{"1.1.1.1"}, Tags: []string{"user_child"}})
+	_, _ = clients.Add(Client{Name: "laptop", IDs: []string{"2.2.2.2"}, UseOwnFilterLists: true, FilterListIDs: []int64{2}})
+	_, _ = clients.Add(Client{Name: "tv", IDs: []string{"3.3.3.3"}, Tags: []string{"device_tv"}})
+	_, _ = clients.Add(Client{Name: "phone", IDs: []string{"4.4.4.4"}, Tags: []string{"device_phone"}})
+	_, _ = clients.Add(Client{Name: "pc", IDs: []string{"5.5.5.5"}, UseOwnFilterLists: true})
+
+	assert.Nil(t, clients.SetTagFilterLists([]tagFilterLists{
+		{Tag: "user_child", FilterListIDs: []int64{1, 3}},
+		{Tag: "device_phone"},
+	}))
+	assert.NotNil(t, clients.SetTagFilterLists([]tagFilterLists{{Tag: "unknown"}}))
+
+	c, _ := clients.Find("1.1.1.1")
+	assert.Equal(t, []int64{1, 3}, clients.FindFilterListIDs(&c))
+
+	c, _ = clients.Find("2.2.2.2")
+	assert.Equal(t, []int64{2}, clients.FindFilterListIDs(&c))
+
+	// all filter lists
+	c, _ = clients.Find("3.3.3.3")
+	assert.Nil(t, clients.FindFilterListIDs(&c))
+
+	// user rules only
+	c, _ = clients.Find("4.4.4.4")
+	assert.Equal(t, []int64{}, clients.FindFilterListIDs(&c))
+	c, _ = clients.Find("5.5.5.5")
+	assert.Equal(t, []int64{}, clients.FindFilterListIDs(&c))
+
+	sets := clients.FilterListSets()
+	assert.Equal(t, 4, len(sets))
+	assert.Equal(t, "[1 3];[2];[];[]", clients.filterListSetsBuilt)
+}
+
+func TestClientGroups(t *testing.T) {
+	dnsfilter.InitModule()
+	clients := clientsContainer{}
+	clients.testing = true
+	clients.Init(nil, nil, nil)
+
+	assert.Nil(t, clients.SetGroups([]clientGroup{
+		{
+			Name:             "kids",
+			UseOwnSettings:   true,
+			FilteringEnabled: true,
+			ParentalEnabled:  true,
+
+			UseOwnBlockedServices: true,
+			BlockedServices:       []string{"youtube"},
+
+			Upstreams: []string{"1.1.1.1"},
+		},
+	}))
+	assert.NotNil(t, clients.SetGroups([]clientGroup{{Name: "a"}, {Name: "a"}}))
+	assert.NotNil(t, clients.AddGroup(clientGroup{Name: "kids"}))
+	assert.NotNil(t, clients.AddGroup(clientGroup{Name: "b", BlockedServices: []string{"unknown"}}))
+
+	ok, err := clients.Add(Client{Name: "tablet", IDs: []string{"1.1.1.1"}, Group: "kids"})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	ok, err = clients.Add(Client{Name: "laptop", IDs: []string{"2.2.2.2"}, Group: "kids",
+		UseOwnSettings: true, FilteringEnabled: true, Upstreams: []string{"8.8.8.8"}})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	_, err = clients.Add(Client{Name: "tv", IDs: []string{"3.3.3.3"}, Group: "unknown"})
+	assert.NotNil(t, err)
+
+	// the settings are inherited from the group
+	c, ok := clients.Find("1.1.1.1")
+	assert.True(t, ok)
+	assert.True(t, c.UseOwnSettings && c.ParentalEnabled)
+	assert.Equal(t, settingsFromGroup, c.settingsSource)
+	assert.Equal(t, []string{"youtube"}, c.BlockedServices)
+	assert.Equal(t, settingsFromGroup, c.blockedServicesSource)
+	assert.Equal(t, []string{"1.1.1.1"}, c.Upstreams)
+	assert.Equal(t, settingsFromGroup, c.upstreamsSource)
+
+	// the client overrides the settings it specifies
+	c, _ = clients.Find("2.2.2.2")
+	assert.False(t, c.ParentalEnabled)
+	assert.Equal(t, settingsFromClient, c.settingsSource)
+	assert.Equal(t, settingsFromGroup, c.blockedServicesSource)
+	assert.Equal(t, []string{"8.8.8.8"}, c.Upstreams)
+	assert.Equal(t, settingsFromClient, c.upstreamsSource)
+
+	// rename the group
+	assert.Nil(t, clients.UpdateGroup("kids", clientGroup{Name: "children"}))
+	c, _ = clients.Find("1.1.1.1")
+	assert.Equal(t, "children", c.Group)
+	assert.False(t, c.UseOwnSettings)
+	assert.Equal(t, settingsFromGlobal, c.settingsSource)
+	assert.Equal(t, settingsFromGlobal, c.upstreamsSource)
+
+	// the group's clients are left without a group
+	assert.True(t, clients.DelGroup("children"))
+	assert.False(t, clients.DelGroup("children"))
+	c, _ = clients.Find("1.1.1.1")
+	assert.Equal(t, "", c.Group)
+
+	list := []clientGroup{}
+	clients.WriteGroupsConfig(&list)
+	assert.Equal(t, 0, len(list))
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/AdguardTeam/AdGuardHome/dnsforward"
 	"github.com/AdguardTeam/AdGuardHome/querylog"
 	"github.com/AdguardTeam/AdGuardHome/stats"
+	"github.com/AdguardTeam/AdGuardHome/util"
 	"github.com/AdguardTeam/golibs/file"
 	"github.com/AdguardTeam/golibs/log"
 	yaml "gopkg.in/yaml.v2"
@@ -65,9 +66,18 @@ type configuration struct {
 
 	DHCP dhcpd.ServerConfig `yaml:"dhcp"`
 
+	// Note: this array is filled only before file read/write and then it's cleared
+	ClientGroups []clientGroup `yaml:"client_groups"`
+
 	// Note: this array is filled only before file read/write and then it's cleared
 	Clients []clientObject `yaml:"clients"`
 
+	// Note: this array is filled only before file read/write and then it's cleared
+	ClientSchedules []clientSchedule `yaml:"client_schedules"`
+
+	// Note: this array is filled only before file read/write and then it's cleared
+	ClientTagFilterLists []tagFilterLists `yaml:"client_tag_filter_lists"`
+
 	logSettings `yaml:",inline"`
 
 	sync.RWMutex `yaml:"-"`
@@ -89,6 +99,9 @@ type dnsConfig struct {
 	QueryLogMemSize     uint32 `yaml:"querylog_size_memory"`  // number of entries kept in memory before they are flushed to disk
 	AnonymizeClientIP   bool   `yaml:"anonymize_client_ip"`   // anonymize clients' IP addresses in logs and stats
 
+	// How clients' IP addresses are anonymized when AnonymizeClientIP is set
+	util.IPAnonymizerConfig `yaml:",inline"`
+
 	dnsforward.FilteringConfig `yaml:",inline"`
 
 	FilteringEnabled           bool             `yaml:"filtering_enabled"`       // whether or not use filter lists
@@ -156,6 +169,9 @@ func initConfig() {
 	config.DNS.QueryLogMemSize = 1000
 
 	config.DNS.CacheSize = 4 * 1024 * 1024
+	config.DNS.RecursorQNAMEMinimization = true
+	config.DNS.RecursorDNSSEC = true
+	config.DNS.EDEBlockingModes = []string{"default", "nxdomain", "null_ip", "custom_ip"}
 	config.DNS.DnsfilterConf.SafeBrowsingCacheSize = 1 * 1024 * 1024
 	config.DNS.DnsfilterConf.SafeSearchCacheSize = 1 * 1024 * 1024
 	config.DNS.DnsfilterConf.ParentalCacheSize = 1 * 1024 * 1024
@@ -235,7 +251,10 @@ func (c *configuration) write() error {
 	c.Lock()
 	defer c.Unlock()
 
+	Context.clients.WriteGroupsConfig(&config.ClientGroups)
 	Context.clients.WriteDiskConfig(&config.Clients)
+	Context.clients.WriteSchedulesConfig(&config.ClientSchedules)
+	Context.clients.WriteTagFilterListsConfig(&config.ClientTagFilterLists)
 
 	if Context.auth != nil {
 		config.Users = Context.auth.GetUsers()
@@ -283,7 +302,10 @@ func (c *configuration) write() error {
 	configFile := config.getConfigFilename()
 	log.Debug("Writing YAML file: %s", configFile)
 	yamlText, err := yaml.Marshal(&config)
+	config.ClientGroups = nil
 	config.Clients = nil
+	config.ClientSchedules = nil
+	config.ClientTagFilterLists = nil
 	if err != nil {
 		log.Error("Couldn't generate YAML file: %s", err)
 		return err
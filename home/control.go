@@ -8,6 +8,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dnsforward"
 	"github.com/AdguardTeam/golibs/log"
@@ -54,9 +55,24 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		"version":       versionString,
 		"language":      config.Language,
 
-		"protection_enabled": c.ProtectionEnabled,
+		"protection_enabled": c.ProtectionEnabled && c.ProtectionDisabledUntil == nil,
 	}
 
+	// remaining time of the protection pause (in milliseconds)
+	now := time.Now()
+	data["protection_disabled_duration"] = int64(0)
+	if c.ProtectionDisabledUntil != nil {
+		data["protection_disabled_duration"] = c.ProtectionDisabledUntil.Sub(now).Milliseconds()
+	}
+	paused := []map[string]interface{}{}
+	for _, p := range c.ProtectionPausedClients {
+		paused = append(paused, map[string]interface{}{
+			"client":   p.Client,
+			"duration": p.Until.Sub(now).Milliseconds(),
+		})
+	}
+	data["protection_paused_clients"] = paused
+
 	jsonVal, err := json.Marshal(data)
 	if err != nil {
 		httpError(w, http.StatusInternalServerError, "Unable to marshal status json: %s", err)
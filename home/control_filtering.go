@@ -12,7 +12,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/AdguardTeam/AdGuardHome/util"
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
 )
@@ -20,8 +20,8 @@ import (
 // IsValidURL - return TRUE if URL or file path is valid
 func IsValidURL(rawurl string) bool {
 	if filepath.IsAbs(rawurl) {
-		// this is a file path
-		return util.FileExists(rawurl)
+		// this is a file or directory path, or a glob pattern
+		return isValidLocalFilterSource(rawurl)
 	}
 
 	url, err := url.ParseRequestURI(rawurl)
@@ -34,10 +34,22 @@ func IsValidURL(rawurl string) bool {
 	return true
 }
 
+// Return TRUE if all mirror URLs are valid
+// Mirrors are used only for the filters downloaded via network, so local paths aren't allowed here
+func isValidMirrors(mirrors []string) bool {
+	for _, m := range mirrors {
+		if filepath.IsAbs(m) || !IsValidURL(m) {
+			return false
+		}
+	}
+	return true
+}
+
 type filterAddJSON struct {
-	Name      string `json:"name"`
-	URL       string `json:"url"`
-	Whitelist bool   `json:"whitelist"`
+	Name      string   `json:"name"`
+	URL       string   `json:"url"`
+	Mirrors   []string `json:"mirrors"`
+	Whitelist bool     `json:"whitelist"`
 }
 
 func (f *Filtering) handleFilteringAddURL(w http.ResponseWriter, r *http.Request) {
@@ -52,6 +64,10 @@ func (f *Filtering) handleFilteringAddURL(w http.ResponseWriter, r *http.Request
 		http.Error(w, "Invalid URL or file path", http.StatusBadRequest)
 		return
 	}
+	if !isValidMirrors(fj.Mirrors) {
+		http.Error(w, "Invalid mirror URL", http.StatusBadRequest)
+		return
+	}
 
 	// Check for duplicates
 	if filterExists(fj.URL) {
@@ -64,6 +80,7 @@ func (f *Filtering) handleFilteringAddURL(w http.ResponseWriter, r *http.Request
 		Enabled: true,
 		URL:     fj.URL,
 		Name:    fj.Name,
+		Mirrors: fj.Mirrors,
 		white:   fj.Whitelist,
 	}
 	filt.ID = assignUniqueFilterID()
@@ -87,6 +104,7 @@ func (f *Filtering) handleFilteringAddURL(w http.ResponseWriter, r *http.Request
 
 	onConfigModified()
 	enableFilters(true)
+	f.watchLocalFilters()
 
 	_, err = fmt.Fprintf(w, "OK %d rules\n", filt.RulesCount)
 	if err != nil {
@@ -122,6 +140,7 @@ func (f *Filtering) handleFilteringRemoveURL(w http.ResponseWriter, r *http.Requ
 			if err != nil {
 				log.Error("os.Rename: %s: %s", filter.Path(), err)
 			}
+			filter.removeHistory()
 		}
 	}
 	// Update the configuration after removing filter files
@@ -130,15 +149,17 @@ func (f *Filtering) handleFilteringRemoveURL(w http.ResponseWriter, r *http.Requ
 
 	onConfigModified()
 	enableFilters(true)
+	f.watchLocalFilters()
 
 	// Note: the old files "filter.txt.old" aren't deleted - it's not really necessary,
 	//  but will require the additional code to run after enableFilters() is finished: i.e. complicated
 }
 
 type filterURLJSON struct {
-	Name    string `json:"name"`
-	URL     string `json:"url"`
-	Enabled bool   `json:"enabled"`
+	Name    string   `json:"name"`
+	URL     string   `json:"url"`
+	Mirrors []string `json:"mirrors"` // the mirrors aren't changed if the field isn't set
+	Enabled bool     `json:"enabled"`
 }
 
 type filterURLReq struct {
@@ -159,11 +180,16 @@ func (f *Filtering) handleFilteringSetURL(w http.ResponseWriter, r *http.Request
 		http.Error(w, "invalid URL or file path", http.StatusBadRequest)
 		return
 	}
+	if !isValidMirrors(fj.Data.Mirrors) {
+		http.Error(w, "invalid mirror URL", http.StatusBadRequest)
+		return
+	}
 
 	filt := filter{
 		Enabled: fj.Data.Enabled,
 		Name:    fj.Data.Name,
 		URL:     fj.Data.URL,
+		Mirrors: fj.Data.Mirrors,
 	}
 	status := f.filterSetProperties(fj.URL, filt, fj.Whitelist)
 	if (status & statusFound) == 0 {
@@ -176,6 +202,7 @@ func (f *Filtering) handleFilteringSetURL(w http.ResponseWriter, r *http.Request
 	}
 
 	onConfigModified()
+	f.watchLocalFilters()
 	restart := false
 	if (status & statusEnabledChanged) != 0 {
 		// we must add or remove filter rules
@@ -207,7 +234,18 @@ func (f *Filtering) handleFilteringSetRules(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	config.UserRules = strings.Split(string(body), "\n")
+	rules := strings.Split(string(body), "\n")
+	stats := dnsfilter.CheckRules(rules)
+	if stats.Invalid != 0 {
+		msgs := []string{}
+		for _, e := range stats.Errors {
+			msgs = append(msgs, fmt.Sprintf("line %d: %s: %s", e.Line, e.Rule, e.Error))
+		}
+		httpError(w, http.StatusBadRequest, "%d invalid rules: %s", stats.Invalid, strings.Join(msgs, "; "))
+		return
+	}
+
+	config.UserRules = rules
 	onConfigModified()
 	enableFilters(true)
 }
@@ -257,6 +295,14 @@ type filterJSON struct {
 	Name        string `json:"name"`
 	RulesCount  uint32 `json:"rules_count"`
 	LastUpdated string `json:"last_updated"`
+
+	RulesStats dnsfilter.RuleStats `json:"rules_stats"` // the numbers of rules of each type and the first errors
+
+	Mirrors       []string `json:"mirrors"`
+	LastError     string   `json:"last_error,omitempty"`      // the error of the last update attempt
+	LastErrorTime string   `json:"last_error_time,omitempty"` // the time of the last failed update attempt
+	Failures      int      `json:"failures"`                  // the number of consecutive failed update attempts
+	RetryAfter    string   `json:"retry_after,omitempty"`     // the filter won't be updated until this time
 }
 
 type filteringConfig struct {
@@ -265,6 +311,8 @@ type filteringConfig struct {
 	Filters          []filterJSON `json:"filters"`
 	WhitelistFilters []filterJSON `json:"whitelist_filters"`
 	UserRules        []string     `json:"user_rules"`
+
+	UserRulesStats *dnsfilter.RuleStats `json:"user_rules_stats,omitempty"` // only in responses
 }
 
 func filterToJSON(f filter) filterJSON {
@@ -274,11 +322,24 @@ func filterToJSON(f filter) filterJSON {
 		URL:        f.URL,
 		Name:       f.Name,
 		RulesCount: uint32(f.RulesCount),
+		RulesStats: f.ruleStats,
+		Mirrors:    f.Mirrors,
+		LastError:  f.lastError,
+		Failures:   f.failures,
+	}
+	if fj.Mirrors == nil {
+		fj.Mirrors = []string{}
 	}
 
 	if !f.LastUpdated.IsZero() {
 		fj.LastUpdated = f.LastUpdated.Format(time.RFC3339)
 	}
+	if !f.lastErrorTime.IsZero() {
+		fj.LastErrorTime = f.lastErrorTime.Format(time.RFC3339)
+	}
+	if !f.retryAfter.IsZero() {
+		fj.RetryAfter = f.retryAfter.Format(time.RFC3339)
+	}
 
 	return fj
 }
@@ -298,6 +359,8 @@ func (f *Filtering) handleFilteringStatus(w http.ResponseWriter, r *http.Request
 		resp.WhitelistFilters = append(resp.WhitelistFilters, fj)
 	}
 	resp.UserRules = config.UserRules
+	userRulesStats := dnsfilter.CheckRules(config.UserRules)
+	resp.UserRulesStats = &userRulesStats
 	config.RUnlock()
 
 	jsonVal, err := json.Marshal(resp)
@@ -351,6 +414,7 @@ func (f *Filtering) handleCheckHost(w http.ResponseWriter, r *http.Request) {
 
 	setts := Context.dnsFilter.GetConfig()
 	setts.FilteringEnabled = true
+	setts.NoRuleHits = true
 	Context.dnsFilter.ApplyBlockedServices(&setts, nil, true)
 	result, err := Context.dnsFilter.CheckHost(host, dns.TypeA, &setts)
 	if err != nil {
@@ -382,6 +446,8 @@ func (f *Filtering) RegisterFilteringHandlers() {
 	httpRegister("POST", "/control/filtering/remove_url", f.handleFilteringRemoveURL)
 	httpRegister("POST", "/control/filtering/set_url", f.handleFilteringSetURL)
 	httpRegister("POST", "/control/filtering/refresh", f.handleFilteringRefresh)
+	httpRegister("GET", "/control/filtering/history", f.handleFilteringHistory)
+	httpRegister("POST", "/control/filtering/rollback", f.handleFilteringRollback)
 	httpRegister("POST", "/control/filtering/set_rules", f.handleFilteringSetRules)
 	httpRegister("GET", "/control/filtering/check_host", f.handleCheckHost)
 }
@@ -20,6 +20,18 @@ func onConfigModified() {
 	_ = config.write()
 }
 
+// Remove the cached responses for the domain after its rewrite entry is changed
+func onRewriteChanged(domain string) {
+	if Context.dnsServer != nil {
+		Context.dnsServer.FlushCache(domain)
+	}
+}
+
+// Get the file where the custom blocked services are cached
+func blockedServicesCacheFile() string {
+	return filepath.Join(Context.getDataDir(), "blocked_services_cache.yaml")
+}
+
 // initDNSServer creates an instance of the dnsforward.Server
 // Please note that we must do it even if we don't start it
 // so that we had access to the query log and the stats
@@ -27,10 +39,18 @@ func initDNSServer() error {
 	var err error
 	baseDir := Context.getDataDir()
 
+	anonConf := config.DNS.IPAnonymizerConfig
+	anonConf.KeyFile = filepath.Join(baseDir, "anonymizer.key")
+	anonymizer, err := util.NewIPAnonymizer(anonConf)
+	if err != nil {
+		return fmt.Errorf("couldn't initialize IP anonymizer: %s", err)
+	}
+
 	statsConf := stats.Config{
 		Filename:          filepath.Join(baseDir, "stats.db"),
 		LimitDays:         config.DNS.StatsInterval,
 		AnonymizeClientIP: config.DNS.AnonymizeClientIP,
+		Anonymizer:        anonymizer,
 		ConfigModified:    onConfigModified,
 		HTTPRegister:      httpRegister,
 	}
@@ -45,6 +65,7 @@ func initDNSServer() error {
 		Interval:          config.DNS.QueryLogInterval,
 		MemSize:           config.DNS.QueryLogMemSize,
 		AnonymizeClientIP: config.DNS.AnonymizeClientIP,
+		Anonymizer:        anonymizer,
 		ConfigModified:    onConfigModified,
 		HTTPRegister:      httpRegister,
 	}
@@ -58,7 +79,12 @@ func initDNSServer() error {
 	filterConf.ResolverAddress = fmt.Sprintf("%s:%d", bindhost, config.DNS.Port)
 	filterConf.AutoHosts = &Context.autoHosts
 	filterConf.ConfigModified = onConfigModified
+	filterConf.RewriteChanged = onRewriteChanged
+	filterConf.FilterListSets = Context.clients.FilterListSets
 	filterConf.HTTPRegister = httpRegister
+	filterConf.RuleHitsFile = filepath.Join(baseDir, "rule_hits.json")
+	filterConf.HTTPClient = Context.client
+	filterConf.BlockedServicesCacheFile = blockedServicesCacheFile()
 	Context.dnsFilter = dnsfilter.New(&filterConf, nil)
 
 	p := dnsforward.DNSCreateParams{
@@ -180,6 +206,12 @@ func generateServerConfig() dnsforward.ServerConfig {
 	newconfig.TLSv12Roots = Context.tlsRoots
 	newconfig.TLSCiphers = Context.tlsCiphers
 	newconfig.TLSAllowUnencryptedDOH = tlsConf.AllowUnencryptedDOH
+	newconfig.TLSServerName = tlsConf.ServerName
+	if Context.dhcpServer != nil {
+		newconfig.FindMACByIP = Context.dhcpServer.FindMACbyIP
+	}
+
+	newconfig.CacheFile = filepath.Join(Context.getDataDir(), "dnscache.db")
 
 	newconfig.FilterHandler = applyAdditionalFiltering
 	newconfig.GetCustomUpstreamByClient = Context.clients.FindUpstreams
@@ -228,7 +260,7 @@ func getDNSAddresses() []string {
 	return dnsAddresses
 }
 
-// If a client has his own settings, apply them
+// If a client has his own settings or active filtering schedules, apply them
 func applyAdditionalFiltering(clientAddr string, setts *dnsfilter.RequestFilteringSettings) {
 	Context.dnsFilter.ApplyBlockedServices(setts, nil, true)
 
@@ -250,15 +282,26 @@ func applyAdditionalFiltering(clientAddr string, setts *dnsfilter.RequestFilteri
 
 	setts.ClientName = c.Name
 	setts.ClientTags = c.Tags
+	setts.FilterListIDs = Context.clients.FindFilterListIDs(&c)
 
-	if !c.UseOwnSettings {
-		return
+	if c.UseOwnSettings {
+		setts.FilteringEnabled = c.FilteringEnabled
+		setts.SafeSearchEnabled = c.SafeSearchEnabled
+		setts.SafeBrowsingEnabled = c.SafeBrowsingEnabled
+		setts.ParentalEnabled = c.ParentalEnabled
+	}
+
+	if c.UseOwnResponseFiltering {
+		setts.FilterResponseCNAME = c.FilterResponseCNAME
+		setts.FilterResponseIP = c.FilterResponseIP
+	}
+
+	if c.UseOwnSafeSearchSettings {
+		setts.SafeSearchDisabledEngines = c.SafeSearchDisabledEngines
+		setts.SafeSearchStrict = c.SafeSearchStrict
 	}
 
-	setts.FilteringEnabled = c.FilteringEnabled
-	setts.SafeSearchEnabled = c.SafeSearchEnabled
-	setts.SafeBrowsingEnabled = c.SafeBrowsingEnabled
-	setts.ParentalEnabled = c.ParentalEnabled
+	Context.clients.applySchedules(&c, setts)
 }
 
 func startDNSServer() error {
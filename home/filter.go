@@ -18,6 +18,7 @@ import (
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 	"github.com/AdguardTeam/AdGuardHome/util"
 	"github.com/AdguardTeam/golibs/log"
+	"github.com/fsnotify/fsnotify"
 )
 
 var (
@@ -30,6 +31,14 @@ type Filtering struct {
 	refreshStatus     uint32 // 0:none; 1:in progress
 	refreshLock       sync.Mutex
 	filterTitleRegexp *regexp.Regexp
+
+	// watcher for the local filter sources
+	watcher         *fsnotify.Watcher
+	watchLock       sync.Mutex
+	watchedDirs     map[string]bool // directories being watched
+	localSources    []string        // local filter sources (file and directory paths and glob patterns)
+	watchUpdateChan chan bool       // signal for 'watchUpdateLoop' goroutine
+	watchStop       chan bool       // closed when the watcher is stopped
 }
 
 // Init - initialize the module
@@ -51,10 +60,13 @@ func (f *Filtering) Start() {
 	//  but currently we can't wake up the periodic task to do so.
 	// So for now we just start this periodic task from here.
 	go f.periodicallyRefreshFilters()
+
+	f.startWatcher()
 }
 
 // Close - close the module
 func (f *Filtering) Close() {
+	f.stopWatcher()
 }
 
 func defaultFilters() []filter {
@@ -68,12 +80,21 @@ func defaultFilters() []filter {
 // field ordering is important -- yaml fields will mirror ordering from here
 type filter struct {
 	Enabled     bool
-	URL         string    // URL or a file path
+	URL         string    // URL, or a path to a file or a directory, or a glob pattern
 	Name        string    `yaml:"name"`
+	Mirrors     []string  `yaml:"mirrors,omitempty"` // URLs to download the filter from if URL is unavailable
 	RulesCount  int       `yaml:"-"`
 	LastUpdated time.Time `yaml:"-"`
 	checksum    uint32    // checksum of the file data
 	white       bool
+	ruleStats   dnsfilter.RuleStats // the numbers of rules of each type
+
+	etag          string    // ETag of the last downloaded data
+	lastModified  string    // Last-Modified of the last downloaded data
+	lastError     string    // the error of the last update attempt
+	lastErrorTime time.Time // the time of the last failed update attempt
+	failures      int       // the number of consecutive failed update attempts
+	retryAfter    time.Time // don't try to update the filter until this time
 
 	dnsfilter.Filter `yaml:",inline"`
 }
@@ -117,6 +138,9 @@ func (f *Filtering) filterSetProperties(url string, newf filter, whitelist bool)
 		log.Debug("filter: set properties: %s: {%s %s %v}",
 			filt.URL, newf.Name, newf.URL, newf.Enabled)
 		filt.Name = newf.Name
+		if newf.Mirrors != nil {
+			filt.Mirrors = newf.Mirrors
+		}
 
 		if filt.URL != newf.URL {
 			r |= statusURLChanged | statusUpdateRequired
@@ -125,9 +149,13 @@ func (f *Filtering) filterSetProperties(url string, newf filter, whitelist bool)
 			}
 			filt.URL = newf.URL
 			filt.unload()
+			filt.removeHistory()
 			filt.LastUpdated = time.Time{}
 			filt.checksum = 0
 			filt.RulesCount = 0
+			filt.etag = ""
+			filt.lastModified = ""
+			filt.updateSucceeded()
 		}
 
 		if filt.Enabled != newf.Enabled {
@@ -293,7 +321,7 @@ func (f *Filtering) refreshFilters(flags int, important bool) (int, error) {
 	return nUpdated, nil
 }
 
-func (f *Filtering) refreshFiltersArray(filters *[]filter, force bool) (int, []filter, []bool, bool) {
+func (f *Filtering) refreshFiltersArray(filters *[]filter, force bool, localOnly bool) (int, []filter, []bool, bool) {
 	var updateFilters []filter
 	var updateFlags []bool // 'true' if filter data has changed
 
@@ -302,12 +330,12 @@ func (f *Filtering) refreshFiltersArray(filters *[]filter, force bool) (int, []f
 	for i := range *filters {
 		f := &(*filters)[i] // otherwise we will be operating on a copy
 
-		if !f.Enabled {
+		if !f.Enabled || (localOnly && !filepath.IsAbs(f.URL)) {
 			continue
 		}
 
 		expireTime := f.LastUpdated.Unix() + int64(config.DNS.FiltersUpdateIntervalHours)*60*60
-		if !force && expireTime > now.Unix() {
+		if !force && (expireTime > now.Unix() || now.Before(f.retryAfter)) {
 			continue
 		}
 
@@ -315,7 +343,13 @@ func (f *Filtering) refreshFiltersArray(filters *[]filter, force bool) (int, []f
 		uf.ID = f.ID
 		uf.URL = f.URL
 		uf.Name = f.Name
+		uf.Mirrors = f.Mirrors
+		uf.LastUpdated = f.LastUpdated
 		uf.checksum = f.checksum
+		uf.ruleStats = f.ruleStats
+		uf.etag = f.etag
+		uf.lastModified = f.lastModified
+		uf.failures = f.failures
 		updateFilters = append(updateFilters, uf)
 	}
 	config.RUnlock()
@@ -336,10 +370,6 @@ func (f *Filtering) refreshFiltersArray(filters *[]filter, force bool) (int, []f
 		}
 	}
 
-	if nfail == len(updateFilters) {
-		return 0, nil, nil, true
-	}
-
 	updateCount := 0
 	for i := range updateFilters {
 		uf := &updateFilters[i]
@@ -352,6 +382,12 @@ func (f *Filtering) refreshFiltersArray(filters *[]filter, force bool) (int, []f
 				continue
 			}
 			f.LastUpdated = uf.LastUpdated
+			f.etag = uf.etag
+			f.lastModified = uf.lastModified
+			f.lastError = uf.lastError
+			f.lastErrorTime = uf.lastErrorTime
+			f.failures = uf.failures
+			f.retryAfter = uf.retryAfter
 			if !updated {
 				continue
 			}
@@ -361,11 +397,16 @@ func (f *Filtering) refreshFiltersArray(filters *[]filter, force bool) (int, []f
 			f.Name = uf.Name
 			f.RulesCount = uf.RulesCount
 			f.checksum = uf.checksum
+			f.ruleStats = uf.ruleStats
 			updateCount++
 		}
 		config.Unlock()
 	}
 
+	if nfail == len(updateFilters) {
+		return 0, nil, nil, true
+	}
+
 	return updateCount, updateFilters, updateFlags, false
 }
 
@@ -373,6 +414,7 @@ const (
 	FilterRefreshForce      = 1 // ignore last file modification date
 	FilterRefreshAllowlists = 2 // update allow-lists
 	FilterRefreshBlocklists = 4 // update block-lists
+	FilterRefreshLocal      = 8 // update only the filters with local sources (ignore last file modification date)
 )
 
 // Checks filters updates if necessary
@@ -403,17 +445,18 @@ func (f *Filtering) refreshFiltersIfNecessary(flags int) (int, bool) {
 	netError := false
 	netErrorW := false
 	force := false
-	if (flags & FilterRefreshForce) != 0 {
+	if (flags & (FilterRefreshForce | FilterRefreshLocal)) != 0 {
 		force = true
 	}
+	localOnly := (flags & FilterRefreshLocal) != 0
 	if (flags & FilterRefreshBlocklists) != 0 {
-		updateCount, updateFilters, updateFlags, netError = f.refreshFiltersArray(&config.Filters, force)
+		updateCount, updateFilters, updateFlags, netError = f.refreshFiltersArray(&config.Filters, force, localOnly)
 	}
 	if (flags & FilterRefreshAllowlists) != 0 {
 		updateCountW := 0
 		var updateFiltersW []filter
 		var updateFlagsW []bool
-		updateCountW, updateFiltersW, updateFlagsW, netErrorW = f.refreshFiltersArray(&config.WhitelistFilters, force)
+		updateCountW, updateFiltersW, updateFlagsW, netErrorW = f.refreshFiltersArray(&config.WhitelistFilters, force, localOnly)
 		updateCount += updateCountW
 		updateFilters = append(updateFilters, updateFiltersW...)
 		updateFlags = append(updateFlags, updateFlagsW...)
@@ -451,17 +494,20 @@ func isPrintableText(data []byte, len int) bool {
 	return true
 }
 
-// A helper function that parses filter contents and returns a number of rules and a filter name (if there's any)
-func (f *Filtering) parseFilterContents(file io.Reader) (int, uint32, string) {
-	rulesCount := 0
+// A helper function that parses filter contents and returns the statistics of rules and a filter name (if there's any)
+// Each rule is classified by its type (see dnsfilter.CheckRule())
+func (f *Filtering) parseFilterContents(file io.Reader) (dnsfilter.RuleStats, uint32, string) {
+	stats := dnsfilter.RuleStats{}
 	name := ""
 	seenTitle := false
 	r := bufio.NewReader(file)
 	checksum := uint32(0)
+	lineNum := 0
 
 	for {
 		line, err := r.ReadString('\n')
 		checksum = crc32.Update(checksum, crc32.IEEETable, []byte(line))
+		lineNum++
 
 		line = strings.TrimSpace(line)
 		if len(line) == 0 {
@@ -474,11 +520,8 @@ func (f *Filtering) parseFilterContents(file io.Reader) (int, uint32, string) {
 				seenTitle = true
 			}
 
-		} else if line[0] == '#' {
-			//
-
 		} else {
-			rulesCount++
+			stats.Add(line, lineNum)
 		}
 
 		if err != nil {
@@ -486,12 +529,18 @@ func (f *Filtering) parseFilterContents(file io.Reader) (int, uint32, string) {
 		}
 	}
 
-	return rulesCount, checksum, name
+	return stats, checksum, name
 }
 
 // Perform upgrade on a filter and update LastUpdated value
+// If the update fails, LastUpdated isn't changed and the next attempt is delayed (see updateFailed())
 func (f *Filtering) update(filter *filter) (bool, error) {
 	b, err := f.updateIntl(filter)
+	if err != nil {
+		filter.updateFailed(err, time.Now())
+		return false, err
+	}
+	filter.updateSucceeded()
 	filter.LastUpdated = time.Now()
 	if !b {
 		e := os.Chtimes(filter.Path(), filter.LastUpdated, filter.LastUpdated)
@@ -518,28 +567,29 @@ func (f *Filtering) updateIntl(filter *filter) (bool, error) {
 	}()
 
 	var reader io.Reader
+	// HTTP validators are saved only when the data is accepted
+	etag := ""
+	lastModified := ""
 	if filepath.IsAbs(filter.URL) {
-		f, err := os.Open(filter.URL)
+		r, closeFiles, err := openLocalFilter(filter.URL)
 		if err != nil {
-			return false, fmt.Errorf("open file: %s", err)
+			return false, err
 		}
-		defer f.Close()
-		reader = f
+		defer closeFiles()
+		reader = r
 	} else {
-		resp, err := Context.client.Get(filter.URL)
-		if resp != nil && resp.Body != nil {
-			defer resp.Body.Close()
-		}
+		d, err := downloadFilter(filter)
 		if err != nil {
-			log.Printf("Couldn't request filter from URL %s, skipping: %s", filter.URL, err)
 			return false, err
 		}
-
-		if resp.StatusCode != 200 {
-			log.Printf("Got status code %d from URL %s, skipping", resp.StatusCode, filter.URL)
-			return false, fmt.Errorf("got status code != 200: %d", resp.StatusCode)
+		if d.body == nil {
+			log.Tracef("Filter #%d at URL %s hasn't been modified, not updating it", filter.ID, filter.URL)
+			return false, nil
 		}
-		reader = resp.Body
+		defer d.body.Close()
+		reader = d.body
+		etag = d.etag
+		lastModified = d.lastModified
 	}
 
 	htmlTest := true
@@ -589,31 +639,70 @@ func (f *Filtering) updateIntl(filter *filter) (bool, error) {
 
 	// Extract filter name and count number of rules
 	_, _ = tmpFile.Seek(0, io.SeekStart)
-	rulesCount, checksum, filterName := f.parseFilterContents(tmpFile)
+	stats, checksum, filterName := f.parseFilterContents(tmpFile)
+	rulesCount := stats.Supported()
 	// Check if the filter has been really changed
 	if filter.checksum == checksum {
 		log.Tracef("Filter #%d at URL %s hasn't changed, not updating it", filter.ID, filter.URL)
+		filter.etag = etag
+		filter.lastModified = lastModified
 		return false, nil
 	}
-
-	log.Printf("Filter %d has been updated: %d bytes, %d rules",
-		filter.ID, total, rulesCount)
-	if len(filter.Name) == 0 {
-		filter.Name = filterName
+	if f.isRolledBackVersion(filter, checksum) {
+		log.Info("Filter #%d has been rolled back from this version, not updating it", filter.ID)
+		filter.etag = etag
+		filter.lastModified = lastModified
+		return false, nil
 	}
-	filter.RulesCount = rulesCount
-	filter.checksum = checksum
+
+	log.Printf("Filter %d has been updated: %d bytes, %d rules (invalid: %d, unsupported: %d)",
+		filter.ID, total, rulesCount, stats.Invalid, stats.Unsupported)
 	filterFilePath := filter.Path()
+
+	// Get the rules added and removed by this update
+	diff, err := filterFilesDiff(filterFilePath, tmpFile.Name())
+	if err != nil {
+		log.Error("Filter #%d: can't compare with the previous version: %s", filter.ID, err)
+	}
+
 	log.Printf("Saving filter %d contents to: %s", filter.ID, filterFilePath)
 
 	// Closing the file before renaming it is necessary on Windows
 	_ = tmpFile.Close()
+
+	// Keep the previous version
+	if diff != nil {
+		err = os.Rename(filterFilePath, filter.prevPath())
+		if err != nil {
+			return false, err
+		}
+	}
+
 	err = os.Rename(tmpFile.Name(), filterFilePath)
 	if err != nil {
+		if diff != nil {
+			// restore the current version
+			_ = os.Rename(filter.prevPath(), filterFilePath)
+		}
 		return false, err
 	}
 	tmpFile = nil
 
+	if len(filter.Name) == 0 {
+		filter.Name = filterName
+	}
+	filter.RulesCount = rulesCount
+	filter.checksum = checksum
+	filter.ruleStats = stats
+
+	if diff != nil {
+		log.Info("Filter #%d: +%d -%d rules", filter.ID, diff.RulesAdded, diff.RulesRemoved)
+		diff.Time = time.Now()
+		filter.addHistory(*diff)
+	}
+
+	filter.etag = etag
+	filter.lastModified = lastModified
 	return true, nil
 }
 
@@ -636,10 +725,11 @@ func (f *Filtering) load(filter *filter) error {
 
 	log.Tracef("File %s, id %d, length %d",
 		filterFilePath, filter.ID, st.Size())
-	rulesCount, checksum, _ := f.parseFilterContents(file)
+	stats, checksum, _ := f.parseFilterContents(file)
 
-	filter.RulesCount = rulesCount
+	filter.RulesCount = stats.Supported()
 	filter.checksum = checksum
+	filter.ruleStats = stats
 	filter.LastUpdated = filter.LastTimeUpdated()
 
 	return nil
@@ -649,6 +739,7 @@ func (f *Filtering) load(filter *filter) error {
 func (filter *filter) unload() {
 	filter.RulesCount = 0
 	filter.checksum = 0
+	filter.ruleStats = dnsfilter.RuleStats{}
 }
 
 // Path to the filter contents
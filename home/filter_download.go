@@ -0,0 +1,124 @@
+package home
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Filter downloading:
+//  the data is requested with ETag and Last-Modified validators of the previous download,
+//  so the server may respond with "304 Not Modified" instead of sending the whole list.
+//  The validators aren't kept across restarts, so until the next download
+//  If-Modified-Since is derived from the modification time of the filter file.
+// If the request to the filter URL fails, its mirrors are tried in order.
+// After a failed update the next attempt is delayed, and the delay grows with each failure.
+
+const (
+	filterRetryMinInterval = 5 * time.Minute // the delay after the first failed update
+	filterRetryMaxInterval = 24 * time.Hour  // the maximum delay (if the update interval isn't set)
+)
+
+// The response to a filter download request
+type filterDownload struct {
+	body         io.ReadCloser // nil if the data hasn't been modified
+	etag         string
+	lastModified string
+}
+
+// Download the filter data from the URL
+func downloadFilterURL(filter *filter, url string) (filterDownload, error) {
+	d := filterDownload{}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return d, err
+	}
+
+	// send the validators only if we still have the data they refer to
+	st, err := os.Stat(filter.Path())
+	if err == nil {
+		if len(filter.etag) != 0 {
+			req.Header.Set("If-None-Match", filter.etag)
+		}
+		if len(filter.lastModified) != 0 {
+			req.Header.Set("If-Modified-Since", filter.lastModified)
+		} else {
+			// the file is touched on each update, so the server's data hasn't changed since then
+			req.Header.Set("If-Modified-Since", st.ModTime().UTC().Format(http.TimeFormat))
+		}
+	}
+
+	resp, err := Context.client.Do(req)
+	if err != nil {
+		return d, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		d.body = resp.Body
+		d.etag = resp.Header.Get("ETag")
+		d.lastModified = resp.Header.Get("Last-Modified")
+		return d, nil
+
+	case http.StatusNotModified:
+		_ = resp.Body.Close()
+		d.etag = filter.etag
+		d.lastModified = filter.lastModified
+		return d, nil
+	}
+
+	_ = resp.Body.Close()
+	return d, fmt.Errorf("got status code != 200: %d", resp.StatusCode)
+}
+
+// Download the filter data, trying the filter URL and then its mirrors in order
+func downloadFilter(filter *filter) (filterDownload, error) {
+	var err error
+	for _, url := range append([]string{filter.URL}, filter.Mirrors...) {
+		var d filterDownload
+		d, err = downloadFilterURL(filter, url)
+		if err == nil {
+			return d, nil
+		}
+		log.Printf("Couldn't request filter from URL %s, skipping: %s", url, err)
+	}
+	return filterDownload{}, err
+}
+
+// Get the delay before the next update attempt after the specified number of consecutive failures
+func filterRetryInterval(failures int, updateInterval time.Duration) time.Duration {
+	max := filterRetryMaxInterval
+	if updateInterval != 0 && updateInterval < max {
+		max = updateInterval
+	}
+
+	d := filterRetryMinInterval
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// Remember the update error and schedule the next update attempt
+func (filter *filter) updateFailed(err error, now time.Time) {
+	filter.failures++
+	filter.lastError = err.Error()
+	filter.lastErrorTime = now
+	interval := time.Duration(config.DNS.FiltersUpdateIntervalHours) * time.Hour
+	filter.retryAfter = now.Add(filterRetryInterval(filter.failures, interval))
+}
+
+// Clear the update error
+func (filter *filter) updateSucceeded() {
+	filter.failures = 0
+	filter.lastError = ""
+	filter.lastErrorTime = time.Time{}
+	filter.retryAfter = time.Time{}
+}
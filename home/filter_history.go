@@ -0,0 +1,311 @@
+package home
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/file"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Filter update history:
+//  the previous version of each filter file is kept, so the filter can be rolled back to it.
+// On each update the rules added and removed by the update are stored in "<id>.history.json" file.
+
+const (
+	filterHistorySize  = 10   // the number of update diffs stored for each filter
+	filterDiffMaxRules = 1000 // the maximum number of added (removed) rules stored in an update diff
+)
+
+// The changes made by a filter update
+type filterUpdateDiff struct {
+	Time         time.Time `json:"time"`
+	Rollback     bool      `json:"rollback"` // the filter was rolled back to its previous version
+	RulesAdded   int       `json:"rules_added"`
+	RulesRemoved int       `json:"rules_removed"`
+	Added        []string  `json:"added"`   // no more than filterDiffMaxRules
+	Removed      []string  `json:"removed"` // no more than filterDiffMaxRules
+}
+
+// Path to the previous version of the filter contents
+func (filter *filter) prevPath() string {
+	return filter.Path() + ".prev"
+}
+
+// Path to the filter update history
+func (filter *filter) historyPath() string {
+	return filepath.Join(Context.getDataDir(), filterDir, strconv.FormatInt(filter.ID, 10)+".history.json")
+}
+
+// Remove the previous version of the filter contents and the update history
+func (filter *filter) removeHistory() {
+	for _, fn := range []string{filter.prevPath(), filter.historyPath()} {
+		err := os.Remove(fn)
+		if err != nil && !os.IsNotExist(err) {
+			log.Error("os.Remove: %s", err)
+		}
+	}
+}
+
+// Read the set of rules from a filter file
+// Return nil if the file doesn't exist
+func readFilterRules(fn string) (map[string]bool, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	rules := map[string]bool{}
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if len(line) != 0 && line[0] != '!' && line[0] != '#' {
+			rules[line] = true
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// Get the rules from 'a' which aren't in 'b'
+func filterRulesSub(a, b map[string]bool) ([]string, int) {
+	var list []string
+	n := 0
+	for rule := range a {
+		if b[rule] {
+			continue
+		}
+		n++
+		list = append(list, rule)
+	}
+	sort.Strings(list)
+	if len(list) > filterDiffMaxRules {
+		list = list[:filterDiffMaxRules]
+	}
+	return list, n
+}
+
+// Compute the rule-level difference between two filter files
+// Return nil if the old file doesn't exist
+func filterFilesDiff(oldFile, newFile string) (*filterUpdateDiff, error) {
+	oldRules, err := readFilterRules(oldFile)
+	if err != nil || oldRules == nil {
+		return nil, err
+	}
+	newRules, err := readFilterRules(newFile)
+	if err != nil {
+		return nil, err
+	}
+
+	d := filterUpdateDiff{}
+	d.Added, d.RulesAdded = filterRulesSub(newRules, oldRules)
+	d.Removed, d.RulesRemoved = filterRulesSub(oldRules, newRules)
+	return &d, nil
+}
+
+// Load the filter update history
+func (filter *filter) loadHistory() []filterUpdateDiff {
+	data, err := ioutil.ReadFile(filter.historyPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("Filter #%d: ioutil.ReadFile: %s", filter.ID, err)
+		}
+		return nil
+	}
+
+	list := []filterUpdateDiff{}
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		log.Error("Filter #%d: json.Unmarshal: %s", filter.ID, err)
+		return nil
+	}
+	return list
+}
+
+// Add a new diff to the beginning of the filter update history
+func (filter *filter) addHistory(d filterUpdateDiff) {
+	list := append([]filterUpdateDiff{d}, filter.loadHistory()...)
+	if len(list) > filterHistorySize {
+		list = list[:filterHistorySize]
+	}
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		log.Error("Filter #%d: json.Marshal: %s", filter.ID, err)
+		return
+	}
+	err = file.SafeWrite(filter.historyPath(), data)
+	if err != nil {
+		log.Error("Filter #%d: %s", filter.ID, err)
+	}
+}
+
+// Find the filter by URL
+// Note: must be called under config lock
+func findFilter(url string, whitelist bool) *filter {
+	filters := config.Filters
+	if whitelist {
+		filters = config.WhitelistFilters
+	}
+	for i := range filters {
+		if filters[i].URL == url {
+			return &filters[i]
+		}
+	}
+	return nil
+}
+
+// Return TRUE if the filter has been rolled back from the version with this checksum
+// After a rollback the previous version is the one the filter was rolled back from,
+//  so it isn't applied by updates until the filter's data changes.
+func (f *Filtering) isRolledBackVersion(filter *filter, checksum uint32) bool {
+	h := filter.loadHistory()
+	if len(h) == 0 || !h[0].Rollback {
+		return false
+	}
+
+	file, err := os.Open(filter.prevPath())
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	_, prevChecksum, _ := f.parseFilterContents(file)
+	return prevChecksum == checksum
+}
+
+// Roll the filter back to its previous version
+// The current version becomes the previous one, so the rollback can be undone by another rollback.
+func (f *Filtering) rollback(url string, whitelist bool) error {
+	f.refreshLock.Lock()
+	defer f.refreshLock.Unlock()
+
+	config.Lock()
+	defer config.Unlock()
+
+	filt := findFilter(url, whitelist)
+	if filt == nil {
+		return fmt.Errorf("filter not found")
+	}
+
+	_, err := os.Stat(filt.prevPath())
+	if err != nil {
+		return fmt.Errorf("the previous version of the filter isn't found")
+	}
+	d, err := filterFilesDiff(filt.Path(), filt.prevPath())
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		return fmt.Errorf("the current version of the filter isn't found")
+	}
+
+	// swap the current and the previous versions
+	tmpPath := filt.Path() + ".tmp"
+	err = os.Rename(filt.Path(), tmpPath)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(filt.prevPath(), filt.Path())
+	if err != nil {
+		_ = os.Rename(tmpPath, filt.Path())
+		return err
+	}
+	err = os.Rename(tmpPath, filt.prevPath())
+	if err != nil {
+		return err
+	}
+
+	// the rolled back version is kept until the filter's data changes (see isRolledBackVersion())
+	now := time.Now()
+	_ = os.Chtimes(filt.Path(), now, now)
+
+	if filt.Enabled {
+		err = f.load(filt)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Info("Filter #%d has been rolled back: +%d -%d rules",
+		filt.ID, d.RulesAdded, d.RulesRemoved)
+	d.Time = now
+	d.Rollback = true
+	filt.addHistory(*d)
+	return nil
+}
+
+// Get the update history of a filter
+func (f *Filtering) handleFilteringHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	url := q.Get("url")
+	whitelist := q.Get("whitelist") == "true"
+
+	config.RLock()
+	filt := findFilter(url, whitelist)
+	var list []filterUpdateDiff
+	if filt != nil {
+		list = filt.loadHistory()
+	}
+	config.RUnlock()
+
+	if filt == nil {
+		httpError(w, http.StatusBadRequest, "Filter not found")
+		return
+	}
+	if list == nil {
+		list = []filterUpdateDiff{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(list)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+}
+
+// Roll a filter back to its previous version
+func (f *Filtering) handleFilteringRollback(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		URL       string `json:"url"`
+		Whitelist bool   `json:"whitelist"`
+	}
+	req := request{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse request body json: %s", err)
+		return
+	}
+
+	// the filters update may be in progress
+	Context.controlLock.Unlock()
+	err = f.rollback(req.URL, req.Whitelist)
+	Context.controlLock.Lock()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	enableFilters(true)
+}
@@ -0,0 +1,270 @@
+package home
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/util"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/fsnotify/fsnotify"
+)
+
+// The filters are reloaded when no changes have been made to the local sources for this time,
+//  so a batch of changed files triggers one reload.
+const localFilterReloadDelay = 1 * time.Second
+
+// Local filter sources:
+//  filter URL may be an absolute path to a file, to a directory or a glob pattern (e.g. "/etc/adguard/lists/*.txt").
+// The files in a directory or matching a pattern are merged into one filter.
+// Local sources are watched for changes, and the filters are reloaded without waiting for the update interval.
+
+// Return TRUE if the local filter source is a glob pattern
+func isGlobPattern(src string) bool {
+	return strings.ContainsAny(src, "*?[")
+}
+
+// Return TRUE if the local filter source is valid:
+//  an existing file or directory, or a pattern for the files in an existing directory
+func isValidLocalFilterSource(src string) bool {
+	if isGlobPattern(src) {
+		_, err := filepath.Match(src, "")
+		return err == nil && util.FileExists(filepath.Dir(src))
+	}
+	return util.FileExists(src)
+}
+
+// Get the sorted list of files of the local filter source
+func localFilterFiles(src string) ([]string, error) {
+	var files []string
+
+	if isGlobPattern(src) {
+		matches, err := filepath.Glob(src)
+		if err != nil {
+			return nil, err
+		}
+		for _, fn := range matches {
+			st, err := os.Stat(fn)
+			if err == nil && st.Mode().IsRegular() {
+				files = append(files, fn)
+			}
+		}
+		sort.Strings(files)
+
+	} else {
+		st, err := os.Stat(src)
+		if err != nil {
+			return nil, err
+		}
+		if !st.IsDir() {
+			return []string{src}, nil
+		}
+
+		entries, err := ioutil.ReadDir(src)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.Mode().IsRegular() {
+				files = append(files, filepath.Join(src, e.Name()))
+			}
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no filter files found: %s", src)
+	}
+	return files, nil
+}
+
+// Open the files of the local filter source
+// Return the reader of the merged data and the function to close the files
+func openLocalFilter(src string) (io.Reader, func(), error) {
+	files, err := localFilterFiles(src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var opened []*os.File
+	closeAll := func() {
+		for _, f := range opened {
+			_ = f.Close()
+		}
+	}
+
+	var readers []io.Reader
+	for _, fn := range files {
+		f, err := os.Open(fn)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("open file: %s", err)
+		}
+		opened = append(opened, f)
+		// the last line of a file may not end with a new line
+		readers = append(readers, f, strings.NewReader("\n"))
+	}
+	return io.MultiReader(readers...), closeAll, nil
+}
+
+// Return TRUE if the file belongs to the local filter source
+func localFilterSourceMatch(src, fn string) bool {
+	if isGlobPattern(src) {
+		m, _ := filepath.Match(src, fn)
+		return m
+	}
+	src = filepath.Clean(src)
+	return fn == src || filepath.Dir(fn) == src
+}
+
+// Get the directory which is watched for the changes of the local filter source
+func localFilterWatchDir(src string) string {
+	if isGlobPattern(src) {
+		return filepath.Dir(src)
+	}
+	st, err := os.Stat(src)
+	if err == nil && st.IsDir() {
+		return filepath.Clean(src)
+	}
+	// watch the directory so we can notice the file that is replaced by rename
+	return filepath.Dir(src)
+}
+
+// Start watching the local filter sources
+func (f *Filtering) startWatcher() {
+	var err error
+	f.watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		log.Error("Filters: %s", err)
+		return
+	}
+	f.watchedDirs = map[string]bool{}
+	f.watchUpdateChan = make(chan bool, 2)
+	f.watchStop = make(chan bool)
+	go f.watcherLoop()
+	go f.watchUpdateLoop()
+
+	f.watchLocalFilters()
+}
+
+// Stop watching the local filter sources
+func (f *Filtering) stopWatcher() {
+	if f.watcher == nil {
+		return
+	}
+	_ = f.watcher.Close()
+	close(f.watchStop)
+}
+
+// Update the list of watched local filter sources
+// This function is called when the filters configuration is changed.
+func (f *Filtering) watchLocalFilters() {
+	if f.watcher == nil {
+		return
+	}
+
+	var sources []string
+	config.RLock()
+	for _, filters := range [][]filter{config.Filters, config.WhitelistFilters} {
+		for _, filt := range filters {
+			if filt.Enabled && filepath.IsAbs(filt.URL) {
+				sources = append(sources, filt.URL)
+			}
+		}
+	}
+	config.RUnlock()
+
+	dirs := map[string]bool{}
+	for _, src := range sources {
+		dirs[localFilterWatchDir(src)] = true
+	}
+
+	f.watchLock.Lock()
+	defer f.watchLock.Unlock()
+
+	f.localSources = sources
+	for dir := range f.watchedDirs {
+		if !dirs[dir] {
+			_ = f.watcher.Remove(dir)
+			delete(f.watchedDirs, dir)
+		}
+	}
+	for dir := range dirs {
+		if f.watchedDirs[dir] {
+			continue
+		}
+		err := f.watcher.Add(dir)
+		if err != nil {
+			log.Error("Filters: error while initializing watcher for a directory %s: %s", dir, err)
+			continue
+		}
+		f.watchedDirs[dir] = true
+	}
+}
+
+// Return TRUE if the file belongs to one of the local filter sources
+func (f *Filtering) isLocalFilterFile(fn string) bool {
+	f.watchLock.Lock()
+	defer f.watchLock.Unlock()
+	for _, src := range f.localSources {
+		if localFilterSourceMatch(src, fn) {
+			return true
+		}
+	}
+	return false
+}
+
+// Receive notifications from fsnotify package
+func (f *Filtering) watcherLoop() {
+	for {
+		select {
+		case event, ok := <-f.watcher.Events:
+			if !ok {
+				return
+			}
+
+			if !f.isLocalFilterFile(event.Name) ||
+				event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) == 0 {
+				continue
+			}
+
+			log.Debug("Filters: modified: %s", event.Name)
+			select {
+			case f.watchUpdateChan <- true:
+				// sent a signal to 'watchUpdateLoop' goroutine
+			default:
+				// queue is full
+			}
+
+		case err, ok := <-f.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Error("Filters: %s", err)
+		}
+	}
+}
+
+// Reload the filters with local sources
+func (f *Filtering) watchUpdateLoop() {
+	var reload <-chan time.Time
+	for {
+		select {
+		case <-f.watchUpdateChan:
+			// wait for the other changes
+			reload = time.After(localFilterReloadDelay)
+
+		case <-reload:
+			reload = nil
+			_, _ = f.refreshFilters(FilterRefreshBlocklists|FilterRefreshAllowlists|FilterRefreshLocal, true)
+
+		case <-f.watchStop:
+			log.Debug("Filters: finished watcher update loop")
+			return
+		}
+	}
+}
@@ -2,9 +2,11 @@ package home
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -51,7 +53,11 @@ func TestFilters(t *testing.T) {
 	ok, err := Context.filters.update(&f)
 	assert.Equal(t, nil, err)
 	assert.True(t, ok)
-	assert.Equal(t, 3, f.RulesCount)
+	// rules with $third-party modifier aren't used for DNS filtering
+	assert.Equal(t, 1, f.RulesCount)
+	assert.Equal(t, 1, f.ruleStats.Hosts)
+	assert.Equal(t, 2, f.ruleStats.Unsupported)
+	assert.Equal(t, 1, f.ruleStats.Errors[0].Line)
 
 	// refresh
 	ok, err = Context.filters.update(&f)
@@ -63,3 +69,228 @@ func TestFilters(t *testing.T) {
 	f.unload()
 	_ = os.Remove(f.Path())
 }
+
+func TestFiltersHistory(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.filters.Init()
+
+	src, _ := filepath.Abs(filepath.Join(dir, "list.txt"))
+	_ = ioutil.WriteFile(src, []byte("! Title: list\n||example.org^\n||example.com^\n"), 0644)
+
+	config.Filters = []filter{{Enabled: true, URL: src}}
+	config.Filters[0].ID = 100
+	defer func() { config.Filters = nil }()
+	f := &config.Filters[0]
+
+	ok, err := Context.filters.update(f)
+	assert.True(t, ok && err == nil)
+	assert.Equal(t, 0, len(f.loadHistory()))
+
+	// update
+	_ = ioutil.WriteFile(src, []byte("! Title: list\n||example.org^\n||example.net^\n"), 0644)
+	ok, err = Context.filters.update(f)
+	assert.True(t, ok && err == nil)
+
+	h := f.loadHistory()
+	assert.Equal(t, 1, len(h))
+	assert.Equal(t, []string{"||example.net^"}, h[0].Added)
+	assert.Equal(t, []string{"||example.com^"}, h[0].Removed)
+	assert.False(t, h[0].Rollback)
+
+	// rollback
+	assert.Nil(t, Context.filters.rollback(src, false))
+	assert.Equal(t, 2, f.RulesCount)
+	rules, _ := readFilterRules(f.Path())
+	assert.True(t, rules["||example.com^"])
+	assert.False(t, rules["||example.net^"])
+
+	h = f.loadHistory()
+	assert.Equal(t, 2, len(h))
+	assert.True(t, h[0].Rollback)
+	assert.Equal(t, []string{"||example.com^"}, h[0].Added)
+	assert.Equal(t, []string{"||example.net^"}, h[0].Removed)
+
+	// the version the filter has been rolled back from isn't applied again
+	ok, err = Context.filters.update(f)
+	assert.True(t, !ok && err == nil)
+	rules, _ = readFilterRules(f.Path())
+	assert.True(t, rules["||example.com^"])
+
+	// the filter's data has changed
+	_ = ioutil.WriteFile(src, []byte("! Title: list\n||example.org^\n||example.info^\n"), 0644)
+	ok, err = Context.filters.update(f)
+	assert.True(t, ok && err == nil)
+	rules, _ = readFilterRules(f.Path())
+	assert.True(t, rules["||example.info^"])
+	assert.Equal(t, 3, len(f.loadHistory()))
+
+	assert.NotNil(t, Context.filters.rollback("/unknown", false))
+
+	f.removeHistory()
+	assert.Equal(t, 0, len(f.loadHistory()))
+	assert.NotNil(t, Context.filters.rollback(src, false))
+}
+
+func TestFiltersLocalSources(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.filters.Init()
+
+	listsDir, _ := filepath.Abs(filepath.Join(dir, "lists"))
+	_ = os.MkdirAll(listsDir, 0755)
+	_ = ioutil.WriteFile(filepath.Join(listsDir, "1.txt"), []byte("||example.org^"), 0644)
+	_ = ioutil.WriteFile(filepath.Join(listsDir, "2.txt"), []byte("||example.com^\n"), 0644)
+	_ = ioutil.WriteFile(filepath.Join(listsDir, "3.list"), []byte("||example.net^\n"), 0644)
+
+	assert.True(t, IsValidURL(listsDir))
+	assert.True(t, IsValidURL(filepath.Join(listsDir, "*.txt")))
+	assert.False(t, IsValidURL(filepath.Join(listsDir, "[.txt")))
+	assert.False(t, IsValidURL(filepath.Join(listsDir, "unknown", "*.txt")))
+
+	// directory: all files are merged
+	f := filter{URL: listsDir}
+	ok, err := Context.filters.update(&f)
+	assert.True(t, ok && err == nil)
+	assert.Equal(t, 3, f.RulesCount)
+
+	// glob pattern
+	f = filter{URL: filepath.Join(listsDir, "*.txt")}
+	f.ID = 1
+	ok, err = Context.filters.update(&f)
+	assert.True(t, ok && err == nil)
+	assert.Equal(t, 2, f.RulesCount)
+
+	// no files
+	f = filter{URL: filepath.Join(listsDir, "*.csv")}
+	f.ID = 2
+	_, err = Context.filters.update(&f)
+	assert.NotNil(t, err)
+
+	src := filepath.Join(listsDir, "*.txt")
+	assert.True(t, localFilterSourceMatch(src, filepath.Join(listsDir, "4.txt")))
+	assert.False(t, localFilterSourceMatch(src, filepath.Join(listsDir, "4.list")))
+	assert.True(t, localFilterSourceMatch(listsDir, filepath.Join(listsDir, "4.list")))
+	assert.Equal(t, listsDir, localFilterWatchDir(src))
+	assert.Equal(t, listsDir, localFilterWatchDir(listsDir))
+	assert.Equal(t, listsDir, localFilterWatchDir(filepath.Join(listsDir, "1.txt")))
+}
+
+func TestFiltersConditionalDownload(t *testing.T) {
+	nReqs := 0
+	nNotModified := 0
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/filter.txt", func(w http.ResponseWriter, r *http.Request) {
+		nReqs++
+		if r.Header.Get("If-None-Match") == `"1"` {
+			nNotModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		if err == nil && !modTime.After(ims) {
+			nNotModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"1"`)
+		_, _ = w.Write([]byte("||example.org^\n"))
+	})
+	mux.HandleFunc("/unavailable.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() { _ = http.Serve(l, mux) }()
+	defer func() { _ = l.Close() }()
+	base := fmt.Sprintf("http://127.0.0.1:%d", l.Addr().(*net.TCPAddr).Port)
+
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.client = &http.Client{
+		Timeout: 5 * time.Second,
+	}
+	Context.filters.Init()
+
+	// the filter URL is unavailable, the mirror is used
+	f := filter{
+		URL:     base + "/unavailable.txt",
+		Mirrors: []string{base + "/filter.txt"},
+	}
+	f.ID = 1
+	ok, err := Context.filters.update(&f)
+	assert.True(t, ok && err == nil)
+	assert.Equal(t, 1, f.RulesCount)
+	assert.Equal(t, `"1"`, f.etag)
+
+	// the data hasn't been modified
+	ok, err = Context.filters.update(&f)
+	assert.True(t, !ok && err == nil)
+	assert.Equal(t, 2, nReqs)
+	assert.Equal(t, 1, nNotModified)
+	assert.Equal(t, 1, f.RulesCount)
+
+	// the filter file is removed: the full data is requested
+	_ = os.Remove(f.Path())
+	f.unload()
+	ok, err = Context.filters.update(&f)
+	assert.True(t, ok && err == nil)
+	assert.Equal(t, 1, nNotModified)
+
+	// the validators are lost after restart: the modification time of the file is used
+	f.etag = ""
+	f.lastModified = ""
+	ok, err = Context.filters.update(&f)
+	assert.True(t, !ok && err == nil)
+	assert.Equal(t, 2, nNotModified)
+
+	// all URLs are unavailable
+	f.Mirrors = nil
+	lastUpdated := f.LastUpdated
+	now := time.Now()
+	ok, err = Context.filters.update(&f)
+	assert.True(t, !ok && err != nil)
+	assert.Equal(t, 1, f.failures)
+	assert.Equal(t, "got status code != 200: 503", f.lastError)
+	assert.Equal(t, lastUpdated, f.LastUpdated)
+	assert.True(t, f.retryAfter.After(now))
+
+	ok, err = Context.filters.update(&f)
+	assert.True(t, !ok && err != nil)
+	assert.Equal(t, 2, f.failures)
+
+	// the time of the last successful update is kept in the configuration
+	config.Filters = []filter{f}
+	config.Filters[0].Enabled = true
+	_, _, _, _ = Context.filters.refreshFiltersArray(&config.Filters, true, false)
+	assert.Equal(t, lastUpdated, config.Filters[0].LastUpdated)
+	assert.Equal(t, 3, config.Filters[0].failures)
+	config.Filters = nil
+
+	// the error is cleared after a successful update
+	f.Mirrors = []string{base + "/filter.txt"}
+	_, err = Context.filters.update(&f)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, f.failures)
+	assert.Equal(t, "", f.lastError)
+	assert.True(t, f.retryAfter.IsZero())
+
+	f.unload()
+	f.removeHistory()
+	_ = os.Remove(f.Path())
+}
+
+func TestFilterRetryInterval(t *testing.T) {
+	assert.Equal(t, 5*time.Minute, filterRetryInterval(1, 0))
+	assert.Equal(t, 10*time.Minute, filterRetryInterval(2, 0))
+	assert.Equal(t, 40*time.Minute, filterRetryInterval(4, 0))
+	assert.Equal(t, 24*time.Hour, filterRetryInterval(100, 0))
+	assert.Equal(t, time.Hour, filterRetryInterval(100, time.Hour))
+}
@@ -210,6 +210,12 @@ func run(args options) {
 	//  so we have to initialize dnsfilter's static data first,
 	//  but also avoid relying on automatic Go init() function
 	dnsfilter.InitModule()
+	// the custom services are loaded from their source in background by 'dnsfilter' module
+	dnsfilter.InitBlockedServices(config.DNS.DnsfilterConf.BlockedServicesSource, blockedServicesCacheFile())
+	err := dnsfilter.LoadSafeSearchEngines(config.DNS.DnsfilterConf.SafeSearchFile)
+	if err != nil {
+		log.Error("%s", err)
+	}
 
 	config.DHCP.WorkDir = Context.workDir
 	config.DHCP.HTTPRegister = httpRegister
@@ -220,8 +226,23 @@ func run(args options) {
 		os.Exit(1)
 	}
 	Context.autoHosts.Init("")
+	err = Context.clients.SetGroups(config.ClientGroups)
+	if err != nil {
+		log.Fatalf("Can't initialize client groups: %s", err)
+	}
+	config.ClientGroups = nil
 	Context.clients.Init(config.Clients, Context.dhcpServer, &Context.autoHosts)
 	config.Clients = nil
+	err = Context.clients.SetSchedules(config.ClientSchedules)
+	if err != nil {
+		log.Fatalf("Can't initialize filtering schedules: %s", err)
+	}
+	config.ClientSchedules = nil
+	err = Context.clients.SetTagFilterLists(config.ClientTagFilterLists)
+	if err != nil {
+		log.Fatalf("Can't initialize filter lists for client tags: %s", err)
+	}
+	config.ClientTagFilterLists = nil
 
 	if (runtime.GOOS == "linux" || runtime.GOOS == "darwin") &&
 		config.RlimitNoFile != 0 {
@@ -257,7 +278,7 @@ func run(args options) {
 		}
 	}
 
-	err := os.MkdirAll(Context.getDataDir(), 0755)
+	err = os.MkdirAll(Context.getDataDir(), 0755)
 	if err != nil {
 		log.Fatalf("Cannot create DNS data dir at %s: %s", Context.getDataDir(), err)
 	}
@@ -0,0 +1,252 @@
+package home
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+)
+
+// Filtering schedules: weekly time ranges during which additional filtering settings are applied
+//  to persistent clients (by name) or to all clients with a tag.
+
+const (
+	minutesInDay  = 24 * 60
+	minutesInWeek = 7 * minutesInDay
+)
+
+// Short weekday names, the index is time.Weekday
+var scheduleDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// A weekly time range
+type scheduleRange struct {
+	Days  []string `yaml:"days" json:"days"`   // "mon", "tue", ...
+	Start string   `yaml:"start" json:"start"` // "HH:MM"
+	End   string   `yaml:"end" json:"end"`     // "HH:MM";  if it's not after Start, the range ends on the next day
+}
+
+// Time range in minutes since Sunday 00:00 (end may exceed minutesInWeek)
+type weekRange struct {
+	start int
+	end   int
+}
+
+// Filtering schedule
+type clientSchedule struct {
+	Name     string          `yaml:"name" json:"name"`
+	Clients  []string        `yaml:"clients" json:"clients"`     // persistent client names
+	Tags     []string        `yaml:"tags" json:"tags"`           // client tags
+	TimeZone string          `yaml:"time_zone" json:"time_zone"` // e.g. "Europe/Berlin";  empty: local time
+	Ranges   []scheduleRange `yaml:"ranges" json:"ranges"`
+
+	// Settings applied while the schedule is active
+	BlockedServices []string `yaml:"blocked_services" json:"blocked_services"` // in addition to the client's services
+	ParentalEnabled bool     `yaml:"parental_enabled" json:"parental_enabled"`
+	BlockAll        bool     `yaml:"block_all" json:"block_all"` // block all requests
+
+	location   *time.Location
+	weekRanges []weekRange
+}
+
+// Additional filtering settings from the active schedules
+type scheduleSettings struct {
+	blockedServices []string
+	parentalEnabled bool
+	blockAll        bool
+}
+
+// Parse "HH:MM" string into the number of minutes since 00:00
+func parseDayTime(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) != 2 {
+		return 0, fmt.Errorf("invalid time: %s", s)
+	}
+	h, err := strconv.Atoi(parts[0])
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("invalid time: %s", s)
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time: %s", s)
+	}
+	return h*60 + m, nil
+}
+
+func parseWeekday(s string) (int, error) {
+	for i, d := range scheduleDays {
+		if strings.EqualFold(s, d) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day: %s", s)
+}
+
+// Check and prepare the schedule for use
+func (sch *clientSchedule) prepare() error {
+	if len(sch.Name) == 0 {
+		return fmt.Errorf("schedule name is empty")
+	}
+
+	for _, s := range sch.BlockedServices {
+		if !dnsfilter.BlockedSvcKnown(s) {
+			return fmt.Errorf("%s: unknown blocked service: %s", sch.Name, s)
+		}
+	}
+
+	loc, err := time.LoadLocation(sch.TimeZone)
+	if err != nil {
+		return fmt.Errorf("%s: invalid time zone: %s", sch.Name, err)
+	}
+	sch.location = loc
+
+	sch.weekRanges = nil
+	for _, r := range sch.Ranges {
+		start, err := parseDayTime(r.Start)
+		if err != nil {
+			return fmt.Errorf("%s: %s", sch.Name, err)
+		}
+		end, err := parseDayTime(r.End)
+		if err != nil {
+			return fmt.Errorf("%s: %s", sch.Name, err)
+		}
+		if start == minutesInDay {
+			return fmt.Errorf("%s: invalid start time: %s", sch.Name, r.Start)
+		}
+		if end <= start {
+			end += minutesInDay
+		}
+
+		if len(r.Days) == 0 {
+			return fmt.Errorf("%s: no days in time range", sch.Name)
+		}
+		for _, d := range r.Days {
+			day, err := parseWeekday(d)
+			if err != nil {
+				return fmt.Errorf("%s: %s", sch.Name, err)
+			}
+			wr := weekRange{
+				start: day*minutesInDay + start,
+				end:   day*minutesInDay + end,
+			}
+			sch.weekRanges = append(sch.weekRanges, wr)
+		}
+	}
+	return nil
+}
+
+// Return TRUE if the schedule is applied to the client
+func (sch *clientSchedule) matchClient(c *Client) bool {
+	for _, name := range sch.Clients {
+		if name == c.Name {
+			return true
+		}
+	}
+	for _, t := range sch.Tags {
+		for _, ct := range c.Tags {
+			if t == ct {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Return TRUE if the time is within one of the schedule's time ranges
+func (sch *clientSchedule) active(now time.Time) bool {
+	now = now.In(sch.location)
+	m := int(now.Weekday())*minutesInDay + now.Hour()*60 + now.Minute()
+	for _, r := range sch.weekRanges {
+		// a range on Saturday may end on Sunday of the next week
+		if (m >= r.start && m < r.end) ||
+			(m+minutesInWeek >= r.start && m+minutesInWeek < r.end) {
+			return true
+		}
+	}
+	return false
+}
+
+func scheduleArrayDup(a []clientSchedule) []clientSchedule {
+	a2 := make([]clientSchedule, len(a))
+	for i := range a {
+		a2[i] = a[i]
+		a2[i].Clients = stringArrayDup(a[i].Clients)
+		a2[i].Tags = stringArrayDup(a[i].Tags)
+		a2[i].BlockedServices = stringArrayDup(a[i].BlockedServices)
+		a2[i].Ranges = make([]scheduleRange, len(a[i].Ranges))
+		for j, r := range a[i].Ranges {
+			a2[i].Ranges[j] = r
+			a2[i].Ranges[j].Days = stringArrayDup(r.Days)
+		}
+	}
+	return a2
+}
+
+// SetSchedules - check and set the new list of filtering schedules
+func (clients *clientsContainer) SetSchedules(list []clientSchedule) error {
+	list = scheduleArrayDup(list)
+	names := map[string]bool{}
+	for i := range list {
+		err := list[i].prepare()
+		if err != nil {
+			return err
+		}
+		for _, t := range list[i].Tags {
+			if !clients.tagKnown(t) {
+				return fmt.Errorf("%s: invalid tag: %s", list[i].Name, t)
+			}
+		}
+		if names[list[i].Name] {
+			return fmt.Errorf("duplicate schedule name: %s", list[i].Name)
+		}
+		names[list[i].Name] = true
+	}
+
+	clients.lock.Lock()
+	clients.schedules = list
+	clients.lock.Unlock()
+	return nil
+}
+
+// WriteSchedulesConfig - write the filtering schedules configuration
+func (clients *clientsContainer) WriteSchedulesConfig(list *[]clientSchedule) {
+	clients.lock.Lock()
+	*list = scheduleArrayDup(clients.schedules)
+	clients.lock.Unlock()
+}
+
+// Get the settings from the client's schedules which are active now
+func (clients *clientsContainer) activeSchedules(c *Client) scheduleSettings {
+	ss := scheduleSettings{}
+	now := clients.now()
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	g := clients.groups[c.Group]
+	for i := range clients.schedules {
+		sch := &clients.schedules[i]
+		if !(sch.matchClient(c) || (g != nil && g.hasSchedule(sch.Name))) || !sch.active(now) {
+			continue
+		}
+		ss.blockedServices = append(ss.blockedServices, sch.BlockedServices...)
+		ss.parentalEnabled = ss.parentalEnabled || sch.ParentalEnabled
+		ss.blockAll = ss.blockAll || sch.BlockAll
+	}
+	return ss
+}
+
+// Apply the filtering settings from the client's active schedules
+func (clients *clientsContainer) applySchedules(c *Client, setts *dnsfilter.RequestFilteringSettings) {
+	ss := clients.activeSchedules(c)
+	if len(ss.blockedServices) != 0 {
+		dnsfilter.AddBlockedServices(setts, ss.blockedServices)
+	}
+	if ss.parentalEnabled {
+		setts.ParentalEnabled = true
+	}
+	if ss.blockAll {
+		setts.BlockAll = true
+	}
+}
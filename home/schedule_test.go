@@ -0,0 +1,100 @@
+package home
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientSchedules(t *testing.T) {
+	dnsfilter.InitModule()
+	clients := clientsContainer{}
+	clients.testing = true
+	clients.Init(nil, nil, nil)
+
+	_, _ = clients.Add(Client{Name: "kid", IDs: []string{"1.1.1.1"}, Tags: []string{"user_child"}})
+	_, _ = clients.Add(Client{Name: "adult", IDs: []string{"2.2.2.2"}})
+
+	loc, err := time.LoadLocation("Europe/Berlin")
+	assert.Nil(t, err)
+
+	// school nights: Sunday..Thursday, 21:00 - 07:00
+	list := []clientSchedule{
+		{
+			Name:     "school nights",
+			Tags:     []string{"user_child"},
+			TimeZone: "Europe/Berlin",
+			Ranges: []scheduleRange{
+				{Days: []string{"sun", "mon", "tue", "wed", "thu"}, Start: "21:00", End: "07:00"},
+			},
+			BlockAll: true,
+		},
+		{
+			Name:     "homework",
+			Clients:  []string{"kid"},
+			TimeZone: "Europe/Berlin",
+			Ranges: []scheduleRange{
+				{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "15:00", End: "18:00"},
+			},
+			BlockedServices: []string{"youtube"},
+			ParentalEnabled: true,
+		},
+	}
+	assert.Nil(t, clients.SetSchedules(list))
+
+	check := func(now time.Time, ip string) dnsfilter.RequestFilteringSettings {
+		clients.now = func() time.Time { return now }
+		setts := dnsfilter.RequestFilteringSettings{}
+		c, ok := clients.Find(ip)
+		assert.True(t, ok)
+		clients.applySchedules(&c, &setts)
+		return setts
+	}
+
+	// Monday 22:00
+	setts := check(time.Date(2020, 6, 1, 22, 0, 0, 0, loc), "1.1.1.1")
+	assert.True(t, setts.BlockAll)
+	assert.False(t, setts.ParentalEnabled)
+
+	// the same time in UTC
+	setts = check(time.Date(2020, 6, 1, 20, 0, 0, 0, time.UTC), "1.1.1.1")
+	assert.True(t, setts.BlockAll)
+
+	// the client doesn't match
+	setts = check(time.Date(2020, 6, 1, 22, 0, 0, 0, loc), "2.2.2.2")
+	assert.False(t, setts.BlockAll)
+
+	// Friday 06:59: the range started on Thursday
+	setts = check(time.Date(2020, 6, 5, 6, 59, 0, 0, loc), "1.1.1.1")
+	assert.True(t, setts.BlockAll)
+
+	// Saturday 22:00: weekend
+	setts = check(time.Date(2020, 6, 6, 22, 0, 0, 0, loc), "1.1.1.1")
+	assert.False(t, setts.BlockAll)
+
+	// Monday 06:00: the range started on Sunday of the previous week
+	setts = check(time.Date(2020, 6, 8, 6, 0, 0, 0, loc), "1.1.1.1")
+	assert.True(t, setts.BlockAll)
+
+	// Tuesday 16:00
+	setts = check(time.Date(2020, 6, 2, 16, 0, 0, 0, loc), "1.1.1.1")
+	assert.False(t, setts.BlockAll)
+	assert.True(t, setts.ParentalEnabled)
+	assert.Equal(t, 1, len(setts.ServicesRules))
+	assert.Equal(t, "youtube", setts.ServicesRules[0].Name)
+
+	// invalid schedules
+	assert.NotNil(t, clients.SetSchedules([]clientSchedule{{Name: "a", TimeZone: "Mars/Olympus"}}))
+	assert.NotNil(t, clients.SetSchedules([]clientSchedule{{Name: "a", Tags: []string{"unknown"}}}))
+	assert.NotNil(t, clients.SetSchedules([]clientSchedule{{Name: "a", BlockedServices: []string{"unknown"}}}))
+	assert.NotNil(t, clients.SetSchedules([]clientSchedule{{Name: "a", Ranges: []scheduleRange{{Days: []string{"mon"}, Start: "25:00", End: "07:00"}}}}))
+	assert.NotNil(t, clients.SetSchedules([]clientSchedule{{Name: "a", Ranges: []scheduleRange{{Days: []string{"monday"}, Start: "21:00", End: "07:00"}}}}))
+	assert.NotNil(t, clients.SetSchedules([]clientSchedule{{Name: "a"}, {Name: "a"}}))
+
+	// the previous settings are intact
+	list = []clientSchedule{}
+	clients.WriteSchedulesConfig(&list)
+	assert.Equal(t, 2, len(list))
+}
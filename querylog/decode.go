@@ -56,9 +56,17 @@ func decodeLogEntry(ent *logEntry, str string) {
 		case "Reason":
 			i, err = strconv.Atoi(v)
 			ent.Result.Reason = dnsfilter.Reason(i)
+		case "ResponseRRType":
+			ent.Result.ResponseRRType = v
+		case "ResponseName":
+			ent.Result.ResponseName = v
+		case "ResponseHost":
+			ent.Result.ResponseHost = v
 
 		case "Upstream":
 			ent.Upstream = v
+		case "DS":
+			ent.DNSSEC = v
 		case "Elapsed":
 			i, err = strconv.Atoi(v)
 			ent.Elapsed = time.Duration(i)
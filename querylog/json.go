@@ -2,7 +2,6 @@ package querylog
 
 import (
 	"fmt"
-	"net"
 	"strconv"
 	"time"
 
@@ -13,17 +12,7 @@ import (
 // Get Client IP address
 func (l *queryLog) getClientIP(clientIP string) string {
 	if l.conf.AnonymizeClientIP {
-		ip := net.ParseIP(clientIP)
-		if ip != nil {
-			ip4 := ip.To4()
-			const AnonymizeClientIP4Mask = 16
-			const AnonymizeClientIP6Mask = 112
-			if ip4 != nil {
-				clientIP = ip4.Mask(net.CIDRMask(AnonymizeClientIP4Mask, 32)).String()
-			} else {
-				clientIP = ip.Mask(net.CIDRMask(AnonymizeClientIP6Mask, 128)).String()
-			}
-		}
+		clientIP = l.conf.Anonymizer.Anonymize(clientIP)
 	}
 
 	return clientIP
@@ -95,6 +84,15 @@ func (l *queryLog) logEntryToJSONEntry(entry *logEntry) map[string]interface{} {
 		jsonEntry["service_name"] = entry.Result.ServiceName
 	}
 
+	if len(entry.Result.ResponseRRType) != 0 {
+		// the request is filtered by a record in DNS response (e.g. CNAME-cloaked tracker)
+		jsonEntry["response_match"] = map[string]interface{}{
+			"type": entry.Result.ResponseRRType,
+			"name": entry.Result.ResponseName,
+			"host": entry.Result.ResponseHost,
+		}
+	}
+
 	answers := answerToMap(msg)
 	if answers != nil {
 		jsonEntry["answer"] = answers
@@ -115,6 +113,10 @@ func (l *queryLog) logEntryToJSONEntry(entry *logEntry) map[string]interface{} {
 
 	jsonEntry["upstream"] = entry.Upstream
 
+	if len(entry.DNSSEC) != 0 {
+		jsonEntry["dnssec_status"] = entry.DNSSEC
+	}
+
 	return jsonEntry
 }
 
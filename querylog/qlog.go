@@ -45,7 +45,8 @@ type logEntry struct {
 
 	Result   dnsfilter.Result
 	Elapsed  time.Duration
-	Upstream string `json:",omitempty"` // if empty, means it was cached
+	Upstream string `json:",omitempty"`   // if empty, means it was cached
+	DNSSEC   string `json:"DS,omitempty"` // DNSSEC validation status
 }
 
 // create a new instance of the query log
@@ -125,6 +126,7 @@ func (l *queryLog) Add(params AddParams) {
 		Elapsed:     params.Elapsed,
 		Upstream:    params.Upstream,
 		ClientProto: params.ClientProto,
+		DNSSEC:      params.DNSSEC,
 	}
 	q := params.Question.Question[0]
 	entry.QHost = strings.ToLower(q.Name[:len(q.Name)-1]) // remove the last dot
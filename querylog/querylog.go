@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/util"
 	"github.com/miekg/dns"
 )
 
@@ -32,6 +33,10 @@ type Config struct {
 	MemSize           uint32 // number of entries kept in memory before they are flushed to disk
 	AnonymizeClientIP bool   // anonymize clients' IP addresses
 
+	// Converts clients' IP addresses when AnonymizeClientIP is set.
+	// If nil, the default mode is used.
+	Anonymizer *util.IPAnonymizer
+
 	// Called when the configuration is changed by HTTP request
 	ConfigModified func()
 
@@ -49,6 +54,7 @@ type AddParams struct {
 	ClientIP    net.IP
 	Upstream    string // Upstream server URL
 	ClientProto string // Protocol for the client connection: "" (plain), "doh", "dot"
+	DNSSEC      string // DNSSEC validation status: "" (not validated), "secure", "insecure", "bogus", "indeterminate"
 }
 
 // New - create a new instance of the query log
@@ -108,7 +108,8 @@ func (c *searchCriteria) match(entry *logEntry) bool {
 		case filteringStatusBlocked:
 			return res.IsFiltered &&
 				(res.Reason == dnsfilter.FilteredBlackList ||
-					res.Reason == dnsfilter.FilteredBlockedService)
+					res.Reason == dnsfilter.FilteredBlockedService ||
+					res.Reason == dnsfilter.FilteredBlockAll)
 		case filteringStatusBlockedParental:
 			return res.IsFiltered && res.Reason == dnsfilter.FilteredParental
 		case filteringStatusBlockedSafebrowsing:
@@ -124,6 +125,7 @@ func (c *searchCriteria) match(entry *logEntry) bool {
 		case filteringStatusProcessed:
 			return !(res.Reason == dnsfilter.FilteredBlackList ||
 				res.Reason == dnsfilter.FilteredBlockedService ||
+				res.Reason == dnsfilter.FilteredBlockAll ||
 				res.Reason == dnsfilter.NotFilteredWhiteList)
 
 		default:
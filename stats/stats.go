@@ -5,6 +5,8 @@ package stats
 import (
 	"net"
 	"net/http"
+
+	"github.com/AdguardTeam/AdGuardHome/util"
 )
 
 type unitIDCallback func() uint32
@@ -21,6 +23,10 @@ type Config struct {
 	UnitID            unitIDCallback // user function to get the current unit ID.  If nil, the current time hour is used.
 	AnonymizeClientIP bool           // anonymize clients' IP addresses
 
+	// Converts clients' IP addresses when AnonymizeClientIP is set.
+	// If nil, the default mode is used.
+	Anonymizer *util.IPAnonymizer
+
 	// Called when the configuration is changed by HTTP request
 	ConfigModified func()
 
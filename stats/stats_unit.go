@@ -5,7 +5,6 @@ import (
 	"encoding/binary"
 	"encoding/gob"
 	"fmt"
-	"net"
 	"os"
 	"sort"
 	"sync"
@@ -446,17 +445,7 @@ func (s *statsCtx) clear() {
 // Get Client IP address
 func (s *statsCtx) getClientIP(clientIP string) string {
 	if s.conf.AnonymizeClientIP {
-		ip := net.ParseIP(clientIP)
-		if ip != nil {
-			ip4 := ip.To4()
-			const AnonymizeClientIP4Mask = 16
-			const AnonymizeClientIP6Mask = 112
-			if ip4 != nil {
-				clientIP = ip4.Mask(net.CIDRMask(AnonymizeClientIP4Mask, 32)).String()
-			} else {
-				clientIP = ip.Mask(net.CIDRMask(AnonymizeClientIP6Mask, 128)).String()
-			}
-		}
+		clientIP = s.conf.Anonymizer.Anonymize(clientIP)
 	}
 
 	return clientIP
@@ -0,0 +1,243 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Client IP anonymization modes
+const (
+	AnonymizeModeMask     = ""         // zero the last octets (default)
+	AnonymizeModeTruncate = "truncate" // keep only the configured prefix
+	AnonymizeModeHMAC     = "hmac"     // replace with a keyed pseudonym
+)
+
+const (
+	anonymizeIP4Mask   = 16  // default IPv4 prefix length for "mask" mode
+	anonymizeIP6Mask   = 112 // default IPv6 prefix length for "mask" mode
+	anonymizeIP4Prefix = 24  // default IPv4 prefix length for "truncate" mode
+	anonymizeIP6Prefix = 48  // default IPv6 prefix length for "truncate" mode
+	anonymizeKeyLen    = 32  // HMAC key length (in bytes)
+	anonymizeKeyRotate = 24  // default key rotation period (in hours)
+)
+
+// IPAnonymizerConfig - settings for IPAnonymizer
+type IPAnonymizerConfig struct {
+	Mode             string `yaml:"anonymize_client_ip_mode"`     // anonymization mode: "" (mask), "truncate", "hmac"
+	IPv4Prefix       uint   `yaml:"anonymize_client_ipv4_prefix"` // "truncate" mode: IPv4 prefix length to keep (default: 24)
+	IPv6Prefix       uint   `yaml:"anonymize_client_ipv6_prefix"` // "truncate" mode: IPv6 prefix length to keep (default: 48)
+	KeyRotationHours uint32 `yaml:"anonymize_client_ip_key_ttl"`  // "hmac" mode: key rotation period (in hours)
+
+	KeyFile string `yaml:"-"` // "hmac" mode: file where the current key is stored (optional, readable only by owner)
+}
+
+// IPAnonymizer converts client IP addresses to their anonymized form.
+// The same object must be used by all modules so that the results are consistent.
+type IPAnonymizer struct {
+	conf IPAnonymizerConfig
+
+	lock      sync.Mutex
+	key       []byte    // the current HMAC key
+	keyExpire time.Time // when the current key must be replaced
+
+	now  func() time.Time // for tests
+	rand io.Reader        // for tests
+}
+
+// NewIPAnonymizer - create object
+func NewIPAnonymizer(conf IPAnonymizerConfig) (*IPAnonymizer, error) {
+	switch conf.Mode {
+	case AnonymizeModeMask, AnonymizeModeHMAC:
+		//
+
+	case AnonymizeModeTruncate:
+		if conf.IPv4Prefix > 32 || conf.IPv6Prefix > 128 {
+			return nil, fmt.Errorf("invalid prefix length: %d/%d", conf.IPv4Prefix, conf.IPv6Prefix)
+		}
+		// a zero prefix would map all clients to the same address
+		if conf.IPv4Prefix == 0 {
+			conf.IPv4Prefix = anonymizeIP4Prefix
+		}
+		if conf.IPv6Prefix == 0 {
+			conf.IPv6Prefix = anonymizeIP6Prefix
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown anonymization mode: %s", conf.Mode)
+	}
+
+	if conf.KeyRotationHours == 0 {
+		conf.KeyRotationHours = anonymizeKeyRotate
+	}
+
+	a := &IPAnonymizer{
+		conf: conf,
+		now:  time.Now,
+		rand: rand.Reader,
+	}
+	if conf.Mode == AnonymizeModeHMAC {
+		err := a.loadKey()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Mode - get anonymization mode
+func (a *IPAnonymizer) Mode() string {
+	return a.conf.Mode
+}
+
+// Anonymize - get anonymized form of the IP address
+// Returns the input string if it's not a valid IP address.
+// A nil object uses the default mode.
+func (a *IPAnonymizer) Anonymize(clientIP string) string {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return clientIP
+	}
+
+	mode := AnonymizeModeMask
+	if a != nil {
+		mode = a.conf.Mode
+	}
+
+	switch mode {
+	case AnonymizeModeTruncate:
+		return maskIP(ip, int(a.conf.IPv4Prefix), int(a.conf.IPv6Prefix))
+
+	case AnonymizeModeHMAC:
+		return a.pseudonym(ip)
+	}
+	return maskIP(ip, anonymizeIP4Mask, anonymizeIP6Mask)
+}
+
+// Zero the bits after prefix
+func maskIP(ip net.IP, prefix4, prefix6 int) string {
+	ip4 := ip.To4()
+	if ip4 != nil {
+		return ip4.Mask(net.CIDRMask(prefix4, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(prefix6, 128)).String()
+}
+
+// Get a pseudonym for the IP address.
+// The result is a valid IP address of the same family which is stable while the key is valid.
+// IPv4 pseudonyms are in 240.0.0.0/4 (reserved), IPv6 pseudonyms are in fd00::/8 (unique local).
+// If there's no valid key, the address is replaced with the first address of the range.
+func (a *IPAnonymizer) pseudonym(ip net.IP) string {
+	ip4 := ip.To4()
+	if ip4 != nil {
+		ip = ip4
+	}
+
+	a.lock.Lock()
+	if !a.now().Before(a.keyExpire) {
+		err := a.rotateKey()
+		if err != nil {
+			log.Error("anonymizer: %s", err)
+		}
+	}
+	if a.key == nil {
+		a.lock.Unlock()
+		if ip4 != nil {
+			return "240.0.0.0"
+		}
+		return "fd00::"
+	}
+	mac := hmac.New(sha256.New, a.key)
+	a.lock.Unlock()
+
+	_, _ = mac.Write(ip)
+	sum := mac.Sum(nil)
+
+	if ip4 != nil {
+		p := net.IP(sum[:net.IPv4len])
+		p[0] = 0xf0 | (p[0] & 0x0f)
+		return p.String()
+	}
+	p := net.IP(sum[:net.IPv6len])
+	p[0] = 0xfd
+	return p.String()
+}
+
+// Load the key from file or generate a new one
+func (a *IPAnonymizer) loadKey() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if len(a.conf.KeyFile) != 0 {
+		data, err := ioutil.ReadFile(a.conf.KeyFile)
+		if err == nil && len(data) == 8+anonymizeKeyLen {
+			expire := time.Unix(int64(binary.BigEndian.Uint64(data)), 0)
+			if a.now().Before(expire) {
+				// the file may have been written by an older version with wider permissions
+				err = os.Chmod(a.conf.KeyFile, 0600)
+				if err != nil {
+					return fmt.Errorf("anonymizer: %s", err)
+				}
+				a.key = data[8:]
+				a.keyExpire = expire
+				log.Debug("anonymizer: loaded key from %s, expires at %s", a.conf.KeyFile, expire)
+				return nil
+			}
+		} else if err != nil && !os.IsNotExist(err) {
+			log.Error("anonymizer: %s", err)
+		}
+	}
+
+	return a.rotateKey()
+}
+
+// Generate a new key and store it in file
+// The old key is lost, so pseudonyms made with it can't be linked with the new ones.
+// If a new key can't be generated, there's no key.
+func (a *IPAnonymizer) rotateKey() error {
+	a.key = nil
+	key := make([]byte, anonymizeKeyLen)
+	_, err := io.ReadFull(a.rand, key)
+	if err != nil {
+		return fmt.Errorf("can't generate a key: %s", err)
+	}
+
+	a.key = key
+	a.keyExpire = a.now().Add(time.Duration(a.conf.KeyRotationHours) * time.Hour).Truncate(time.Second)
+	log.Debug("anonymizer: new key, expires at %s", a.keyExpire)
+
+	if len(a.conf.KeyFile) == 0 {
+		return nil
+	}
+	data := make([]byte, 8+anonymizeKeyLen)
+	binary.BigEndian.PutUint64(data, uint64(a.keyExpire.Unix()))
+	copy(data[8:], key)
+	err = writeKeyFile(a.conf.KeyFile, data)
+	if err != nil {
+		log.Error("anonymizer: %s", err)
+	}
+	return nil
+}
+
+// Write the key file readable only by owner
+// The data is written to a temporary file first and then the file is replaced.
+func writeKeyFile(fn string, data []byte) error {
+	tmp := fn + ".tmp"
+	_ = os.Remove(tmp) // a file left by a failed attempt may have other permissions
+	err := ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
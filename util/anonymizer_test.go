@@ -0,0 +1,114 @@
+package util
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnonymizerMask(t *testing.T) {
+	var a *IPAnonymizer
+	assert.Equal(t, "1.2.0.0", a.Anonymize("1.2.3.4"))
+	assert.Equal(t, "1:2:3:4:5:6:7:0", a.Anonymize("1:2:3:4:5:6:7:8"))
+	assert.Equal(t, "client", a.Anonymize("client"))
+
+	a, err := NewIPAnonymizer(IPAnonymizerConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, "1.2.0.0", a.Anonymize("1.2.3.4"))
+}
+
+func TestAnonymizerTruncate(t *testing.T) {
+	a, err := NewIPAnonymizer(IPAnonymizerConfig{
+		Mode:       AnonymizeModeTruncate,
+		IPv4Prefix: 24,
+		IPv6Prefix: 48,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "1.2.3.0", a.Anonymize("1.2.3.4"))
+	assert.Equal(t, "1:2:3::", a.Anonymize("1:2:3:4:5:6:7:8"))
+
+	// default prefix lengths
+	a, err = NewIPAnonymizer(IPAnonymizerConfig{Mode: AnonymizeModeTruncate})
+	assert.Nil(t, err)
+	assert.Equal(t, "1.2.3.0", a.Anonymize("1.2.3.4"))
+	assert.Equal(t, "1:2:3::", a.Anonymize("1:2:3:4:5:6:7:8"))
+
+	_, err = NewIPAnonymizer(IPAnonymizerConfig{Mode: AnonymizeModeTruncate, IPv4Prefix: 33})
+	assert.NotNil(t, err)
+	_, err = NewIPAnonymizer(IPAnonymizerConfig{Mode: "unknown"})
+	assert.NotNil(t, err)
+}
+
+func TestAnonymizerHMAC(t *testing.T) {
+	fn := "./anonymizer.key"
+	defer func() { _ = os.Remove(fn) }()
+
+	a, err := NewIPAnonymizer(IPAnonymizerConfig{
+		Mode:             AnonymizeModeHMAC,
+		KeyRotationHours: 1,
+		KeyFile:          fn,
+	})
+	assert.Nil(t, err)
+
+	// stable and family-preserving
+	p := a.Anonymize("1.2.3.4")
+	assert.Equal(t, p, a.Anonymize("1.2.3.4"))
+	assert.NotEqual(t, p, a.Anonymize("1.2.3.5"))
+	ip := net.ParseIP(p).To4()
+	assert.NotNil(t, ip)
+	assert.Equal(t, byte(0xf0), ip[0]&0xf0)
+
+	p6 := a.Anonymize("1:2:3:4:5:6:7:8")
+	ip = net.ParseIP(p6)
+	assert.True(t, ip != nil && ip.To4() == nil && ip[0] == 0xfd)
+
+	// the key is loaded from file
+	a2, err := NewIPAnonymizer(IPAnonymizerConfig{
+		Mode:             AnonymizeModeHMAC,
+		KeyRotationHours: 1,
+		KeyFile:          fn,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, p, a2.Anonymize("1.2.3.4"))
+
+	// the key file is readable only by owner
+	if runtime.GOOS != "windows" {
+		st, err := os.Stat(fn)
+		assert.Nil(t, err)
+		assert.Equal(t, os.FileMode(0600), st.Mode().Perm())
+	}
+
+	// the key is rotated
+	a2.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	assert.NotEqual(t, p, a2.Anonymize("1.2.3.4"))
+	assert.Equal(t, a2.Anonymize("1.2.3.4"), a2.Anonymize("1.2.3.4"))
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("no random data")
+}
+
+func TestAnonymizerHMACNoKey(t *testing.T) {
+	a, err := NewIPAnonymizer(IPAnonymizerConfig{Mode: AnonymizeModeHMAC, KeyRotationHours: 1})
+	assert.Nil(t, err)
+	p := a.Anonymize("1.2.3.4")
+
+	// a new key can't be generated: the pseudonyms don't depend on the address
+	a.rand = errReader{}
+	a.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	assert.Equal(t, "240.0.0.0", a.Anonymize("1.2.3.4"))
+	assert.Equal(t, "fd00::", a.Anonymize("1:2:3:4:5:6:7:8"))
+	assert.NotEqual(t, p, a.Anonymize("1.2.3.4"))
+
+	// the key is generated on the next attempt
+	a.rand = rand.Reader
+	assert.NotEqual(t, "240.0.0.0", a.Anonymize("1.2.3.4"))
+}